@@ -0,0 +1,62 @@
+package circuit
+
+import (
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+// AccountIdsCheck is the in circuit utils.AccountIdsCheck.
+type AccountIdsCheck struct {
+	SortedAccountIdsHash Variable
+	BeforeLastAccountId  Variable
+	AfterLastAccountId   Variable
+	Challenge            Variable
+	BeforeProduct        Variable
+	AfterProduct         Variable
+}
+
+func newAccountIdsCheck() AccountIdsCheck {
+	return AccountIdsCheck{
+		SortedAccountIdsHash: 0,
+		BeforeLastAccountId:  0,
+		AfterLastAccountId:   0,
+		Challenge:            0,
+		BeforeProduct:        0,
+		AfterProduct:         0,
+	}
+}
+
+func setAccountIdsCheckWitness(check *utils.AccountIdsCheck) AccountIdsCheck {
+	return AccountIdsCheck{
+		SortedAccountIdsHash: check.SortedAccountIdsHash,
+		BeforeLastAccountId:  check.BeforeLastAccountId,
+		AfterLastAccountId:   check.AfterLastAccountId,
+		Challenge:            check.Challenge,
+		BeforeProduct:        check.BeforeProduct,
+		AfterProduct:         check.AfterProduct,
+	}
+}
+
+func (c AccountIdsCheck) commitment(api API) Variable {
+	return hashVariables(api, c.SortedAccountIdsHash, c.BeforeLastAccountId, c.AfterLastAccountId,
+		c.Challenge, c.BeforeProduct, c.AfterProduct)
+}
+
+// checkAccountIds verifies sortedIds are strictly increasing from
+// BeforeLastAccountId to AfterLastAccountId, and updates the running product
+// from BeforeProduct to AfterProduct with ids and sortedIds.
+func checkAccountIds(api API, c AccountIdsCheck, ids []Variable, sortedIds []Variable) {
+	api.AssertIsEqual(c.SortedAccountIdsHash, hashVariables(api, sortedIds...))
+	lastId := c.BeforeLastAccountId
+	var numerator, denominator Variable = 1, 1
+	for i := 0; i < len(sortedIds); i++ {
+		api.AssertIsLessOrEqual(lastId, sortedIds[i])
+		api.AssertIsDifferent(lastId, sortedIds[i])
+		lastId = sortedIds[i]
+		numerator = api.Mul(numerator, api.Sub(c.Challenge, ids[i]))
+		denominator = api.Mul(denominator, api.Sub(c.Challenge, sortedIds[i]))
+	}
+	api.AssertIsEqual(c.AfterLastAccountId, lastId)
+	// AfterProduct = BeforeProduct * numerator / denominator
+	api.AssertIsDifferent(denominator, 0)
+	api.AssertIsEqual(api.Mul(c.AfterProduct, denominator), api.Mul(c.BeforeProduct, numerator))
+}
@@ -0,0 +1,97 @@
+package circuit
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/test"
+)
+
+type accountIdsCircuit struct {
+	Check     AccountIdsCheck
+	Ids       []Variable
+	SortedIds []Variable
+}
+
+func (c accountIdsCircuit) Define(api API) error {
+	checkAccountIds(api, c.Check, c.Ids, c.SortedIds)
+	return nil
+}
+
+func newAccountIdsAssignment(check *utils.AccountIdsCheck, ids, sortedIds [][]byte) *accountIdsCircuit {
+	res := &accountIdsCircuit{
+		Check:     setAccountIdsCheckWitness(check),
+		Ids:       make([]Variable, len(ids)),
+		SortedIds: make([]Variable, len(sortedIds)),
+	}
+	for i := range ids {
+		res.Ids[i] = ids[i]
+		res.SortedIds[i] = sortedIds[i]
+	}
+	return res
+}
+
+// accountIdsCommitment returns the utils.AccountIdsCheck.Commitment of the witness c.
+func accountIdsCommitment(c AccountIdsCheck) []byte {
+	check := utils.AccountIdsCheck{
+		SortedAccountIdsHash: c.SortedAccountIdsHash.([]byte),
+		BeforeLastAccountId:  c.BeforeLastAccountId.([]byte),
+		AfterLastAccountId:   c.AfterLastAccountId.([]byte),
+		Challenge:            c.Challenge.([]byte),
+		BeforeProduct:        c.BeforeProduct.([]byte),
+		AfterProduct:         c.AfterProduct.([]byte),
+	}
+	return check.Commitment()
+}
+
+func testAccountId(v int64) []byte {
+	return big.NewInt(v).FillBytes(make([]byte, utils.FieldElementSize))
+}
+
+func TestCheckAccountIds(t *testing.T) {
+	root := []byte{1}
+	batchIds := [][][]byte{
+		{testAccountId(5), testAccountId(2)},
+		{testAccountId(3), testAccountId(9)},
+	}
+	checks, sortedIds, err := utils.NewAccountIdsChecks(root, batchIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = utils.CheckAccountIdsChain(root, checks); err != nil {
+		t.Fatal(err)
+	}
+	circuit := &accountIdsCircuit{Check: newAccountIdsCheck(), Ids: make([]Variable, 2), SortedIds: make([]Variable, 2)}
+	for i := range batchIds {
+		err = test.IsSolved(circuit, newAccountIdsAssignment(&checks[i], batchIds[i], sortedIds[i]), utils.CurveID().ScalarField())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the account ids of the batch must match the running product
+	duplicateIds := [][]byte{testAccountId(3), testAccountId(3)}
+	err = test.IsSolved(circuit, newAccountIdsAssignment(&checks[1], duplicateIds, sortedIds[1]), utils.CurveID().ScalarField())
+	if err == nil {
+		t.Fatal("expected failure with the account ids which don't match the sorted account ids")
+	}
+
+	// the sorted account ids must be strictly increasing
+	duplicateCheck := checks[1]
+	duplicateCheck.SortedAccountIdsHash = utils.HashBytes(duplicateIds...)
+	duplicateCheck.BeforeLastAccountId = testAccountId(2)
+	duplicateCheck.AfterLastAccountId = testAccountId(3)
+	duplicateCheck.AfterProduct = duplicateCheck.BeforeProduct
+	err = test.IsSolved(circuit, newAccountIdsAssignment(&duplicateCheck, duplicateIds, duplicateIds), utils.CurveID().ScalarField())
+	if err == nil {
+		t.Fatal("expected failure with the duplicate sorted account ids")
+	}
+	duplicateCheck.SortedAccountIdsHash = utils.HashBytes(duplicateIds[:1]...)
+	duplicateCheck.BeforeLastAccountId = testAccountId(3)
+	circuit = &accountIdsCircuit{Check: newAccountIdsCheck(), Ids: make([]Variable, 1), SortedIds: make([]Variable, 1)}
+	err = test.IsSolved(circuit, newAccountIdsAssignment(&duplicateCheck, duplicateIds[:1], duplicateIds[:1]), utils.CurveID().ScalarField())
+	if err == nil {
+		t.Fatal("expected failure with the sorted account id equal to the last one of the previous batch")
+	}
+}
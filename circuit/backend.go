@@ -0,0 +1,258 @@
+package circuit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/kzg"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+	gnarkio "github.com/consensys/gnark/io"
+	"github.com/consensys/gnark/test/unsafekzg"
+)
+
+// Supported proving backends for BatchCreateUserCircuit.
+// Groth16 needs a circuit specific setup for every tier, while PLONK only
+// needs a universal KZG SRS which is large enough for the biggest tier.
+// Groth16Evm uses the groth16 keys but hashes the commitment with keccak256,
+// so its proofs can be verified by the exported Solidity verifier. PlonkEvm
+// uses the plonk keys with the transcript hash of the Solidity verifier, while
+// the plonk proofs use a transcript hash which can be computed in circuit so
+// that they can be aggregated.
+const (
+	Groth16Backend    = "groth16"
+	Groth16EvmBackend = "groth16_evm"
+	PlonkBackend      = "plonk"
+	PlonkEvmBackend   = "plonk_evm"
+)
+
+type (
+	ProvingKey interface {
+		io.WriterTo
+		io.ReaderFrom
+		gnarkio.UnsafeReaderFrom
+	}
+
+	VerifyingKey interface {
+		io.WriterTo
+		io.ReaderFrom
+	}
+
+	Proof interface {
+		io.WriterTo
+		io.ReaderFrom
+		gnarkio.WriterRawTo
+	}
+)
+
+// ParseProvingBackend validates the backend name. An empty name means groth16,
+// so configs and proof rows produced before the backend was selectable keep working.
+func ParseProvingBackend(name string) (string, error) {
+	switch name {
+	case "", Groth16Backend:
+		return Groth16Backend, nil
+	case Groth16EvmBackend:
+		// the Solidity verifier of gnark only supports bn254
+		if utils.Curve != utils.BN254Curve {
+			return "", fmt.Errorf("proving backend %s is not supported on curve %s", name, utils.Curve)
+		}
+		return Groth16EvmBackend, nil
+	case PlonkBackend:
+		return PlonkBackend, nil
+	case PlonkEvmBackend:
+		if utils.Curve != utils.BN254Curve {
+			return "", fmt.Errorf("proving backend %s is not supported on curve %s", name, utils.Curve)
+		}
+		return PlonkEvmBackend, nil
+	default:
+		return "", fmt.Errorf("unsupported proving backend: %q", name)
+	}
+}
+
+// IsPlonk returns whether backend uses the plonk keys.
+func IsPlonk(backend string) bool {
+	return backend == PlonkBackend || backend == PlonkEvmBackend
+}
+
+// ZkKeyName returns the file name prefix of the keys generated for one tier.
+// Groth16 keeps the historical name so existing key files stay valid.
+func ZkKeyName(backend string, assetCounts int, opsCounts int) string {
+	name := "zkpor" + strconv.Itoa(assetCounts) + "_" + strconv.Itoa(opsCounts)
+	if IsPlonk(backend) {
+		name += "_" + PlonkBackend
+	}
+	return name
+}
+
+// UpdateZkKeyName returns the name of the keys of BatchUpdateUserCircuit.
+func UpdateZkKeyName(backend string, assetCounts int, opsCounts int) string {
+	return ZkKeyName(backend, assetCounts, opsCounts) + "_update"
+}
+
+// ConstraintSystemFileSuffix returns the suffix of the compiled constraint system file.
+func ConstraintSystemFileSuffix(backend string) string {
+	if IsPlonk(backend) {
+		return ".scs"
+	}
+	return ".r1cs"
+}
+
+// Compile compiles circuit into a R1CS for groth16 or a sparse R1CS for plonk.
+func Compile(backend string, circuit frontend.Circuit, opts ...frontend.CompileOption) (constraint.ConstraintSystem, error) {
+	builder := r1cs.NewBuilder
+	if IsPlonk(backend) {
+		builder = scs.NewBuilder
+	}
+	return frontend.Compile(utils.CurveID().ScalarField(), builder, circuit, opts...)
+}
+
+func NewConstraintSystem(backend string) constraint.ConstraintSystem {
+	if IsPlonk(backend) {
+		return plonk.NewCS(utils.CurveID())
+	}
+	return groth16.NewCS(utils.CurveID())
+}
+
+func NewProvingKey(backend string) ProvingKey {
+	if IsPlonk(backend) {
+		return plonk.NewProvingKey(utils.CurveID())
+	}
+	return groth16.NewProvingKey(utils.CurveID())
+}
+
+func NewVerifyingKey(backend string) VerifyingKey {
+	if IsPlonk(backend) {
+		return plonk.NewVerifyingKey(utils.CurveID())
+	}
+	return groth16.NewVerifyingKey(utils.CurveID())
+}
+
+func NewProof(backend string) Proof {
+	if IsPlonk(backend) {
+		return plonk.NewProof(utils.CurveID())
+	}
+	return groth16.NewProof(utils.CurveID())
+}
+
+// Setup generates the proving and verifying key of a compiled circuit.
+// srs and srsLagrange are only used by the plonk backend.
+func Setup(backend string, ccs constraint.ConstraintSystem, srs, srsLagrange kzg.SRS) (ProvingKey, VerifyingKey, error) {
+	if IsPlonk(backend) {
+		return plonk.Setup(ccs, srs, srsLagrange)
+	}
+	return groth16.Setup(ccs)
+}
+
+func Prove(backend string, ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness) (Proof, error) {
+	if backend == PlonkBackend {
+		return plonk.Prove(ccs, pk.(plonk.ProvingKey), fullWitness, plonkRecursionProverOptions())
+	}
+	if backend == PlonkEvmBackend {
+		return plonk.Prove(ccs, pk.(plonk.ProvingKey), fullWitness)
+	}
+	if backend == Groth16EvmBackend {
+		return groth16.Prove(ccs, pk.(groth16.ProvingKey), fullWitness, groth16EvmProverOptions())
+	}
+	return groth16.Prove(ccs, pk.(groth16.ProvingKey), fullWitness)
+}
+
+func Verify(backend string, proof Proof, vk VerifyingKey, publicWitness witness.Witness) error {
+	if backend == PlonkBackend {
+		return plonk.Verify(proof.(plonk.Proof), vk.(plonk.VerifyingKey), publicWitness, plonkRecursionVerifierOptions())
+	}
+	if backend == PlonkEvmBackend {
+		return plonk.Verify(proof.(plonk.Proof), vk.(plonk.VerifyingKey), publicWitness)
+	}
+	if backend == Groth16EvmBackend {
+		return groth16.Verify(proof.(groth16.Proof), vk.(groth16.VerifyingKey), publicWitness, groth16EvmVerifierOptions())
+	}
+	return groth16.Verify(proof.(groth16.Proof), vk.(groth16.VerifyingKey), publicWitness)
+}
+
+// LoadKzgSrs reads a canonical BN254 KZG SRS (e.g. the output of a public
+// powers of tau ceremony) and returns it truncated to the size ccs needs,
+// together with its lagrange form.
+func LoadKzgSrs(fileName string, ccs constraint.ConstraintSystem) (kzg.SRS, kzg.SRS, error) {
+	if utils.Curve != utils.BN254Curve {
+		return nil, nil, fmt.Errorf("loading kzg srs is not supported on curve %s", utils.Curve)
+	}
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	var srs kzg_bn254.SRS
+	if _, err = srs.ReadFrom(bytes.NewBuffer(content)); err != nil {
+		return nil, nil, err
+	}
+	return truncateKzgSrs(&srs, ccs)
+}
+
+// truncateKzgSrs returns srs truncated to the size ccs needs together with its
+// lagrange form, the keys of all the circuits truncated from the same srs share
+// the same kzg verifying key.
+func truncateKzgSrs(srs *kzg_bn254.SRS, ccs constraint.ConstraintSystem) (kzg.SRS, kzg.SRS, error) {
+	sizeLagrange := ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints() + ccs.GetNbPublicVariables()))
+	sizeCanonical := sizeLagrange + 3
+	if uint64(len(srs.Pk.G1)) < sizeCanonical {
+		return nil, nil, fmt.Errorf("kzg srs too small: has %d points, need %d", len(srs.Pk.G1), sizeCanonical)
+	}
+	truncated := &kzg_bn254.SRS{Vk: srs.Vk}
+	truncated.Pk.G1 = srs.Pk.G1[:sizeCanonical]
+	lagrangeG1, err := kzg_bn254.ToLagrangeG1(srs.Pk.G1[:sizeLagrange])
+	if err != nil {
+		return nil, nil, err
+	}
+	srsLagrange := &kzg_bn254.SRS{Vk: srs.Vk}
+	srsLagrange.Pk.G1 = lagrangeG1
+	return truncated, srsLagrange, nil
+}
+
+// UnsafeKzgSrs generates the KZG SRS of a locally drawn tau, only for test.
+// unsafekzg.NewSRS draws a new tau for every size, so the keys of the tiers or
+// the aggregation levels set up from it don't share the same kzg verifying key.
+// UnsafeKzgSrs keeps one tau and grows one SRS for the largest circuit seen,
+// which is truncated for every circuit the way LoadKzgSrs does.
+type UnsafeKzgSrs struct {
+	tau *big.Int
+	srs *kzg_bn254.SRS
+}
+
+func NewUnsafeKzgSrs() (*UnsafeKzgSrs, error) {
+	tau, err := rand.Int(rand.Reader, ecc.BN254.ScalarField())
+	if err != nil {
+		return nil, err
+	}
+	return &UnsafeKzgSrs{tau: tau}, nil
+}
+
+// Truncate returns the srs truncated to the size ccs needs together with its
+// lagrange form. The srs of other curves than bn254 are generated by
+// unsafekzg for every circuit, they can't be aggregated anyway.
+func (s *UnsafeKzgSrs) Truncate(ccs constraint.ConstraintSystem) (kzg.SRS, kzg.SRS, error) {
+	if utils.Curve != utils.BN254Curve {
+		return unsafekzg.NewSRS(ccs)
+	}
+	sizeCanonical := ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints()+ccs.GetNbPublicVariables())) + 3
+	if s.srs == nil || uint64(len(s.srs.Pk.G1)) < sizeCanonical {
+		// the srs of the same tau is a prefix of the larger one
+		srs, err := kzg_bn254.NewSRS(sizeCanonical, s.tau)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.srs = srs
+	}
+	return truncateKzgSrs(s.srs, ccs)
+}
@@ -0,0 +1,118 @@
+package circuit
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/kzg"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/frontend"
+)
+
+type squareCircuit struct {
+	Y Variable `gnark:",public"`
+	X Variable
+}
+
+func (c squareCircuit) Define(api API) error {
+	api.AssertIsEqual(c.Y, api.Mul(c.X, c.X))
+	return nil
+}
+
+func TestParseProvingBackend(t *testing.T) {
+	for name, expected := range map[string]string{"": Groth16Backend, "groth16": Groth16Backend, "groth16_evm": Groth16EvmBackend, "plonk": PlonkBackend, "plonk_evm": PlonkEvmBackend} {
+		backend, err := ParseProvingBackend(name)
+		if err != nil || backend != expected {
+			t.Fatalf("parse %q: got %q, %v", name, backend, err)
+		}
+	}
+	if _, err := ParseProvingBackend("marlin"); err == nil {
+		t.Fatal("expected error for unsupported backend")
+	}
+	if ZkKeyName(Groth16Backend, 50, 1380) != "zkpor50_1380" || ZkKeyName(PlonkBackend, 50, 1380) != "zkpor50_1380_plonk" ||
+		ZkKeyName(Groth16EvmBackend, 50, 1380) != "zkpor50_1380" || ZkKeyName(PlonkEvmBackend, 50, 1380) != "zkpor50_1380_plonk" {
+		t.Fatal("unexpected zk key name")
+	}
+}
+
+func TestProveAndVerifyWithBackends(t *testing.T) {
+	for _, backend := range []string{Groth16Backend, PlonkBackend, PlonkEvmBackend} {
+		t.Run(backend, func(t *testing.T) {
+			ccs, err := Compile(backend, &squareCircuit{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the constraint system must survive a serialization round trip,
+			// which is how prover loads it from the keygen output
+			var ccsBuf bytes.Buffer
+			if _, err = ccs.WriteTo(&ccsBuf); err != nil {
+				t.Fatal(err)
+			}
+			ccs = NewConstraintSystem(backend)
+			if _, err = ccs.ReadFrom(&ccsBuf); err != nil {
+				t.Fatal(err)
+			}
+
+			var srs, srsLagrange kzg.SRS
+			if IsPlonk(backend) {
+				canonical, err := kzg_bn254.NewSRS(64, big.NewInt(42))
+				if err != nil {
+					t.Fatal(err)
+				}
+				srsFile := filepath.Join(t.TempDir(), "kzg.srs")
+				f, err := os.Create(srsFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = canonical.WriteTo(f); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+				srs, srsLagrange, err = LoadKzgSrs(srsFile, ccs)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			pk, vk, err := Setup(backend, ccs, srs, srsLagrange)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fullWitness, err := frontend.NewWitness(&squareCircuit{Y: 9, X: 3}, ecc.BN254.ScalarField())
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicWitness, err := fullWitness.Public()
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof, err := Prove(backend, ccs, pk, fullWitness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var proofBuf bytes.Buffer
+			if _, err = proof.WriteRawTo(&proofBuf); err != nil {
+				t.Fatal(err)
+			}
+			proof = NewProof(backend)
+			if _, err = proof.ReadFrom(&proofBuf); err != nil {
+				t.Fatal(err)
+			}
+			if err = Verify(backend, proof, vk, publicWitness); err != nil {
+				t.Fatal(err)
+			}
+
+			wrongWitness, err := frontend.NewWitness(&squareCircuit{Y: 10}, ecc.BN254.ScalarField(), frontend.PublicOnly())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = Verify(backend, proof, vk, wrongWitness); err == nil {
+				t.Fatal("expected verification failure with wrong public input")
+			}
+		})
+	}
+}
@@ -1,10 +1,9 @@
 package circuit
 
 import (
-	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
-	"github.com/consensys/gnark/std/hash/poseidon"
+	"fmt"
 
-	"github.com/consensys/gnark/std/lookup/logderivlookup"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark/std/rangecheck"
 )
 
@@ -15,8 +14,19 @@ type BatchCreateUserCircuit struct {
 	AfterCEXAssetsCommitment  Variable
 	MinAccountIndex           Variable
 	MaxAccountIndex           Variable
-	BeforeCexAssets           []CexAssetInfo
-	CreateUserOps             []CreateUserOperation
+	// UserCount is the number of the ops which are not padding accounts
+	UserCount Variable
+	// SnapshotId is the audit of the batch, see utils.ParseSnapshotId
+	SnapshotId Variable
+	// AccountIds proves the account ids of all batches are distinct with
+	// SortedAccountIds, see utils.AccountIdsCheck
+	AccountIds       AccountIdsCheck
+	SortedAccountIds []Variable
+	// CexAssetsBlinding is the blinding factor of the cex assets commitments,
+	// it is zero if BlindCexAssetsCommitment is not set
+	CexAssetsBlinding Variable
+	BeforeCexAssets   []CexAssetInfo
+	CreateUserOps     []CreateUserOperation
 }
 
 func NewVerifyBatchCreateUserCircuit(commitment []byte) *BatchCreateUserCircuit {
@@ -33,291 +43,160 @@ func NewBatchCreateUserCircuit(userAssetCounts uint32, allAssetCounts uint32, ba
 	circuit.AfterCEXAssetsCommitment = 0
 	circuit.MinAccountIndex = 0
 	circuit.MaxAccountIndex = 0
+	circuit.UserCount = 0
+	circuit.SnapshotId = 0
+	circuit.AccountIds = newAccountIdsCheck()
+	circuit.SortedAccountIds = make([]Variable, batchCounts)
+	for i := uint32(0); i < batchCounts; i++ {
+		circuit.SortedAccountIds[i] = 0
+	}
+	circuit.CexAssetsBlinding = 0
+	collateralCounts := len(utils.CollateralCategories)
 	circuit.BeforeCexAssets = make([]CexAssetInfo, allAssetCounts)
 	for i := uint32(0); i < allAssetCounts; i++ {
 		circuit.BeforeCexAssets[i] = CexAssetInfo{
-			TotalEquity:               0,
-			TotalDebt:                 0,
-			BasePrice:                 0,
-			LoanCollateral:            0,
-			MarginCollateral:          0,
-			PortfolioMarginCollateral: 0,
-			LoanRatios:                make([]TierRatio, utils.TierCount),
-			MarginRatios:              make([]TierRatio, utils.TierCount),
-			PortfolioMarginRatios:     make([]TierRatio, utils.TierCount),
+			TotalEquity:      0,
+			TotalDebt:        0,
+			BasePrice:        0,
+			Collaterals:      make([]Variable, collateralCounts),
+			CollateralRatios: make([][]TierRatio, collateralCounts),
 		}
-		for j := uint32(0); j < utils.TierCount; j++ {
-			circuit.BeforeCexAssets[i].LoanRatios[j] = TierRatio{
-				BoundaryValue:    0,
-				Ratio:            0,
-				PrecomputedValue: 0,
-			}
-			circuit.BeforeCexAssets[i].MarginRatios[j] = TierRatio{
-				BoundaryValue:    0,
-				Ratio:            0,
-				PrecomputedValue: 0,
-			}
-			circuit.BeforeCexAssets[i].PortfolioMarginRatios[j] = TierRatio{
-				BoundaryValue:    0,
-				Ratio:            0,
-				PrecomputedValue: 0,
+		for c := 0; c < collateralCounts; c++ {
+			circuit.BeforeCexAssets[i].Collaterals[c] = 0
+			circuit.BeforeCexAssets[i].CollateralRatios[c] = make([]TierRatio, utils.TierCount)
+			for j := 0; j < utils.TierCount; j++ {
+				circuit.BeforeCexAssets[i].CollateralRatios[c][j] = TierRatio{
+					BoundaryValue:    0,
+					Ratio:            0,
+					PrecomputedValue: 0,
+				}
 			}
 		}
 	}
 	circuit.CreateUserOps = make([]CreateUserOperation, batchCounts)
 	for i := uint32(0); i < batchCounts; i++ {
 		circuit.CreateUserOps[i] = CreateUserOperation{
-			Assets:             make([]UserAssetInfo, userAssetCounts),
-			AssetsForUpdateCex: make([]UserAssetMeta, allAssetCounts),
-			AccountIndex:       0,
-			AccountIdHash:      0,
-			AccountProof:       [utils.AccountTreeDepth]Variable{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-		}
-		for j := uint32(0); j < allAssetCounts; j++ {
-			circuit.CreateUserOps[i].AssetsForUpdateCex[j].Debt = 0
-			circuit.CreateUserOps[i].AssetsForUpdateCex[j].Equity = 0
-			circuit.CreateUserOps[i].AssetsForUpdateCex[j].LoanCollateral = 0
-			circuit.CreateUserOps[i].AssetsForUpdateCex[j].MarginCollateral = 0
-			circuit.CreateUserOps[i].AssetsForUpdateCex[j].PortfolioMarginCollateral = 0
-		}
-		for j := uint32(0); j < userAssetCounts; j++ {
-			circuit.CreateUserOps[i].Assets[j] = UserAssetInfo{
-				AssetIndex:                     j,
-				LoanCollateralIndex:            0,
-				LoanCollateralFlag:             0,
-				MarginCollateralIndex:          0,
-				MarginCollateralFlag:           0,
-				PortfolioMarginCollateralIndex: 0,
-				PortfolioMarginCollateralFlag:  0,
-			}
+			AccountIndex:  0,
+			AccountIdHash: 0,
+			AccountProof:  newAccountProofVariables(),
 		}
+		circuit.CreateUserOps[i].Assets, circuit.CreateUserOps[i].AssetsForUpdateCex = newUserAssetsVariables(userAssetCounts, allAssetCounts)
 	}
 	return &circuit
 }
 
+// newUserAssetsVariables returns the Assets and AssetsForUpdateCex of a user op.
+func newUserAssetsVariables(userAssetCounts uint32, allAssetCounts uint32) ([]UserAssetInfo, []UserAssetMeta) {
+	collateralCounts := len(utils.CollateralCategories)
+	assets := make([]UserAssetInfo, userAssetCounts)
+	assetsForUpdateCex := make([]UserAssetMeta, allAssetCounts)
+	for j := uint32(0); j < allAssetCounts; j++ {
+		assetsForUpdateCex[j].Debt = 0
+		assetsForUpdateCex[j].Equity = 0
+		assetsForUpdateCex[j].Collaterals = make([]Variable, collateralCounts)
+		for c := 0; c < collateralCounts; c++ {
+			assetsForUpdateCex[j].Collaterals[c] = 0
+		}
+	}
+	for j := uint32(0); j < userAssetCounts; j++ {
+		assets[j] = newPaddingUserAssetInfo(j, collateralCounts)
+	}
+	return assets, assetsForUpdateCex
+}
+
+func newAccountProofVariables() []Variable {
+	proof := make([]Variable, utils.AccountTreeDepth)
+	for j := 0; j < utils.AccountTreeDepth; j++ {
+		proof[j] = 0
+	}
+	return proof
+}
+
+// newPaddingUserAssetInfo returns the UserAssetInfo of the asset which the user doesn't have.
+func newPaddingUserAssetInfo(assetIndex uint32, collateralCounts int) UserAssetInfo {
+	res := UserAssetInfo{
+		AssetIndex:        assetIndex,
+		CollateralIndexes: make([]Variable, collateralCounts),
+		CollateralFlags:   make([]Variable, collateralCounts),
+	}
+	for c := 0; c < collateralCounts; c++ {
+		res.CollateralIndexes[c] = 0
+		res.CollateralFlags[c] = 0
+	}
+	return res
+}
+
 func (b BatchCreateUserCircuit) Define(api API) error {
 	// verify MinAccountIndex and MaxAccountIndex match the first and last op
+	labelOp(api, -1)
+	labelCheck(api, -1, "account index range")
 	api.AssertIsEqual(b.MinAccountIndex, b.CreateUserOps[0].AccountIndex)
 	api.AssertIsEqual(b.MaxAccountIndex, b.CreateUserOps[len(b.CreateUserOps)-1].AccountIndex)
 
 	// verify whether BatchCommitment is computed correctly
-	actualBatchCommitment := poseidon.Poseidon(api, b.AccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment, b.MinAccountIndex, b.MaxAccountIndex)
+	actualBatchCommitment := hashVariables(api, b.AccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment,
+		b.MinAccountIndex, b.MaxAccountIndex, b.UserCount, b.SnapshotId, b.AccountIds.commitment(api))
+	labelCheck(api, -1, "batch commitment")
 	api.AssertIsEqual(b.BatchCommitment, actualBatchCommitment)
-	countOfCexAsset := getVariableCountOfCexAsset(b.BeforeCexAssets[0])
-	cexAssets := make([]Variable, len(b.BeforeCexAssets)*countOfCexAsset)
-	afterCexAssets := make([]CexAssetInfo, len(b.BeforeCexAssets))
 
 	r := rangecheck.New(api)
 	// verify whether beforeCexAssetsCommitment is computed correctly
-	assetPriceTable := logderivlookup.New(api)
-	for i := 0; i < len(b.BeforeCexAssets); i++ {
-		r.Check(b.BeforeCexAssets[i].TotalEquity, 64)
-		r.Check(b.BeforeCexAssets[i].TotalDebt, 64)
-		r.Check(b.BeforeCexAssets[i].BasePrice, 64)
-		r.Check(b.BeforeCexAssets[i].LoanCollateral, 64)
-		r.Check(b.BeforeCexAssets[i].MarginCollateral, 64)
-		r.Check(b.BeforeCexAssets[i].PortfolioMarginCollateral, 64)
-
-		fillCexAssetCommitment(api, b.BeforeCexAssets[i], i, cexAssets)
-		generateRapidArithmeticForCollateral(api, r, b.BeforeCexAssets[i].LoanRatios)
-		generateRapidArithmeticForCollateral(api, r, b.BeforeCexAssets[i].MarginRatios)
-		generateRapidArithmeticForCollateral(api, r, b.BeforeCexAssets[i].PortfolioMarginRatios)
-		afterCexAssets[i] = b.BeforeCexAssets[i]
-
-		assetPriceTable.Insert(b.BeforeCexAssets[i].BasePrice)
-	}
-	actualCexAssetsCommitment := poseidon.Poseidon(api, cexAssets...)
+	actualCexAssetsCommitment, afterCexAssets, tables := checkBeforeCexAssets(api, r, b.BeforeCexAssets, b.CexAssetsBlinding)
+	labelCheck(api, -1, "before cex assets commitment")
 	api.AssertIsEqual(b.BeforeCEXAssetsCommitment, actualCexAssetsCommitment)
+	tables.constructTierRatiosTables(api, b.BeforeCexAssets)
 
-	loanTierRatiosTable := constructLoanTierRatiosLookupTable(api, b.BeforeCexAssets)
-	marginTierRatiosTable := constructMarginTierRatiosLookupTable(api, b.BeforeCexAssets)
-	portfolioMarginTierRatiosTable := constructPortfolioTierRatiosLookupTable(api, b.BeforeCexAssets)
 	userAssetIdHashes := make([]Variable, len(b.CreateUserOps)+1)
-
-	userAssetsResults := make([][]Variable, len(b.CreateUserOps))
-	userAssetsQueries := make([][]Variable, len(b.CreateUserOps))
+	userAssetsResults := make([]userAssetsCheckResult, len(b.CreateUserOps))
+	accountIds := make([]Variable, len(b.CreateUserOps))
+	var userCount Variable = 0
 
 	for i := 0; i < len(b.CreateUserOps); i++ {
+		labelOp(api, i)
 		// verify AccountIndex increments by 1 across the batch
+		labelCheck(api, -1, "account index increment")
 		if i > 0 {
 			api.AssertIsEqual(b.CreateUserOps[i].AccountIndex, api.Add(b.CreateUserOps[i-1].AccountIndex, 1))
 		}
 
 		accountIndexHelper := accountIdToMerkleHelper(api, b.CreateUserOps[i].AccountIndex)
-
-		var totalUserEquity Variable = 0
-		var totalUserDebt Variable = 0
-		userAssets := b.CreateUserOps[i].Assets
-		var totalUserCollateralRealValue Variable = 0
-
-		// construct lookup table for user assets
-		userAssetsLookupTable := logderivlookup.New(api)
-		for j := 0; j < len(b.CreateUserOps[i].AssetsForUpdateCex); j++ {
-			userAssetsLookupTable.Insert(b.CreateUserOps[i].AssetsForUpdateCex[j].Equity)
-			userAssetsLookupTable.Insert(b.CreateUserOps[i].AssetsForUpdateCex[j].Debt)
-			userAssetsLookupTable.Insert(b.CreateUserOps[i].AssetsForUpdateCex[j].LoanCollateral)
-			userAssetsLookupTable.Insert(b.CreateUserOps[i].AssetsForUpdateCex[j].MarginCollateral)
-			userAssetsLookupTable.Insert(b.CreateUserOps[i].AssetsForUpdateCex[j].PortfolioMarginCollateral)
-		}
-
-		// To check all the user assetIndexes are unique to each other.
-		// If the user assetIndex is increasing, Then all the assetIndexes are unique
-		for j := 0; j < len(userAssets)-1; j++ {
-			r.Check(userAssets[j].AssetIndex, 16)
-			cr := api.CmpNOp(userAssets[j+1].AssetIndex, userAssets[j].AssetIndex, 16, true)
-			api.AssertIsEqual(cr, 1)
-		}
-		r.Check(userAssets[len(userAssets)-1].AssetIndex, 16)
-
-		// one Variable can store 15 assetIds, one assetId is less than 16 bits
-		assetIdsToVariables := make([]Variable, (len(userAssets)+14)/15)
-		for j := 0; j < len(assetIdsToVariables); j++ {
-			var v Variable = 0
-			for p := j * 15; p < (j+1)*15 && p < len(userAssets); p++ {
-				v = api.Add(v, api.Mul(userAssets[p].AssetIndex, utils.PowersOfSixteenBits[p%15]))
-			}
-			assetIdsToVariables[j] = v
-		}
-		userAssetIdHashes[i] = poseidon.Poseidon(api, assetIdsToVariables...)
-
-		// construct query to get user assets
-		userAssetsQueries[i] = make([]Variable, len(userAssets)*5)
-		assetPriceQueries := make([]Variable, len(userAssets))
-		numOfAssetsFields := 6
-		for j := 0; j < len(userAssets); j++ {
-			p := api.Mul(userAssets[j].AssetIndex, 5)
-			for k := 0; k < 5; k++ {
-				userAssetsQueries[i][j*5+k] = api.Add(p, k)
-			}
-			assetPriceQueries[j] = userAssets[j].AssetIndex
-		}
-		userAssetsResults[i] = userAssetsLookupTable.Lookup(userAssetsQueries[i]...)
-		assetPriceResponses := assetPriceTable.Lookup(assetPriceQueries...)
-
-		flattenAssetFieldsForHash := make([]Variable, len(userAssets)*numOfAssetsFields)
-		for j := 0; j < len(userAssets); j++ {
-			// Equity
-			userEquity := userAssetsResults[i][j*5]
-			r.Check(userEquity, 64)
-			// Debt
-			userDebt := userAssetsResults[i][j*5+1]
-			r.Check(userDebt, 64)
-			// LoanCollateral
-			userLoanCollateral := userAssetsResults[i][j*5+2]
-			r.Check(userLoanCollateral, 64)
-			// MarginCollateral
-			userMarginCollateral := userAssetsResults[i][j*5+3]
-			r.Check(userMarginCollateral, 64)
-			// PortfolioMarginCollateral
-			userPortfolioMarginCollateral := userAssetsResults[i][j*5+4]
-			r.Check(userPortfolioMarginCollateral, 64)
-
-			flattenAssetFieldsForHash[j*numOfAssetsFields] = userAssets[j].AssetIndex
-			flattenAssetFieldsForHash[j*numOfAssetsFields+1] = userEquity
-			flattenAssetFieldsForHash[j*numOfAssetsFields+2] = userDebt
-			flattenAssetFieldsForHash[j*numOfAssetsFields+3] = userLoanCollateral
-			flattenAssetFieldsForHash[j*numOfAssetsFields+4] = userMarginCollateral
-			flattenAssetFieldsForHash[j*numOfAssetsFields+5] = userPortfolioMarginCollateral
-
-			assetTotalCollateral := api.Add(userLoanCollateral, userMarginCollateral, userPortfolioMarginCollateral)
-			r.Check(assetTotalCollateral, 64)
-			api.AssertIsLessOrEqualNOp(assetTotalCollateral, userEquity, 64, true)
-
-			flattenTierRatiosLength := 3 * (utils.TierCount + 1)
-			loanRealValue := getAndCheckTierRatiosQueryResults(api, r, loanTierRatiosTable, userAssets[j].AssetIndex,
-				userLoanCollateral,
-				userAssets[j].LoanCollateralIndex,
-				userAssets[j].LoanCollateralFlag,
-				assetPriceResponses[j],
-				flattenTierRatiosLength,
-				utils.TierCount-1)
-
-			marginRealValue := getAndCheckTierRatiosQueryResults(api, r, marginTierRatiosTable, userAssets[j].AssetIndex,
-				userMarginCollateral,
-				userAssets[j].MarginCollateralIndex,
-				userAssets[j].MarginCollateralFlag,
-				assetPriceResponses[j],
-				flattenTierRatiosLength,
-				utils.TierCount-1)
-
-			portfolioMarginRealValue := getAndCheckTierRatiosQueryResults(api, r, portfolioMarginTierRatiosTable, userAssets[j].AssetIndex,
-				userPortfolioMarginCollateral,
-				userAssets[j].PortfolioMarginCollateralIndex,
-				userAssets[j].PortfolioMarginCollateralFlag,
-				assetPriceResponses[j],
-				flattenTierRatiosLength,
-				utils.TierCount-1)
-
-			totalUserCollateralRealValue = api.Add(totalUserCollateralRealValue, loanRealValue, marginRealValue, portfolioMarginRealValue)
-
-			totalUserEquity = api.Add(totalUserEquity, api.Mul(userEquity, assetPriceResponses[j]))
-			totalUserDebt = api.Add(totalUserDebt, api.Mul(userDebt, assetPriceResponses[j]))
-		}
-
-		for j := 0; j < len(b.CreateUserOps[i].AssetsForUpdateCex); j++ {
-			afterCexAssets[j].TotalEquity = api.Add(afterCexAssets[j].TotalEquity, b.CreateUserOps[i].AssetsForUpdateCex[j].Equity)
-			afterCexAssets[j].TotalDebt = api.Add(afterCexAssets[j].TotalDebt, b.CreateUserOps[i].AssetsForUpdateCex[j].Debt)
-			afterCexAssets[j].LoanCollateral = api.Add(afterCexAssets[j].LoanCollateral, b.CreateUserOps[i].AssetsForUpdateCex[j].LoanCollateral)
-			afterCexAssets[j].MarginCollateral = api.Add(afterCexAssets[j].MarginCollateral, b.CreateUserOps[i].AssetsForUpdateCex[j].MarginCollateral)
-			afterCexAssets[j].PortfolioMarginCollateral = api.Add(afterCexAssets[j].PortfolioMarginCollateral, b.CreateUserOps[i].AssetsForUpdateCex[j].PortfolioMarginCollateral)
-		}
-
-		// make sure user's total Debt is less or equal than total collateral
-		r.Check(totalUserDebt, 128)
-		r.Check(totalUserCollateralRealValue, 128)
-		api.AssertIsLessOrEqualNOp(totalUserDebt, totalUserCollateralRealValue, 128, true)
-		userAssetsCommitment := computeUserAssetsCommitment(api, flattenAssetFieldsForHash)
-		accountHash := poseidon.Poseidon(api, b.CreateUserOps[i].AccountIdHash, totalUserEquity, totalUserDebt, totalUserCollateralRealValue, userAssetsCommitment)
+		userAssetsResults[i] = checkUserAssets(api, r, tables, b.CreateUserOps[i].AccountIdHash,
+			b.CreateUserOps[i].Assets, b.CreateUserOps[i].AssetsForUpdateCex, afterCexAssets, false)
+		userAssetIdHashes[i] = userAssetsResults[i].assetIdHash
+		accountIds[i] = b.CreateUserOps[i].AccountIdHash
+		// the padding accounts have no asset, so they are not counted
+		userCount = api.Add(userCount, api.Sub(1, api.IsZero(userAssetsResults[i].assetsSum)))
 		// verify the account hash against the final merkle tree root
-		verifyMerkleProof(api, b.AccountTreeRoot, accountHash, b.CreateUserOps[i].AccountProof[:], accountIndexHelper)
+		labelCheck(api, -1, "account merkle proof")
+		verifyMerkleProof(api, b.AccountTreeRoot, userAssetsResults[i].accountHash, b.CreateUserOps[i].AccountProof, accountIndexHelper)
 	}
 
+	labelOp(api, -1)
+	labelCheck(api, -1, "user count")
+	api.AssertIsEqual(b.UserCount, userCount)
+	labelCheck(api, -1, "account ids")
+	checkAccountIds(api, b.AccountIds, accountIds, b.SortedAccountIds)
+
 	// make sure user assets contains all non-zero assets of AssetsForUpdateCex
-	// use random linear combination to check, the random number is poseidon hash of two elements:
+	// use random linear combination to check, the random number is the hash of two elements:
 	// 1. the public input of circuit -- batch commitment
-	// 2. the poseidon hash of user assets index
+	// 2. the hash of user assets index
 
 	userAssetIdHashes[len(b.CreateUserOps)] = b.BatchCommitment
-	randomChallenge := poseidon.Poseidon(api, userAssetIdHashes...)
-	powersOfRandomChallenge := make([]Variable, 5*len(b.BeforeCexAssets))
-	powersOfRandomChallenge[0] = randomChallenge
-	powersOfRandomChallengeLookupTable := logderivlookup.New(api)
-	powersOfRandomChallengeLookupTable.Insert(randomChallenge)
-	for i := 1; i < len(powersOfRandomChallenge); i++ {
-		powersOfRandomChallenge[i] = api.Mul(powersOfRandomChallenge[i-1], randomChallenge)
-		powersOfRandomChallengeLookupTable.Insert(powersOfRandomChallenge[i])
-	}
+	powersOfRandomChallenge, powersOfRandomChallengeLookupTable := constructPowersOfRandomChallenge(api,
+		hashVariables(api, userAssetIdHashes...), tables.numOfAssetMetaFields()*len(b.BeforeCexAssets))
 
 	for i := 0; i < len(b.CreateUserOps); i++ {
-		powersOfRCResults := powersOfRandomChallengeLookupTable.Lookup(userAssetsQueries[i]...)
-		var sumA Variable = 0
-		for j := 0; j < len(powersOfRCResults); j++ {
-			sumA = api.Add(sumA, api.Mul(powersOfRCResults[j], userAssetsResults[i][j]))
-		}
-
-		var sumB Variable = 0
-		for j := 0; j < len(b.CreateUserOps[i].AssetsForUpdateCex); j++ {
-			sumB = api.Add(sumB, api.Mul(b.CreateUserOps[i].AssetsForUpdateCex[j].Equity, powersOfRandomChallenge[5*j]))
-			sumB = api.Add(sumB, api.Mul(b.CreateUserOps[i].AssetsForUpdateCex[j].Debt, powersOfRandomChallenge[5*j+1]))
-			sumB = api.Add(sumB, api.Mul(b.CreateUserOps[i].AssetsForUpdateCex[j].LoanCollateral, powersOfRandomChallenge[5*j+2]))
-			sumB = api.Add(sumB, api.Mul(b.CreateUserOps[i].AssetsForUpdateCex[j].MarginCollateral, powersOfRandomChallenge[5*j+3]))
-			sumB = api.Add(sumB, api.Mul(b.CreateUserOps[i].AssetsForUpdateCex[j].PortfolioMarginCollateral, powersOfRandomChallenge[5*j+4]))
-		}
-		api.AssertIsEqual(sumA, sumB)
-	}
-	tempAfterCexAssets := make([]Variable, len(b.BeforeCexAssets)*countOfCexAsset)
-	for j := 0; j < len(b.BeforeCexAssets); j++ {
-		r.Check(afterCexAssets[j].TotalEquity, 64)
-		r.Check(afterCexAssets[j].TotalDebt, 64)
-		r.Check(afterCexAssets[j].LoanCollateral, 64)
-		r.Check(afterCexAssets[j].MarginCollateral, 64)
-		r.Check(afterCexAssets[j].PortfolioMarginCollateral, 64)
-
-		fillCexAssetCommitment(api, afterCexAssets[j], j, tempAfterCexAssets)
+		labelOp(api, i)
+		labelCheck(api, -1, "assets for update cex")
+		assertUserAssetsForUpdateCex(api, powersOfRandomChallenge, powersOfRandomChallengeLookupTable,
+			userAssetsResults[i], b.CreateUserOps[i].AssetsForUpdateCex)
 	}
 
 	// verify AfterCEXAssetsCommitment is computed correctly
-	actualAfterCEXAssetsCommitment := poseidon.Poseidon(api, tempAfterCexAssets...)
+	labelOp(api, -1)
+	labelCheck(api, -1, "after cex assets commitment")
+	actualAfterCEXAssetsCommitment := computeAfterCexAssetsCommitment(api, r, afterCexAssets, b.CexAssetsBlinding)
 	api.AssertIsEqual(actualAfterCEXAssetsCommitment, b.AfterCEXAssetsCommitment)
 	return nil
 }
@@ -331,7 +210,19 @@ func copyTierRatios(dst []TierRatio, src []utils.TierRatio) {
 
 }
 
+// cexAssetsBlindingWitness returns zero for the cex assets commitments without blinding.
+func cexAssetsBlindingWitness(blinding []byte) Variable {
+	if blinding == nil {
+		return 0
+	}
+	return blinding
+}
+
 func SetBatchCreateUserCircuitWitness(batchWitness *utils.BatchCreateUserWitness) (witness *BatchCreateUserCircuit, err error) {
+	beforeCexAssets, err := setCexAssetsWitness(batchWitness.BeforeCexAssets)
+	if err != nil {
+		return nil, err
+	}
 	witness = &BatchCreateUserCircuit{
 		BatchCommitment:           batchWitness.BatchCommitment,
 		AccountTreeRoot:           batchWitness.AccountTreeRoot,
@@ -339,98 +230,142 @@ func SetBatchCreateUserCircuitWitness(batchWitness *utils.BatchCreateUserWitness
 		AfterCEXAssetsCommitment:  batchWitness.AfterCEXAssetsCommitment,
 		MinAccountIndex:           batchWitness.MinAccountIndex,
 		MaxAccountIndex:           batchWitness.MaxAccountIndex,
-		BeforeCexAssets:           make([]CexAssetInfo, len(batchWitness.BeforeCexAssets)),
+		UserCount:                 batchWitness.UserCount,
+		SnapshotId:                batchWitness.SnapshotId,
+		AccountIds:                setAccountIdsCheckWitness(&batchWitness.AccountIds),
+		SortedAccountIds:          make([]Variable, len(batchWitness.SortedAccountIds)),
+		CexAssetsBlinding:         cexAssetsBlindingWitness(batchWitness.CexAssetsBlinding),
+		BeforeCexAssets:           beforeCexAssets,
 		CreateUserOps:             make([]CreateUserOperation, len(batchWitness.CreateUserOps)),
 	}
 
-	for i := 0; i < len(witness.BeforeCexAssets); i++ {
-		witness.BeforeCexAssets[i].TotalEquity = batchWitness.BeforeCexAssets[i].TotalEquity
-		witness.BeforeCexAssets[i].TotalDebt = batchWitness.BeforeCexAssets[i].TotalDebt
-		witness.BeforeCexAssets[i].BasePrice = batchWitness.BeforeCexAssets[i].BasePrice
-		witness.BeforeCexAssets[i].LoanCollateral = batchWitness.BeforeCexAssets[i].LoanCollateral
-		witness.BeforeCexAssets[i].MarginCollateral = batchWitness.BeforeCexAssets[i].MarginCollateral
-		witness.BeforeCexAssets[i].PortfolioMarginCollateral = batchWitness.BeforeCexAssets[i].PortfolioMarginCollateral
-		witness.BeforeCexAssets[i].LoanRatios = make([]TierRatio, len(batchWitness.BeforeCexAssets[i].LoanRatios))
-		copyTierRatios(witness.BeforeCexAssets[i].LoanRatios, batchWitness.BeforeCexAssets[i].LoanRatios[:])
-		witness.BeforeCexAssets[i].MarginRatios = make([]TierRatio, len(batchWitness.BeforeCexAssets[i].MarginRatios))
-		copyTierRatios(witness.BeforeCexAssets[i].MarginRatios, batchWitness.BeforeCexAssets[i].MarginRatios[:])
-		witness.BeforeCexAssets[i].PortfolioMarginRatios = make([]TierRatio, len(batchWitness.BeforeCexAssets[i].PortfolioMarginRatios))
-		copyTierRatios(witness.BeforeCexAssets[i].PortfolioMarginRatios, batchWitness.BeforeCexAssets[i].PortfolioMarginRatios[:])
+	if len(witness.SortedAccountIds) != len(witness.CreateUserOps) {
+		return nil, fmt.Errorf("the sorted account ids count %d doesn't match the ops count %d",
+			len(witness.SortedAccountIds), len(witness.CreateUserOps))
+	}
+	for i := 0; i < len(witness.SortedAccountIds); i++ {
+		witness.SortedAccountIds[i] = batchWitness.SortedAccountIds[i]
 	}
 
-	cexAssetsCount := len(witness.BeforeCexAssets)
 	// Decide the assets count for user according to the first user,
 	// because the assets count for all users in a batch are the same
 	// and the rest of the users in the batch may be padding accounts
 	targetCounts := utils.GetNonEmptyAssetsCountOfUser(batchWitness.CreateUserOps[0].Assets)
 	for i := 0; i < len(witness.CreateUserOps); i++ {
-		witness.CreateUserOps[i].AssetsForUpdateCex = make([]UserAssetMeta, cexAssetsCount)
+		witness.CreateUserOps[i].Assets, witness.CreateUserOps[i].AssetsForUpdateCex, err = setUserAssetsWitness(
+			batchWitness.CreateUserOps[i].AccountIndex, batchWitness.CreateUserOps[i].Assets, targetCounts, batchWitness.BeforeCexAssets)
+		if err != nil {
+			return nil, err
+		}
+		witness.CreateUserOps[i].AccountIdHash = batchWitness.CreateUserOps[i].AccountIdHash
+		witness.CreateUserOps[i].AccountIndex = batchWitness.CreateUserOps[i].AccountIndex
+		if len(batchWitness.CreateUserOps[i].AccountProof) != utils.AccountTreeDepth {
+			return nil, fmt.Errorf("the account proof length of account %d doesn't match the AccountTreeDepth %d", batchWitness.CreateUserOps[i].AccountIndex, utils.AccountTreeDepth)
+		}
+		witness.CreateUserOps[i].AccountProof = make([]Variable, utils.AccountTreeDepth)
+		for j := 0; j < len(witness.CreateUserOps[i].AccountProof); j++ {
+			witness.CreateUserOps[i].AccountProof[j] = batchWitness.CreateUserOps[i].AccountProof[j]
+		}
+	}
+	return witness, nil
+}
 
-		existingKeys := make([]int, 0)
-		for j := 0; j < len(batchWitness.CreateUserOps[i].Assets); j++ {
-			u := batchWitness.CreateUserOps[i].Assets[j]
-			userAsset := UserAssetMeta{
-				Equity:                    u.Equity,
-				Debt:                      u.Debt,
-				LoanCollateral:            u.Loan,
-				MarginCollateral:          u.Margin,
-				PortfolioMarginCollateral: u.PortfolioMargin,
+func setCexAssetsWitness(cexAssets []utils.CexAssetInfo) ([]CexAssetInfo, error) {
+	res := make([]CexAssetInfo, len(cexAssets))
+	collateralCounts := len(utils.CollateralCategories)
+	for i := 0; i < len(res); i++ {
+		res[i].TotalEquity = cexAssets[i].TotalEquity.Big()
+		res[i].TotalDebt = cexAssets[i].TotalDebt.Big()
+		res[i].BasePrice = cexAssets[i].BasePrice
+		if len(cexAssets[i].Collaterals) != collateralCounts ||
+			len(cexAssets[i].CollateralRatios) != collateralCounts {
+			return nil, fmt.Errorf("the collaterals of cex asset %d don't match the collateral categories", i)
+		}
+		res[i].Collaterals = make([]Variable, collateralCounts)
+		res[i].CollateralRatios = make([][]TierRatio, collateralCounts)
+		for c := 0; c < collateralCounts; c++ {
+			if len(cexAssets[i].CollateralRatios[c]) != utils.TierCount {
+				return nil, fmt.Errorf("the tiers ratio count of cex asset %d doesn't match the TierCount %d", i, utils.TierCount)
 			}
+			res[i].Collaterals[c] = cexAssets[i].Collaterals[c].Big()
+			res[i].CollateralRatios[c] = make([]TierRatio, utils.TierCount)
+			copyTierRatios(res[i].CollateralRatios[c], cexAssets[i].CollateralRatios[c])
+		}
+	}
+	return res, nil
+}
 
-			witness.CreateUserOps[i].AssetsForUpdateCex[j] = userAsset
+// setUserAssetsWitness converts the assets of one account to the Assets padded to
+// targetCounts and the AssetsForUpdateCex of a user op. The assets are sorted by
+// index, they may contain all the cex assets or only the assets the user owns.
+func setUserAssetsWitness(accountIndex uint32, assets []utils.AccountAsset, targetCounts int, cexAssets []utils.CexAssetInfo) ([]UserAssetInfo, []UserAssetMeta, error) {
+	collateralCounts := len(utils.CollateralCategories)
+	assetsForUpdateCex := make([]UserAssetMeta, len(cexAssets))
+	for j := 0; j < len(assetsForUpdateCex); j++ {
+		assetsForUpdateCex[j] = UserAssetMeta{
+			Equity:      0,
+			Debt:        0,
+			Collaterals: make([]Variable, collateralCounts),
+		}
+		for c := 0; c < collateralCounts; c++ {
+			assetsForUpdateCex[j].Collaterals[c] = 0
+		}
+	}
 
-			if !utils.IsAssetEmpty(&u) {
-				existingKeys = append(existingKeys, int(u.Index))
-			}
+	existingAssets := make([]*utils.AccountAsset, 0)
+	for j := 0; j < len(assets); j++ {
+		u := &assets[j]
+		if len(u.Collaterals) != collateralCounts {
+			return nil, nil, fmt.Errorf("the collaterals of account %d don't match the collateral categories", accountIndex)
 		}
-		paddingCounts := targetCounts - len(existingKeys)
-		witness.CreateUserOps[i].Assets = make([]UserAssetInfo, targetCounts)
-		currentPaddingCounts := 0
-		currentAssetIndex := 0
-		index := 0
-		for _, v := range existingKeys {
-			if currentPaddingCounts < paddingCounts {
-				for k := currentAssetIndex; k < v; k++ {
-					currentPaddingCounts += 1
-					witness.CreateUserOps[i].Assets[index] = UserAssetInfo{
-						AssetIndex:                     uint32(k),
-						LoanCollateralIndex:            0,
-						LoanCollateralFlag:             0,
-						MarginCollateralIndex:          0,
-						MarginCollateralFlag:           0,
-						PortfolioMarginCollateralIndex: 0,
-						PortfolioMarginCollateralFlag:  0,
-					}
-					index += 1
-					if currentPaddingCounts >= paddingCounts {
-						break
-					}
-				}
-			}
-			var uAssetInfo UserAssetInfo
-			uAssetInfo.AssetIndex = uint32(v)
-			calcAndSetCollateralInfo(v, &uAssetInfo, &batchWitness.CreateUserOps[i].Assets[v], batchWitness.BeforeCexAssets)
-			witness.CreateUserOps[i].Assets[index] = uAssetInfo
-			index += 1
-			currentAssetIndex = v + 1
+		if int(u.Index) >= len(cexAssets) {
+			return nil, nil, fmt.Errorf("the asset index %d of account %d is out of the cex assets", u.Index, accountIndex)
 		}
-		for k := index; k < targetCounts; k++ {
-			witness.CreateUserOps[i].Assets[k] = UserAssetInfo{
-				AssetIndex:                     uint32(currentAssetIndex),
-				LoanCollateralIndex:            0,
-				LoanCollateralFlag:             0,
-				MarginCollateralIndex:          0,
-				MarginCollateralFlag:           0,
-				PortfolioMarginCollateralIndex: 0,
-				PortfolioMarginCollateralFlag:  0,
-			}
-			currentAssetIndex += 1
+		userAsset := UserAssetMeta{
+			Equity:      u.Equity.Big(),
+			Debt:        u.Debt.Big(),
+			Collaterals: make([]Variable, collateralCounts),
 		}
-		witness.CreateUserOps[i].AccountIdHash = batchWitness.CreateUserOps[i].AccountIdHash
-		witness.CreateUserOps[i].AccountIndex = batchWitness.CreateUserOps[i].AccountIndex
-		for j := 0; j < len(witness.CreateUserOps[i].AccountProof); j++ {
-			witness.CreateUserOps[i].AccountProof[j] = batchWitness.CreateUserOps[i].AccountProof[j]
+		for c := 0; c < collateralCounts; c++ {
+			userAsset.Collaterals[c] = u.Collaterals[c].Big()
+		}
+
+		assetsForUpdateCex[u.Index] = userAsset
+
+		if !utils.IsAssetEmpty(u) {
+			existingAssets = append(existingAssets, u)
 		}
 	}
-	return witness, nil
+	if len(existingAssets) > targetCounts {
+		return nil, nil, fmt.Errorf("account %d has %d assets, more than the %d assets of the batch", accountIndex, len(existingAssets), targetCounts)
+	}
+	paddingCounts := targetCounts - len(existingAssets)
+	userAssets := make([]UserAssetInfo, targetCounts)
+	currentPaddingCounts := 0
+	currentAssetIndex := 0
+	index := 0
+	for _, u := range existingAssets {
+		v := int(u.Index)
+		if currentPaddingCounts < paddingCounts {
+			for k := currentAssetIndex; k < v; k++ {
+				currentPaddingCounts += 1
+				userAssets[index] = newPaddingUserAssetInfo(uint32(k), collateralCounts)
+				index += 1
+				if currentPaddingCounts >= paddingCounts {
+					break
+				}
+			}
+		}
+		var uAssetInfo UserAssetInfo
+		uAssetInfo.AssetIndex = uint32(v)
+		calcAndSetCollateralInfo(v, &uAssetInfo, u, cexAssets)
+		userAssets[index] = uAssetInfo
+		index += 1
+		currentAssetIndex = v + 1
+	}
+	for k := index; k < targetCounts; k++ {
+		userAssets[k] = newPaddingUserAssetInfo(uint32(currentAssetIndex), collateralCounts)
+		currentAssetIndex += 1
+	}
+	return userAssets, assetsForUpdateCex, nil
 }
@@ -15,7 +15,6 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark-crypto/ecc"
 	"github.com/consensys/gnark-crypto/ecc/bls24-315/fr"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/backend/plonk"
 	"github.com/consensys/gnark/backend/witness"
@@ -42,7 +41,7 @@ func ConstructR1csAndWitness(provingSystem string, assetCountsTier int, userOpsP
 	} else {
 		return nil, nil, fmt.Errorf("invalid proving system")
 	}
-	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), builder, emptyUserCircuit)
+	oR1cs, err := frontend.Compile(utils.CurveID().ScalarField(), builder, emptyUserCircuit)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -52,7 +51,7 @@ func ConstructR1csAndWitness(provingSystem string, assetCountsTier int, userOpsP
 
 	userCircuit := ConstructValidBatch(assetCountsTier, totalAssetsCount, userOpsPerBatch)
 
-	witness, e := frontend.NewWitness(userCircuit, ecc.BN254.ScalarField())
+	witness, e := frontend.NewWitness(userCircuit, utils.CurveID().ScalarField())
 	if witness == nil {
 		return nil, nil, e
 	}
@@ -60,6 +59,9 @@ func ConstructR1csAndWitness(provingSystem string, assetCountsTier int, userOpsP
 }
 
 func TestBatchCreateUserCircuit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
 	for _, assetCountsTier := range utils.AssetCountsTiers {
 		userOpsPerBatch := 2
 		t.Run(fmt.Sprintf("assets_%d_users_%d", assetCountsTier, userOpsPerBatch), func(t *testing.T) {
@@ -75,7 +77,140 @@ func TestBatchCreateUserCircuit(t *testing.T) {
 	}
 }
 
+func TestBatchCreateUserCircuitWithCircuitParams(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+	for _, hashSuite := range []string{utils.PoseidonHashSuite, utils.MiMCHashSuite} {
+		err := utils.SetCircuitParams(utils.CircuitParams{
+			Version:          utils.CircuitParamsVersion,
+			AccountTreeDepth: 8,
+			AssetCounts:      16,
+			TierCount:        4,
+			HashSuite:        hashSuite,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		oR1cs, witness, err := ConstructR1csAndWitness("groth16", 4, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = oR1cs.IsSolved(witness)
+		if err != nil {
+			t.Fatalf("%s: %v", hashSuite, err)
+		}
+	}
+}
+
+// TestBatchCreateUserCircuitOnCurves proves and verifies a small batch on every curve
+func TestBatchCreateUserCircuitOnCurves(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+	for _, curve := range []string{utils.BN254Curve, utils.BLS12381Curve} {
+		t.Run(curve, func(t *testing.T) {
+			err := utils.SetCircuitParams(utils.CircuitParams{
+				Version:          utils.CircuitParamsVersion,
+				AccountTreeDepth: 8,
+				AssetCounts:      16,
+				TierCount:        4,
+				HashSuite:        utils.MiMCHashSuite,
+				Curve:            curve,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ccs, err := Compile(Groth16Backend, NewBatchCreateUserCircuit(4, 16, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pk, vk, err := Setup(Groth16Backend, ccs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch := ConstructValidBatch(4, 16, 2)
+			fullWitness, err := frontend.NewWitness(batch, utils.CurveID().ScalarField())
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof, err := Prove(Groth16Backend, ccs, pk, fullWitness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicWitness, err := fullWitness.Public()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = Verify(Groth16Backend, proof, vk, publicWitness); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBatchCreateUserCircuitUserCount(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+	err := utils.SetCircuitParams(utils.CircuitParams{
+		Version:          utils.CircuitParamsVersion,
+		AccountTreeDepth: 8,
+		AssetCounts:      16,
+		TierCount:        4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver.RegisterHint(IntegerDivision)
+	ccs, err := frontend.Compile(utils.CurveID().ScalarField(), r1cs.NewBuilder, NewBatchCreateUserCircuit(4, 16, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := constructValidBatchWithPadding(4, 16, 3, 2)
+	if batch.UserCount != uint32(1) {
+		t.Fatalf("got user count %v, want 1", batch.UserCount)
+	}
+	w, err := frontend.NewWitness(batch, utils.CurveID().ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ccs.IsSolved(w); err != nil {
+		t.Fatal(err)
+	}
+
+	// the padding accounts can't be counted as real users
+	batch.UserCount = 3
+	batch.BatchCommitment = utils.ComputeBatchCommitment(batch.AccountTreeRoot.([]byte), batch.BeforeCEXAssetsCommitment.([]byte),
+		batch.AfterCEXAssetsCommitment.([]byte), 0, 2, 3, testSnapshotId, accountIdsCommitment(batch.AccountIds))
+	w, err = frontend.NewWitness(batch, utils.CurveID().ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ccs.IsSolved(w); err == nil {
+		t.Fatal("expected failure with the padding accounts counted")
+	}
+}
+
 func TestBatchCreateUserCircuitFromKeySetup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
 	oR1cs, witness, err := ConstructR1csAndWitness("groth16", 50, 1)
 	if err != nil {
 		t.Fatal(err)
@@ -108,6 +243,9 @@ func TestBatchCreateUserCircuitFromKeySetup(t *testing.T) {
 }
 
 func TestBatchCreateUserCircuitFromPlonkKeySetup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
 	oScs, witness, err := ConstructR1csAndWitness("plonk", 50, 1)
 	if err != nil {
 		t.Fatal(err)
@@ -144,6 +282,9 @@ func TestBatchCreateUserCircuitFromPlonkKeySetup(t *testing.T) {
 }
 
 func TestBatchCreateUserCircuitFromKeyFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
 	oR1cs, witness, err := ConstructR1csAndWitness("groth16", 50, 1)
 	if err != nil {
 		t.Fatal(err)
@@ -205,6 +346,12 @@ func TestBatchCreateUserCircuitFromKeyFiles(t *testing.T) {
 }
 
 func TestBatchCreateUserCircuitFromWitnessFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the setup and prove of the batch circuit in short mode")
+	}
+	if _, err := os.Stat("witness.log"); err != nil {
+		t.Skip("witness.log not found, generate it by dbtool query_witness_data subcommand")
+	}
 	targetAssetCounts := 30
 	totalAssetsCount := 500
 	userOpsPerBatch := 2
@@ -231,7 +378,7 @@ func TestBatchCreateUserCircuitFromWitnessFile(t *testing.T) {
 	// the witness.log can be generated by dbtool query_witness_data subcommand
 	userCircuit = ConstructBatchFromFile("witness.log")
 	solver.RegisterHint(IntegerDivision)
-	witness, e := frontend.NewWitness(userCircuit, ecc.BN254.ScalarField())
+	witness, e := frontend.NewWitness(userCircuit, utils.CurveID().ScalarField())
 	if witness == nil {
 		t.Fatal(e)
 		t.Fatal("witness is nil")
@@ -286,94 +433,137 @@ func ConstructBatchFromFile(fileName string) (witness *BatchCreateUserCircuit) {
 	return circuitWitness
 }
 
-func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch int) (witness *BatchCreateUserCircuit) {
-	// construct cex assets
+func constructCexAssets(totalAssetsCount int) []utils.CexAssetInfo {
 	cexAssets := make([]utils.CexAssetInfo, totalAssetsCount)
 	for i := 0; i < totalAssetsCount; i++ {
 		u := utils.CexAssetInfo{
-			BasePrice: 1,
-			Index:     uint32(i),
+			BasePrice:        1,
+			Index:            uint32(i),
+			Collaterals:      make([]utils.Uint128, len(utils.CollateralCategories)),
+			CollateralRatios: make([][]utils.TierRatio, len(utils.CollateralCategories)),
 		}
 		avgRatio := 100 / utils.TierCount
-		for j := 0; j < utils.TierCount; j++ {
-			u.LoanRatios[j] = utils.TierRatio{
-				BoundaryValue:    new(big.Int).SetInt64(int64(100 * (j + 1))),
-				Ratio:            uint8(100 - avgRatio*j),
-				PrecomputedValue: new(big.Int).SetInt64(0),
-			}
-			u.MarginRatios[j] = utils.TierRatio{
-				BoundaryValue:    new(big.Int).SetInt64(int64(100 * (j + 1))),
-				Ratio:            uint8(100 - avgRatio*j),
-				PrecomputedValue: new(big.Int).SetInt64(0),
-			}
-			u.PortfolioMarginRatios[j] = utils.TierRatio{
-				BoundaryValue:    new(big.Int).SetInt64(int64(100 * (j + 1))),
-				Ratio:            uint8(100 - avgRatio*j),
-				PrecomputedValue: new(big.Int).SetInt64(0),
+		for c := 0; c < len(u.CollateralRatios); c++ {
+			u.CollateralRatios[c] = make([]utils.TierRatio, utils.TierCount)
+			for j := 0; j < utils.TierCount; j++ {
+				u.CollateralRatios[c][j] = utils.TierRatio{
+					BoundaryValue:    new(big.Int).SetInt64(int64(100 * (j + 1))),
+					Ratio:            uint8(100 - avgRatio*j),
+					PrecomputedValue: new(big.Int).SetInt64(0),
+				}
 			}
+			utils.CalculatePrecomputedValue(u.CollateralRatios[c])
 		}
-		utils.CalculatePrecomputedValue(u.LoanRatios[:])
-		utils.CalculatePrecomputedValue(u.MarginRatios[:])
-		utils.CalculatePrecomputedValue(u.PortfolioMarginRatios[:])
 		cexAssets[i] = u
 	}
+	return cexAssets
+}
+
+// constructRandomAccount returns an account of assetsCount random assets and
+// adds its assets to cexAssets.
+func constructRandomAccount(cexAssets []utils.CexAssetInfo, accountIndex uint32, assetsCount int) utils.AccountInfo {
+	gap := len(cexAssets) / assetsCount
+	account := utils.AccountInfo{
+		AccountIndex: accountIndex,
+		AccountId:    make([]byte, 32),
+	}
+	rand.Read(account.AccountId)
+	account.AccountId = new(fr.Element).SetBytes(account.AccountId).Marshal()
+	account.Assets = make([]utils.AccountAsset, assetsCount)
+	totalEquity := new(big.Int).SetInt64(0)
+	totalDebt := new(big.Int).SetInt64(0)
+	totalCollateral := new(big.Int).SetInt64(0)
+
+	for j := 0; j < len(account.Assets); j++ {
+		account.Assets[j].Index = uint16(gap * j)
+		assetPrice := new(big.Int).SetUint64(cexAssets[account.Assets[j].Index].BasePrice)
+		account.Assets[j].Collaterals = make([]utils.Uint128, len(utils.CollateralCategories))
+		totalValue := uint64(0)
+		for c := 0; c < len(account.Assets[j].Collaterals); c++ {
+			collateral := uint64(rand.Intn(1000)) + 1
+			account.Assets[j].Collaterals[c] = utils.NewUint128(collateral)
+			totalValue += collateral
+		}
+		collateralValue := utils.CalculateAssetValueForCollateral(account.Assets[j].Collaterals,
+			&cexAssets[account.Assets[j].Index])
+		totalCollateral.Add(totalCollateral, collateralValue)
+		collateralValue.Div(collateralValue, assetPrice)
+		account.Assets[j].Debt = utils.NewUint128(uint64(rand.Intn(int(collateralValue.Int64()))) + 1)
+		account.Assets[j].Equity = utils.NewUint128(uint64(rand.Intn(1000)) + totalValue)
+		debtBigInt := account.Assets[j].Debt.Big()
+		equityBigInt := account.Assets[j].Equity.Big()
+		debtBigInt.Mul(debtBigInt, assetPrice)
+		totalDebt.Add(totalDebt, debtBigInt)
+		equityBigInt.Mul(equityBigInt, assetPrice)
+		totalEquity.Add(totalEquity, equityBigInt)
+		// update cexAssets
+		cexAsset := &cexAssets[account.Assets[j].Index]
+		cexAsset.TotalEquity = utils.SafeAdd(cexAsset.TotalEquity, account.Assets[j].Equity)
+		cexAsset.TotalDebt = utils.SafeAdd(cexAsset.TotalDebt, account.Assets[j].Debt)
+		for c := 0; c < len(account.Assets[j].Collaterals); c++ {
+			cexAsset.Collaterals[c] = utils.SafeAdd(cexAsset.Collaterals[c], account.Assets[j].Collaterals[c])
+		}
+	}
+	account.TotalEquity = totalEquity
+	account.TotalDebt = totalDebt
+	account.TotalCollateral = totalCollateral
+	return account
+}
+
+// testSnapshotId is the snapshot id "20240131-1" of the test batches
+const testSnapshotId = 202401310001
+
+func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch int) (witness *BatchCreateUserCircuit) {
+	return constructValidBatchWithPadding(assetsCount, totalAssetsCount, userOpsPerBatch, 0)
+}
+
+// constructValidBatchWithPadding returns a batch whose last paddingOps ops are padding accounts.
+func constructValidBatchWithPadding(assetsCount int, totalAssetsCount int, userOpsPerBatch int, paddingOps int) (witness *BatchCreateUserCircuit) {
+	circuitWitness, _ := SetBatchCreateUserCircuitWitness(constructValidBatchWitness(assetsCount, totalAssetsCount, userOpsPerBatch, paddingOps))
+	return circuitWitness
+}
+
+// constructValidBatchWitness returns the utils.BatchCreateUserWitness of
+// constructValidBatchWithPadding.
+func constructValidBatchWitness(assetsCount int, totalAssetsCount int, userOpsPerBatch int, paddingOps int) *utils.BatchCreateUserWitness {
+	// construct cex assets
+	cexAssets := constructCexAssets(totalAssetsCount)
+	beforeCexAssets := utils.CloneCexAssetsInfo(cexAssets)
 
-	gap := totalAssetsCount / assetsCount
 	// construct accounts
 	accounts := make([]utils.AccountInfo, userOpsPerBatch)
+	for i := 0; i < len(accounts); i++ {
+		if i >= userOpsPerBatch-paddingOps {
+			accounts[i] = utils.NewPaddingAccount(assetsCount)
+			accounts[i].AccountIndex = uint32(i)
+			accounts[i].AccountId = utils.ReduceToFieldElement([]byte{byte(i + 1)})
+			continue
+		}
+		accounts[i] = constructRandomAccount(cexAssets, uint32(i), assetsCount)
+	}
+	return constructBatchWitness(beforeCexAssets, accounts)
+}
 
+// constructBatchWitness returns the witness of a batch of the accounts, the
+// after cex assets are beforeCexAssets plus the assets of the accounts.
+func constructBatchWitness(beforeCexAssets []utils.CexAssetInfo, accounts []utils.AccountInfo) *utils.BatchCreateUserWitness {
+	userOpsPerBatch := len(accounts)
 	batchCreateUserWit := &utils.BatchCreateUserWitness{
-		BeforeCexAssets: make([]utils.CexAssetInfo, totalAssetsCount),
+		BeforeCexAssets: utils.CloneCexAssetsInfo(beforeCexAssets),
 		CreateUserOps:   make([]utils.CreateUserOperation, userOpsPerBatch),
 	}
-	for i := 0; i < totalAssetsCount; i++ {
-		batchCreateUserWit.BeforeCexAssets[i] = cexAssets[i]
-	}
 	batchCreateUserWit.BeforeCEXAssetsCommitment = utils.ComputeCexAssetsCommitment(batchCreateUserWit.BeforeCexAssets)
-
+	// the totals wrap around on overflow, which the circuit must reject
+	cexAssets := utils.CloneCexAssetsInfo(beforeCexAssets)
 	for i := 0; i < len(accounts); i++ {
-		accounts[i] = utils.AccountInfo{
-			AccountIndex: uint32(i),
-			AccountId:    make([]byte, 32),
-		}
-		rand.Read(accounts[i].AccountId)
-		accounts[i].AccountId = new(fr.Element).SetBytes(accounts[i].AccountId).Marshal()
-		accounts[i].Assets = make([]utils.AccountAsset, assetsCount)
-		totalEquity := new(big.Int).SetInt64(0)
-		totalDebt := new(big.Int).SetInt64(0)
-		totalCollateral := new(big.Int).SetInt64(0)
-
-		for j := 0; j < len(accounts[i].Assets); j++ {
-			accounts[i].Assets[j].Index = uint16(gap * j)
-			assetPrice := new(big.Int).SetUint64(cexAssets[accounts[i].Assets[j].Index].BasePrice)
-			accounts[i].Assets[j].Loan = uint64(rand.Intn(1000)) + 1
-			accounts[i].Assets[j].Margin = uint64(rand.Intn(1000)) + 1
-			accounts[i].Assets[j].PortfolioMargin = uint64(rand.Intn(1000)) + 1
-			totalValue := accounts[i].Assets[j].Loan + accounts[i].Assets[j].Margin + accounts[i].Assets[j].PortfolioMargin
-			collateralValue := utils.CalculateAssetValueForCollateral(accounts[i].Assets[j].Loan,
-				accounts[i].Assets[j].Margin,
-				accounts[i].Assets[j].PortfolioMargin,
-				&cexAssets[accounts[i].Assets[j].Index])
-			totalCollateral.Add(totalCollateral, collateralValue)
-			collateralValue.Div(collateralValue, assetPrice)
-			accounts[i].Assets[j].Debt = uint64(rand.Intn(int(collateralValue.Int64()))) + 1
-			accounts[i].Assets[j].Equity = uint64(rand.Intn(1000)) + totalValue
-			debtBigInt := new(big.Int).SetUint64(accounts[i].Assets[j].Debt)
-			equityBigInt := new(big.Int).SetUint64(accounts[i].Assets[j].Equity)
-			debtBigInt.Mul(debtBigInt, assetPrice)
-			totalDebt.Add(totalDebt, debtBigInt)
-			equityBigInt.Mul(equityBigInt, assetPrice)
-			totalEquity.Add(totalEquity, equityBigInt)
-			// update cexAssets
-			cexAssets[accounts[i].Assets[j].Index].TotalEquity += accounts[i].Assets[j].Equity
-			cexAssets[accounts[i].Assets[j].Index].TotalDebt += accounts[i].Assets[j].Debt
-			cexAssets[accounts[i].Assets[j].Index].LoanCollateral += accounts[i].Assets[j].Loan
-			cexAssets[accounts[i].Assets[j].Index].MarginCollateral += accounts[i].Assets[j].Margin
-			cexAssets[accounts[i].Assets[j].Index].PortfolioMarginCollateral += accounts[i].Assets[j].PortfolioMargin
+		for _, asset := range accounts[i].Assets {
+			cexAsset := &cexAssets[asset.Index]
+			cexAsset.TotalEquity, _ = cexAsset.TotalEquity.Add(asset.Equity)
+			cexAsset.TotalDebt, _ = cexAsset.TotalDebt.Add(asset.Debt)
+			for c := 0; c < len(asset.Collaterals); c++ {
+				cexAsset.Collaterals[c], _ = cexAsset.Collaterals[c].Add(asset.Collaterals[c])
+			}
 		}
-		accounts[i].TotalEquity = totalEquity
-		accounts[i].TotalDebt = totalDebt
-		accounts[i].TotalCollateral = totalCollateral
 	}
 
 	// Build the account tree using the two-phase approach
@@ -382,8 +572,8 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 		panic(err.Error())
 	}
 	for i := 0; i < len(accounts); i++ {
-		poseidonHasher := poseidon.NewPoseidon()
-		accountHash := utils.AccountInfoToHash(&accounts[i], &poseidonHasher)
+		hasher := utils.NewHasher()
+		accountHash := utils.AccountInfoToHash(&accounts[i], &hasher)
 		accountTree.Set(accounts[i].AccountIndex, accountHash)
 	}
 	accountTree.Build()
@@ -399,27 +589,34 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 			AccountIndex:  accounts[i].AccountIndex,
 			AccountIdHash: accounts[i].AccountId,
 		}
-		copy(batchCreateUserWit.CreateUserOps[i].AccountProof[:], accountProof[:])
+		batchCreateUserWit.CreateUserOps[i].AccountProof = accountProof
 	}
 
 	batchCreateUserWit.AccountTreeRoot = accountTree.Root()
 	batchCreateUserWit.AfterCEXAssetsCommitment = utils.ComputeCexAssetsCommitment(cexAssets)
 	batchCreateUserWit.MinAccountIndex = accounts[0].AccountIndex
 	batchCreateUserWit.MaxAccountIndex = accounts[len(accounts)-1].AccountIndex
-	minBytes := new(big.Int).SetUint64(uint64(batchCreateUserWit.MinAccountIndex)).Bytes()
-	if len(minBytes) == 0 {
-		minBytes = []byte{0}
+	batchCreateUserWit.UserCount = utils.CountRealUsers(batchCreateUserWit.CreateUserOps)
+	batchCreateUserWit.SnapshotId = testSnapshotId
+	accountIds := make([][]byte, len(accounts))
+	for i := 0; i < len(accounts); i++ {
+		accountIds[i] = accounts[i].AccountId
 	}
-	maxBytes := new(big.Int).SetUint64(uint64(batchCreateUserWit.MaxAccountIndex)).Bytes()
-	if len(maxBytes) == 0 {
-		maxBytes = []byte{0}
+	accountIdsChecks, sortedAccountIds, err := utils.NewAccountIdsChecks(batchCreateUserWit.AccountTreeRoot, [][][]byte{accountIds})
+	if err != nil {
+		panic(err.Error())
 	}
-	batchCreateUserWit.BatchCommitment = poseidon.PoseidonBytes(
+	batchCreateUserWit.AccountIds = accountIdsChecks[0]
+	batchCreateUserWit.SortedAccountIds = sortedAccountIds[0]
+	batchCreateUserWit.BatchCommitment = utils.ComputeBatchCommitment(
 		batchCreateUserWit.AccountTreeRoot,
 		batchCreateUserWit.BeforeCEXAssetsCommitment,
 		batchCreateUserWit.AfterCEXAssetsCommitment,
-		minBytes,
-		maxBytes)
+		batchCreateUserWit.MinAccountIndex,
+		batchCreateUserWit.MaxAccountIndex,
+		batchCreateUserWit.UserCount,
+		batchCreateUserWit.SnapshotId,
+		batchCreateUserWit.AccountIds.Commitment())
 	var serializeBuf bytes.Buffer
 	enc := gob.NewEncoder(&serializeBuf)
 	err = enc.Encode(batchCreateUserWit)
@@ -429,9 +626,7 @@ func ConstructValidBatch(assetsCount int, totalAssetsCount int, userOpsPerBatch
 	buf := serializeBuf.Bytes()
 	compressedBuf := s2.Encode(nil, buf)
 	witnessDataStr := base64.StdEncoding.EncodeToString(compressedBuf)
-	witnessForCircuit := utils.DecodeBatchWitness(witnessDataStr)
-	circuitWitness, _ := SetBatchCreateUserCircuitWitness(witnessForCircuit)
-	return circuitWitness
+	return utils.DecodeBatchWitness(witnessDataStr)
 }
 
 func TestSetBatchCreateUserCircuitWitness(t *testing.T) {
@@ -443,7 +638,7 @@ func TestSetBatchCreateUserCircuitWitness(t *testing.T) {
 			t.Fatal("asset counts not match")
 		}
 	}
-	fmt.Println("assets info ", circuitWitness.CreateUserOps[0].Assets[0].LoanCollateralIndex)
-	fmt.Println("assets info ", circuitWitness.CreateUserOps[0].Assets[0].MarginCollateralIndex)
-	fmt.Println("assets info ", circuitWitness.CreateUserOps[0].Assets[0].PortfolioMarginCollateralIndex)
+	for c := 0; c < len(utils.CollateralCategories); c++ {
+		fmt.Println("assets info ", circuitWitness.CreateUserOps[0].Assets[0].CollateralIndexes[c])
+	}
 }
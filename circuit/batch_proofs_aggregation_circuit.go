@@ -0,0 +1,472 @@
+package circuit
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/plonk"
+	plonk_bn254 "github.com/consensys/gnark/backend/plonk/bn254"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/commitments/kzg"
+	"github.com/consensys/gnark/std/math/emulated"
+	stdplonk "github.com/consensys/gnark/std/recursion/plonk"
+)
+
+type (
+	InnerProof               = stdplonk.Proof[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine]
+	InnerVerifyingKey        = stdplonk.VerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine]
+	InnerBaseVerifyingKey    = stdplonk.BaseVerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine]
+	InnerCircuitVerifyingKey = stdplonk.CircuitVerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine]
+	innerWitness             = stdplonk.Witness[sw_bn254.ScalarField]
+	innerVerifier            = stdplonk.Verifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl]
+	innerScalarField         = emulated.Field[sw_bn254.ScalarField]
+)
+
+// The batch proofs are aggregated by a tree of fixed arity. The circuit of
+// level 0 verifies the plonk proofs of up to arity batches, the circuit of
+// level l verifies the proofs of up to arity aggregation proofs of level l-1.
+// The circuits don't depend on the number of batches of an audit, so their
+// keys are generated once from the universal KZG SRS. Every aggregation proof
+// has the commitment of the AggregatedRange of its batches as the only public
+// input, so the proof of any level can be verified as the final proof.
+
+// AggregationKeyName returns the name of the keys of the aggregation circuit of level.
+func AggregationKeyName(keyName string, level int) string {
+	return keyName + "_level" + strconv.Itoa(level)
+}
+
+// AggregationLevel returns the level of the final aggregation proof of
+// batchCount batches, it is the lowest level whose circuit covers up to
+// arity^(level+1) batches. The proofs of arity 1 are never folded, so their
+// level is 0.
+func AggregationLevel(batchCount, arity int) int {
+	level := 0
+	for capacity := arity; arity > 1 && capacity < batchCount; capacity *= arity {
+		level++
+	}
+	return level
+}
+
+// AggregatedRange is the in circuit utils.AggregatedRange.
+type AggregatedRange struct {
+	AccountTreeRoot           Variable
+	SnapshotId                Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+	MinAccountIndex           Variable
+	MaxAccountIndex           Variable
+	UserCount                 Variable
+	AccountIdsChallenge       Variable
+	BeforeLastAccountId       Variable
+	AfterLastAccountId        Variable
+	BeforeAccountIdsProduct   Variable
+	AfterAccountIdsProduct    Variable
+	BeforeAccountIdsHash      Variable
+	AfterAccountIdsHash       Variable
+}
+
+func setAggregatedRangeWitness(r *utils.AggregatedRange) AggregatedRange {
+	return AggregatedRange{
+		AccountTreeRoot:           r.AccountTreeRoot,
+		SnapshotId:                r.SnapshotId,
+		BeforeCEXAssetsCommitment: r.BeforeCEXAssetsCommitment,
+		AfterCEXAssetsCommitment:  r.AfterCEXAssetsCommitment,
+		MinAccountIndex:           r.MinAccountIndex,
+		MaxAccountIndex:           r.MaxAccountIndex,
+		UserCount:                 r.UserCount,
+		AccountIdsChallenge:       r.AccountIdsChallenge,
+		BeforeLastAccountId:       r.BeforeLastAccountId,
+		AfterLastAccountId:        r.AfterLastAccountId,
+		BeforeAccountIdsProduct:   r.BeforeAccountIdsProduct,
+		AfterAccountIdsProduct:    r.AfterAccountIdsProduct,
+		BeforeAccountIdsHash:      r.BeforeAccountIdsHash,
+		AfterAccountIdsHash:       r.AfterAccountIdsHash,
+	}
+}
+
+func (r AggregatedRange) commitment(api API) Variable {
+	return hashVariables(api, r.AccountTreeRoot, r.SnapshotId, r.BeforeCEXAssetsCommitment, r.AfterCEXAssetsCommitment,
+		r.MinAccountIndex, r.MaxAccountIndex, r.UserCount, r.AccountIdsChallenge,
+		r.BeforeLastAccountId, r.AfterLastAccountId, r.BeforeAccountIdsProduct, r.AfterAccountIdsProduct,
+		r.BeforeAccountIdsHash, r.AfterAccountIdsHash)
+}
+
+// chainAggregatedRanges asserts the ranges which are not padding are
+// consecutive as utils.ChainAggregatedRanges and returns the range covering
+// all of them. The first range is never padding and a padding range is only
+// followed by padding ranges.
+func chainAggregatedRanges(api API, ranges []AggregatedRange, padding []Variable) AggregatedRange {
+	api.AssertIsEqual(padding[0], 0)
+	r := ranges[0]
+	for i := 1; i < len(ranges); i++ {
+		api.AssertIsBoolean(padding[i])
+		api.AssertIsEqual(api.Mul(padding[i-1], api.Sub(1, padding[i])), 0)
+		used := api.Sub(1, padding[i])
+		assertIsEqualIf(api, used, ranges[i].AccountTreeRoot, r.AccountTreeRoot)
+		assertIsEqualIf(api, used, ranges[i].SnapshotId, r.SnapshotId)
+		assertIsEqualIf(api, used, ranges[i].AccountIdsChallenge, r.AccountIdsChallenge)
+		assertIsEqualIf(api, used, ranges[i].BeforeCEXAssetsCommitment, r.AfterCEXAssetsCommitment)
+		assertIsEqualIf(api, used, ranges[i].MinAccountIndex, api.Add(r.MaxAccountIndex, 1))
+		assertIsEqualIf(api, used, ranges[i].BeforeLastAccountId, r.AfterLastAccountId)
+		assertIsEqualIf(api, used, ranges[i].BeforeAccountIdsProduct, r.AfterAccountIdsProduct)
+		assertIsEqualIf(api, used, ranges[i].BeforeAccountIdsHash, r.AfterAccountIdsHash)
+		r.AfterCEXAssetsCommitment = api.Select(used, ranges[i].AfterCEXAssetsCommitment, r.AfterCEXAssetsCommitment)
+		r.MaxAccountIndex = api.Select(used, ranges[i].MaxAccountIndex, r.MaxAccountIndex)
+		r.UserCount = api.Add(r.UserCount, api.Mul(used, ranges[i].UserCount))
+		r.AfterLastAccountId = api.Select(used, ranges[i].AfterLastAccountId, r.AfterLastAccountId)
+		r.AfterAccountIdsProduct = api.Select(used, ranges[i].AfterAccountIdsProduct, r.AfterAccountIdsProduct)
+		r.AfterAccountIdsHash = api.Select(used, ranges[i].AfterAccountIdsHash, r.AfterAccountIdsHash)
+	}
+	return r
+}
+
+// assertIsEqualIf asserts a == b if flag is 1.
+func assertIsEqualIf(api API, flag Variable, a, b Variable) {
+	api.AssertIsEqual(api.Mul(flag, api.Sub(a, b)), 0)
+}
+
+// publicInputOf returns the inner witness of a proof whose only public input is commitment.
+func publicInputOf(api API, scalarApi *innerScalarField, commitment Variable) innerWitness {
+	return innerWitness{
+		Public: []emulated.Element[sw_bn254.ScalarField]{*scalarApi.FromBits(api.ToBinary(commitment)...)},
+	}
+}
+
+func newInnerVerifier(api API) (*innerVerifier, *innerScalarField, error) {
+	verifier, err := stdplonk.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return nil, nil, err
+	}
+	scalarApi, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return nil, nil, err
+	}
+	return verifier, scalarApi, nil
+}
+
+// placeholderInnerProof returns the placeholder of a proof of vk.
+func placeholderInnerProof(vk *plonk_bn254.VerifyingKey) InnerProof {
+	return InnerProof{
+		BatchedProof: kzg.BatchOpeningProof[sw_bn254.ScalarField, sw_bn254.G1Affine]{
+			ClaimedValues: make([]emulated.Element[sw_bn254.ScalarField], 6+len(vk.Qcp)),
+		},
+		Bsb22Commitments: make([]kzg.Commitment[sw_bn254.G1Affine], len(vk.Qcp)),
+	}
+}
+
+// AggregatedBatch is one batch proof verified by the aggregation circuit of
+// level 0 together with the preimage of its BatchCommitment, except the
+// account tree root and the snapshot id which are shared by all batches.
+type AggregatedBatch struct {
+	Proof InnerProof
+	// VerifyingKeyIndex is the tier of the batch
+	VerifyingKeyIndex         Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+	MinAccountIndex           Variable
+	MaxAccountIndex           Variable
+	UserCount                 Variable
+	AccountIds                AccountIdsCheck
+	BeforeAccountIdsHash      Variable
+	// Padding is 1 if the slot is not used, its proof is still verified so the
+	// first batch is repeated
+	Padding Variable
+}
+
+// BatchProofsAggregationCircuit is the aggregation circuit of level 0, it
+// verifies up to len(Batches) consecutive batch proofs. The verifying key of a
+// batch is selected by its VerifyingKeyIndex among the keys of all the tiers.
+type BatchProofsAggregationCircuit struct {
+	RangeCommitment Variable `gnark:",public"`
+	AccountTreeRoot Variable
+	SnapshotId      Variable
+	Batches         []AggregatedBatch
+
+	// The verifying keys of the tiers are constants of the circuit, they share
+	// the KZG SRS and only differ in the circuit part.
+	BaseVerifyingKey InnerBaseVerifyingKey      `gnark:"-"`
+	VerifyingKeys    []InnerCircuitVerifyingKey `gnark:"-"`
+}
+
+// NewBatchProofsAggregationCircuit returns the aggregation circuit of level 0
+// which verifies up to arity batch proofs of the tiers of batchVks.
+func NewBatchProofsAggregationCircuit(batchVks []plonk.VerifyingKey, arity int) (*BatchProofsAggregationCircuit, error) {
+	if len(batchVks) == 0 {
+		return nil, fmt.Errorf("no batch verifying keys")
+	}
+	if arity < 1 {
+		return nil, fmt.Errorf("invalid aggregation arity %d", arity)
+	}
+	vk0, ok := batchVks[0].(*plonk_bn254.VerifyingKey)
+	if !ok {
+		return nil, fmt.Errorf("expected bn254 plonk verifying key, got %T", batchVks[0])
+	}
+	var circuit BatchProofsAggregationCircuit
+	var err error
+	circuit.BaseVerifyingKey, err = stdplonk.ValueOfBaseVerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine](vk0)
+	if err != nil {
+		return nil, err
+	}
+	circuit.VerifyingKeys = make([]InnerCircuitVerifyingKey, len(batchVks))
+	for i := 0; i < len(batchVks); i++ {
+		vk, ok := batchVks[i].(*plonk_bn254.VerifyingKey)
+		if !ok {
+			return nil, fmt.Errorf("expected bn254 plonk verifying key, got %T", batchVks[i])
+		}
+		if vk.NbPublicVariables != vk0.NbPublicVariables || len(vk.Qcp) != len(vk0.Qcp) || !vk.CosetShift.Equal(&vk0.CosetShift) {
+			return nil, fmt.Errorf("the verifying key of tier %d doesn't have the same shape as tier 0", i)
+		}
+		if !vk.Kzg.G1.Equal(&vk0.Kzg.G1) || !vk.Kzg.G2[0].Equal(&vk0.Kzg.G2[0]) || !vk.Kzg.G2[1].Equal(&vk0.Kzg.G2[1]) {
+			return nil, fmt.Errorf("the verifying key of tier %d isn't generated from the same kzg srs as tier 0", i)
+		}
+		circuit.VerifyingKeys[i], err = stdplonk.ValueOfCircuitVerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine](vk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	circuit.Batches = make([]AggregatedBatch, arity)
+	for i := 0; i < arity; i++ {
+		circuit.Batches[i].Proof = placeholderInnerProof(vk0)
+	}
+	return &circuit, nil
+}
+
+func (c BatchProofsAggregationCircuit) Define(api API) error {
+	verifier, scalarApi, err := newInnerVerifier(api)
+	if err != nil {
+		return err
+	}
+	ranges := make([]AggregatedRange, len(c.Batches))
+	padding := make([]Variable, len(c.Batches))
+	switches := make([]frontend.Variable, len(c.Batches))
+	proofs := make([]InnerProof, len(c.Batches))
+	witnesses := make([]innerWitness, len(c.Batches))
+	for i := 0; i < len(c.Batches); i++ {
+		b := c.Batches[i]
+		ranges[i] = AggregatedRange{
+			AccountTreeRoot:           c.AccountTreeRoot,
+			SnapshotId:                c.SnapshotId,
+			BeforeCEXAssetsCommitment: b.BeforeCEXAssetsCommitment,
+			AfterCEXAssetsCommitment:  b.AfterCEXAssetsCommitment,
+			MinAccountIndex:           b.MinAccountIndex,
+			MaxAccountIndex:           b.MaxAccountIndex,
+			UserCount:                 b.UserCount,
+			AccountIdsChallenge:       b.AccountIds.Challenge,
+			BeforeLastAccountId:       b.AccountIds.BeforeLastAccountId,
+			AfterLastAccountId:        b.AccountIds.AfterLastAccountId,
+			BeforeAccountIdsProduct:   b.AccountIds.BeforeProduct,
+			AfterAccountIdsProduct:    b.AccountIds.AfterProduct,
+			BeforeAccountIdsHash:      b.BeforeAccountIdsHash,
+			AfterAccountIdsHash:       hashVariables(api, b.BeforeAccountIdsHash, b.AccountIds.SortedAccountIdsHash),
+		}
+		padding[i] = b.Padding
+		switches[i] = b.VerifyingKeyIndex
+		proofs[i] = b.Proof
+		// the public input of the batch proof is recomputed from the chained
+		// values, so a proof can only be accepted for the batch it belongs to
+		batchCommitment := hashVariables(api, c.AccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment,
+			b.MinAccountIndex, b.MaxAccountIndex, b.UserCount, c.SnapshotId, b.AccountIds.commitment(api))
+		witnesses[i] = publicInputOf(api, scalarApi, batchCommitment)
+	}
+	r := chainAggregatedRanges(api, ranges, padding)
+	api.AssertIsEqual(c.RangeCommitment, r.commitment(api))
+	return verifier.AssertDifferentProofs(c.BaseVerifyingKey, c.VerifyingKeys, switches, proofs, witnesses)
+}
+
+// AggregatedChild is one aggregation proof of the level below verified by an
+// AggregationNodeCircuit, Range is the preimage of its public input.
+type AggregatedChild struct {
+	Proof InnerProof
+	Range AggregatedRange
+	// Padding is 1 if the slot is not used, its proof is still verified so the
+	// first child is repeated
+	Padding Variable
+}
+
+// AggregationNodeCircuit is the aggregation circuit of a level above 0, it
+// verifies up to len(Children) consecutive aggregation proofs of the level below.
+type AggregationNodeCircuit struct {
+	RangeCommitment Variable `gnark:",public"`
+	Children        []AggregatedChild
+
+	// VerifyingKey is the verifying key of the level below
+	VerifyingKey InnerVerifyingKey `gnark:"-"`
+}
+
+// NewAggregationNodeCircuit returns the aggregation circuit which verifies up
+// to arity aggregation proofs of childVk.
+func NewAggregationNodeCircuit(childVk plonk.VerifyingKey, arity int) (*AggregationNodeCircuit, error) {
+	if arity < 1 {
+		return nil, fmt.Errorf("invalid aggregation arity %d", arity)
+	}
+	vk, ok := childVk.(*plonk_bn254.VerifyingKey)
+	if !ok {
+		return nil, fmt.Errorf("expected bn254 plonk verifying key, got %T", childVk)
+	}
+	var circuit AggregationNodeCircuit
+	var err error
+	circuit.VerifyingKey, err = stdplonk.ValueOfVerifyingKey[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine](vk)
+	if err != nil {
+		return nil, err
+	}
+	circuit.Children = make([]AggregatedChild, arity)
+	for i := 0; i < arity; i++ {
+		circuit.Children[i].Proof = placeholderInnerProof(vk)
+	}
+	return &circuit, nil
+}
+
+func (c AggregationNodeCircuit) Define(api API) error {
+	verifier, scalarApi, err := newInnerVerifier(api)
+	if err != nil {
+		return err
+	}
+	ranges := make([]AggregatedRange, len(c.Children))
+	padding := make([]Variable, len(c.Children))
+	proofs := make([]InnerProof, len(c.Children))
+	witnesses := make([]innerWitness, len(c.Children))
+	for i := 0; i < len(c.Children); i++ {
+		ranges[i] = c.Children[i].Range
+		padding[i] = c.Children[i].Padding
+		proofs[i] = c.Children[i].Proof
+		witnesses[i] = publicInputOf(api, scalarApi, c.Children[i].Range.commitment(api))
+	}
+	r := chainAggregatedRanges(api, ranges, padding)
+	api.AssertIsEqual(c.RangeCommitment, r.commitment(api))
+	return verifier.AssertSameProofs(c.VerifyingKey, proofs, witnesses)
+}
+
+// NewAggregationPublicWitness returns the public witness of the aggregation
+// proof of r, which is the same for all levels.
+func NewAggregationPublicWitness(r *utils.AggregatedRange) (witness.Witness, error) {
+	assignment := &AggregationNodeCircuit{RangeCommitment: r.Commitment()}
+	return frontend.NewWitness(assignment, utils.CurveID().ScalarField(), frontend.PublicOnly())
+}
+
+// BatchProofWitness is the data of one batch needed by the aggregation,
+// as stored in the proof table.
+type BatchProofWitness struct {
+	Proof plonk.Proof
+	// VerifyingKeyIndex is the tier of the batch
+	VerifyingKeyIndex         int
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+	MinAccountIndex           uint32
+	MaxAccountIndex           uint32
+	UserCount                 uint32
+	SnapshotId                uint64
+	AccountIds                utils.AccountIdsCheck
+}
+
+// BatchAggregatedRanges returns the range of every batch, the SortedAccountIdsHash
+// of the batches are chained from the account tree root.
+func BatchAggregatedRanges(accountTreeRoot []byte, batches []BatchProofWitness) []utils.AggregatedRange {
+	ranges := make([]utils.AggregatedRange, len(batches))
+	accountIdsHash := accountTreeRoot
+	for i := 0; i < len(batches); i++ {
+		b := &batches[i]
+		ranges[i] = utils.AggregatedRange{
+			AccountTreeRoot:           accountTreeRoot,
+			SnapshotId:                b.SnapshotId,
+			BeforeCEXAssetsCommitment: b.BeforeCEXAssetsCommitment,
+			AfterCEXAssetsCommitment:  b.AfterCEXAssetsCommitment,
+			MinAccountIndex:           b.MinAccountIndex,
+			MaxAccountIndex:           b.MaxAccountIndex,
+			UserCount:                 uint64(b.UserCount),
+			AccountIdsChallenge:       b.AccountIds.Challenge,
+			BeforeLastAccountId:       b.AccountIds.BeforeLastAccountId,
+			AfterLastAccountId:        b.AccountIds.AfterLastAccountId,
+			BeforeAccountIdsProduct:   b.AccountIds.BeforeProduct,
+			AfterAccountIdsProduct:    b.AccountIds.AfterProduct,
+			BeforeAccountIdsHash:      accountIdsHash,
+		}
+		accountIdsHash = utils.ChainAccountIdsHash(accountIdsHash, b.AccountIds.SortedAccountIdsHash)
+		ranges[i].AfterAccountIdsHash = accountIdsHash
+	}
+	return ranges
+}
+
+// SetBatchProofsAggregationCircuitWitness returns the witness of the aggregation
+// circuit of level 0 for up to arity consecutive batches and the range of the
+// batches, ranges are the ranges of the batches returned by BatchAggregatedRanges.
+func SetBatchProofsAggregationCircuitWitness(batches []BatchProofWitness, ranges []utils.AggregatedRange, arity int) (*BatchProofsAggregationCircuit, *utils.AggregatedRange, error) {
+	if len(batches) == 0 || len(batches) > arity || len(ranges) != len(batches) {
+		return nil, nil, fmt.Errorf("invalid number of batches %d for aggregation arity %d", len(batches), arity)
+	}
+	r, err := utils.ChainAggregatedRanges(ranges)
+	if err != nil {
+		return nil, nil, err
+	}
+	witness := &BatchProofsAggregationCircuit{
+		RangeCommitment: r.Commitment(),
+		AccountTreeRoot: r.AccountTreeRoot,
+		SnapshotId:      r.SnapshotId,
+		Batches:         make([]AggregatedBatch, arity),
+	}
+	for i := 0; i < arity; i++ {
+		// the unused slots repeat the first batch
+		k, padding := i, 0
+		if i >= len(batches) {
+			k, padding = 0, 1
+		}
+		witness.Batches[i].Proof, err = stdplonk.ValueOfProof[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine](batches[k].Proof)
+		if err != nil {
+			return nil, nil, err
+		}
+		witness.Batches[i].VerifyingKeyIndex = batches[k].VerifyingKeyIndex
+		witness.Batches[i].BeforeCEXAssetsCommitment = batches[k].BeforeCEXAssetsCommitment
+		witness.Batches[i].AfterCEXAssetsCommitment = batches[k].AfterCEXAssetsCommitment
+		witness.Batches[i].MinAccountIndex = batches[k].MinAccountIndex
+		witness.Batches[i].MaxAccountIndex = batches[k].MaxAccountIndex
+		witness.Batches[i].UserCount = batches[k].UserCount
+		witness.Batches[i].AccountIds = setAccountIdsCheckWitness(&batches[k].AccountIds)
+		witness.Batches[i].BeforeAccountIdsHash = ranges[k].BeforeAccountIdsHash
+		witness.Batches[i].Padding = padding
+	}
+	return witness, &r, nil
+}
+
+// SetAggregationNodeCircuitWitness returns the witness of an aggregation
+// circuit above level 0 for up to arity consecutive aggregation proofs of the
+// level below and their ranges, and the range of all of them.
+func SetAggregationNodeCircuitWitness(proofs []plonk.Proof, ranges []utils.AggregatedRange, arity int) (*AggregationNodeCircuit, *utils.AggregatedRange, error) {
+	if len(proofs) == 0 || len(proofs) > arity || len(ranges) != len(proofs) {
+		return nil, nil, fmt.Errorf("invalid number of aggregation proofs %d for aggregation arity %d", len(proofs), arity)
+	}
+	r, err := utils.ChainAggregatedRanges(ranges)
+	if err != nil {
+		return nil, nil, err
+	}
+	witness := &AggregationNodeCircuit{
+		RangeCommitment: r.Commitment(),
+		Children:        make([]AggregatedChild, arity),
+	}
+	for i := 0; i < arity; i++ {
+		k, padding := i, 0
+		if i >= len(proofs) {
+			k, padding = 0, 1
+		}
+		witness.Children[i].Proof, err = stdplonk.ValueOfProof[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine](proofs[k])
+		if err != nil {
+			return nil, nil, err
+		}
+		witness.Children[i].Range = setAggregatedRangeWitness(&ranges[k])
+		witness.Children[i].Padding = padding
+	}
+	return witness, &r, nil
+}
+
+// Plonk batch proofs are generated and verified with the hash functions which
+// can be computed in circuit, otherwise they couldn't be aggregated. The
+// aggregation proofs use the same options to be verified by the level above.
+func plonkRecursionProverOptions() backend.ProverOption {
+	return stdplonk.GetNativeProverOptions(utils.CurveID().ScalarField(), utils.CurveID().ScalarField())
+}
+
+func plonkRecursionVerifierOptions() backend.VerifierOption {
+	return stdplonk.GetNativeVerifierOptions(utils.CurveID().ScalarField(), utils.CurveID().ScalarField())
+}
@@ -0,0 +1,376 @@
+package circuit
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/kzg"
+	"github.com/consensys/gnark/backend/plonk"
+	plonk_bn254 "github.com/consensys/gnark/backend/plonk/bn254"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/rangecheck"
+	"github.com/consensys/gnark/test"
+)
+
+// mockBatchCircuit has the same public input as BatchCreateUserCircuit and
+// uses the range checker so that its proofs carry a commitment as well.
+// Padding adds constraints so that the tiers have different sizes.
+type mockBatchCircuit struct {
+	BatchCommitment           Variable `gnark:",public"`
+	AccountTreeRoot           Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+	MinAccountIndex           Variable
+	MaxAccountIndex           Variable
+	UserCount                 Variable
+	SnapshotId                Variable
+	AccountIdsCommitment      Variable
+	Padding                   int `gnark:"-"`
+}
+
+func (c mockBatchCircuit) Define(api API) error {
+	r := rangecheck.New(api)
+	r.Check(c.MinAccountIndex, 32)
+	r.Check(c.MaxAccountIndex, 32)
+	commitment := hashVariables(api, c.AccountTreeRoot, c.BeforeCEXAssetsCommitment, c.AfterCEXAssetsCommitment,
+		c.MinAccountIndex, c.MaxAccountIndex, c.UserCount, c.SnapshotId, c.AccountIdsCommitment)
+	api.AssertIsEqual(c.BatchCommitment, commitment)
+	x := c.UserCount
+	for i := 0; i < c.Padding; i++ {
+		x = api.Mul(x, c.UserCount)
+	}
+	api.AssertIsDifferent(x, -1)
+	return nil
+}
+
+// mockAggregationCircuit has the same public input as the aggregation circuits.
+type mockAggregationCircuit struct {
+	RangeCommitment Variable `gnark:",public"`
+	Range           AggregatedRange
+}
+
+func (c mockAggregationCircuit) Define(api API) error {
+	api.AssertIsEqual(c.RangeCommitment, c.Range.commitment(api))
+	return nil
+}
+
+func mockBatchCommitment(root, before, after []byte, minIndex, maxIndex, userCount uint32, snapshotId uint64, accountIdsCommitment []byte) []byte {
+	return utils.ComputeBatchCommitment(root, before, after, minIndex, maxIndex, userCount, snapshotId, accountIdsCommitment)
+}
+
+// testKzgSrs returns a kzg srs shared by all the plonk keys of the tests.
+func testKzgSrs(t *testing.T) *kzg_bn254.SRS {
+	srs, err := kzg_bn254.NewSRS(1<<15+3, big.NewInt(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srs
+}
+
+func testPlonkSetup(t *testing.T, srs *kzg_bn254.SRS, c frontend.Circuit) (constraint.ConstraintSystem, ProvingKey, plonk.VerifyingKey) {
+	ccs, err := Compile(PlonkBackend, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical, lagrange, err := truncateKzgSrs(srs, ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := Setup(PlonkBackend, ccs, canonical, lagrange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ccs, pk, vk.(plonk.VerifyingKey)
+}
+
+func testPlonkProve(t *testing.T, ccs constraint.ConstraintSystem, pk ProvingKey, assignment frontend.Circuit) plonk.Proof {
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := Prove(PlonkBackend, ccs, pk, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof.(plonk.Proof)
+}
+
+// testAggregatedBatches returns the batch proofs of 3 consecutive batches of
+// two tiers, and the batches of the tiers.
+func testAggregatedBatches(t *testing.T) ([]byte, []BatchProofWitness, []plonk.VerifyingKey) {
+	srs := testKzgSrs(t)
+	var ccs [2]constraint.ConstraintSystem
+	var pks [2]ProvingKey
+	vks := make([]plonk.VerifyingKey, 2)
+	for i := 0; i < 2; i++ {
+		ccs[i], pks[i], vks[i] = testPlonkSetup(t, srs, &mockBatchCircuit{Padding: 2000 * i})
+	}
+
+	root := []byte{1}
+	commitments := [][]byte{{2}, {3}, {4}, {5}}
+	ranges := [][2]uint32{{0, 9}, {10, 19}, {20, 24}}
+	userCounts := []uint32{10, 7, 5}
+	tiers := []int{0, 1, 0}
+	batchAccountIds := make([][][]byte, len(ranges))
+	for i := 0; i < len(ranges); i++ {
+		for j := ranges[i][0]; j <= ranges[i][1]; j++ {
+			batchAccountIds[i] = append(batchAccountIds[i], testAccountId(int64(100-j)))
+		}
+	}
+	accountIdsChecks, _, err := utils.NewAccountIdsChecks(root, batchAccountIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := make([]BatchProofWitness, len(ranges))
+	for i := 0; i < len(ranges); i++ {
+		assignment := &mockBatchCircuit{
+			BatchCommitment: mockBatchCommitment(root, commitments[i], commitments[i+1], ranges[i][0], ranges[i][1],
+				userCounts[i], testSnapshotId, accountIdsChecks[i].Commitment()),
+			AccountTreeRoot:           root,
+			BeforeCEXAssetsCommitment: commitments[i],
+			AfterCEXAssetsCommitment:  commitments[i+1],
+			MinAccountIndex:           ranges[i][0],
+			MaxAccountIndex:           ranges[i][1],
+			UserCount:                 userCounts[i],
+			SnapshotId:                testSnapshotId,
+			AccountIdsCommitment:      accountIdsChecks[i].Commitment(),
+		}
+		batches[i] = BatchProofWitness{
+			Proof:                     testPlonkProve(t, ccs[tiers[i]], pks[tiers[i]], assignment),
+			VerifyingKeyIndex:         tiers[i],
+			BeforeCEXAssetsCommitment: commitments[i],
+			AfterCEXAssetsCommitment:  commitments[i+1],
+			MinAccountIndex:           ranges[i][0],
+			MaxAccountIndex:           ranges[i][1],
+			UserCount:                 userCounts[i],
+			SnapshotId:                testSnapshotId,
+			AccountIds:                accountIdsChecks[i],
+		}
+	}
+	return root, batches, vks
+}
+
+func TestBatchProofsAggregationCircuit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the plonk recursion in short mode")
+	}
+	root, batches, vks := testAggregatedBatches(t)
+	const arity = 4
+	aggregationCircuit, err := NewBatchProofsAggregationCircuit(vks, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := BatchAggregatedRanges(root, batches)
+	assignment, r, err := SetBatchProofsAggregationCircuitWitness(batches, ranges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test.IsSolved(aggregationCircuit, assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.UserCount != 22 || r.MinAccountIndex != 0 || r.MaxAccountIndex != 24 {
+		t.Fatalf("unexpected range %+v", r)
+	}
+	// the range of all the batches is the range the verifier expects
+	aggregatedProof := utils.AggregatedProof{
+		AccountTreeRoot:          root,
+		EmptyCEXAssetsCommitment: []byte{2},
+		FinalCEXAssetsCommitment: []byte{5},
+		AccountCount:             25,
+		UserCount:                22,
+		SnapshotId:               testSnapshotId,
+		AccountIdsChallenge:      batches[0].AccountIds.Challenge,
+		LastAccountId:            batches[2].AccountIds.AfterLastAccountId,
+	}
+	expected, err := aggregatedProof.Range()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected.Commitment()) != string(r.Commitment()) {
+		t.Fatal("the range of the batches doesn't match the range of the aggregated proof")
+	}
+
+	// a batch proof is only accepted with the verifying key of its tier
+	assignment, _, err = SetBatchProofsAggregationCircuitWitness(batches, ranges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.Batches[1].VerifyingKeyIndex = 0
+	if err = test.IsSolved(aggregationCircuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("expected aggregation failure with the verifying key of another tier")
+	}
+
+	// the user count of a batch is bound to its proof
+	assignment, _, err = SetBatchProofsAggregationCircuitWitness(batches, ranges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.Batches[1].UserCount = 8
+	assignment.RangeCommitment = withUserCount(r, 23).Commitment()
+	if err = test.IsSolved(aggregationCircuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("expected aggregation failure with wrong user count")
+	}
+
+	// the padding slots only follow the used slots
+	assignment, _, err = SetBatchProofsAggregationCircuitWitness(batches, ranges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.Batches[1].Padding = 1
+	if err = test.IsSolved(aggregationCircuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("expected aggregation failure with a padding slot before a used slot")
+	}
+
+	// the batches must belong to the same snapshot
+	batches[1].SnapshotId = testSnapshotId + 1
+	if _, _, err = SetBatchProofsAggregationCircuitWitness(batches, BatchAggregatedRanges(root, batches), arity); err == nil {
+		t.Fatal("expected failure with the batches of different snapshots")
+	}
+	batches[1].SnapshotId = testSnapshotId
+
+	// the account indexes of the batches must be contiguous
+	batches[1].MinAccountIndex = 11
+	if _, _, err = SetBatchProofsAggregationCircuitWitness(batches, BatchAggregatedRanges(root, batches), arity); err == nil {
+		t.Fatal("expected failure with non contiguous account indexes")
+	}
+	batches[1].MinAccountIndex = 10
+
+	// too many batches for the arity
+	if _, _, err = SetBatchProofsAggregationCircuitWitness(batches, ranges, 2); err == nil {
+		t.Fatal("expected failure with more batches than the arity")
+	}
+}
+
+func withUserCount(r *utils.AggregatedRange, userCount uint64) *utils.AggregatedRange {
+	res := *r
+	res.UserCount = userCount
+	return &res
+}
+
+func TestNewBatchProofsAggregationCircuitRejectsOtherSrs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the plonk recursion in short mode")
+	}
+	srs := testKzgSrs(t)
+	_, _, vk0 := testPlonkSetup(t, srs, &mockBatchCircuit{})
+	other, err := kzg_bn254.NewSRS(1<<15+3, big.NewInt(43))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, vk1 := testPlonkSetup(t, other, &mockBatchCircuit{Padding: 2000})
+	if _, err = NewBatchProofsAggregationCircuit([]plonk.VerifyingKey{vk0, vk1}, 2); err == nil {
+		t.Fatal("expected failure with the tiers of different kzg srs")
+	}
+}
+
+func TestUnsafeKzgSrsSharedByTiers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the plonk recursion in short mode")
+	}
+	unsafeKzgSrs, err := NewUnsafeKzgSrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the srs grows for the bigger tier with the same tau
+	vks := make([]plonk.VerifyingKey, 2)
+	for i := 0; i < 2; i++ {
+		ccs, err := Compile(PlonkBackend, &mockBatchCircuit{Padding: 20000 * i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		canonical, lagrange, err := unsafeKzgSrs.Truncate(ccs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, vk, err := Setup(PlonkBackend, ccs, canonical, lagrange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vks[i] = vk.(plonk.VerifyingKey)
+	}
+	if vks[0].(*plonk_bn254.VerifyingKey).Size == vks[1].(*plonk_bn254.VerifyingKey).Size {
+		t.Fatal("the tiers should have different sizes")
+	}
+	if _, err = NewBatchProofsAggregationCircuit(vks, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregationLevel(t *testing.T) {
+	for _, c := range []struct {
+		batchCount, arity, level int
+	}{
+		{1, 4, 0}, {4, 4, 0}, {5, 4, 1}, {16, 4, 1}, {17, 4, 2}, {1, 1, 0}, {3, 2, 1}, {8, 2, 2}, {9, 2, 3},
+	} {
+		if level := AggregationLevel(c.batchCount, c.arity); level != c.level {
+			t.Errorf("got level %d of %d batches of arity %d, want %d", level, c.batchCount, c.arity, c.level)
+		}
+	}
+}
+
+func TestAggregationNodeCircuit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the plonk recursion in short mode")
+	}
+	root, batches, _ := testAggregatedBatches(t)
+	batchRanges := BatchAggregatedRanges(root, batches)
+	// the children cover the batches 0-1 and the batch 2
+	var childRanges []utils.AggregatedRange
+	for _, rs := range [][]utils.AggregatedRange{batchRanges[:2], batchRanges[2:]} {
+		r, err := utils.ChainAggregatedRanges(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		childRanges = append(childRanges, r)
+	}
+
+	ccs, pk, vk := testPlonkSetup(t, testKzgSrs(t), &mockAggregationCircuit{})
+	proofs := make([]plonk.Proof, len(childRanges))
+	for i := range childRanges {
+		proofs[i] = testPlonkProve(t, ccs, pk, &mockAggregationCircuit{
+			RangeCommitment: childRanges[i].Commitment(),
+			Range:           setAggregatedRangeWitness(&childRanges[i]),
+		})
+	}
+
+	const arity = 3
+	nodeCircuit, err := NewAggregationNodeCircuit(vk, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, r, err := SetAggregationNodeCircuitWitness(proofs, childRanges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = test.IsSolved(nodeCircuit, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatal(err)
+	}
+	all, err := utils.ChainAggregatedRanges(batchRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all.Commitment()) != string(r.Commitment()) {
+		t.Fatal("the range of the children doesn't match the range of the batches")
+	}
+
+	// the range of a child is bound to its proof
+	assignment, _, err = SetAggregationNodeCircuitWitness(proofs, childRanges, arity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.Children[1].Range.UserCount = 6
+	assignment.RangeCommitment = withUserCount(r, 23).Commitment()
+	if err = test.IsSolved(nodeCircuit, assignment, ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("expected aggregation failure with wrong child range")
+	}
+
+	// the children must be consecutive
+	if _, _, err = SetAggregationNodeCircuitWitness([]plonk.Proof{proofs[1], proofs[0]},
+		[]utils.AggregatedRange{childRanges[1], childRanges[0]}, arity); err == nil {
+		t.Fatal("expected failure with the children out of order")
+	}
+}
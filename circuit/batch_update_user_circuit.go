@@ -0,0 +1,173 @@
+package circuit
+
+import (
+	"fmt"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/std/rangecheck"
+)
+
+// BatchUpdateUserCircuit proves the transition of the account tree and the cex
+// assets from a previous audit to a new one. Every op replaces the leaf of one
+// account of the previous account tree by a leaf of the same account id, so
+// only the changed accounts of the new snapshot need to be proved, and the
+// account ids stay distinct as the previous audit proved them.
+// The prices and tier ratios of the cex assets can't change, because they are
+// part of the cex assets commitment and the unchanged leaves are computed with them.
+type BatchUpdateUserCircuit struct {
+	BatchCommitment           Variable `gnark:",public"`
+	BeforeAccountTreeRoot     Variable
+	AfterAccountTreeRoot      Variable
+	BeforeCEXAssetsCommitment Variable
+	AfterCEXAssetsCommitment  Variable
+	// SnapshotId is the audit of the batch, see utils.ParseSnapshotId
+	SnapshotId Variable
+	// OldUserCount and NewUserCount are the number of the ops whose old and
+	// new leaves are not padding accounts
+	OldUserCount      Variable
+	NewUserCount      Variable
+	CexAssetsBlinding Variable
+	BeforeCexAssets   []CexAssetInfo
+	UpdateUserOps     []UpdateUserOperation
+}
+
+func NewVerifyBatchUpdateUserCircuit(commitment []byte) *BatchUpdateUserCircuit {
+	var v BatchUpdateUserCircuit
+	v.BatchCommitment = commitment
+	return &v
+}
+
+func NewBatchUpdateUserCircuit(userAssetCounts uint32, allAssetCounts uint32, batchCounts uint32) *BatchUpdateUserCircuit {
+	var circuit BatchUpdateUserCircuit
+	circuit.BatchCommitment = 0
+	circuit.BeforeAccountTreeRoot = 0
+	circuit.AfterAccountTreeRoot = 0
+	circuit.BeforeCEXAssetsCommitment = 0
+	circuit.AfterCEXAssetsCommitment = 0
+	circuit.SnapshotId = 0
+	circuit.OldUserCount = 0
+	circuit.NewUserCount = 0
+	circuit.CexAssetsBlinding = 0
+	circuit.BeforeCexAssets = NewBatchCreateUserCircuit(userAssetCounts, allAssetCounts, 0).BeforeCexAssets
+	circuit.UpdateUserOps = make([]UpdateUserOperation, batchCounts)
+	for i := uint32(0); i < batchCounts; i++ {
+		circuit.UpdateUserOps[i] = UpdateUserOperation{
+			AccountIndex:  0,
+			AccountIdHash: 0,
+			AccountProof:  newAccountProofVariables(),
+		}
+		circuit.UpdateUserOps[i].OldAssets, circuit.UpdateUserOps[i].OldAssetsForUpdateCex = newUserAssetsVariables(userAssetCounts, allAssetCounts)
+		circuit.UpdateUserOps[i].NewAssets, circuit.UpdateUserOps[i].NewAssetsForUpdateCex = newUserAssetsVariables(userAssetCounts, allAssetCounts)
+	}
+	return &circuit
+}
+
+func (b BatchUpdateUserCircuit) Define(api API) error {
+	// verify whether BatchCommitment is computed correctly
+	actualBatchCommitment := hashVariables(api, b.BeforeAccountTreeRoot, b.AfterAccountTreeRoot, b.BeforeCEXAssetsCommitment, b.AfterCEXAssetsCommitment,
+		b.SnapshotId, b.OldUserCount, b.NewUserCount)
+	api.AssertIsEqual(b.BatchCommitment, actualBatchCommitment)
+
+	r := rangecheck.New(api)
+	// verify whether beforeCexAssetsCommitment is computed correctly
+	actualCexAssetsCommitment, afterCexAssets, tables := checkBeforeCexAssets(api, r, b.BeforeCexAssets, b.CexAssetsBlinding)
+	api.AssertIsEqual(b.BeforeCEXAssetsCommitment, actualCexAssetsCommitment)
+	tables.constructTierRatiosTables(api, b.BeforeCexAssets)
+
+	userAssetIdHashes := make([]Variable, 2*len(b.UpdateUserOps)+1)
+	oldUserAssetsResults := make([]userAssetsCheckResult, len(b.UpdateUserOps))
+	newUserAssetsResults := make([]userAssetsCheckResult, len(b.UpdateUserOps))
+	var oldUserCount Variable = 0
+	var newUserCount Variable = 0
+
+	accountTreeRoot := b.BeforeAccountTreeRoot
+	for i := 0; i < len(b.UpdateUserOps); i++ {
+		op := b.UpdateUserOps[i]
+		accountIndexHelper := accountIdToMerkleHelper(api, op.AccountIndex)
+
+		// the old assets are removed from the cex assets and the new assets are added
+		oldUserAssetsResults[i] = checkUserAssets(api, r, tables, op.AccountIdHash,
+			op.OldAssets, op.OldAssetsForUpdateCex, afterCexAssets, true)
+		newUserAssetsResults[i] = checkUserAssets(api, r, tables, op.AccountIdHash,
+			op.NewAssets, op.NewAssetsForUpdateCex, afterCexAssets, false)
+		userAssetIdHashes[2*i] = oldUserAssetsResults[i].assetIdHash
+		userAssetIdHashes[2*i+1] = newUserAssetsResults[i].assetIdHash
+
+		// the padding accounts have no asset, so they are not counted
+		oldUserCount = api.Add(oldUserCount, api.Sub(1, api.IsZero(oldUserAssetsResults[i].assetsSum)))
+		newUserCount = api.Add(newUserCount, api.Sub(1, api.IsZero(newUserAssetsResults[i].assetsSum)))
+
+		// verify the old leaf against the current root, then replace it by the new leaf.
+		// Both leaves have the account id of the op and the old leaf isn't empty,
+		// so an op can't add an account id to the account tree.
+		verifyMerkleProof(api, accountTreeRoot, oldUserAssetsResults[i].accountHash, op.AccountProof, accountIndexHelper)
+		accountTreeRoot = computeMerkleRoot(api, newUserAssetsResults[i].accountHash, op.AccountProof, accountIndexHelper)
+	}
+	api.AssertIsEqual(b.AfterAccountTreeRoot, accountTreeRoot)
+	api.AssertIsEqual(b.OldUserCount, oldUserCount)
+	api.AssertIsEqual(b.NewUserCount, newUserCount)
+
+	// make sure the old and new user assets contain all non-zero assets of their AssetsForUpdateCex,
+	// the random challenge is the hash of the batch commitment and all the user assets index
+	userAssetIdHashes[2*len(b.UpdateUserOps)] = b.BatchCommitment
+	powersOfRandomChallenge, powersOfRandomChallengeLookupTable := constructPowersOfRandomChallenge(api,
+		hashVariables(api, userAssetIdHashes...), tables.numOfAssetMetaFields()*len(b.BeforeCexAssets))
+
+	for i := 0; i < len(b.UpdateUserOps); i++ {
+		assertUserAssetsForUpdateCex(api, powersOfRandomChallenge, powersOfRandomChallengeLookupTable,
+			oldUserAssetsResults[i], b.UpdateUserOps[i].OldAssetsForUpdateCex)
+		assertUserAssetsForUpdateCex(api, powersOfRandomChallenge, powersOfRandomChallengeLookupTable,
+			newUserAssetsResults[i], b.UpdateUserOps[i].NewAssetsForUpdateCex)
+	}
+
+	// verify AfterCEXAssetsCommitment is computed correctly
+	actualAfterCEXAssetsCommitment := computeAfterCexAssetsCommitment(api, r, afterCexAssets, b.CexAssetsBlinding)
+	api.AssertIsEqual(actualAfterCEXAssetsCommitment, b.AfterCEXAssetsCommitment)
+	return nil
+}
+
+func SetBatchUpdateUserCircuitWitness(batchWitness *utils.BatchUpdateUserWitness) (witness *BatchUpdateUserCircuit, err error) {
+	if len(batchWitness.UpdateUserOps) == 0 {
+		return nil, fmt.Errorf("the batch has no update user ops")
+	}
+	beforeCexAssets, err := setCexAssetsWitness(batchWitness.BeforeCexAssets)
+	if err != nil {
+		return nil, err
+	}
+	witness = &BatchUpdateUserCircuit{
+		BatchCommitment:           batchWitness.BatchCommitment,
+		BeforeAccountTreeRoot:     batchWitness.BeforeAccountTreeRoot,
+		AfterAccountTreeRoot:      batchWitness.AfterAccountTreeRoot,
+		BeforeCEXAssetsCommitment: batchWitness.BeforeCEXAssetsCommitment,
+		AfterCEXAssetsCommitment:  batchWitness.AfterCEXAssetsCommitment,
+		SnapshotId:                batchWitness.SnapshotId,
+		OldUserCount:              batchWitness.OldUserCount,
+		NewUserCount:              batchWitness.NewUserCount,
+		CexAssetsBlinding:         cexAssetsBlindingWitness(batchWitness.CexAssetsBlinding),
+		BeforeCexAssets:           beforeCexAssets,
+		UpdateUserOps:             make([]UpdateUserOperation, len(batchWitness.UpdateUserOps)),
+	}
+
+	for i := 0; i < len(witness.UpdateUserOps); i++ {
+		op := &batchWitness.UpdateUserOps[i]
+		if len(op.AccountProof) != utils.AccountTreeDepth {
+			return nil, fmt.Errorf("the account proof length of account %d doesn't match the AccountTreeDepth %d", op.AccountIndex, utils.AccountTreeDepth)
+		}
+		w := &witness.UpdateUserOps[i]
+		w.OldAssets, w.OldAssetsForUpdateCex, err = setUserAssetsWitness(op.AccountIndex, op.OldAssets, batchWitness.AssetCounts, batchWitness.BeforeCexAssets)
+		if err != nil {
+			return nil, err
+		}
+		w.NewAssets, w.NewAssetsForUpdateCex, err = setUserAssetsWitness(op.AccountIndex, op.NewAssets, batchWitness.AssetCounts, batchWitness.BeforeCexAssets)
+		if err != nil {
+			return nil, err
+		}
+		w.AccountIndex = op.AccountIndex
+		w.AccountIdHash = op.AccountIdHash
+		w.AccountProof = make([]Variable, utils.AccountTreeDepth)
+		for j := 0; j < len(w.AccountProof); j++ {
+			w.AccountProof[j] = op.AccountProof[j]
+		}
+	}
+	return witness, nil
+}
@@ -0,0 +1,165 @@
+package circuit
+
+import (
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/constraint/solver"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+func updateCexAssets(cexAssets []utils.CexAssetInfo, assets []utils.AccountAsset, subtract bool) {
+	update := utils.SafeAdd
+	if subtract {
+		update = utils.SafeSub
+	}
+	for _, asset := range assets {
+		cexAssets[asset.Index].TotalEquity = update(cexAssets[asset.Index].TotalEquity, asset.Equity)
+		cexAssets[asset.Index].TotalDebt = update(cexAssets[asset.Index].TotalDebt, asset.Debt)
+		for c := 0; c < len(asset.Collaterals); c++ {
+			cexAssets[asset.Index].Collaterals[c] = update(cexAssets[asset.Index].Collaterals[c], asset.Collaterals[c])
+		}
+	}
+}
+
+// constructValidUpdateBatch updates a tree of two accounts: the first account
+// changes its assets and the second one leaves.
+func constructValidUpdateBatch(assetsCount int, totalAssetsCount int) *utils.BatchUpdateUserWitness {
+	cexAssets := constructCexAssets(totalAssetsCount)
+	prevAccounts := []utils.AccountInfo{
+		constructRandomAccount(cexAssets, 0, assetsCount),
+		constructRandomAccount(cexAssets, 1, assetsCount),
+	}
+	accountTree, err := utils.NewAccountTree(3)
+	if err != nil {
+		panic(err.Error())
+	}
+	poseidonHasher := poseidon.NewPoseidon()
+	for i := 0; i < len(prevAccounts); i++ {
+		accountTree.Set(prevAccounts[i].AccountIndex, utils.AccountInfoToHash(&prevAccounts[i], &poseidonHasher))
+	}
+	accountTree.Build()
+
+	changedAccount := constructRandomAccount(utils.CloneCexAssetsInfo(cexAssets), 0, assetsCount)
+	changedAccount.AccountId = prevAccounts[0].AccountId
+	emptiedAccount := utils.NewPaddingAccount(assetsCount)
+	emptiedAccount.AccountIndex = 1
+	emptiedAccount.AccountId = prevAccounts[1].AccountId
+	updates := []struct {
+		old *utils.AccountInfo
+		new *utils.AccountInfo
+	}{
+		{&prevAccounts[0], &changedAccount},
+		{&prevAccounts[1], &emptiedAccount},
+	}
+
+	batchUpdateUserWit := &utils.BatchUpdateUserWitness{
+		BeforeAccountTreeRoot:     accountTree.Root(),
+		BeforeCEXAssetsCommitment: utils.ComputeCexAssetsCommitment(cexAssets),
+		AssetCounts:               assetsCount,
+		BeforeCexAssets:           utils.CloneCexAssetsInfo(cexAssets),
+		UpdateUserOps:             make([]utils.UpdateUserOperation, len(updates)),
+		SnapshotId:                testSnapshotId,
+	}
+	for i, update := range updates {
+		accountProof, err := accountTree.GetProof(update.new.AccountIndex)
+		if err != nil {
+			panic(err.Error())
+		}
+		batchUpdateUserWit.UpdateUserOps[i] = utils.UpdateUserOperation{
+			OldAssets:     update.old.Assets,
+			NewAssets:     update.new.Assets,
+			AccountIndex:  update.new.AccountIndex,
+			AccountIdHash: update.new.AccountId,
+			AccountProof:  accountProof,
+		}
+		updateCexAssets(cexAssets, update.old.Assets, true)
+		updateCexAssets(cexAssets, update.new.Assets, false)
+		accountTree.Set(update.new.AccountIndex, utils.AccountInfoToHash(update.new, &poseidonHasher))
+		accountTree.Build()
+	}
+	batchUpdateUserWit.AfterAccountTreeRoot = accountTree.Root()
+	batchUpdateUserWit.AfterCEXAssetsCommitment = utils.ComputeCexAssetsCommitment(cexAssets)
+	setBatchUpdateCommitment(batchUpdateUserWit)
+	return batchUpdateUserWit
+}
+
+func setBatchUpdateCommitment(batchUpdateUserWit *utils.BatchUpdateUserWitness) {
+	batchUpdateUserWit.BatchCommitment = utils.ComputeBatchUpdateCommitment(
+		batchUpdateUserWit.BeforeAccountTreeRoot,
+		batchUpdateUserWit.AfterAccountTreeRoot,
+		batchUpdateUserWit.BeforeCEXAssetsCommitment,
+		batchUpdateUserWit.AfterCEXAssetsCommitment,
+		batchUpdateUserWit.SnapshotId,
+		batchUpdateUserWit.OldUserCount,
+		batchUpdateUserWit.NewUserCount)
+}
+
+func isUpdateBatchSolved(ccs constraint.ConstraintSystem, batchUpdateUserWit *utils.BatchUpdateUserWitness) error {
+	circuitWitness, err := SetBatchUpdateUserCircuitWitness(batchUpdateUserWit)
+	if err != nil {
+		return err
+	}
+	witness, err := frontend.NewWitness(circuitWitness, ecc.BN254.ScalarField())
+	if err != nil {
+		return err
+	}
+	return ccs.IsSolved(witness)
+}
+
+func TestBatchUpdateUserCircuit(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+	err := utils.SetCircuitParams(utils.CircuitParams{
+		Version:          utils.CircuitParamsVersion,
+		AccountTreeDepth: 8,
+		AssetCounts:      16,
+		TierCount:        4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver.RegisterHint(IntegerDivision)
+
+	batchUpdateUserWit := constructValidUpdateBatch(4, utils.AssetCounts)
+	batchUpdateUserWit.OldUserCount, batchUpdateUserWit.NewUserCount = utils.CountUpdatedUsers(batchUpdateUserWit.UpdateUserOps)
+	if batchUpdateUserWit.OldUserCount != 2 || batchUpdateUserWit.NewUserCount != 1 {
+		t.Fatalf("got %d old users and %d new users, want 2 and 1", batchUpdateUserWit.OldUserCount, batchUpdateUserWit.NewUserCount)
+	}
+	setBatchUpdateCommitment(batchUpdateUserWit)
+	oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder,
+		NewBatchUpdateUserCircuit(4, uint32(utils.AssetCounts), uint32(len(batchUpdateUserWit.UpdateUserOps))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = isUpdateBatchSolved(oR1cs, batchUpdateUserWit); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user count of the emptied account must be removed
+	wrongCount := *batchUpdateUserWit
+	wrongCount.OldUserCount = 1
+	setBatchUpdateCommitment(&wrongCount)
+	if err = isUpdateBatchSolved(oR1cs, &wrongCount); err == nil {
+		t.Fatal("expected the wrong old user count to fail")
+	}
+
+	// an op can't fill the empty leaf of a new account, the old leaf must be an
+	// account of the previous tree with the same account id
+	newAccount := *batchUpdateUserWit
+	newAccount.UpdateUserOps = append([]utils.UpdateUserOperation(nil), batchUpdateUserWit.UpdateUserOps...)
+	newAccount.UpdateUserOps[1].AccountIndex = 2
+	newAccount.UpdateUserOps[1].OldAssets = nil
+	if err = isUpdateBatchSolved(oR1cs, &newAccount); err == nil {
+		t.Fatal("expected the op on an empty leaf to fail")
+	}
+}
@@ -0,0 +1,178 @@
+package circuit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+)
+
+// AssertionError is the first failed assertion of a batch found by
+// DiagnoseBatchCreateUserWitness.
+type AssertionError struct {
+	// Op is the index of the failed op in CreateUserOps, -1 if the assertion
+	// is not about one op
+	Op           int
+	AccountIndex uint32
+	// AssetIndex is the cex asset index of the failed assertion, -1 if the
+	// assertion is not about one asset
+	AssetIndex int
+	// Check names the failed constraint, such as "collateral <= equity"
+	Check string
+	// Message is the failure reported by the gnark test engine
+	Message string
+}
+
+func (e *AssertionError) Error() string {
+	var sb strings.Builder
+	if e.Op >= 0 {
+		fmt.Fprintf(&sb, "CreateUserOps[%d] (account index %d", e.Op, e.AccountIndex)
+		if e.AssetIndex >= 0 {
+			fmt.Fprintf(&sb, ", asset index %d", e.AssetIndex)
+		}
+		sb.WriteString("): ")
+	} else if e.AssetIndex >= 0 {
+		fmt.Fprintf(&sb, "cex asset index %d: ", e.AssetIndex)
+	}
+	if e.Check != "" {
+		fmt.Fprintf(&sb, "%s failed: ", e.Check)
+	}
+	sb.WriteString(e.Message)
+	return sb.String()
+}
+
+// assertionLabel locates the assertions the circuit is checking. asset is the
+// position in the Assets of the op if op >= 0, or the cex asset index otherwise.
+type assertionLabel struct {
+	op    int
+	asset int
+	check string
+}
+
+// labelledAPI runs the circuit in the gnark test engine and records the label
+// of the first failed assertion. It is a frontend.Rangechecker, so the range
+// checks fail at the checked variable instead of the end of the circuit.
+type labelledAPI struct {
+	frontend.API
+	label   assertionLabel
+	failure *assertionLabel
+	message string
+}
+
+// labelOp sets the op the following assertions belong to, -1 for none.
+// It is a no-op unless the circuit is diagnosed.
+func labelOp(api API, op int) {
+	if l, ok := api.(*labelledAPI); ok {
+		l.label = assertionLabel{op: op, asset: -1}
+	}
+}
+
+// labelCheck names the following assertions and the asset they belong to,
+// -1 for none. It is a no-op unless the circuit is diagnosed.
+func labelCheck(api API, asset int, check string) {
+	if l, ok := api.(*labelledAPI); ok {
+		l.label.asset = asset
+		l.label.check = check
+	}
+}
+
+// recordFailure must be deferred by the assertions to record their failure.
+func (l *labelledAPI) recordFailure() {
+	if r := recover(); r != nil {
+		if l.failure == nil {
+			label := l.label
+			l.failure = &label
+			l.message = fmt.Sprint(r)
+		}
+		panic(r)
+	}
+}
+
+func (l *labelledAPI) AssertIsEqual(i1, i2 Variable) {
+	defer l.recordFailure()
+	l.API.AssertIsEqual(i1, i2)
+}
+
+func (l *labelledAPI) AssertIsDifferent(i1, i2 Variable) {
+	defer l.recordFailure()
+	l.API.AssertIsDifferent(i1, i2)
+}
+
+func (l *labelledAPI) AssertIsBoolean(i1 Variable) {
+	defer l.recordFailure()
+	l.API.AssertIsBoolean(i1)
+}
+
+func (l *labelledAPI) AssertIsLessOrEqual(v Variable, bound Variable) {
+	defer l.recordFailure()
+	l.API.AssertIsLessOrEqual(v, bound)
+}
+
+func (l *labelledAPI) AssertIsLessOrEqualNOp(v, bound Variable, maxBits int, omitRangeCheck ...bool) {
+	defer l.recordFailure()
+	l.API.AssertIsLessOrEqualNOp(v, bound, maxBits, omitRangeCheck...)
+}
+
+func (l *labelledAPI) ToBinary(i1 Variable, n ...int) []Variable {
+	defer l.recordFailure()
+	return l.API.ToBinary(i1, n...)
+}
+
+// Check implements frontend.Rangechecker.
+func (l *labelledAPI) Check(v Variable, bits int) {
+	l.ToBinary(v, bits)
+}
+
+// diagnosedBatchCreateUserCircuit runs BatchCreateUserCircuit with labelledAPI.
+type diagnosedBatchCreateUserCircuit struct {
+	Batch BatchCreateUserCircuit
+	api   *labelledAPI
+}
+
+func (c *diagnosedBatchCreateUserCircuit) Define(api API) error {
+	c.api.API = api
+	return c.Batch.Define(c.api)
+}
+
+// DiagnoseBatchCreateUserWitness runs the batch witness in the gnark test engine,
+// it returns an *AssertionError naming the op, account index, asset index and
+// constraint of the first failed assertion, or nil if the witness is valid.
+// It is much slower than the prover, so it is only for the batches which
+// failed to prove.
+func DiagnoseBatchCreateUserWitness(batchWitness *utils.BatchCreateUserWitness) error {
+	assignment, err := SetBatchCreateUserCircuitWitness(batchWitness)
+	if err != nil {
+		return err
+	}
+	userAssetCounts := len(assignment.CreateUserOps[0].Assets)
+	c := &diagnosedBatchCreateUserCircuit{
+		Batch: *NewBatchCreateUserCircuit(uint32(userAssetCounts), uint32(len(assignment.BeforeCexAssets)), uint32(len(assignment.CreateUserOps))),
+		api:   &labelledAPI{},
+	}
+	err = test.IsSolved(c, &diagnosedBatchCreateUserCircuit{Batch: *assignment}, utils.CurveID().ScalarField())
+	if err == nil {
+		return nil
+	}
+	failure := c.api.failure
+	if failure == nil {
+		// the failures of the deferred checks, such as the lookup tables,
+		// can't be located
+		return err
+	}
+	res := &AssertionError{
+		Op:         failure.op,
+		AssetIndex: failure.asset,
+		Check:      failure.check,
+		Message:    c.api.message,
+	}
+	if failure.op >= 0 {
+		op := &batchWitness.CreateUserOps[failure.op]
+		res.AccountIndex = op.AccountIndex
+		if failure.asset >= 0 {
+			res.AssetIndex = int(assignment.CreateUserOps[failure.op].Assets[failure.asset].AssetIndex.(uint32))
+		}
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+// nonEmptyAsset returns the k-th non empty asset of the op, the assets of the
+// ops contain all the cex assets.
+func nonEmptyAsset(w *utils.BatchCreateUserWitness, op int, k int) *utils.AccountAsset {
+	assets := w.CreateUserOps[op].Assets
+	for j := range assets {
+		if utils.IsAssetEmpty(&assets[j]) {
+			continue
+		}
+		if k == 0 {
+			return &assets[j]
+		}
+		k--
+	}
+	panic("not enough assets")
+}
+
+func TestDiagnoseBatchCreateUserWitness(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+	err := utils.SetCircuitParams(utils.CircuitParams{
+		Version:          utils.CircuitParamsVersion,
+		AccountTreeDepth: 8,
+		AssetCounts:      16,
+		TierCount:        4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = DiagnoseBatchCreateUserWitness(constructValidBatchWitness(4, 16, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		corrupt    func(w *utils.BatchCreateUserWitness) int
+		assetIndex func(w *utils.BatchCreateUserWitness) int
+		check      string
+	}{
+		{
+			name: "debt exceeds the collateral value",
+			corrupt: func(w *utils.BatchCreateUserWitness) int {
+				nonEmptyAsset(w, 1, 2).Debt = utils.NewUint128(1 << 40)
+				return 1
+			},
+			assetIndex: func(w *utils.BatchCreateUserWitness) int { return -1 },
+			check:      "debt <= collateral value",
+		},
+		{
+			name: "collateral exceeds the equity",
+			corrupt: func(w *utils.BatchCreateUserWitness) int {
+				nonEmptyAsset(w, 0, 1).Equity = utils.Uint128{}
+				return 0
+			},
+			assetIndex: func(w *utils.BatchCreateUserWitness) int { return int(nonEmptyAsset(w, 0, 1).Index) },
+			check:      "collateral <= equity",
+		},
+		{
+			name: "asset indexes are not increasing",
+			corrupt: func(w *utils.BatchCreateUserWitness) int {
+				a, b := nonEmptyAsset(w, 1, 0), nonEmptyAsset(w, 1, 1)
+				*a, *b = *b, *a
+				return 1
+			},
+			assetIndex: func(w *utils.BatchCreateUserWitness) int { return int(nonEmptyAsset(w, 1, 1).Index) },
+			check:      "asset index ordering",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := constructValidBatchWitness(4, 16, 3, 1)
+			op := tc.corrupt(w)
+			err := DiagnoseBatchCreateUserWitness(w)
+			var assertionErr *AssertionError
+			if !errors.As(err, &assertionErr) {
+				t.Fatalf("got %v, want an AssertionError", err)
+			}
+			if assertionErr.Op != op || assertionErr.AccountIndex != w.CreateUserOps[op].AccountIndex ||
+				assertionErr.AssetIndex != tc.assetIndex(w) || assertionErr.Check != tc.check {
+				t.Fatalf("got %v, want CreateUserOps[%d] asset index %d %s", err, op, tc.assetIndex(w), tc.check)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package circuit
 
 import (
 	"fmt"
+	"math"
 	"math/big"
 	"testing"
 
@@ -34,12 +35,12 @@ type singleTierQueryCircuit struct {
 func (c singleTierQueryCircuit) Define(api API) error {
 	r := rangecheck.New(api)
 	for i := range c.CAssets {
-		generateRapidArithmeticForCollateral(api, r, c.CAssets[i].LoanRatios)
+		generateRapidArithmeticForCollateral(api, r, c.CAssets[i].CollateralRatios[loanCategory])
 	}
-	t := constructLoanTierRatiosLookupTable(api, c.CAssets)
+	t := constructTierRatiosLookupTable(api, c.CAssets, loanCategory)
 
-	tierRatiosLen := 3 * (len(c.CAssets[0].LoanRatios) + 1)
-	maxTierIndex := len(c.CAssets[0].LoanRatios) - 1
+	tierRatiosLen := 3 * (len(c.CAssets[0].CollateralRatios[loanCategory]) + 1)
+	maxTierIndex := len(c.CAssets[0].CollateralRatios[loanCategory]) - 1
 	got := getAndCheckTierRatiosQueryResults(
 		api, r, t,
 		c.AssetIndex,
@@ -71,12 +72,12 @@ type twoAssetOffsetIsolationCircuit struct {
 func (c twoAssetOffsetIsolationCircuit) Define(api API) error {
 	r := rangecheck.New(api)
 	for i := range c.CAssets {
-		generateRapidArithmeticForCollateral(api, r, c.CAssets[i].LoanRatios)
+		generateRapidArithmeticForCollateral(api, r, c.CAssets[i].CollateralRatios[loanCategory])
 	}
-	t := constructLoanTierRatiosLookupTable(api, c.CAssets)
+	t := constructTierRatiosLookupTable(api, c.CAssets, loanCategory)
 
-	tierRatiosLen := 3 * (len(c.CAssets[0].LoanRatios) + 1)
-	maxTierIndex := len(c.CAssets[0].LoanRatios) - 1
+	tierRatiosLen := 3 * (len(c.CAssets[0].CollateralRatios[loanCategory]) + 1)
+	maxTierIndex := len(c.CAssets[0].CollateralRatios[loanCategory]) - 1
 
 	got0 := getAndCheckTierRatiosQueryResults(
 		api, r, t,
@@ -131,6 +132,15 @@ func TestGetAndCheckTierRatiosQueryResultsEdgeCases(t *testing.T) {
 	}
 
 	maxTierPlusOne := new(big.Int).Add(new(big.Int).Set(utils.MaxTierBoundaryValue), big.NewInt(1))
+	// the worst case of 24 value decimals and 16 price decimals: the largest
+	// price is about 1844 USD and the largest balance has 8 decimals
+	maxPrice := new(big.Int).SetUint64(math.MaxUint64)
+	maxBalance := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), utils.BalanceBits), big.NewInt(1))
+	capCollateral := new(big.Int).Quo(utils.MaxTierBoundaryValue, maxPrice)
+	capCollateralPlusOne := new(big.Int).Add(capCollateral, big.NewInt(1))
+	maxBoundaryTiers := []tierInput{
+		{Boundary: new(big.Int).Set(utils.MaxTierBoundaryValue), Ratio: 100},
+	}
 
 	type tc struct {
 		name       string
@@ -167,6 +177,13 @@ func TestGetAndCheckTierRatiosQueryResultsEdgeCases(t *testing.T) {
 		{name: "floor_semantics_non_divisible", tiers: floorTiers, collateral: big.NewInt(150), index: 1, flag: 0, price: priceOne},
 		{name: "zero_ratio_tier_increment", tiers: zeroRatioTiers, collateral: big.NewInt(150), index: 1, flag: 0, price: priceOne},
 		{name: "zero_width_tier_equal_boundary", tiers: zeroWidthTiers, collateral: big.NewInt(100), index: 0, flag: 0, price: priceOne},
+
+		// P2: the bounds of the balances and the prices
+		{name: "max_price_flag_zero_at_max_boundary", tiers: maxBoundaryTiers, collateral: capCollateral, index: 0, flag: 0, price: maxPrice},
+		{name: "max_price_flag_one_below_max_boundary", tiers: stdTiers, collateral: capCollateral, index: 2, flag: 1, price: maxPrice},
+		{name: "max_price_flag_zero_above_max_boundary_should_fail", tiers: maxBoundaryTiers, collateral: capCollateralPlusOne, index: 0, flag: 0, price: maxPrice, expectFail: true},
+		{name: "max_price_flag_one_above_max_boundary_should_fail", tiers: stdTiers, collateral: capCollateralPlusOne, index: 2, flag: 1, price: maxPrice, expectFail: true},
+		{name: "max_price_max_balance_should_fail", tiers: stdTiers, collateral: maxBalance, index: 2, flag: 1, price: maxPrice, expectFail: true},
 	}
 
 	for _, tt := range tests {
@@ -283,7 +300,7 @@ func makeLoanOnlyAsset(tiers []tierInput) CexAssetInfo {
 	asset := blankLoanOnlyAsset(len(tiers))
 	asset.BasePrice = big.NewInt(1)
 	for i, tr := range tiers {
-		asset.LoanRatios[i] = TierRatio{
+		asset.CollateralRatios[loanCategory][i] = TierRatio{
 			BoundaryValue:    new(big.Int).Set(tr.Boundary),
 			Ratio:            tr.Ratio,
 			PrecomputedValue: 0,
@@ -293,32 +310,23 @@ func makeLoanOnlyAsset(tiers []tierInput) CexAssetInfo {
 }
 
 func blankLoanOnlyAsset(tierCount int) CexAssetInfo {
+	collateralCounts := len(utils.CollateralCategories)
 	asset := CexAssetInfo{
-		TotalEquity:               0,
-		TotalDebt:                 0,
-		BasePrice:                 0,
-		LoanCollateral:            0,
-		MarginCollateral:          0,
-		PortfolioMarginCollateral: 0,
-		LoanRatios:                make([]TierRatio, tierCount),
-		MarginRatios:              make([]TierRatio, tierCount),
-		PortfolioMarginRatios:     make([]TierRatio, tierCount),
+		TotalEquity:      0,
+		TotalDebt:        0,
+		BasePrice:        0,
+		Collaterals:      make([]Variable, collateralCounts),
+		CollateralRatios: make([][]TierRatio, collateralCounts),
 	}
-	for i := 0; i < tierCount; i++ {
-		asset.LoanRatios[i] = TierRatio{
-			BoundaryValue:    0,
-			Ratio:            0,
-			PrecomputedValue: 0,
-		}
-		asset.MarginRatios[i] = TierRatio{
-			BoundaryValue:    0,
-			Ratio:            0,
-			PrecomputedValue: 0,
-		}
-		asset.PortfolioMarginRatios[i] = TierRatio{
-			BoundaryValue:    0,
-			Ratio:            0,
-			PrecomputedValue: 0,
+	for c := 0; c < collateralCounts; c++ {
+		asset.Collaterals[c] = 0
+		asset.CollateralRatios[c] = make([]TierRatio, tierCount)
+		for i := 0; i < tierCount; i++ {
+			asset.CollateralRatios[c][i] = TierRatio{
+				BoundaryValue:    0,
+				Ratio:            0,
+				PrecomputedValue: 0,
+			}
 		}
 	}
 	return asset
@@ -0,0 +1,23 @@
+package circuit
+
+import (
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/hash/poseidon"
+)
+
+// hashVariables returns the hash of utils.HashSuite of the inputs, it is the same as
+// utils.HashBytes of the values of the inputs.
+func hashVariables(api API, inputs ...Variable) Variable {
+	switch utils.HashSuite {
+	case utils.MiMCHashSuite:
+		h, err := mimc.NewMiMC(api)
+		if err != nil {
+			panic(err)
+		}
+		h.Write(inputs...)
+		return h.Sum()
+	default:
+		return poseidon.Poseidon(api, inputs...)
+	}
+}
@@ -0,0 +1,63 @@
+package circuit
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+type hashCircuit struct {
+	Inputs []Variable
+	Hash   Variable
+}
+
+func (c hashCircuit) Define(api API) error {
+	api.AssertIsEqual(hashVariables(api, c.Inputs...), c.Hash)
+	return nil
+}
+
+func TestHashSuites(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defer utils.SetCircuitParams(defaultParams)
+
+	// more than 12 inputs to cover the hash chain of poseidon
+	inputs := make([][]byte, 20)
+	for i := 0; i < len(inputs); i++ {
+		inputs[i] = new(big.Int).SetUint64(uint64(i * 1000003)).Bytes()
+	}
+	var maxElement fr.Element
+	maxElement.SetInt64(-1)
+	inputs[1] = maxElement.Marshal()
+
+	for _, hashSuite := range []string{utils.PoseidonHashSuite, utils.MiMCHashSuite} {
+		params := defaultParams
+		params.HashSuite = hashSuite
+		if err := utils.SetCircuitParams(params); err != nil {
+			t.Fatal(err)
+		}
+		circuit := hashCircuit{Inputs: make([]Variable, len(inputs)), Hash: 0}
+		for i := range circuit.Inputs {
+			circuit.Inputs[i] = 0
+		}
+		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignment := hashCircuit{Inputs: make([]Variable, len(inputs)), Hash: utils.HashBytes(inputs...)}
+		for i := range inputs {
+			assignment.Inputs[i] = inputs[i]
+		}
+		witness, err := frontend.NewWitness(&assignment, ecc.BN254.ScalarField())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = oR1cs.IsSolved(witness); err != nil {
+			t.Fatalf("%s: the hash of the circuit doesn't match utils.HashBytes: %v", hashSuite, err)
+		}
+	}
+}
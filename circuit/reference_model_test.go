@@ -0,0 +1,484 @@
+package circuit
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/test"
+)
+
+// The Go code in utils and the witness generation is the reference model of
+// the rules of BatchCreateUserCircuit. The tests below generate random users,
+// tier ratios and prices biased to the tier edges and the balance limits, and
+// check that the circuit agrees with the model on accept/reject and on every
+// computed value and commitment.
+
+// referenceSeed makes the failures of the tests reproducible, the fuzz
+// targets, such as FuzzTierRatiosAgainstReferenceModel, try the other seeds.
+const referenceSeed = 20240131
+
+// referenceRand generates the values biased to the edges.
+type referenceRand struct {
+	*rand.Rand
+}
+
+func newReferenceRand(seed int64) referenceRand {
+	return referenceRand{rand.New(rand.NewSource(seed))}
+}
+
+var maxUint128 = utils.Uint128{Hi: math.MaxUint64, Lo: math.MaxUint64}
+
+// uint128 converts the balance of the model, it must fit in 128 bits.
+func uint128(v *big.Int) utils.Uint128 {
+	res, err := utils.Uint128FromBig(v)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func (r referenceRand) balanceEdge() utils.Uint128 {
+	switch r.Intn(8) {
+	case 0:
+		return utils.Uint128{}
+	case 1:
+		return utils.NewUint128(1)
+	case 2:
+		v, _ := maxUint128.Sub(utils.NewUint128(uint64(r.Intn(2))))
+		return v
+	case 3:
+		// the uint64 limit
+		v, _ := utils.NewUint128(math.MaxUint64).Add(utils.NewUint128(uint64(r.Intn(2))))
+		return v
+	case 4:
+		return uint128(new(big.Int).Lsh(big.NewInt(1), uint(32+r.Intn(96))))
+	case 5:
+		return utils.Uint128{Hi: r.Uint64(), Lo: r.Uint64()}
+	default:
+		return utils.NewUint128(uint64(r.Intn(1000)))
+	}
+}
+
+func (r referenceRand) price() uint64 {
+	switch r.Intn(4) {
+	case 0:
+		return 1
+	case 1:
+		return math.MaxUint64
+	case 2:
+		return 1 << (20 + r.Intn(40))
+	default:
+		return uint64(r.Intn(100000000)) + 1
+	}
+}
+
+// tierRatios returns count tier ratios with increasing boundaries, some of
+// the tiers have zero width and the last boundary may be MaxTierBoundaryValue.
+func (r referenceRand) tierRatios(count int) []utils.TierRatio {
+	res := make([]utils.TierRatio, count)
+	boundary := big.NewInt(0)
+	for i := 0; i < count; i++ {
+		switch r.Intn(4) {
+		case 0:
+			// zero width tier
+		case 1:
+			boundary = new(big.Int).Add(boundary, big.NewInt(r.Int63n(1000)+1))
+		default:
+			step := new(big.Int).Rand(r.Rand, new(big.Int).Lsh(big.NewInt(1), uint(r.Intn(100)+1)))
+			boundary = new(big.Int).Add(boundary, step)
+		}
+		if i == count-1 && r.Intn(4) == 0 || boundary.Cmp(utils.MaxTierBoundaryValue) > 0 {
+			boundary = new(big.Int).Set(utils.MaxTierBoundaryValue)
+		}
+		res[i] = utils.TierRatio{
+			BoundaryValue: boundary,
+			Ratio:         uint8(r.Intn(int(utils.PercentageMultiplier.Int64()) + 1)),
+		}
+	}
+	utils.CalculatePrecomputedValue(res)
+	return res
+}
+
+// collaterals returns the collaterals of the edges of the tier ratios with the price.
+func (r referenceRand) collaterals(tiers []utils.TierRatio, price uint64) []utils.Uint128 {
+	res := []utils.Uint128{{}, utils.NewUint128(1), maxUint128, r.balanceEdge()}
+	p := new(big.Int).SetUint64(price)
+	for _, tier := range tiers {
+		q := new(big.Int).Div(tier.BoundaryValue, p)
+		for _, delta := range []int64{-1, 0, 1} {
+			v := new(big.Int).Add(q, big.NewInt(delta))
+			if v.Sign() >= 0 && v.BitLen() <= utils.BalanceBits {
+				res = append(res, uint128(v))
+			}
+		}
+	}
+	return res
+}
+
+// referenceCollateralValue returns the collateral value of the model, and
+// whether the circuit must accept it.
+func referenceCollateralValue(collateral utils.Uint128, price uint64, tiers []utils.TierRatio) (*big.Int, bool) {
+	value := new(big.Int).Mul(collateral.Big(), new(big.Int).SetUint64(price))
+	accept := value.Cmp(utils.MaxTierBoundaryValue) <= 0
+	return utils.CalculateAssetValueViaTiersRatio(value, tiers), accept
+}
+
+// checkTierRatiosAgainstReferenceModel checks the collateral values of random
+// tier ratios and prices at the tier edges against the model.
+func checkTierRatiosAgainstReferenceModel(t *testing.T, r referenceRand) {
+	tiers := r.tierRatios(r.Intn(4) + 1)
+	price := r.price()
+	inputs := make([]tierInput, len(tiers))
+	for i := range tiers {
+		inputs[i] = tierInput{Boundary: tiers[i].BoundaryValue, Ratio: uint64(tiers[i].Ratio)}
+	}
+	circuit := &singleTierQueryCircuit{
+		CAssets:     []CexAssetInfo{blankLoanOnlyAsset(len(tiers))},
+		CheckOutput: true,
+	}
+
+	for _, collateral := range r.collaterals(tiers, price) {
+		expected, accept := referenceCollateralValue(collateral, price, tiers)
+		// the tier index and flag of the witness generation
+		cexAsset := utils.CexAssetInfo{
+			BasePrice:        price,
+			CollateralRatios: make([][]utils.TierRatio, len(utils.CollateralCategories)),
+		}
+		cexAsset.CollateralRatios[loanCategory] = tiers
+		asset := utils.NewEmptyAccountAsset(0)
+		asset.Collaterals[loanCategory] = collateral
+		var info UserAssetInfo
+		calcAndSetCollateralInfo(0, &info, &asset, []utils.CexAssetInfo{cexAsset})
+
+		for index := 0; index < len(tiers); index++ {
+			for flag := 0; flag < 2; flag++ {
+				assignment := &singleTierQueryCircuit{
+					CAssets:         []CexAssetInfo{makeLoanOnlyAsset(inputs)},
+					AssetIndex:      0,
+					UserCollateral:  collateral.Big(),
+					CollateralIndex: index,
+					CollateralFlag:  flag,
+					AssetPrice:      price,
+					Expected:        expected,
+					CheckOutput:     true,
+				}
+				want := accept && index == info.CollateralIndexes[loanCategory] && flag == info.CollateralFlags[loanCategory]
+				err := test.IsSolved(circuit, assignment, utils.CurveID().ScalarField())
+				if (err == nil) != want {
+					t.Fatalf("tiers %v price %d collateral %s index %d flag %d: the model accepts %v, the circuit error %v",
+						inputs, price, collateral, index, flag, want, err)
+				}
+				if want {
+					assignment.Expected = new(big.Int).Add(expected, big.NewInt(1))
+					if test.IsSolved(circuit, assignment, utils.CurveID().ScalarField()) == nil {
+						t.Fatalf("tiers %v price %d collateral %s: the circuit accepts a value other than %s",
+							inputs, price, collateral, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTierRatiosAgainstReferenceModel(t *testing.T) {
+	r := newReferenceRand(referenceSeed)
+	for n := 0; n < 20; n++ {
+		checkTierRatiosAgainstReferenceModel(t, r)
+	}
+}
+
+func FuzzTierRatiosAgainstReferenceModel(f *testing.F) {
+	f.Add(int64(referenceSeed))
+	f.Fuzz(func(t *testing.T, seed int64) {
+		checkTierRatiosAgainstReferenceModel(t, newReferenceRand(seed))
+	})
+}
+
+type userAssetsCommitmentCircuit struct {
+	FlattenAssets []Variable
+	Commitment    Variable
+}
+
+func (c userAssetsCommitmentCircuit) Define(api API) error {
+	api.AssertIsEqual(c.Commitment, computeUserAssetsCommitment(api, c.FlattenAssets, utils.GetNumOfAssetFields()))
+	return nil
+}
+
+// accountAssets returns count non empty assets of increasing indexes.
+func (r referenceRand) accountAssets(count int, allAssetCounts int) []utils.AccountAsset {
+	indexes := r.Perm(allAssetCounts)[:count]
+	assets := make([]utils.AccountAsset, 0, count)
+	for index := 0; index < allAssetCounts; index++ {
+		for _, v := range indexes {
+			if v != index {
+				continue
+			}
+			asset := utils.NewEmptyAccountAsset(uint16(index))
+			asset.Equity = r.balanceEdge()
+			asset.Equity.Lo |= 1
+			asset.Debt = r.balanceEdge()
+			for c := range asset.Collaterals {
+				asset.Collaterals[c] = r.balanceEdge()
+			}
+			assets = append(assets, asset)
+		}
+	}
+	return assets
+}
+
+func TestUserAssetsCommitmentAgainstReferenceModel(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4, 8}
+	err := utils.SetCircuitParams(utils.CircuitParams{
+		Version:          utils.CircuitParamsVersion,
+		AccountTreeDepth: 8,
+		AssetCounts:      16,
+		TierCount:        4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cexAssets := constructCexAssets(utils.AssetCounts)
+
+	r := newReferenceRand(referenceSeed)
+	for n := 0; n < 20; n++ {
+		assets := r.accountAssets(r.Intn(8)+1, utils.AssetCounts)
+		hasher := utils.NewHasher()
+		expected := utils.ComputeUserAssetsCommitment(&hasher, assets)
+
+		// flatten the assets as checkUserAssets does
+		targetCounts := utils.GetNonEmptyAssetsCountOfUser(assets)
+		userAssets, assetsForUpdateCex, err := setUserAssetsWitness(0, assets, targetCounts, cexAssets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numOfAssetsFields := utils.GetNumOfAssetFields()
+		assignment := &userAssetsCommitmentCircuit{
+			FlattenAssets: make([]Variable, 0, len(userAssets)*numOfAssetsFields),
+			Commitment:    expected,
+		}
+		for _, u := range userAssets {
+			meta := assetsForUpdateCex[u.AssetIndex.(uint32)]
+			assignment.FlattenAssets = append(assignment.FlattenAssets, u.AssetIndex, meta.Equity, meta.Debt)
+			assignment.FlattenAssets = append(assignment.FlattenAssets, meta.Collaterals...)
+		}
+		circuit := &userAssetsCommitmentCircuit{FlattenAssets: make([]Variable, len(assignment.FlattenAssets))}
+		if err = test.IsSolved(circuit, assignment, utils.CurveID().ScalarField()); err != nil {
+			t.Fatalf("assets %v: the user assets commitments don't match: %v", assets, err)
+		}
+	}
+}
+
+// referenceCexAssets returns the cex assets of random tier ratios and prices,
+// the totals of some of them are close to the balance limit.
+func (r referenceRand) cexAssets(count int) []utils.CexAssetInfo {
+	res := make([]utils.CexAssetInfo, count)
+	for i := range res {
+		res[i] = utils.CexAssetInfo{
+			BasePrice:        r.price(),
+			Index:            uint32(i),
+			Collaterals:      make([]utils.Uint128, len(utils.CollateralCategories)),
+			CollateralRatios: make([][]utils.TierRatio, len(utils.CollateralCategories)),
+		}
+		if r.Intn(32) == 0 {
+			res[i].TotalEquity, _ = maxUint128.Sub(utils.NewUint128(uint64(r.Intn(1000))))
+		}
+		for c := range res[i].CollateralRatios {
+			res[i].CollateralRatios[c] = r.tierRatios(utils.TierCount)
+		}
+	}
+	return res
+}
+
+// account returns an account of the assets, whose collaterals are close to
+// the equity and whose debt is close to the collateral value. The model
+// accepts all the accounts but the edge ones, which may break any rule.
+// It returns whether the model accepts the account.
+func (r referenceRand) account(cexAssets []utils.CexAssetInfo, accountIndex uint32, assetsCount int, edge bool) (utils.AccountInfo, bool) {
+	account := utils.AccountInfo{
+		AccountIndex: accountIndex,
+		AccountId:    utils.ReduceToFieldElement(big.NewInt(r.Int63()).Bytes()),
+		Assets:       r.accountAssets(assetsCount, len(cexAssets)),
+	}
+	accept := true
+	totalEquity := new(big.Int)
+	totalDebt := new(big.Int)
+	totalCollateral := new(big.Int)
+	for j := range account.Assets {
+		asset := &account.Assets[j]
+		cexAsset := &cexAssets[asset.Index]
+		sum := new(big.Int)
+		for c := range asset.Collaterals {
+			if !edge || r.Intn(2) == 0 {
+				asset.Collaterals[c] = utils.NewUint128(uint64(r.Intn(1000)))
+			}
+			sum.Add(sum, asset.Collaterals[c].Big())
+			_, ok := referenceCollateralValue(asset.Collaterals[c], cexAsset.BasePrice, cexAsset.CollateralRatios[c])
+			accept = accept && ok
+		}
+		asset.Debt = utils.Uint128{}
+		asset.Equity = maxUint128
+		if sum.BitLen() <= utils.BalanceBits {
+			extra := big.NewInt(int64(r.Intn(3)))
+			if edge && r.Intn(8) == 0 {
+				extra = maxUint128.Big()
+			}
+			equity := new(big.Int).Add(sum, extra)
+			if edge && sum.Sign() > 0 && r.Intn(4) == 0 {
+				asset.Equity = uint128(new(big.Int).Sub(sum, big.NewInt(1)))
+			} else if equity.BitLen() <= utils.BalanceBits {
+				asset.Equity = uint128(equity)
+			}
+		}
+		if asset.Equity.IsZero() {
+			asset.Equity = utils.NewUint128(1)
+		}
+		accept = accept && sum.Cmp(asset.Equity.Big()) <= 0
+
+		price := new(big.Int).SetUint64(cexAsset.BasePrice)
+		totalEquity.Add(totalEquity, new(big.Int).Mul(asset.Equity.Big(), price))
+		totalCollateral.Add(totalCollateral, utils.CalculateAssetValueForCollateral(asset.Collaterals, cexAsset))
+	}
+	// the debt of the last asset is close to the collateral value of the user
+	last := &account.Assets[len(account.Assets)-1]
+	price := new(big.Int).SetUint64(cexAssets[last.Index].BasePrice)
+	debt := new(big.Int).Div(totalCollateral, price)
+	delta := -r.Intn(2)
+	if edge {
+		delta = r.Intn(3) - 1
+	}
+	debt.Add(debt, big.NewInt(int64(delta)))
+	if debt.Sign() < 0 {
+		debt.SetUint64(0)
+	}
+	if debt.BitLen() > utils.BalanceBits {
+		debt = maxUint128.Big()
+	}
+	last.Debt = uint128(debt)
+	totalDebt.Mul(debt, price)
+
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(userValueBits()))
+	accept = accept && totalDebt.Cmp(totalCollateral) <= 0 && totalDebt.Cmp(limit) < 0 && totalCollateral.Cmp(limit) < 0
+	account.TotalEquity = totalEquity
+	account.TotalDebt = totalDebt
+	account.TotalCollateral = totalCollateral
+	return account, accept
+}
+
+// referenceCexAssetsOverflow returns whether the totals of the cex assets
+// overflow 128 bits after the accounts are added.
+func referenceCexAssetsOverflow(cexAssets []utils.CexAssetInfo, accounts []utils.AccountInfo) bool {
+	add := func(total *big.Int, v utils.Uint128) bool {
+		total.Add(total, v.Big())
+		return total.BitLen() > utils.BalanceBits
+	}
+	for i := range cexAssets {
+		equity := cexAssets[i].TotalEquity.Big()
+		debt := cexAssets[i].TotalDebt.Big()
+		collaterals := make([]*big.Int, len(cexAssets[i].Collaterals))
+		for c := range collaterals {
+			collaterals[c] = cexAssets[i].Collaterals[c].Big()
+		}
+		for _, account := range accounts {
+			for _, asset := range account.Assets {
+				if int(asset.Index) != i {
+					continue
+				}
+				if add(equity, asset.Equity) || add(debt, asset.Debt) {
+					return true
+				}
+				for c := range collaterals {
+					if add(collaterals[c], asset.Collaterals[c]) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// setReferenceModelCircuitParams sets the small circuit params of the batches
+// of the reference model tests, it returns a function to restore them.
+func setReferenceModelCircuitParams(tb testing.TB) func() {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	utils.AssetCountsTiers = []int{4}
+	err := utils.SetCircuitParams(utils.CircuitParams{
+		Version:          utils.CircuitParamsVersion,
+		AccountTreeDepth: 8,
+		AssetCounts:      16,
+		TierCount:        4,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}
+}
+
+// checkBatchAgainstReferenceModel checks a random batch of 3 users of 4 assets
+// against the model, it returns whether the model accepts the batch.
+func checkBatchAgainstReferenceModel(t *testing.T, r referenceRand, circuit *BatchCreateUserCircuit) bool {
+	cexAssets := r.cexAssets(utils.AssetCounts)
+	accounts := make([]utils.AccountInfo, len(circuit.CreateUserOps))
+	accept := true
+	for i := range accounts {
+		var ok bool
+		accounts[i], ok = r.account(cexAssets, uint32(i), len(circuit.CreateUserOps[i].Assets), r.Intn(4) == 0)
+		accept = accept && ok
+	}
+	accept = accept && !referenceCexAssetsOverflow(cexAssets, accounts)
+	batchWitness := constructBatchWitness(cexAssets, accounts)
+	if accept {
+		// the after cex assets commitment of the model
+		recovered := *batchWitness
+		recovered.BeforeCexAssets = utils.CloneCexAssetsInfo(batchWitness.BeforeCexAssets)
+		utils.RecoverAfterCexAssets(&recovered)
+	}
+
+	assignment, err := SetBatchCreateUserCircuitWitness(batchWitness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test.IsSolved(circuit, assignment, utils.CurveID().ScalarField())
+	if (err == nil) != accept {
+		t.Fatalf("the model accepts %v, the circuit error %v", accept, err)
+	}
+	return accept
+}
+
+func TestBatchCreateUserCircuitAgainstReferenceModel(t *testing.T) {
+	defer setReferenceModelCircuitParams(t)()
+	circuit := NewBatchCreateUserCircuit(4, 16, 3)
+
+	r := newReferenceRand(referenceSeed)
+	accepted := 0
+	for n := 0; n < 20; n++ {
+		if checkBatchAgainstReferenceModel(t, r, circuit) {
+			accepted++
+		}
+	}
+	if accepted == 0 || accepted == 20 {
+		t.Fatalf("the model accepts %d of 20 batches, expected both cases", accepted)
+	}
+}
+
+func FuzzBatchCreateUserCircuitAgainstReferenceModel(f *testing.F) {
+	defer setReferenceModelCircuitParams(f)()
+	circuit := NewBatchCreateUserCircuit(4, 16, 3)
+	f.Add(int64(referenceSeed))
+	f.Fuzz(func(t *testing.T, seed int64) {
+		checkBatchAgainstReferenceModel(t, newReferenceRand(seed), circuit)
+	})
+}
@@ -0,0 +1,109 @@
+package circuit
+
+import (
+	"fmt"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark/std/rangecheck"
+)
+
+// ReservesComparisonCircuit proves the reserves of every cex asset are not less
+// than its liabilities TotalEquity - TotalDebt, the totals of the cex assets are
+// opened from the final cex assets commitment of the batch proofs and are not
+// revealed if the commitment is blinded. The public Commitment binds:
+//   - EmptyCEXAssetsCommitment and FinalCEXAssetsCommitment, the first and the
+//     last cex assets commitments of the batch proofs;
+//   - PublicCEXAssetsCommitment, the commitment of the cex assets without totals
+//     and blinding, which is computed by the verifier from the published prices;
+//   - ReservesCommitment, the commitment of the reserves of every cex asset.
+type ReservesComparisonCircuit struct {
+	Commitment                Variable `gnark:",public"`
+	EmptyCEXAssetsCommitment  Variable
+	FinalCEXAssetsCommitment  Variable
+	PublicCEXAssetsCommitment Variable
+	ReservesCommitment        Variable
+	CexAssetsBlinding         Variable
+	CexAssets                 []CexAssetInfo
+	Reserves                  []Variable
+}
+
+func NewVerifyReservesComparisonCircuit(commitment []byte) *ReservesComparisonCircuit {
+	var v ReservesComparisonCircuit
+	v.Commitment = commitment
+	return &v
+}
+
+func NewReservesComparisonCircuit(allAssetCounts uint32) *ReservesComparisonCircuit {
+	var circuit ReservesComparisonCircuit
+	circuit.Commitment = 0
+	circuit.EmptyCEXAssetsCommitment = 0
+	circuit.FinalCEXAssetsCommitment = 0
+	circuit.PublicCEXAssetsCommitment = 0
+	circuit.ReservesCommitment = 0
+	circuit.CexAssetsBlinding = 0
+	circuit.CexAssets = NewBatchCreateUserCircuit(0, allAssetCounts, 0).BeforeCexAssets
+	circuit.Reserves = make([]Variable, allAssetCounts)
+	for i := uint32(0); i < allAssetCounts; i++ {
+		circuit.Reserves[i] = 0
+	}
+	return &circuit
+}
+
+func (b ReservesComparisonCircuit) Define(api API) error {
+	// verify whether Commitment is computed correctly
+	actualCommitment := hashVariables(api, b.EmptyCEXAssetsCommitment, b.FinalCEXAssetsCommitment,
+		b.PublicCEXAssetsCommitment, b.ReservesCommitment)
+	api.AssertIsEqual(b.Commitment, actualCommitment)
+
+	r := rangecheck.New(api)
+	countOfCexAsset := getVariableCountOfCexAsset(b.CexAssets[0])
+	finalCexAssets := make([]Variable, len(b.CexAssets)*countOfCexAsset)
+	emptyCexAssets := make([]Variable, len(b.CexAssets)*countOfCexAsset)
+	for i := 0; i < len(b.CexAssets); i++ {
+		r.Check(b.CexAssets[i].TotalEquity, utils.BalanceBits)
+		r.Check(b.CexAssets[i].TotalDebt, utils.BalanceBits)
+		r.Check(b.Reserves[i], utils.BalanceBits)
+		// reserves + TotalDebt - TotalEquity is less than 2^129 if it isn't negative
+		r.Check(api.Sub(api.Add(b.Reserves[i], b.CexAssets[i].TotalDebt), b.CexAssets[i].TotalEquity), utils.BalanceBits+1)
+
+		fillCexAssetCommitment(api, b.CexAssets[i], i, finalCexAssets)
+		emptyCexAsset := b.CexAssets[i]
+		emptyCexAsset.TotalEquity = 0
+		emptyCexAsset.TotalDebt = 0
+		emptyCexAsset.Collaterals = make([]Variable, len(b.CexAssets[i].Collaterals))
+		for c := 0; c < len(emptyCexAsset.Collaterals); c++ {
+			emptyCexAsset.Collaterals[c] = 0
+		}
+		fillCexAssetCommitment(api, emptyCexAsset, i, emptyCexAssets)
+	}
+	api.AssertIsEqual(b.FinalCEXAssetsCommitment, hashCexAssets(api, finalCexAssets, b.CexAssetsBlinding))
+	api.AssertIsEqual(b.EmptyCEXAssetsCommitment, hashCexAssets(api, emptyCexAssets, b.CexAssetsBlinding))
+	api.AssertIsEqual(b.PublicCEXAssetsCommitment, hashVariables(api, emptyCexAssets...))
+	api.AssertIsEqual(b.ReservesCommitment, hashVariables(api, b.Reserves...))
+	return nil
+}
+
+func SetReservesComparisonCircuitWitness(reservesWitness *utils.ReservesComparisonWitness) (witness *ReservesComparisonCircuit, err error) {
+	if len(reservesWitness.Reserves) != len(reservesWitness.CexAssets) {
+		return nil, fmt.Errorf("the reserves count %d doesn't match the cex assets count %d",
+			len(reservesWitness.Reserves), len(reservesWitness.CexAssets))
+	}
+	cexAssets, err := setCexAssetsWitness(reservesWitness.CexAssets)
+	if err != nil {
+		return nil, err
+	}
+	witness = &ReservesComparisonCircuit{
+		Commitment:                reservesWitness.Commitment,
+		EmptyCEXAssetsCommitment:  reservesWitness.EmptyCEXAssetsCommitment,
+		FinalCEXAssetsCommitment:  reservesWitness.FinalCEXAssetsCommitment,
+		PublicCEXAssetsCommitment: reservesWitness.PublicCEXAssetsCommitment,
+		ReservesCommitment:        reservesWitness.ReservesCommitment,
+		CexAssetsBlinding:         cexAssetsBlindingWitness(reservesWitness.CexAssetsBlinding),
+		CexAssets:                 cexAssets,
+		Reserves:                  make([]Variable, len(reservesWitness.Reserves)),
+	}
+	for i := 0; i < len(witness.Reserves); i++ {
+		witness.Reserves[i] = reservesWitness.Reserves[i].Big()
+	}
+	return witness, nil
+}
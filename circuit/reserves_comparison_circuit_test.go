@@ -0,0 +1,88 @@
+package circuit
+
+import (
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+func TestReservesComparisonCircuit(t *testing.T) {
+	defaultParams := utils.CurrentCircuitParams()
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+		utils.SetCircuitParams(defaultParams)
+	}()
+	utils.AssetCountsTiers = []int{4}
+
+	for _, params := range []struct {
+		blind     bool
+		hashSuite string
+	}{
+		{false, utils.PoseidonHashSuite},
+		{true, utils.PoseidonHashSuite},
+		{true, utils.MiMCHashSuite},
+	} {
+		blind := params.blind
+		err := utils.SetCircuitParams(utils.CircuitParams{
+			Version:                  utils.CircuitParamsVersion,
+			AccountTreeDepth:         8,
+			AssetCounts:              16,
+			TierCount:                4,
+			BlindCexAssetsCommitment: blind,
+			HashSuite:                params.hashSuite,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder,
+			NewReservesComparisonCircuit(uint32(utils.AssetCounts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cexAssets := constructCexAssets(utils.AssetCounts)
+		reserves := make([]utils.Uint128, len(cexAssets))
+		for i := 0; i < len(cexAssets); i++ {
+			// the totals take more than 64 bits
+			cexAssets[i].TotalEquity = utils.Uint128{Hi: uint64(i + 1), Lo: uint64(1000 * (i + 1))}
+			cexAssets[i].TotalDebt = utils.NewUint128(uint64(10 * i))
+			reserves[i] = utils.SafeAdd(utils.SafeSub(cexAssets[i].TotalEquity, cexAssets[i].TotalDebt), utils.NewUint128(uint64(i%2)))
+		}
+		blinding, err := utils.NewCexAssetsBlinding()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (blinding != nil) != blind {
+			t.Fatalf("got blinding %x with BlindCexAssetsCommitment %v", blinding, blind)
+		}
+		solve := func() error {
+			reservesWit := utils.NewReservesComparisonWitness(cexAssets, blinding, reserves)
+			circuitWitness, err := SetReservesComparisonCircuitWitness(reservesWit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			witness, err := frontend.NewWitness(circuitWitness, ecc.BN254.ScalarField())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return oR1cs.IsSolved(witness)
+		}
+		if err = solve(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the reserves can't be less than TotalEquity - TotalDebt
+		reserves[1] = utils.SafeSub(reserves[1], utils.NewUint128(1))
+		if err = solve(); err != nil {
+			t.Fatal(err)
+		}
+		reserves[1] = utils.SafeSub(reserves[1], utils.NewUint128(1))
+		if err = solve(); err == nil {
+			t.Fatal("expected the reserves less than the liabilities to fail")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package circuit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	fr_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	plonk_bn254 "github.com/consensys/gnark/backend/plonk/bn254"
+	"github.com/consensys/gnark/backend/solidity"
+	"github.com/consensys/gnark/backend/witness"
+	"golang.org/x/crypto/sha3"
+)
+
+// The Solidity verifier of groth16 only supports keccak256 or sha256 as the
+// hash to field function of the commitment, so the groth16_evm proofs are
+// generated and verified with keccak256.
+func groth16EvmProverOptions() backend.ProverOption {
+	return solidity.WithProverTargetSolidityVerifier(backend.GROTH16)
+}
+
+func groth16EvmVerifierOptions() backend.VerifierOption {
+	return solidity.WithVerifierTargetSolidityVerifier(backend.GROTH16)
+}
+
+// ExportSolidity writes the Solidity verifier contract of vk. The groth16 keys
+// are shared by groth16 and groth16_evm and the plonk keys by plonk and
+// plonk_evm, but the contract only accepts groth16_evm or plonk_evm proofs.
+func ExportSolidity(backend string, vk VerifyingKey, w io.Writer) error {
+	if utils.Curve != utils.BN254Curve {
+		return fmt.Errorf("the Solidity verifier is not supported on curve %s", utils.Curve)
+	}
+	if IsPlonk(backend) {
+		return vk.(*plonk_bn254.VerifyingKey).ExportSolidity(w)
+	}
+	return vk.(*groth16_bn254.VerifyingKey).ExportSolidity(w, solidity.WithHashToFieldFunction(sha3.NewLegacyKeccak256()))
+}
+
+// SolidityCalldata returns the abi encoded call of the exported Solidity
+// verifier for proof and its public inputs:
+// verifyProof(uint256[8],uint256[2],uint256[2],uint256[n]) for groth16_evm and
+// Verify(bytes,uint256[]) for plonk_evm.
+func SolidityCalldata(backend string, proof Proof, publicWitness witness.Witness) ([]byte, error) {
+	publicInputs, ok := publicWitness.Vector().(fr_bn254.Vector)
+	if !ok {
+		return nil, fmt.Errorf("public witness is not a bn254 vector")
+	}
+	switch backend {
+	case Groth16EvmBackend:
+		return groth16SolidityCalldata(proof.(*groth16_bn254.Proof), publicInputs), nil
+	case PlonkEvmBackend:
+		return plonkSolidityCalldata(proof.(*plonk_bn254.Proof), publicInputs), nil
+	default:
+		return nil, fmt.Errorf("%s proofs can't be verified by the Solidity verifier", backend)
+	}
+}
+
+func solidityFunctionSelector(signature string) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(signature))
+	return h.Sum(nil)[:4]
+}
+
+func solidityUint256(v uint64) []byte {
+	var word [32]byte
+	binary.BigEndian.PutUint64(word[24:], v)
+	return word[:]
+}
+
+func groth16SolidityCalldata(proof *groth16_bn254.Proof, publicInputs fr_bn254.Vector) []byte {
+	nbCommitments := len(proof.Commitments)
+	signature := "verifyProof(uint256[8],"
+	if nbCommitments > 0 {
+		signature += fmt.Sprintf("uint256[%d],uint256[2],", 2*nbCommitments)
+	}
+	signature += fmt.Sprintf("uint256[%d])", len(publicInputs))
+	calldata := solidityFunctionSelector(signature)
+
+	// Ar | Bs | Krs | number of commitments | Commitments | CommitmentPok,
+	// all the arguments are static arrays so they are just concatenated
+	raw := proof.MarshalSolidity()
+	calldata = append(calldata, raw[:8*fr_bn254.Bytes]...)
+	if nbCommitments > 0 {
+		calldata = append(calldata, raw[8*fr_bn254.Bytes+4:]...)
+	}
+	for i := 0; i < len(publicInputs); i++ {
+		b := publicInputs[i].Bytes()
+		calldata = append(calldata, b[:]...)
+	}
+	return calldata
+}
+
+func plonkSolidityCalldata(proof *plonk_bn254.Proof, publicInputs fr_bn254.Vector) []byte {
+	calldata := solidityFunctionSelector("Verify(bytes,uint256[])")
+	raw := proof.MarshalSolidity()
+	paddedLen := (len(raw) + 31) / 32 * 32
+	// head: offsets of the two dynamic arguments
+	calldata = append(calldata, solidityUint256(64)...)
+	calldata = append(calldata, solidityUint256(uint64(64+32+paddedLen))...)
+	// tail: length prefixed proof bytes padded to 32 bytes, then the public inputs
+	calldata = append(calldata, solidityUint256(uint64(len(raw)))...)
+	calldata = append(calldata, raw...)
+	calldata = append(calldata, make([]byte, paddedLen-len(raw))...)
+	calldata = append(calldata, solidityUint256(uint64(len(publicInputs)))...)
+	for i := 0; i < len(publicInputs); i++ {
+		b := publicInputs[i].Bytes()
+		calldata = append(calldata, b[:]...)
+	}
+	return calldata
+}
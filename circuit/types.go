@@ -1,7 +1,6 @@
 package circuit
 
 import (
-	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark/frontend"
 )
 
@@ -22,35 +21,25 @@ type CexAssetInfo struct {
 	TotalDebt   Variable
 	BasePrice   Variable
 
-	LoanCollateral            Variable
-	MarginCollateral          Variable
-	PortfolioMarginCollateral Variable
-
-	LoanRatios            []TierRatio
-	MarginRatios          []TierRatio
-	PortfolioMarginRatios []TierRatio
+	// indexed by utils.CollateralCategories
+	Collaterals      []Variable
+	CollateralRatios [][]TierRatio
 }
 
 type UserAssetInfo struct {
 	AssetIndex Variable
+	// indexed by utils.CollateralCategories
 	// The index means the position of tier ratios where the boundary value is larger than the collateral.
-	LoanCollateralIndex Variable
+	CollateralIndexes []Variable
 	// If the flag is 1, the boundary value of last tier ratio is less than the collateral.
-	LoanCollateralFlag Variable
-
-	MarginCollateralIndex Variable
-	MarginCollateralFlag  Variable
-
-	PortfolioMarginCollateralIndex Variable
-	PortfolioMarginCollateralFlag  Variable
+	CollateralFlags []Variable
 }
 
 type UserAssetMeta struct {
-	Equity                    Variable
-	Debt                      Variable
-	LoanCollateral            Variable
-	MarginCollateral          Variable
-	PortfolioMarginCollateral Variable
+	Equity Variable
+	Debt   Variable
+	// indexed by utils.CollateralCategories
+	Collaterals []Variable
 }
 
 type CreateUserOperation struct {
@@ -58,5 +47,18 @@ type CreateUserOperation struct {
 	AssetsForUpdateCex []UserAssetMeta
 	AccountIndex       Variable
 	AccountIdHash      Variable
-	AccountProof       [utils.AccountTreeDepth]Variable
+	// AccountProof has utils.AccountTreeDepth elements
+	AccountProof []Variable
+}
+
+type UpdateUserOperation struct {
+	OldAssets             []UserAssetInfo
+	OldAssetsForUpdateCex []UserAssetMeta
+	NewAssets             []UserAssetInfo
+	NewAssetsForUpdateCex []UserAssetMeta
+	AccountIndex          Variable
+	// AccountIdHash is the account id of both the old and the new leaf
+	AccountIdHash Variable
+	// AccountProof has utils.AccountTreeDepth elements
+	AccountProof []Variable
 }
@@ -2,22 +2,28 @@ package circuit
 
 import (
 	"math/big"
+	"math/bits"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/std/hash/poseidon"
 	"github.com/consensys/gnark/std/lookup/logderivlookup"
 )
 
 func verifyMerkleProof(api API, merkleRoot Variable, node Variable, proofSet, helper []Variable) {
+	// Compare our calculated Merkle root to the desired Merkle root.
+	api.AssertIsEqual(merkleRoot, computeMerkleRoot(api, node, proofSet, helper))
+}
+
+// computeMerkleRoot returns the root of the merkle tree whose leaf at the
+// position of helper is node and whose siblings on the path are proofSet.
+func computeMerkleRoot(api API, node Variable, proofSet, helper []Variable) Variable {
 	for i := 0; i < len(proofSet); i++ {
 		api.AssertIsBoolean(helper[i])
 		d1 := api.Select(helper[i], proofSet[i], node)
 		d2 := api.Select(helper[i], node, proofSet[i])
-		node = poseidon.Poseidon(api, d1, d2)
+		node = hashVariables(api, d1, d2)
 	}
-	// Compare our calculated Merkle root to the desired Merkle root.
-	api.AssertIsEqual(merkleRoot, node)
+	return node
 }
 
 func accountIdToMerkleHelper(api API, accountId Variable) []Variable {
@@ -25,69 +31,78 @@ func accountIdToMerkleHelper(api API, accountId Variable) []Variable {
 	return merkleHelpers
 }
 
-func computeUserAssetsCommitment(api API, flattenAssets []Variable) Variable {
-	nEles := (len(flattenAssets) + 2) / 3
-	quotientEles := len(flattenAssets) / 3
-	remainderEles := len(flattenAssets) % 3
-	tmpUserAssets := make([]Variable, nEles)
-	for i := 0; i < quotientEles; i++ {
-		tmpUserAssets[i] = api.Add(api.Mul(flattenAssets[3*i], utils.Uint64MaxValueFrSquare),
-			api.Mul(flattenAssets[3*i+1], utils.Uint64MaxValueFr), flattenAssets[3*i+2])
-	}
-	var lastEle Variable = 0
-	for i := 0; i < remainderEles; i++ {
-		lastEle = api.Add(api.Mul(lastEle, utils.Uint64MaxValueFr), flattenAssets[3*quotientEles+i])
+// computeUserAssetsCommitment packs the fields of every asset as
+// utils.ComputeUserAssetsCommitment does: index*2^128 + equity, debt and every
+// collateral. The assets have numOfAssetsFields fields each.
+func computeUserAssetsCommitment(api API, flattenAssets []Variable, numOfAssetsFields int) Variable {
+	tmpUserAssets := make([]Variable, 0, len(flattenAssets)/numOfAssetsFields*(numOfAssetsFields-1))
+	for i := 0; i < len(flattenAssets); i += numOfAssetsFields {
+		tmpUserAssets = append(tmpUserAssets, api.Add(api.Mul(flattenAssets[i], utils.Uint64MaxValueBigIntSquare), flattenAssets[i+1]))
+		tmpUserAssets = append(tmpUserAssets, flattenAssets[i+2:i+numOfAssetsFields]...)
 	}
-	for i := remainderEles; i < 3; i++ {
-		lastEle = api.Mul(lastEle, utils.Uint64MaxValueFr)
-	}
-	if remainderEles > 0 {
-		tmpUserAssets[quotientEles] = lastEle
-	}
-	commitment := poseidon.Poseidon(api, tmpUserAssets...)
+	commitment := hashVariables(api, tmpUserAssets...)
 	return commitment
 }
 
-// one variable: TotalEquity + TotalDebt + BasePrice
-// one variable: LoanCollateral + MarginCollateral + PortfolioMarginCollateral
-// one variable contain two TierRatios and the length of TierRatios is even
+// userValueBits is the bit size of the total values of one user, the sum of
+// utils.AssetCounts products of a balance and a price.
+func userValueBits() int {
+	return utils.UserValueBits(utils.AssetCounts)
+}
+
+// one variable: TotalEquity + BasePrice
+// one variable: TotalDebt
+// one variable contain one Collateral
+// one variable contain utils.TierRatiosPerElement TierRatios, it is two for both curves
 func getVariableCountOfCexAsset(cexAsset CexAssetInfo) int {
 	res := 2
-	res += len(cexAsset.LoanRatios) / 2
-	res += len(cexAsset.MarginRatios) / 2
-	res += len(cexAsset.PortfolioMarginRatios) / 2
+	res += len(cexAsset.Collaterals)
+	perElement := utils.TierRatiosPerElement()
+	for i := 0; i < len(cexAsset.CollateralRatios); i++ {
+		res += (len(cexAsset.CollateralRatios[i]) + perElement - 1) / perElement
+	}
 	return res
 }
 
+// convertTierRatiosToVariables packs the tier ratios as utils.ConvertTierRatiosToBytes does
 func convertTierRatiosToVariables(api API, ratios []TierRatio, res []Variable) {
-	for i := 0; i < len(ratios); i += 2 {
-		v := api.Add(ratios[i].Ratio, api.Mul(ratios[i].BoundaryValue, utils.Uint8MaxValueFr))
-		v1 := api.Add(api.Mul(ratios[i+1].Ratio, utils.Uint126MaxValueFr), api.Mul(ratios[i+1].BoundaryValue, utils.Uint134MaxValueFr))
-		res[i/2] = api.Add(v, v1)
+	perElement := utils.TierRatiosPerElement()
+	for i := 0; i < len(ratios); i += perElement {
+		var v Variable = 0
+		for j := i; j < i+perElement && j < len(ratios); j++ {
+			shift := uint((j - i) * utils.TierRatioBits)
+			v = api.Add(v, api.Mul(ratios[j].Ratio, new(big.Int).Lsh(big.NewInt(1), shift)),
+				api.Mul(ratios[j].BoundaryValue, new(big.Int).Lsh(big.NewInt(1), shift+8)))
+		}
+		res[i/perElement] = v
 	}
 }
 
 func fillCexAssetCommitment(api API, asset CexAssetInfo, currentIndex int, commitments []Variable) {
 	counts := getVariableCountOfCexAsset(asset)
-	commitments[currentIndex*counts] = api.Add(api.Mul(asset.TotalEquity, utils.Uint64MaxValueFrSquare),
-		api.Mul(asset.TotalDebt, utils.Uint64MaxValueFr), asset.BasePrice)
+	commitments[currentIndex*counts] = api.Add(api.Mul(asset.TotalEquity, utils.Uint64MaxValueBigInt), asset.BasePrice)
+	commitments[currentIndex*counts+1] = asset.TotalDebt
 
-	commitments[currentIndex*counts+1] = api.Add(api.Mul(asset.LoanCollateral, utils.Uint64MaxValueFrSquare),
-		api.Mul(asset.MarginCollateral, utils.Uint64MaxValueFr), asset.PortfolioMarginCollateral)
+	position := currentIndex*counts + 2
+	for i := 0; i < len(asset.Collaterals); i++ {
+		commitments[position] = asset.Collaterals[i]
+		position += 1
+	}
 
-	convertTierRatiosToVariables(api, asset.LoanRatios, commitments[currentIndex*counts+2:])
-	convertTierRatiosToVariables(api, asset.MarginRatios, commitments[currentIndex*counts+2+len(asset.LoanRatios)/2:])
-	convertTierRatiosToVariables(api, asset.PortfolioMarginRatios, commitments[currentIndex*counts+2+len(asset.LoanRatios)/2+len(asset.MarginRatios)/2:])
+	for i := 0; i < len(asset.CollateralRatios); i++ {
+		convertTierRatiosToVariables(api, asset.CollateralRatios[i], commitments[position:])
+		position += (len(asset.CollateralRatios[i]) + utils.TierRatiosPerElement() - 1) / utils.TierRatiosPerElement()
+	}
 }
 
 func generateRapidArithmeticForCollateral(api API, r frontend.Rangechecker, tierRatios []TierRatio) {
 	tierRatios[0].PrecomputedValue = checkAndGetIntegerDivisionRes(api, r, api.Mul(tierRatios[0].BoundaryValue, tierRatios[0].Ratio))
-	api.AssertIsLessOrEqualNOp(tierRatios[0].Ratio, utils.PercentageMultiplierFr, 8, true)
-	api.AssertIsLessOrEqualNOp(tierRatios[0].BoundaryValue, utils.MaxTierBoundaryValueFr, 128, true)
+	api.AssertIsLessOrEqualNOp(tierRatios[0].Ratio, utils.PercentageMultiplier, 8, true)
+	api.AssertIsLessOrEqualNOp(tierRatios[0].BoundaryValue, utils.MaxTierBoundaryValue, 128, true)
 	for i := 1; i < len(tierRatios); i++ {
 		api.AssertIsLessOrEqualNOp(tierRatios[i-1].BoundaryValue, tierRatios[i].BoundaryValue, 128, true)
-		api.AssertIsLessOrEqualNOp(tierRatios[i].Ratio, utils.PercentageMultiplierFr, 8, true)
-		api.AssertIsLessOrEqualNOp(tierRatios[i].BoundaryValue, utils.MaxTierBoundaryValueFr, 128, true)
+		api.AssertIsLessOrEqualNOp(tierRatios[i].Ratio, utils.PercentageMultiplier, 8, true)
+		api.AssertIsLessOrEqualNOp(tierRatios[i].BoundaryValue, utils.MaxTierBoundaryValue, 128, true)
 		diffBoundary := api.Sub(tierRatios[i].BoundaryValue, tierRatios[i-1].BoundaryValue)
 		current := checkAndGetIntegerDivisionRes(api, r, api.Mul(diffBoundary, tierRatios[i].Ratio))
 		tierRatios[i].PrecomputedValue = api.Add(tierRatios[i-1].PrecomputedValue, current)
@@ -112,23 +127,26 @@ func IntegerDivision(_ *big.Int, in []*big.Int, out []*big.Int) error {
 func getAndCheckTierRatiosQueryResults(api API, r frontend.Rangechecker, tierRatiosTable *logderivlookup.Table,
 	assetIndex, userCollateral, collateralIndex, collateralFlag, assetPrice, collateralTierRatiosLen, maxCollateralTierIndex Variable) (collateralValueRes Variable) {
 	// Constrain collateralIndex to [0, maxCollateralTierIndex] to prevent cross-asset lookup table access.
-	api.AssertIsLessOrEqualNOp(collateralIndex, maxCollateralTierIndex, 4)
+	// collateralIndex is less than utils.TierCount, so it fits in the bits of utils.TierCount-1
+	api.AssertIsLessOrEqualNOp(collateralIndex, maxCollateralTierIndex, max(bits.Len(uint(utils.TierCount-1)), 1))
 	// Constrain collateralFlag to boolean
 	api.AssertIsBoolean(collateralFlag)
 	// Constrain flag semantics:
 	// when collateralFlag == 1, collateralIndex must point to the last tier.
 	api.AssertIsEqual(api.Mul(collateralFlag, api.Sub(collateralIndex, maxCollateralTierIndex)), 0)
 
-	// All indexes are shifted by 1 overall because we add a dummy tier ratio at the beginning
-	// 18 = 3 * 6: 3 means the number of collateral types, 6 means the number of tier ratios queries for each collateral type
+	// The table of the collateral category holds numOfTierRatioFields entries per tier ratio: the
+	// boundary value, the ratio and the precomputed value. All indexes are shifted by 1 overall
+	// because we add a dummy tier ratio at the beginning of each asset. The queries read the tier
+	// ratio at collateralIndex and the next one, so there are 2 * numOfTierRatioFields queries.
 	numOfTierRatioFields := 3
-	queries := make([]Variable, 6)
+	queries := make([]Variable, 2*numOfTierRatioFields)
 	gap := api.Mul(assetIndex, collateralTierRatiosLen)
 	collateralValue := api.Mul(userCollateral, assetPrice)
 	// When cv == 0, collateralIndex must be 0 (the dummy tier slot).
 	api.AssertIsEqual(api.Mul(api.IsZero(collateralValue), collateralIndex), 0)
 	for i := 0; i < 2; i++ {
-		startPosition := api.Mul(collateralIndex, 3)
+		startPosition := api.Mul(collateralIndex, numOfTierRatioFields)
 		queries[i*numOfTierRatioFields+0] = api.Add(startPosition, gap)
 		queries[i*numOfTierRatioFields+1] = api.Add(startPosition, api.Add(gap, 1))
 		queries[i*numOfTierRatioFields+2] = api.Add(startPosition, api.Add(gap, 2))
@@ -149,10 +167,11 @@ func getAndCheckTierRatiosQueryResults(api API, r frontend.Rangechecker, tierRat
 	gtDiff := api.Sub(collateralValue, api.Add(results[3], 1))
 	r.Check(api.Select(collateralFlag, gtDiff, leqDiff), 128)
 
-	// Keep the global cap for saturated branch:
-	// when flag=1, collateralValue must still be <= MaxTierBoundaryValue.
-	maxBoundaryDiff := api.Sub(utils.MaxTierBoundaryValueFr, collateralValue)
-	r.Check(api.Select(collateralFlag, maxBoundaryDiff, 0), 128)
+	// Global cap for both flag values: collateralValue <= MaxTierBoundaryValue.
+	// userCollateral fits in utils.BalanceBits and assetPrice in utils.PriceBits,
+	// so collateralValue is less than 2^192 and never wraps around the field, the
+	// difference fits in 128 bits only when collateralValue is at most the cap.
+	r.Check(api.Sub(utils.MaxTierBoundaryValue, collateralValue), 128)
 	// results[4] is ratio of upper boundary value
 	// diffValue = (collateralValue - lower boundary value) * ratio
 	diffValue := api.Mul(api.Sub(collateralValue, results[0]), results[4])
@@ -164,115 +183,324 @@ func getAndCheckTierRatiosQueryResults(api API, r frontend.Rangechecker, tierRat
 }
 
 func checkAndGetIntegerDivisionRes(api API, r frontend.Rangechecker, dividend Variable) (quotient Variable) {
-	quotientRes, err := api.NewHint(IntegerDivision, 2, dividend, utils.PercentageMultiplierFr)
+	quotientRes, err := api.NewHint(IntegerDivision, 2, dividend, utils.PercentageMultiplier)
 	if err != nil {
 		panic(err)
 	}
 	r.Check(quotientRes[0], 128)
 	r.Check(quotientRes[1], 8)
 	// remainder must satisfy 0 <= r < PercentageMultiplier
-	api.AssertIsEqual(api.CmpNOp(quotientRes[1], utils.PercentageMultiplierFr, 8, true), -1)
-	api.AssertIsEqual(api.Add(api.Mul(quotientRes[0], utils.PercentageMultiplierFr), quotientRes[1]), dividend)
+	api.AssertIsEqual(api.CmpNOp(quotientRes[1], utils.PercentageMultiplier, 8, true), -1)
+	api.AssertIsEqual(api.Add(api.Mul(quotientRes[0], utils.PercentageMultiplier), quotientRes[1]), dividend)
 	return quotientRes[0]
 }
 
-func constructLoanTierRatiosLookupTable(api API, cexAssetInfo []CexAssetInfo) *logderivlookup.Table {
+// constructTierRatiosLookupTable returns the tier ratios of the collateral
+// category of all the cex assets.
+func constructTierRatiosLookupTable(api API, cexAssetInfo []CexAssetInfo, category int) *logderivlookup.Table {
 	t := logderivlookup.New(api)
 	for i := 0; i < len(cexAssetInfo); i++ {
-		// dummy tier ratio
+		// dummy tier ratio, see getAndCheckTierRatiosQueryResults for the layout
 		for range 3 {
 			t.Insert(0)
 		}
-		for j := 0; j < len(cexAssetInfo[i].LoanRatios); j++ {
-			t.Insert(cexAssetInfo[i].LoanRatios[j].BoundaryValue)
-			t.Insert(cexAssetInfo[i].LoanRatios[j].Ratio)
-			t.Insert(cexAssetInfo[i].LoanRatios[j].PrecomputedValue)
+		tierRatios := cexAssetInfo[i].CollateralRatios[category]
+		for j := 0; j < len(tierRatios); j++ {
+			t.Insert(tierRatios[j].BoundaryValue)
+			t.Insert(tierRatios[j].Ratio)
+			t.Insert(tierRatios[j].PrecomputedValue)
 		}
 	}
 	return t
 }
 
-func constructMarginTierRatiosLookupTable(api API, cexAssetInfo []CexAssetInfo) *logderivlookup.Table {
-	t := logderivlookup.New(api)
-	for i := 0; i < len(cexAssetInfo); i++ {
-		// dummy tier ratio
-		for range 3 {
-			t.Insert(0)
+func calcAndSetCollateralInfo(assetIndex int, ua *UserAssetInfo, um *utils.AccountAsset, cexInfo []utils.CexAssetInfo) {
+	p := cexInfo[assetIndex]
+	assestPrice := new(big.Int).SetUint64(p.BasePrice)
+	ua.CollateralIndexes = make([]Variable, len(um.Collaterals))
+	ua.CollateralFlags = make([]Variable, len(um.Collaterals))
+	for c := 0; c < len(um.Collaterals); c++ {
+		userCollateral := um.Collaterals[c].Big()
+		userCollateral.Mul(userCollateral, assestPrice)
+		tierRatios := p.CollateralRatios[c]
+
+		var findFlag bool = false
+		for i := 0; i < len(tierRatios); i++ {
+			if userCollateral.Cmp(tierRatios[i].BoundaryValue) <= 0 {
+				ua.CollateralIndexes[c] = i
+				ua.CollateralFlags[c] = 0
+				findFlag = true
+				break
+			}
 		}
-		for j := 0; j < len(cexAssetInfo[i].MarginRatios); j++ {
-			t.Insert(cexAssetInfo[i].MarginRatios[j].BoundaryValue)
-			t.Insert(cexAssetInfo[i].MarginRatios[j].Ratio)
-			t.Insert(cexAssetInfo[i].MarginRatios[j].PrecomputedValue)
+		if !findFlag {
+			ua.CollateralIndexes[c] = len(tierRatios) - 1
+			ua.CollateralFlags[c] = 1
 		}
 	}
-	return t
 }
 
-func constructPortfolioTierRatiosLookupTable(api API, cexAssetInfo []CexAssetInfo) *logderivlookup.Table {
-	t := logderivlookup.New(api)
-	for i := 0; i < len(cexAssetInfo); i++ {
-		// dummy tier ratio
-		for range 3 {
-			t.Insert(0)
+// cexAssetsTables are the lookup tables of the cex assets shared by all the
+// users of a batch.
+type cexAssetsTables struct {
+	assetPrice       *logderivlookup.Table
+	tierRatios       []*logderivlookup.Table
+	collateralCounts int
+}
+
+// numOfAssetMetaFields returns the number of fields of one asset in the user
+// assets lookup table: equity, debt and the collaterals.
+func (t *cexAssetsTables) numOfAssetMetaFields() int {
+	return 2 + t.collateralCounts
+}
+
+func (t *cexAssetsTables) constructTierRatiosTables(api API, cexAssets []CexAssetInfo) {
+	t.tierRatios = make([]*logderivlookup.Table, t.collateralCounts)
+	for c := 0; c < t.collateralCounts; c++ {
+		t.tierRatios[c] = constructTierRatiosLookupTable(api, cexAssets, c)
+	}
+}
+
+// checkBeforeCexAssets range checks the cex assets of a batch and computes their
+// commitment. It returns a copy of the cex assets whose totals are updated by
+// the users of the batch, and the asset price table. The tier ratios tables
+// must be constructed after the commitment is checked.
+func checkBeforeCexAssets(api API, r frontend.Rangechecker, beforeCexAssets []CexAssetInfo, blinding Variable) (Variable, []CexAssetInfo, *cexAssetsTables) {
+	countOfCexAsset := getVariableCountOfCexAsset(beforeCexAssets[0])
+	collateralCounts := len(beforeCexAssets[0].Collaterals)
+	cexAssets := make([]Variable, len(beforeCexAssets)*countOfCexAsset)
+	afterCexAssets := make([]CexAssetInfo, len(beforeCexAssets))
+	tables := &cexAssetsTables{
+		assetPrice:       logderivlookup.New(api),
+		collateralCounts: collateralCounts,
+	}
+	for i := 0; i < len(beforeCexAssets); i++ {
+		labelCheck(api, i, "cex asset")
+		r.Check(beforeCexAssets[i].TotalEquity, utils.BalanceBits)
+		r.Check(beforeCexAssets[i].TotalDebt, utils.BalanceBits)
+		r.Check(beforeCexAssets[i].BasePrice, utils.PriceBits)
+		for c := 0; c < collateralCounts; c++ {
+			r.Check(beforeCexAssets[i].Collaterals[c], utils.BalanceBits)
+		}
+
+		fillCexAssetCommitment(api, beforeCexAssets[i], i, cexAssets)
+		for c := 0; c < collateralCounts; c++ {
+			generateRapidArithmeticForCollateral(api, r, beforeCexAssets[i].CollateralRatios[c])
 		}
-		for j := 0; j < len(cexAssetInfo[i].PortfolioMarginRatios); j++ {
-			t.Insert(cexAssetInfo[i].PortfolioMarginRatios[j].BoundaryValue)
-			t.Insert(cexAssetInfo[i].PortfolioMarginRatios[j].Ratio)
-			t.Insert(cexAssetInfo[i].PortfolioMarginRatios[j].PrecomputedValue)
+		afterCexAssets[i] = beforeCexAssets[i]
+		afterCexAssets[i].Collaterals = make([]Variable, collateralCounts)
+		copy(afterCexAssets[i].Collaterals, beforeCexAssets[i].Collaterals)
+
+		// the prices of the table are range checked above, so the products of the
+		// balances and the prices of the users take at most BalanceBits+PriceBits bits
+		tables.assetPrice.Insert(beforeCexAssets[i].BasePrice)
+	}
+	labelCheck(api, -1, "before cex assets commitment")
+	return hashCexAssets(api, cexAssets, blinding), afterCexAssets, tables
+}
+
+// computeAfterCexAssetsCommitment range checks the updated cex assets and
+// computes their commitment.
+func computeAfterCexAssetsCommitment(api API, r frontend.Rangechecker, afterCexAssets []CexAssetInfo, blinding Variable) Variable {
+	countOfCexAsset := getVariableCountOfCexAsset(afterCexAssets[0])
+	tempAfterCexAssets := make([]Variable, len(afterCexAssets)*countOfCexAsset)
+	for j := 0; j < len(afterCexAssets); j++ {
+		labelCheck(api, j, "after cex asset")
+		r.Check(afterCexAssets[j].TotalEquity, utils.BalanceBits)
+		r.Check(afterCexAssets[j].TotalDebt, utils.BalanceBits)
+		for c := 0; c < len(afterCexAssets[j].Collaterals); c++ {
+			r.Check(afterCexAssets[j].Collaterals[c], utils.BalanceBits)
 		}
+
+		fillCexAssetCommitment(api, afterCexAssets[j], j, tempAfterCexAssets)
 	}
-	return t
+	labelCheck(api, -1, "after cex assets commitment")
+	return hashCexAssets(api, tempAfterCexAssets, blinding)
 }
 
-func calcAndSetCollateralInfo(assetIndex int, ua *UserAssetInfo, um *utils.AccountAsset, cexInfo []utils.CexAssetInfo) {
-	p := cexInfo[assetIndex]
-	assestPrice := new(big.Int).SetUint64(p.BasePrice)
-	userLoanCollateral := new(big.Int).SetUint64(um.Loan)
-	userLoanCollateral.Mul(userLoanCollateral, assestPrice)
-	userMarginCollateral := new(big.Int).SetUint64(um.Margin)
-	userMarginCollateral.Mul(userMarginCollateral, assestPrice)
-	userPortfolioMarginCollateral := new(big.Int).SetUint64(um.PortfolioMargin)
-	userPortfolioMarginCollateral.Mul(userPortfolioMarginCollateral, assestPrice)
-
-	var findFlag bool = false
-	for i := 0; i < len(p.LoanRatios); i++ {
-		if userLoanCollateral.Cmp(p.LoanRatios[i].BoundaryValue) <= 0 {
-			ua.LoanCollateralIndex = i
-			ua.LoanCollateralFlag = 0
-			findFlag = true
-			break
+// hashCexAssets computes the cex assets commitment, the blinding factor is
+// appended if BlindCexAssetsCommitment is set, otherwise it must be zero.
+func hashCexAssets(api API, cexAssets []Variable, blinding Variable) Variable {
+	if utils.BlindCexAssetsCommitment {
+		return hashVariables(api, append(cexAssets, blinding)...)
+	}
+	api.AssertIsEqual(blinding, 0)
+	return hashVariables(api, cexAssets...)
+}
+
+// userAssetsCheckResult is computed by checkUserAssets for one user.
+type userAssetsCheckResult struct {
+	// the hash of the user asset indexes, it is a seed of the random challenge
+	assetIdHash Variable
+	// the queries and results of the user assets lookup table
+	queries []Variable
+	results []Variable
+	// the leaf of the user in the account tree
+	accountHash Variable
+	// the sum of the equity, debt and collaterals of the user assets,
+	// it is zero only for the padding accounts
+	assetsSum Variable
+}
+
+// checkUserAssets checks the assets of one user and computes the account hash.
+// The assets in assetsForUpdateCex are added to afterCexAssets, or subtracted
+// from them if subtract is true. assertUserAssetsForUpdateCex must be called
+// with the result to bind assetsForUpdateCex to the user assets.
+func checkUserAssets(api API, r frontend.Rangechecker, tables *cexAssetsTables, accountIdHash Variable,
+	userAssets []UserAssetInfo, assetsForUpdateCex []UserAssetMeta, afterCexAssets []CexAssetInfo, subtract bool) (res userAssetsCheckResult) {
+	collateralCounts := tables.collateralCounts
+	numOfAssetMetaFields := tables.numOfAssetMetaFields()
+	var totalUserEquity Variable = 0
+	var totalUserDebt Variable = 0
+	var totalUserCollateralRealValue Variable = 0
+	res.assetsSum = 0
+
+	// construct lookup table for user assets
+	userAssetsLookupTable := logderivlookup.New(api)
+	for j := 0; j < len(assetsForUpdateCex); j++ {
+		userAssetsLookupTable.Insert(assetsForUpdateCex[j].Equity)
+		userAssetsLookupTable.Insert(assetsForUpdateCex[j].Debt)
+		for c := 0; c < collateralCounts; c++ {
+			userAssetsLookupTable.Insert(assetsForUpdateCex[j].Collaterals[c])
 		}
 	}
-	if !findFlag {
-		ua.LoanCollateralIndex = len(p.LoanRatios) - 1
-		ua.LoanCollateralFlag = 1
+
+	// To check all the user assetIndexes are unique to each other.
+	// If the user assetIndex is increasing, Then all the assetIndexes are unique
+	for j := 0; j < len(userAssets)-1; j++ {
+		labelCheck(api, j+1, "asset index ordering")
+		r.Check(userAssets[j].AssetIndex, 16)
+		cr := api.CmpNOp(userAssets[j+1].AssetIndex, userAssets[j].AssetIndex, 16, true)
+		api.AssertIsEqual(cr, 1)
+	}
+	r.Check(userAssets[len(userAssets)-1].AssetIndex, 16)
+	labelCheck(api, -1, "")
+
+	// one Variable can store 15 assetIds of bn254 or bls12-381, one assetId is less than 16 bits
+	perElement := utils.PackingWidth(utils.AssetIndexBits)
+	assetIdsToVariables := make([]Variable, (len(userAssets)+perElement-1)/perElement)
+	for j := 0; j < len(assetIdsToVariables); j++ {
+		var v Variable = 0
+		for p := j * perElement; p < (j+1)*perElement && p < len(userAssets); p++ {
+			power := new(big.Int).Lsh(big.NewInt(1), uint(utils.AssetIndexBits*(p%perElement)))
+			v = api.Add(v, api.Mul(userAssets[p].AssetIndex, power))
+		}
+		assetIdsToVariables[j] = v
 	}
+	res.assetIdHash = hashVariables(api, assetIdsToVariables...)
 
-	findFlag = false
-	for i := 0; i < len(p.MarginRatios); i++ {
-		if userMarginCollateral.Cmp(p.MarginRatios[i].BoundaryValue) <= 0 {
-			ua.MarginCollateralIndex = i
-			ua.MarginCollateralFlag = 0
-			findFlag = true
-			break
+	// construct query to get user assets
+	res.queries = make([]Variable, len(userAssets)*numOfAssetMetaFields)
+	assetPriceQueries := make([]Variable, len(userAssets))
+	// asset index, equity, debt and the collaterals
+	numOfAssetsFields := numOfAssetMetaFields + 1
+	for j := 0; j < len(userAssets); j++ {
+		p := api.Mul(userAssets[j].AssetIndex, numOfAssetMetaFields)
+		for k := 0; k < numOfAssetMetaFields; k++ {
+			res.queries[j*numOfAssetMetaFields+k] = api.Add(p, k)
 		}
+		assetPriceQueries[j] = userAssets[j].AssetIndex
 	}
-	if !findFlag {
-		ua.MarginCollateralIndex = len(p.MarginRatios) - 1
-		ua.MarginCollateralFlag = 1
+	res.results = userAssetsLookupTable.Lookup(res.queries...)
+	assetPriceResponses := tables.assetPrice.Lookup(assetPriceQueries...)
+
+	flattenAssetFieldsForHash := make([]Variable, len(userAssets)*numOfAssetsFields)
+	for j := 0; j < len(userAssets); j++ {
+		labelCheck(api, j, "asset range")
+		// Equity
+		userEquity := res.results[j*numOfAssetMetaFields]
+		r.Check(userEquity, utils.BalanceBits)
+		// Debt
+		userDebt := res.results[j*numOfAssetMetaFields+1]
+		r.Check(userDebt, utils.BalanceBits)
+
+		flattenAssetFieldsForHash[j*numOfAssetsFields] = userAssets[j].AssetIndex
+		flattenAssetFieldsForHash[j*numOfAssetsFields+1] = userEquity
+		flattenAssetFieldsForHash[j*numOfAssetsFields+2] = userDebt
+
+		var assetTotalCollateral Variable = 0
+		flattenTierRatiosLength := 3 * (utils.TierCount + 1)
+		for c := 0; c < collateralCounts; c++ {
+			userCollateral := res.results[j*numOfAssetMetaFields+2+c]
+			r.Check(userCollateral, utils.BalanceBits)
+			flattenAssetFieldsForHash[j*numOfAssetsFields+3+c] = userCollateral
+			assetTotalCollateral = api.Add(assetTotalCollateral, userCollateral)
+
+			labelCheck(api, j, "collateral tier ratio")
+			collateralRealValue := getAndCheckTierRatiosQueryResults(api, r, tables.tierRatios[c], userAssets[j].AssetIndex,
+				userCollateral,
+				userAssets[j].CollateralIndexes[c],
+				userAssets[j].CollateralFlags[c],
+				assetPriceResponses[j],
+				flattenTierRatiosLength,
+				utils.TierCount-1)
+			totalUserCollateralRealValue = api.Add(totalUserCollateralRealValue, collateralRealValue)
+		}
+		labelCheck(api, j, "collateral <= equity")
+		r.Check(assetTotalCollateral, utils.BalanceBits)
+		api.AssertIsLessOrEqualNOp(assetTotalCollateral, userEquity, utils.BalanceBits, true)
+		// every addend is less than 2^128, so the sum never wraps around the field
+		res.assetsSum = api.Add(res.assetsSum, userEquity, userDebt, assetTotalCollateral)
+
+		totalUserEquity = api.Add(totalUserEquity, api.Mul(userEquity, assetPriceResponses[j]))
+		totalUserDebt = api.Add(totalUserDebt, api.Mul(userDebt, assetPriceResponses[j]))
 	}
 
-	findFlag = false
-	for i := 0; i < len(p.PortfolioMarginRatios); i++ {
-		if userPortfolioMarginCollateral.Cmp(p.PortfolioMarginRatios[i].BoundaryValue) <= 0 {
-			ua.PortfolioMarginCollateralIndex = i
-			ua.PortfolioMarginCollateralFlag = 0
-			findFlag = true
-			break
+	update := api.Add
+	if subtract {
+		update = api.Sub
+	}
+	for j := 0; j < len(assetsForUpdateCex); j++ {
+		afterCexAssets[j].TotalEquity = update(afterCexAssets[j].TotalEquity, assetsForUpdateCex[j].Equity)
+		afterCexAssets[j].TotalDebt = update(afterCexAssets[j].TotalDebt, assetsForUpdateCex[j].Debt)
+		for c := 0; c < collateralCounts; c++ {
+			afterCexAssets[j].Collaterals[c] = update(afterCexAssets[j].Collaterals[c], assetsForUpdateCex[j].Collaterals[c])
 		}
 	}
-	if !findFlag {
-		ua.PortfolioMarginCollateralIndex = len(p.PortfolioMarginRatios) - 1
-		ua.PortfolioMarginCollateralFlag = 1
+
+	// make sure user's total Debt is less or equal than total collateral
+	labelCheck(api, -1, "debt <= collateral value")
+	r.Check(totalUserDebt, userValueBits())
+	r.Check(totalUserCollateralRealValue, userValueBits())
+	api.AssertIsLessOrEqualNOp(totalUserDebt, totalUserCollateralRealValue, userValueBits(), true)
+	userAssetsCommitment := computeUserAssetsCommitment(api, flattenAssetFieldsForHash, numOfAssetsFields)
+	res.accountHash = hashVariables(api, accountIdHash, totalUserEquity, totalUserDebt, totalUserCollateralRealValue, userAssetsCommitment)
+	return res
+}
+
+// constructPowersOfRandomChallenge returns counts powers of the random challenge
+// and the lookup table of them.
+func constructPowersOfRandomChallenge(api API, randomChallenge Variable, counts int) ([]Variable, *logderivlookup.Table) {
+	powersOfRandomChallenge := make([]Variable, counts)
+	powersOfRandomChallenge[0] = randomChallenge
+	powersOfRandomChallengeLookupTable := logderivlookup.New(api)
+	powersOfRandomChallengeLookupTable.Insert(randomChallenge)
+	for i := 1; i < len(powersOfRandomChallenge); i++ {
+		powersOfRandomChallenge[i] = api.Mul(powersOfRandomChallenge[i-1], randomChallenge)
+		powersOfRandomChallengeLookupTable.Insert(powersOfRandomChallenge[i])
+	}
+	return powersOfRandomChallenge, powersOfRandomChallengeLookupTable
+}
+
+// assertUserAssetsForUpdateCex checks that the user assets looked up by
+// checkUserAssets contain all the non-zero assets of assetsForUpdateCex, using
+// a random linear combination of both.
+func assertUserAssetsForUpdateCex(api API, powersOfRandomChallenge []Variable, powersOfRandomChallengeLookupTable *logderivlookup.Table,
+	userAssets userAssetsCheckResult, assetsForUpdateCex []UserAssetMeta) {
+	powersOfRCResults := powersOfRandomChallengeLookupTable.Lookup(userAssets.queries...)
+	var sumA Variable = 0
+	for j := 0; j < len(powersOfRCResults); j++ {
+		sumA = api.Add(sumA, api.Mul(powersOfRCResults[j], userAssets.results[j]))
+	}
+
+	numOfAssetMetaFields := len(powersOfRandomChallenge) / len(assetsForUpdateCex)
+	var sumB Variable = 0
+	for j := 0; j < len(assetsForUpdateCex); j++ {
+		sumB = api.Add(sumB, api.Mul(assetsForUpdateCex[j].Equity, powersOfRandomChallenge[numOfAssetMetaFields*j]))
+		sumB = api.Add(sumB, api.Mul(assetsForUpdateCex[j].Debt, powersOfRandomChallenge[numOfAssetMetaFields*j+1]))
+		for c := 0; c < len(assetsForUpdateCex[j].Collaterals); c++ {
+			sumB = api.Add(sumB, api.Mul(assetsForUpdateCex[j].Collaterals[c], powersOfRandomChallenge[numOfAssetMetaFields*j+2+c]))
+		}
 	}
+	api.AssertIsEqual(sumA, sumB)
 }
@@ -16,6 +16,24 @@ import (
 	"github.com/consensys/gnark/std/rangecheck"
 )
 
+// the positions of the default collateral categories in utils.CollateralCategories
+const (
+	loanCategory = iota
+	marginCategory
+	portfolioMarginCategory
+)
+
+func newMockUserAssets(count int) ([]UserAssetInfo, []UserAssetMeta) {
+	assets := make([]UserAssetInfo, count)
+	metas := make([]UserAssetMeta, count)
+	for i := 0; i < count; i++ {
+		assets[i].CollateralIndexes = make([]Variable, 3)
+		assets[i].CollateralFlags = make([]Variable, 3)
+		metas[i].Collaterals = make([]Variable, 3)
+	}
+	return assets, metas
+}
+
 type MockCollateralCircuit struct {
 	UAssetInfo     []UserAssetInfo
 	UAssetMataInfo []UserAssetMeta
@@ -31,38 +49,38 @@ type MockCollateralCircuit struct {
 func (circuit MockCollateralCircuit) Define(api API) error {
 	r := rangecheck.New(api)
 	for i := 0; i < len(circuit.CAssetInfo); i++ {
-		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].LoanRatios)
-		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].MarginRatios)
-		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].PortfolioMarginRatios)
+		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].CollateralRatios[loanCategory])
+		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].CollateralRatios[marginCategory])
+		generateRapidArithmeticForCollateral(api, r, circuit.CAssetInfo[i].CollateralRatios[portfolioMarginCategory])
 	}
-	t0 := constructLoanTierRatiosLookupTable(api, circuit.CAssetInfo)
-	t1 := constructMarginTierRatiosLookupTable(api, circuit.CAssetInfo)
-	t2 := constructPortfolioTierRatiosLookupTable(api, circuit.CAssetInfo)
+	t0 := constructTierRatiosLookupTable(api, circuit.CAssetInfo, loanCategory)
+	t1 := constructTierRatiosLookupTable(api, circuit.CAssetInfo, marginCategory)
+	t2 := constructTierRatiosLookupTable(api, circuit.CAssetInfo, portfolioMarginCategory)
 
 	for i := 0; i < len(circuit.UAssetInfo); i++ {
 		realLoanCollateralValue := getAndCheckTierRatiosQueryResults(api, r, t0, circuit.UAssetInfo[i].AssetIndex,
-			circuit.UAssetMataInfo[i].LoanCollateral,
-			circuit.UAssetInfo[i].LoanCollateralIndex,
-			circuit.UAssetInfo[i].LoanCollateralFlag,
+			circuit.UAssetMataInfo[i].Collaterals[loanCategory],
+			circuit.UAssetInfo[i].CollateralIndexes[loanCategory],
+			circuit.UAssetInfo[i].CollateralFlags[loanCategory],
 			circuit.CAssetInfo[circuit.AssetId[i]].BasePrice,
-			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].LoanRatios)+1),
-			len(circuit.CAssetInfo[circuit.AssetId[i]].LoanRatios)-1)
+			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[loanCategory])+1),
+			len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[loanCategory])-1)
 
 		realMarginCollateralValue := getAndCheckTierRatiosQueryResults(api, r, t1, circuit.UAssetInfo[i].AssetIndex,
-			circuit.UAssetMataInfo[i].MarginCollateral,
-			circuit.UAssetInfo[i].MarginCollateralIndex,
-			circuit.UAssetInfo[i].MarginCollateralFlag,
+			circuit.UAssetMataInfo[i].Collaterals[marginCategory],
+			circuit.UAssetInfo[i].CollateralIndexes[marginCategory],
+			circuit.UAssetInfo[i].CollateralFlags[marginCategory],
 			circuit.CAssetInfo[circuit.AssetId[i]].BasePrice,
-			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].MarginRatios)+1),
-			len(circuit.CAssetInfo[circuit.AssetId[i]].MarginRatios)-1)
+			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[marginCategory])+1),
+			len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[marginCategory])-1)
 
 		realPortfolioMarginCollateralValue := getAndCheckTierRatiosQueryResults(api, r, t2, circuit.UAssetInfo[i].AssetIndex,
-			circuit.UAssetMataInfo[i].PortfolioMarginCollateral,
-			circuit.UAssetInfo[i].PortfolioMarginCollateralIndex,
-			circuit.UAssetInfo[i].PortfolioMarginCollateralFlag,
+			circuit.UAssetMataInfo[i].Collaterals[portfolioMarginCategory],
+			circuit.UAssetInfo[i].CollateralIndexes[portfolioMarginCategory],
+			circuit.UAssetInfo[i].CollateralFlags[portfolioMarginCategory],
 			circuit.CAssetInfo[circuit.AssetId[i]].BasePrice,
-			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].PortfolioMarginRatios)+1),
-			len(circuit.CAssetInfo[circuit.AssetId[i]].PortfolioMarginRatios)-1)
+			3*(len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[portfolioMarginCategory])+1),
+			len(circuit.CAssetInfo[circuit.AssetId[i]].CollateralRatios[portfolioMarginCategory])-1)
 
 		api.AssertIsEqual(circuit.ExpectedLoanCollateral[i], realLoanCollateralValue)
 		api.AssertIsEqual(circuit.ExpectedMarginCollateral[i], realMarginCollateralValue)
@@ -75,13 +93,14 @@ func TestMockCollateralCircuit(t *testing.T) {
 	var circuit MockCollateralCircuit
 	circuit.CAssetInfo = make([]CexAssetInfo, 5)
 	for i := 0; i < len(circuit.CAssetInfo); i++ {
-		circuit.CAssetInfo[i].LoanRatios = make([]TierRatio, 10)
-		circuit.CAssetInfo[i].MarginRatios = make([]TierRatio, 10)
-		circuit.CAssetInfo[i].PortfolioMarginRatios = make([]TierRatio, 10)
+		circuit.CAssetInfo[i].Collaterals = make([]Variable, 3)
+		circuit.CAssetInfo[i].CollateralRatios = make([][]TierRatio, 3)
+		circuit.CAssetInfo[i].CollateralRatios[loanCategory] = make([]TierRatio, 10)
+		circuit.CAssetInfo[i].CollateralRatios[marginCategory] = make([]TierRatio, 10)
+		circuit.CAssetInfo[i].CollateralRatios[portfolioMarginCategory] = make([]TierRatio, 10)
 	}
 	circuit.AssetId = make([]int, 2)
-	circuit.UAssetInfo = make([]UserAssetInfo, 2)
-	circuit.UAssetMataInfo = make([]UserAssetMeta, 2)
+	circuit.UAssetInfo, circuit.UAssetMataInfo = newMockUserAssets(2)
 	circuit.ExpectedLoanCollateral = make([]Variable, 2)
 	circuit.ExpectedMarginCollateral = make([]Variable, 2)
 	circuit.ExpectedPortfolioMarginCollateral = make([]Variable, 2)
@@ -100,76 +119,74 @@ func TestMockCollateralCircuit(t *testing.T) {
 		circuit2.CAssetInfo[i].TotalEquity = 0
 		circuit2.CAssetInfo[i].TotalDebt = 0
 		circuit2.CAssetInfo[i].BasePrice = 1
-		circuit2.CAssetInfo[i].LoanCollateral = 0
-		circuit2.CAssetInfo[i].MarginCollateral = 0
-		circuit2.CAssetInfo[i].PortfolioMarginCollateral = 0
+		circuit2.CAssetInfo[i].Collaterals = []Variable{0, 0, 0}
+		circuit2.CAssetInfo[i].CollateralRatios = make([][]TierRatio, 3)
 
-		circuit2.CAssetInfo[i].LoanRatios = make([]TierRatio, 10)
+		circuit2.CAssetInfo[i].CollateralRatios[loanCategory] = make([]TierRatio, 10)
 		for j := 0; j < 10; j++ {
-			circuit2.CAssetInfo[i].LoanRatios[j].BoundaryValue = 10000 * (j + 1)
+			circuit2.CAssetInfo[i].CollateralRatios[loanCategory][j].BoundaryValue = 10000 * (j + 1)
 			ratio := 100 - j*10
-			circuit2.CAssetInfo[i].LoanRatios[j].Ratio = ratio
-			circuit2.CAssetInfo[i].LoanRatios[j].PrecomputedValue = 0
+			circuit2.CAssetInfo[i].CollateralRatios[loanCategory][j].Ratio = ratio
+			circuit2.CAssetInfo[i].CollateralRatios[loanCategory][j].PrecomputedValue = 0
 		}
 
-		circuit2.CAssetInfo[i].MarginRatios = make([]TierRatio, 10)
+		circuit2.CAssetInfo[i].CollateralRatios[marginCategory] = make([]TierRatio, 10)
 		for j := 0; j < 10; j++ {
-			circuit2.CAssetInfo[i].MarginRatios[j].BoundaryValue = 20001 * (j + 1)
+			circuit2.CAssetInfo[i].CollateralRatios[marginCategory][j].BoundaryValue = 20001 * (j + 1)
 			ratio := 100 - j*9
-			circuit2.CAssetInfo[i].MarginRatios[j].Ratio = ratio
-			circuit2.CAssetInfo[i].MarginRatios[j].PrecomputedValue = 0
+			circuit2.CAssetInfo[i].CollateralRatios[marginCategory][j].Ratio = ratio
+			circuit2.CAssetInfo[i].CollateralRatios[marginCategory][j].PrecomputedValue = 0
 		}
 
-		circuit2.CAssetInfo[i].PortfolioMarginRatios = make([]TierRatio, 10)
+		circuit2.CAssetInfo[i].CollateralRatios[portfolioMarginCategory] = make([]TierRatio, 10)
 		for j := 0; j < 10; j++ {
-			circuit2.CAssetInfo[i].PortfolioMarginRatios[j].BoundaryValue = 30000 * (j + 1)
+			circuit2.CAssetInfo[i].CollateralRatios[portfolioMarginCategory][j].BoundaryValue = 30000 * (j + 1)
 			ratio := 100 - j*8
-			circuit2.CAssetInfo[i].PortfolioMarginRatios[j].Ratio = ratio
-			circuit2.CAssetInfo[i].PortfolioMarginRatios[j].PrecomputedValue = 0
+			circuit2.CAssetInfo[i].CollateralRatios[portfolioMarginCategory][j].Ratio = ratio
+			circuit2.CAssetInfo[i].CollateralRatios[portfolioMarginCategory][j].PrecomputedValue = 0
 		}
 	}
 
 	circuit2.AssetId = []int{0, 1}
-	circuit2.UAssetInfo = make([]UserAssetInfo, 2)
-	circuit2.UAssetMataInfo = make([]UserAssetMeta, 2)
+	circuit2.UAssetInfo, circuit2.UAssetMataInfo = newMockUserAssets(2)
 	circuit2.ExpectedMarginCollateral = make([]Variable, 2)
 	circuit2.ExpectedLoanCollateral = make([]Variable, 2)
 	circuit2.ExpectedPortfolioMarginCollateral = make([]Variable, 2)
 
 	circuit2.UAssetMataInfo[0].Equity = 0
 	circuit2.UAssetMataInfo[0].Debt = 0
-	circuit2.UAssetMataInfo[0].LoanCollateral = 9000
+	circuit2.UAssetMataInfo[0].Collaterals[loanCategory] = 9000
 	circuit2.UAssetInfo[0].AssetIndex = 0
-	circuit2.UAssetInfo[0].LoanCollateralIndex = 0
-	circuit2.UAssetInfo[0].LoanCollateralFlag = 0
+	circuit2.UAssetInfo[0].CollateralIndexes[loanCategory] = 0
+	circuit2.UAssetInfo[0].CollateralFlags[loanCategory] = 0
 	circuit2.ExpectedLoanCollateral[0] = 9000
 
-	circuit2.UAssetMataInfo[0].MarginCollateral = 39000
-	circuit2.UAssetInfo[0].MarginCollateralIndex = 1
-	circuit2.UAssetInfo[0].MarginCollateralFlag = 0
+	circuit2.UAssetMataInfo[0].Collaterals[marginCategory] = 39000
+	circuit2.UAssetInfo[0].CollateralIndexes[marginCategory] = 1
+	circuit2.UAssetInfo[0].CollateralFlags[marginCategory] = 0
 	circuit2.ExpectedMarginCollateral[0] = 37290
 
-	circuit2.UAssetMataInfo[0].PortfolioMarginCollateral = 300100
-	circuit2.UAssetInfo[0].PortfolioMarginCollateralIndex = 9
-	circuit2.UAssetInfo[0].PortfolioMarginCollateralFlag = 1
+	circuit2.UAssetMataInfo[0].Collaterals[portfolioMarginCategory] = 300100
+	circuit2.UAssetInfo[0].CollateralIndexes[portfolioMarginCategory] = 9
+	circuit2.UAssetInfo[0].CollateralFlags[portfolioMarginCategory] = 1
 	circuit2.ExpectedPortfolioMarginCollateral[0] = 192000
 
 	circuit2.UAssetMataInfo[1].Equity = 0
 	circuit2.UAssetMataInfo[1].Debt = 0
-	circuit2.UAssetMataInfo[1].LoanCollateral = 100001
+	circuit2.UAssetMataInfo[1].Collaterals[loanCategory] = 100001
 	circuit2.UAssetInfo[1].AssetIndex = 1
-	circuit2.UAssetInfo[1].LoanCollateralIndex = 9
-	circuit2.UAssetInfo[1].LoanCollateralFlag = 1
+	circuit2.UAssetInfo[1].CollateralIndexes[loanCategory] = 9
+	circuit2.UAssetInfo[1].CollateralFlags[loanCategory] = 1
 	circuit2.ExpectedLoanCollateral[1] = 55000
 
-	circuit2.UAssetMataInfo[1].MarginCollateral = 10000
-	circuit2.UAssetInfo[1].MarginCollateralIndex = 0
-	circuit2.UAssetInfo[1].MarginCollateralFlag = 0
+	circuit2.UAssetMataInfo[1].Collaterals[marginCategory] = 10000
+	circuit2.UAssetInfo[1].CollateralIndexes[marginCategory] = 0
+	circuit2.UAssetInfo[1].CollateralFlags[marginCategory] = 0
 	circuit2.ExpectedMarginCollateral[1] = 10000
 
-	circuit2.UAssetMataInfo[1].PortfolioMarginCollateral = 200000
-	circuit2.UAssetInfo[1].PortfolioMarginCollateralIndex = 6
-	circuit2.UAssetInfo[1].PortfolioMarginCollateralFlag = 0
+	circuit2.UAssetMataInfo[1].Collaterals[portfolioMarginCategory] = 200000
+	circuit2.UAssetInfo[1].CollateralIndexes[portfolioMarginCategory] = 6
+	circuit2.UAssetInfo[1].CollateralFlags[portfolioMarginCategory] = 0
 	circuit2.ExpectedPortfolioMarginCollateral[1] = 154400
 
 	witness, err := frontend.NewWitness(&circuit2, ecc.BN254.ScalarField())
@@ -219,19 +236,19 @@ type MockCollateralFlagBypassCircuit struct {
 
 func (circuit MockCollateralFlagBypassCircuit) Define(api API) error {
 	r := rangecheck.New(api)
-	generateRapidArithmeticForCollateral(api, r, circuit.CAsset.LoanRatios)
-	t := constructLoanTierRatiosLookupTable(api, []CexAssetInfo{circuit.CAsset})
+	generateRapidArithmeticForCollateral(api, r, circuit.CAsset.CollateralRatios[loanCategory])
+	t := constructTierRatiosLookupTable(api, []CexAssetInfo{circuit.CAsset}, loanCategory)
 	realLoanCollateralValue := getAndCheckTierRatiosQueryResults(
 		api,
 		r,
 		t,
 		circuit.Asset.AssetIndex,
-		circuit.AssetMeta.LoanCollateral,
-		circuit.Asset.LoanCollateralIndex,
-		circuit.Asset.LoanCollateralFlag,
+		circuit.AssetMeta.Collaterals[loanCategory],
+		circuit.Asset.CollateralIndexes[loanCategory],
+		circuit.Asset.CollateralFlags[loanCategory],
 		circuit.CAsset.BasePrice,
-		3*(len(circuit.CAsset.LoanRatios)+1),
-		len(circuit.CAsset.LoanRatios)-1,
+		3*(len(circuit.CAsset.CollateralRatios[loanCategory])+1),
+		len(circuit.CAsset.CollateralRatios[loanCategory])-1,
 	)
 	api.AssertIsEqual(circuit.Expected, realLoanCollateralValue)
 	return nil
@@ -244,8 +261,16 @@ func TestCollateralFlagBypassShouldFail(t *testing.T) {
 	solver.RegisterHint(IntegerDivision)
 
 	circuit := MockCollateralFlagBypassCircuit{
+		Asset: UserAssetInfo{
+			CollateralIndexes: make([]Variable, 3),
+			CollateralFlags:   make([]Variable, 3),
+		},
+		AssetMeta: UserAssetMeta{
+			Collaterals: make([]Variable, 3),
+		},
 		CAsset: CexAssetInfo{
-			LoanRatios: make([]TierRatio, 2),
+			Collaterals:      make([]Variable, 3),
+			CollateralRatios: [][]TierRatio{make([]TierRatio, 2)},
 		},
 	}
 	oR1cs, err := frontend.Compile(
@@ -260,38 +285,32 @@ func TestCollateralFlagBypassShouldFail(t *testing.T) {
 
 	witness := MockCollateralFlagBypassCircuit{
 		Asset: UserAssetInfo{
-			AssetIndex:                     0,
-			LoanCollateralIndex:            0,
-			LoanCollateralFlag:             1, // malicious: should only be valid on final tier and x > final boundary
-			MarginCollateralIndex:          0,
-			MarginCollateralFlag:           0,
-			PortfolioMarginCollateralIndex: 0,
-			PortfolioMarginCollateralFlag:  0,
+			AssetIndex:        0,
+			CollateralIndexes: []Variable{0, 0, 0},
+			CollateralFlags:   []Variable{1, 0, 0}, // malicious: should only be valid on final tier and x > final boundary
 		},
 		AssetMeta: UserAssetMeta{
-			Equity:                    0,
-			Debt:                      0,
-			LoanCollateral:            50,
-			MarginCollateral:          0,
-			PortfolioMarginCollateral: 0,
+			Equity:      0,
+			Debt:        0,
+			Collaterals: []Variable{50, 0, 0},
 		},
 		CAsset: CexAssetInfo{
-			TotalEquity:               0,
-			TotalDebt:                 0,
-			BasePrice:                 1,
-			LoanCollateral:            0,
-			MarginCollateral:          0,
-			PortfolioMarginCollateral: 0,
-			LoanRatios: []TierRatio{
-				{
-					BoundaryValue:    100,
-					Ratio:            100,
-					PrecomputedValue: 0,
-				},
+			TotalEquity: 0,
+			TotalDebt:   0,
+			BasePrice:   1,
+			Collaterals: []Variable{0, 0, 0},
+			CollateralRatios: [][]TierRatio{
 				{
-					BoundaryValue:    200,
-					Ratio:            100,
-					PrecomputedValue: 0,
+					{
+						BoundaryValue:    100,
+						Ratio:            100,
+						PrecomputedValue: 0,
+					},
+					{
+						BoundaryValue:    200,
+						Ratio:            100,
+						PrecomputedValue: 0,
+					},
 				},
 			},
 		},
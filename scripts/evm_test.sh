@@ -0,0 +1,176 @@
+#!/bin/bash
+set -euo pipefail
+
+##############################################################################
+# PoR EVM Test
+#
+# Runs keygen -> witness -> dbtool -> prover -> verifier on the sample data
+# with a groth16_evm or plonk_evm backend, then verifies the proofs of the
+# prover with the Solidity verifiers exported by keygen on a simulated chain
+# (TestBatchProofsOnSimulatedChain in test/evm).
+#
+# Prerequisites: go 1.22+, solc, a mysql and a redis server
+# Usage: BACKEND=plonk_evm ./scripts/evm_test.sh
+##############################################################################
+
+# --- Configuration ---
+PROJECT_ROOT="$(cd "$(dirname "$0")/.." && pwd)"
+BACKEND="${BACKEND:-groth16_evm}"
+WORK_DIR="${PROJECT_ROOT}/_evm_test_${BACKEND}"
+TEST_TIERS="50:20"
+ZK_KEY_NAME="zkpor50_20"
+MYSQL_DSN="${TEST_MYSQL_DSN:-zkpos:zkpos@123@tcp(127.0.0.1:3306)/zkpos?parseTime=true}"
+REDIS_ADDR="${TEST_REDIS_ADDR:-127.0.0.1:6379}"
+DB_SUFFIX="evm"
+witness_done_marker=/tmp/witness_done_evm
+
+KEYGEN_FLAGS=(-backend "$BACKEND")
+case "$BACKEND" in
+    groth16_evm) ;;
+    plonk_evm)
+        ZK_KEY_NAME="${ZK_KEY_NAME}_plonk"
+        KEYGEN_FLAGS+=(-unsafe_srs)
+        ;;
+    *)
+        echo "ERROR: BACKEND must be groth16_evm or plonk_evm, got ${BACKEND}"
+        exit 1
+        ;;
+esac
+
+# --- Helper functions ---
+log() { echo "=== [$(date '+%H:%M:%S')] $*"; }
+log_step() { echo ""; echo "###############################################"; log "$*"; echo "###############################################"; }
+
+write_config() {
+    local config_content="$1"
+    mkdir -p "${WORK_DIR}/config"
+    echo "$config_content" > "${WORK_DIR}/config/config.json"
+}
+
+db_config() {
+    cat <<EOF
+{
+    "MysqlDataSource": "${MYSQL_DSN}",
+    "DbSuffix": "${DB_SUFFIX}",
+    "Redis": {
+        "Host": "${REDIS_ADDR}",
+        "Password": ""
+    }
+}
+EOF
+}
+
+# --- Step 0: Clean up previous run ---
+log_step "Step 0: Cleaning up previous run"
+rm -rf "${WORK_DIR}/config"
+rm -f "$witness_done_marker"
+
+# --- Step 1: Build all service binaries ---
+log_step "Step 1: Building service binaries"
+
+mkdir -p "$WORK_DIR"
+cd "$PROJECT_ROOT"
+go build -o "${WORK_DIR}/keygen"   ./src/keygen
+go build -o "${WORK_DIR}/witness"  ./src/witness
+go build -o "${WORK_DIR}/dbtool"   ./src/dbtool
+go build -o "${WORK_DIR}/prover"   ./src/prover
+go build -o "${WORK_DIR}/verifier" ./src/verifier
+log "All binaries built"
+
+cd "$WORK_DIR"
+write_config "$(db_config)"
+./dbtool -delete_all
+
+# --- Step 2: Keygen and Solidity verifier ---
+log_step "Step 2: Keygen (${BACKEND})"
+
+ZKPOR_TEST_TIERS="$TEST_TIERS" ./keygen "${KEYGEN_FLAGS[@]}"
+ZKPOR_TEST_TIERS="$TEST_TIERS" ./keygen -backend "$BACKEND" -solidity
+log "Keygen complete, exported ${ZK_KEY_NAME}.sol"
+
+# --- Step 3: Run witness ---
+log_step "Step 3: Running witness"
+
+write_config "$(cat <<EOF
+{
+    "MysqlDataSource": "${MYSQL_DSN}",
+    "DbSuffix": "${DB_SUFFIX}",
+    "UserDataFile": "${PROJECT_ROOT}/src/sampledata",
+    "SnapshotId": "20240131-1"
+}
+EOF
+)"
+
+ZKPOR_TEST_TIERS="$TEST_TIERS" ./witness -witness_done_marker "$witness_done_marker" &
+WITNESS_PID=$!
+while [ ! -f "$witness_done_marker" ]; do
+    if ! kill -0 $WITNESS_PID 2>/dev/null; then
+        [ -f "$witness_done_marker" ] && break
+        echo "ERROR: witness process exited before witness generation completed"
+        exit 1
+    fi
+    sleep 1
+done
+rm -f "$witness_done_marker"
+log "Witness complete"
+
+# --- Step 4: Push tasks to Redis ---
+log_step "Step 4: Pushing tasks to Redis"
+
+write_config "$(db_config)"
+./dbtool -push_task_to_redis
+
+# --- Step 5: Run prover ---
+log_step "Step 5: Running prover"
+
+write_config "$(cat <<EOF
+{
+    "MysqlDataSource": "${MYSQL_DSN}",
+    "DbSuffix": "${DB_SUFFIX}",
+    "Redis": {
+        "Host": "${REDIS_ADDR}",
+        "Password": ""
+    },
+    "Backend": "${BACKEND}",
+    "ZkKeyName": ["${ZK_KEY_NAME}"],
+    "AssetsCountTiers": [50]
+}
+EOF
+)"
+
+ZKPOR_TEST_TIERS="$TEST_TIERS" ./prover
+wait $WITNESS_PID
+log "Prover complete"
+
+# --- Step 6: Export proofs to CSV ---
+log_step "Step 6: Exporting proofs to CSV"
+
+write_config "$(db_config)"
+./dbtool -export_proof_csv config/proof.csv
+CEX_ASSETS_JSON=$(./dbtool -query_cex_assets)
+
+# --- Step 7: Batch verification and calldata ---
+log_step "Step 7: Batch proof verification"
+
+cat > "${WORK_DIR}/config/config.json" <<EOF
+{
+    "ProofTable": "config/proof.csv",
+    "ZkKeyName": ["${ZK_KEY_NAME}"],
+    "AssetsCountTiers": [50],
+    "CexAssetsInfo": ${CEX_ASSETS_JSON}
+}
+EOF
+
+./verifier
+./verifier -calldata config/calldata.csv
+log "Batch verification PASSED"
+
+# --- Step 8: On chain verification ---
+log_step "Step 8: Verifying the proofs on a simulated chain"
+
+cd "${PROJECT_ROOT}/test/evm"
+ZKPOR_TEST_VERIFIER_CONFIG="${WORK_DIR}/config/config.json" \
+    go test -v -run TestBatchProofsOnSimulatedChain -count=1 -timeout 600s
+
+# --- Done ---
+log_step "EVM test PASSED"
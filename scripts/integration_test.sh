@@ -152,7 +152,8 @@ write_config "$(cat <<EOF
 {
     "MysqlDataSource": "${MYSQL_DSN}",
     "DbSuffix": "${DB_SUFFIX}",
-    "UserDataFile": "${PROJECT_ROOT}/src/userdata"
+    "UserDataFile": "${PROJECT_ROOT}/src/userdata",
+    "SnapshotId": "20240131-1"
 }
 EOF
 )"
@@ -81,7 +81,8 @@ write_witness_config() {
 {
     "MysqlDataSource": "${MYSQL_DSN}",
     "DbSuffix": "${DB_SUFFIX}",
-    "UserDataFile": "${PROJECT_ROOT}/src/userdata"
+    "UserDataFile": "${PROJECT_ROOT}/src/userdata",
+    "SnapshotId": "20240131-1"
 }
 EOF
 }
@@ -0,0 +1,18 @@
+package config
+
+type Config struct {
+	// ProofTable is the batch proof table exported by dbtool
+	ProofTable string
+	// ZkKeyName are the plonk keys of the batch circuit of every tier
+	ZkKeyName        []string
+	AssetsCountTiers []int
+	// AggregationArity is the number of proofs verified by one aggregation
+	// proof, AggregationLevels is the number of levels of the aggregation tree,
+	// so up to AggregationArity^AggregationLevels batches can be aggregated
+	AggregationArity   int
+	AggregationLevels  int
+	AggregationKeyName string
+	AggregatedProof    string
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+}
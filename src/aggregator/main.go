@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/aggregator/config"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/gocarina/gocsv"
+)
+
+type Proof struct {
+	BatchNumber        int64    `csv:"batch_number"`
+	ZkProof            string   `csv:"proof_info"`
+	CexAssetCommitment []string `csv:"cex_asset_list_commitments"`
+	AccountTreeRoots   []string `csv:"account_tree_roots"`
+	BatchCommitment    string   `csv:"batch_commitment"`
+	MinAccountIndex    uint32   `csv:"min_account_index"`
+	MaxAccountIndex    uint32   `csv:"max_account_index"`
+	UserCount          uint32   `csv:"user_count"`
+	SnapshotId         uint64   `csv:"snapshot_id"`
+	AccountIdsCheck    string   `csv:"account_ids_check"`
+	AssetsCount        int      `csv:"assets_count"`
+	Backend            string   `csv:"backend"`
+}
+
+func loadProofTable(fileName string) []Proof {
+	f, err := os.Open(fileName)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer f.Close()
+	tmpProofs := []*Proof{}
+	err = gocsv.UnmarshalFile(f, &tmpProofs)
+	if err != nil {
+		panic(err.Error())
+	}
+	proofs := make([]Proof, len(tmpProofs))
+	for i := 0; i < len(tmpProofs); i++ {
+		if tmpProofs[i].BatchNumber < 0 || int(tmpProofs[i].BatchNumber) >= len(proofs) {
+			panic("invalid batch number: " + strconv.FormatInt(tmpProofs[i].BatchNumber, 10))
+		}
+		proofs[tmpProofs[i].BatchNumber] = *tmpProofs[i]
+	}
+	return proofs
+}
+
+func loadBatchVerifyingKeys(aggregatorConfig *config.Config) []plonk.VerifyingKey {
+	vks := make([]plonk.VerifyingKey, len(aggregatorConfig.ZkKeyName))
+	for i := 0; i < len(aggregatorConfig.ZkKeyName); i++ {
+		content, err := os.ReadFile(aggregatorConfig.ZkKeyName[i] + ".vk")
+		if err != nil {
+			panic(err.Error())
+		}
+		vks[i] = plonk.NewVerifyingKey(ecc.BN254)
+		_, err = vks[i].ReadFrom(bytes.NewBuffer(content))
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	return vks
+}
+
+// getVerifyingKeyIndexes returns the tier of every batch, which selects the
+// verifying key used for it in the aggregation circuit.
+func getVerifyingKeyIndexes(proofs []Proof, assetsCountTiers []int) []int {
+	vkIndexes := make([]int, len(proofs))
+	for i := 0; i < len(proofs); i++ {
+		backend, err := circuit.ParseProvingBackend(proofs[i].Backend)
+		if err != nil {
+			panic(err.Error())
+		}
+		if backend != circuit.PlonkBackend {
+			panic("only plonk batch proofs can be aggregated, batch " + strconv.Itoa(i) + " is " + backend)
+		}
+		vkIndexes[i] = -1
+		for p := 0; p < len(assetsCountTiers); p++ {
+			if assetsCountTiers[p] == proofs[i].AssetsCount {
+				vkIndexes[i] = p
+				break
+			}
+		}
+		if vkIndexes[i] == -1 {
+			panic("invalid asset counts tier of batch " + strconv.Itoa(i))
+		}
+	}
+	return vkIndexes
+}
+
+func decodeBatchProofs(proofs []Proof, vkIndexes []int) ([]byte, []circuit.BatchProofWitness) {
+	var accountTreeRoot []byte
+	batches := make([]circuit.BatchProofWitness, len(proofs))
+	for i := 0; i < len(proofs); i++ {
+		proofRaw, err := base64.StdEncoding.DecodeString(proofs[i].ZkProof)
+		if err != nil {
+			panic("decode proof " + strconv.Itoa(i) + " failed: " + err.Error())
+		}
+		batches[i].Proof = plonk.NewProof(ecc.BN254)
+		_, err = batches[i].Proof.ReadFrom(bytes.NewBuffer(proofRaw))
+		if err != nil {
+			panic("deserialize proof " + strconv.Itoa(i) + " failed: " + err.Error())
+		}
+		batches[i].VerifyingKeyIndex = vkIndexes[i]
+		if len(proofs[i].CexAssetCommitment) != 2 || len(proofs[i].AccountTreeRoots) != 1 {
+			panic("invalid commitments of batch " + strconv.Itoa(i))
+		}
+		batches[i].BeforeCEXAssetsCommitment, err = base64.StdEncoding.DecodeString(proofs[i].CexAssetCommitment[0])
+		if err != nil {
+			panic(err.Error())
+		}
+		batches[i].AfterCEXAssetsCommitment, err = base64.StdEncoding.DecodeString(proofs[i].CexAssetCommitment[1])
+		if err != nil {
+			panic(err.Error())
+		}
+		batches[i].MinAccountIndex = proofs[i].MinAccountIndex
+		batches[i].MaxAccountIndex = proofs[i].MaxAccountIndex
+		batches[i].UserCount = proofs[i].UserCount
+		batches[i].SnapshotId = proofs[i].SnapshotId
+		if err = json.Unmarshal([]byte(proofs[i].AccountIdsCheck), &batches[i].AccountIds); err != nil {
+			panic("decode account ids check " + strconv.Itoa(i) + " failed: " + err.Error())
+		}
+		// all batches share the same account tree root, which is enforced by the
+		// aggregation circuit
+		if i == 0 {
+			accountTreeRoot, err = base64.StdEncoding.DecodeString(proofs[i].AccountTreeRoots[0])
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+	}
+	return accountTreeRoot, batches
+}
+
+// setup generates the keys of the aggregation circuit of every level, the
+// circuit of level l verifies the proofs of the circuit of level l-1 with the
+// verifying key generated just before.
+func setup(aggregatorConfig *config.Config, srsFile string, unsafeSrs bool) {
+	var vk plonk.VerifyingKey
+	unsafeKzgSrs, err := circuit.NewUnsafeKzgSrs()
+	if err != nil {
+		panic(err)
+	}
+	for level := 0; level < aggregatorConfig.AggregationLevels; level++ {
+		var aggregationCircuit frontend.Circuit
+		var err error
+		if level == 0 {
+			aggregationCircuit, err = circuit.NewBatchProofsAggregationCircuit(loadBatchVerifyingKeys(aggregatorConfig), aggregatorConfig.AggregationArity)
+		} else {
+			aggregationCircuit, err = circuit.NewAggregationNodeCircuit(vk, aggregatorConfig.AggregationArity)
+		}
+		if err != nil {
+			panic(err.Error())
+		}
+		keyName := circuit.AggregationKeyName(aggregatorConfig.AggregationKeyName, level)
+		startTime := time.Now()
+		ccs, err := circuit.Compile(circuit.PlonkBackend, aggregationCircuit)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("constraint system generation time is ", time.Since(startTime))
+		fmt.Println("aggregation level ", level, " constraints number is ", ccs.GetNbConstraints())
+		var srs, srsLagrange kzg.SRS
+		if srsFile != "" {
+			srs, srsLagrange, err = circuit.LoadKzgSrs(srsFile, ccs)
+		} else {
+			fmt.Println("WARNING: using a locally generated kzg srs, the keys must not be used in production")
+			srs, srsLagrange, err = unsafeKzgSrs.Truncate(ccs)
+		}
+		if err != nil {
+			panic(err)
+		}
+		pk, levelVk, err := circuit.Setup(circuit.PlonkBackend, ccs, srs, srsLagrange)
+		if err != nil {
+			panic(err)
+		}
+		vk = levelVk.(plonk.VerifyingKey)
+		files := map[string]io.WriterTo{
+			keyName + ".pk": pk,
+			keyName + ".vk": vk,
+			keyName + circuit.ConstraintSystemFileSuffix(circuit.PlonkBackend): ccs,
+		}
+		for fileName, v := range files {
+			f, err := os.Create(fileName)
+			if err != nil {
+				panic(err)
+			}
+			n, err := v.WriteTo(f)
+			if err != nil {
+				panic(err)
+			}
+			f.Close()
+			fmt.Println(fileName, " size is ", n)
+		}
+		if err = utils.WriteCircuitParams(keyName + utils.CircuitParamsFileSuffix); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func loadAggregationKeys(keyName string) (constraint.ConstraintSystem, circuit.ProvingKey, circuit.VerifyingKey) {
+	if err := utils.CheckCircuitParamsOfKey(keyName); err != nil {
+		panic(err)
+	}
+	ccs := circuit.NewConstraintSystem(circuit.PlonkBackend)
+	pk := circuit.NewProvingKey(circuit.PlonkBackend)
+	vk := circuit.NewVerifyingKey(circuit.PlonkBackend)
+	for fileName, v := range map[string]io.ReaderFrom{
+		keyName + circuit.ConstraintSystemFileSuffix(circuit.PlonkBackend): ccs,
+		keyName + ".pk": pk,
+		keyName + ".vk": vk,
+	} {
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = v.ReadFrom(bytes.NewBuffer(content)); err != nil {
+			panic(err)
+		}
+	}
+	return ccs, pk, vk
+}
+
+func proveAggregation(ccs constraint.ConstraintSystem, pk circuit.ProvingKey, vk circuit.VerifyingKey, assignment frontend.Circuit) plonk.Proof {
+	fullWitness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		panic(err)
+	}
+	publicWitness, err := fullWitness.Public()
+	if err != nil {
+		panic(err)
+	}
+	proof, err := circuit.Prove(circuit.PlonkBackend, ccs, pk, fullWitness)
+	if err != nil {
+		panic(err)
+	}
+	if err = circuit.Verify(circuit.PlonkBackend, proof, vk, publicWitness); err != nil {
+		panic(err)
+	}
+	return proof.(plonk.Proof)
+}
+
+// prove aggregates the batches by chunks of arity at level 0, then the
+// aggregation proofs of every level by chunks of arity until one is left.
+func prove(aggregatorConfig *config.Config, accountTreeRoot []byte, batches []circuit.BatchProofWitness) {
+	arity := aggregatorConfig.AggregationArity
+	capacity := 1
+	for i := 0; i < aggregatorConfig.AggregationLevels; i++ {
+		capacity *= arity
+	}
+	if len(batches) > capacity {
+		panic(fmt.Sprintf("%d batches exceed the capacity %d of %d aggregation levels of arity %d",
+			len(batches), capacity, aggregatorConfig.AggregationLevels, arity))
+	}
+
+	startTime := time.Now()
+	batchRanges := circuit.BatchAggregatedRanges(accountTreeRoot, batches)
+	var proofs []plonk.Proof
+	var ranges []utils.AggregatedRange
+	ccs, pk, vk := loadAggregationKeys(circuit.AggregationKeyName(aggregatorConfig.AggregationKeyName, 0))
+	for i := 0; i < len(batches); i += arity {
+		end := min(i+arity, len(batches))
+		assignment, r, err := circuit.SetBatchProofsAggregationCircuitWitness(batches[i:end], batchRanges[i:end], arity)
+		if err != nil {
+			panic(err)
+		}
+		proofs = append(proofs, proveAggregation(ccs, pk, vk, assignment))
+		ranges = append(ranges, *r)
+	}
+	level := 0
+	for len(proofs) > 1 {
+		level++
+		ccs, pk, vk = loadAggregationKeys(circuit.AggregationKeyName(aggregatorConfig.AggregationKeyName, level))
+		var nextProofs []plonk.Proof
+		var nextRanges []utils.AggregatedRange
+		for i := 0; i < len(proofs); i += arity {
+			end := min(i+arity, len(proofs))
+			assignment, r, err := circuit.SetAggregationNodeCircuitWitness(proofs[i:end], ranges[i:end], arity)
+			if err != nil {
+				panic(err)
+			}
+			nextProofs = append(nextProofs, proveAggregation(ccs, pk, vk, assignment))
+			nextRanges = append(nextRanges, *r)
+		}
+		proofs, ranges = nextProofs, nextRanges
+	}
+	fmt.Println("aggregation proof generation cost ", time.Since(startTime))
+
+	var buf bytes.Buffer
+	if _, err := proofs[0].WriteRawTo(&buf); err != nil {
+		panic(err)
+	}
+	r := ranges[0]
+	aggregatedProof := utils.AggregatedProof{
+		Backend:                  circuit.PlonkBackend,
+		Level:                    level,
+		Proof:                    buf.Bytes(),
+		AccountTreeRoot:          r.AccountTreeRoot,
+		EmptyCEXAssetsCommitment: r.BeforeCEXAssetsCommitment,
+		FinalCEXAssetsCommitment: r.AfterCEXAssetsCommitment,
+		AccountCount:             uint64(r.MaxAccountIndex) + 1,
+		UserCount:                r.UserCount,
+		SnapshotId:               r.SnapshotId,
+		AccountIdsChallenge:      r.AccountIdsChallenge,
+		LastAccountId:            r.AfterLastAccountId,
+	}
+	content, err := json.MarshalIndent(aggregatedProof, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(aggregatorConfig.AggregatedProof, content, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Println("aggregated ", len(batches), " batch proofs into ", aggregatorConfig.AggregatedProof, " at level ", level)
+}
+
+func main() {
+	setupFlag := flag.Bool("setup", false, "generate the keys of the aggregation circuits of every level")
+	srsFile := flag.String("srs", "", "canonical bn254 kzg srs file, the same as the one of the batch keys")
+	unsafeSrs := flag.Bool("unsafe_srs", false, "generate a local kzg srs, only for test")
+	flag.Parse()
+
+	aggregatorConfig := &config.Config{}
+	content, err := os.ReadFile("config/config.json")
+	if err != nil {
+		panic(err.Error())
+	}
+	err = json.Unmarshal(content, aggregatorConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	if len(aggregatorConfig.AssetsCountTiers) != len(aggregatorConfig.ZkKeyName) {
+		panic("asset tiers and asset tier names should have the same length")
+	}
+	if aggregatorConfig.AggregationArity < 1 || aggregatorConfig.AggregationLevels < 1 {
+		panic("the aggregation arity and levels should be positive")
+	}
+	if err = utils.InitCircuitParams(aggregatorConfig.CircuitParams); err != nil {
+		panic(err.Error())
+	}
+	// the aggregation circuit verifies the batch proofs in a bn254 circuit
+	if utils.Curve != utils.BN254Curve {
+		panic("the aggregation of the batch proofs is not supported on curve " + utils.Curve)
+	}
+	for _, zkKeyName := range aggregatorConfig.ZkKeyName {
+		if err = utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if *setupFlag {
+		if *srsFile == "" && !*unsafeSrs {
+			panic("plonk backend needs a kzg srs, please specify -srs")
+		}
+		setup(aggregatorConfig, *srsFile, *unsafeSrs)
+		return
+	}
+	proofs := loadProofTable(aggregatorConfig.ProofTable)
+	if len(proofs) == 0 {
+		panic("no batch proofs in " + aggregatorConfig.ProofTable)
+	}
+	vkIndexes := getVerifyingKeyIndexes(proofs, aggregatorConfig.AssetsCountTiers)
+	accountTreeRoot, batches := decodeBatchProofs(proofs, vkIndexes)
+	prove(aggregatorConfig, accountTreeRoot, batches)
+}
@@ -3,7 +3,9 @@ package config
 type Config struct {
 	MysqlDataSource string
 	DbSuffix        string
-	Redis           struct {
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+	Redis         struct {
 		Host     	string
 		Password  	string
 	}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/dbtool/config"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/prover"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
@@ -40,6 +41,7 @@ func main() {
 	queryAccountData := flag.Int("query_account_data", -1, "query account data by index")
 	pushTaskToRedis := flag.Bool("push_task_to_redis", false, "push task to redis")
 	exportProofCSV := flag.String("export_proof_csv", "", "export proof table to csv file")
+	diagnoseWitness := flag.Int("diagnose_witness", -1, "diagnose the failed constraint of witness by height")
 
 	flag.Parse()
 
@@ -60,6 +62,9 @@ func main() {
 		}
 		dbtoolConfig.MysqlDataSource = s
 	}
+	if err = utils.InitCircuitParams(dbtoolConfig.CircuitParams); err != nil {
+		panic(err.Error())
+	}
 	if *deleteAllData {
 		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource))
 		if err != nil {
@@ -187,6 +192,31 @@ func main() {
 		fmt.Printf("%x", w.WitnessData)
 	}
 
+	if *diagnoseWitness != -1 {
+		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
+			Logger: newLogger,
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		witnessModel := witness.NewWitnessModel(db, dbtoolConfig.DbSuffix)
+
+		w, err := witnessModel.GetBatchWitnessByHeight(int64(*diagnoseWitness))
+		if err != nil {
+			panic(err.Error())
+		}
+		batchWitness := utils.DecodeBatchWitness(w.WitnessData)
+		if batchWitness == nil {
+			panic("decode invalid witness data")
+		}
+		err = circuit.DiagnoseBatchCreateUserWitness(batchWitness)
+		if err != nil {
+			fmt.Printf("witness of height %d is invalid: %s\n", *diagnoseWitness, err.Error())
+		} else {
+			fmt.Printf("witness of height %d is valid\n", *diagnoseWitness)
+		}
+	}
+
 	if *queryAccountData != -1 {
 		db, err := gorm.Open(mysql.Open(dbtoolConfig.MysqlDataSource), &gorm.Config{
 			Logger: newLogger,
@@ -265,7 +295,12 @@ func main() {
 			BatchCommitment         string `csv:"batch_commitment"`
 			MinAccountIndex         uint32 `csv:"min_account_index"`
 			MaxAccountIndex         uint32 `csv:"max_account_index"`
+			UserCount               uint32 `csv:"user_count"`
+			OldUserCount            uint32 `csv:"old_user_count"`
+			SnapshotId              uint64 `csv:"snapshot_id"`
+			AccountIdsCheck         string `csv:"account_ids_check"`
 			AssetsCount             int    `csv:"assets_count"`
+			Backend                 string `csv:"backend"`
 		}
 		var proofs []prover.Proof
 		tableName := "proof" + dbtoolConfig.DbSuffix
@@ -283,7 +318,12 @@ func main() {
 				BatchCommitment:         p.BatchCommitment,
 				MinAccountIndex:         p.MinAccountIndex,
 				MaxAccountIndex:         p.MaxAccountIndex,
+				UserCount:               p.UserCount,
+				OldUserCount:            p.OldUserCount,
+				SnapshotId:              p.SnapshotId,
+				AccountIdsCheck:         p.AccountIdsCheck,
 				AssetsCount:             p.AssetsCount,
+				Backend:                 p.Backend,
 			}
 		}
 		f, err := os.Create(*exportProofCSV)
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs "github.com/consensys/gnark/constraint/bn254"
+)
+
+// Steps of the groth16 multi-party trusted setup ceremony. Every tier in
+// BatchCreateUserOpsCountsTiers has its own transcript:
+//
+//	zkpor50_1380.r1cs        compiled by init_phase1
+//	zkpor50_1380.phase1.<n>  n-th contribution of phase 1, 0 is the initial state
+//	zkpor50_1380.phase2.<n>  n-th contribution of phase 2, 0 is derived from the r1cs and the last phase 1 contribution
+//
+// The keys are only safe if at least one contributor of each phase discarded
+// its randomness, which is why anyone can verify the whole transcript.
+const (
+	stepInitPhase1       = "init_phase1"
+	stepContributePhase1 = "contribute_phase1"
+	stepVerifyPhase1     = "verify_phase1"
+	stepInitPhase2       = "init_phase2"
+	stepContributePhase2 = "contribute_phase2"
+	stepVerifyPhase2     = "verify_phase2"
+	stepFinalize         = "finalize"
+)
+
+func runCeremony(step string) {
+	if utils.Curve != utils.BN254Curve {
+		panic("the trusted setup ceremony is not supported on curve " + utils.Curve)
+	}
+	for k, v := range utils.BatchCreateUserOpsCountsTiers {
+		zkKeyName := circuit.ZkKeyName(circuit.Groth16Backend, k, v)
+		fmt.Println("ceremony step", step, "for", zkKeyName)
+		if step != stepInitPhase1 {
+			if err := utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+				panic(err)
+			}
+		}
+		switch step {
+		case stepInitPhase1:
+			initPhase1(zkKeyName, k, v)
+		case stepContributePhase1:
+			phase1, n := loadLastPhase1(zkKeyName)
+			phase1.Contribute()
+			writeCeremonyFile(phase1FileName(zkKeyName, n+1), &phase1)
+		case stepVerifyPhase1:
+			verifyPhase1Transcript(zkKeyName)
+		case stepInitPhase2:
+			if _, err := os.Stat(phase2FileName(zkKeyName, 0)); err == nil {
+				panic(phase2FileName(zkKeyName, 0) + " already exists")
+			}
+			phase2, _ := preparePhase2(zkKeyName)
+			writeCeremonyFile(phase2FileName(zkKeyName, 0), &phase2)
+		case stepContributePhase2:
+			phase2, n := loadLastPhase2(zkKeyName)
+			phase2.Contribute()
+			writeCeremonyFile(phase2FileName(zkKeyName, n+1), &phase2)
+		case stepVerifyPhase2:
+			verifyPhase2Transcript(zkKeyName)
+		case stepFinalize:
+			finalize(zkKeyName)
+		default:
+			panic("unsupported ceremony step: " + step)
+		}
+	}
+}
+
+func phase1FileName(zkKeyName string, n int) string {
+	return zkKeyName + ".phase1." + strconv.Itoa(n)
+}
+
+func phase2FileName(zkKeyName string, n int) string {
+	return zkKeyName + ".phase2." + strconv.Itoa(n)
+}
+
+func writeCeremonyFile(fileName string, v io.WriterTo) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	n, err := v.WriteTo(f)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(fileName, " size is ", n)
+}
+
+func readCeremonyFile(fileName string, v io.ReaderFrom) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = v.ReadFrom(bytes.NewBuffer(content)); err != nil {
+		panic(fileName + ": " + err.Error())
+	}
+}
+
+// isSameAsFile checks the file content is exactly the serialization of v,
+// the hash stored in a contribution file can't be trusted on its own.
+func isSameAsFile(fileName string, v io.WriterTo) bool {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	if _, err = v.WriteTo(&buf); err != nil {
+		panic(err)
+	}
+	return bytes.Equal(content, buf.Bytes())
+}
+
+// countContributions returns the number of consecutive files named by fileName
+// starting from index 0.
+func countContributions(zkKeyName string, fileName func(string, int) string) int {
+	n := 0
+	for {
+		if _, err := os.Stat(fileName(zkKeyName, n)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func initPhase1(zkKeyName string, userAssetCounts int, batchCounts int) {
+	if _, err := os.Stat(phase1FileName(zkKeyName, 0)); err == nil {
+		panic(phase1FileName(zkKeyName, 0) + " already exists")
+	}
+	batchCircuit := circuit.NewBatchCreateUserCircuit(uint32(userAssetCounts), uint32(utils.AssetCounts), uint32(batchCounts))
+	ccs, err := circuit.Compile(circuit.Groth16Backend, batchCircuit)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("batch create user constraints number is ", ccs.GetNbConstraints())
+	initTranscript(zkKeyName, ccs)
+}
+
+// initTranscript writes the constraint system, the circuit parameters and the
+// initial phase 1 state of the transcript of zkKeyName.
+func initTranscript(zkKeyName string, ccs constraint.ConstraintSystem) {
+	writeCeremonyFile(zkKeyName+circuit.ConstraintSystemFileSuffix(circuit.Groth16Backend), ccs)
+	if err := utils.WriteCircuitParams(zkKeyName + utils.CircuitParamsFileSuffix); err != nil {
+		panic(err)
+	}
+	phase1 := mpcsetup.InitPhase1(phase1Power(ccs))
+	writeCeremonyFile(phase1FileName(zkKeyName, 0), &phase1)
+}
+
+// phase1Power returns log2 of the phase 1 size. The lagrange basis of phase 1
+// must be computed on the same fft domain as the prover uses, so its size is
+// the constraints number rounded up to a power of 2.
+func phase1Power(ccs constraint.ConstraintSystem) int {
+	return bits.Len64(ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints()))) - 1
+}
+
+func loadR1CS(zkKeyName string) *cs.R1CS {
+	ccs := circuit.NewConstraintSystem(circuit.Groth16Backend)
+	readCeremonyFile(zkKeyName+circuit.ConstraintSystemFileSuffix(circuit.Groth16Backend), ccs)
+	return ccs.(*cs.R1CS)
+}
+
+func loadLastPhase1(zkKeyName string) (mpcsetup.Phase1, int) {
+	n := countContributions(zkKeyName, phase1FileName)
+	if n == 0 {
+		panic("phase 1 is not initialized, please run " + stepInitPhase1)
+	}
+	var phase1 mpcsetup.Phase1
+	readCeremonyFile(phase1FileName(zkKeyName, n-1), &phase1)
+	return phase1, n - 1
+}
+
+func loadLastPhase2(zkKeyName string) (phase2, int) {
+	n := countContributions(zkKeyName, phase2FileName)
+	if n == 0 {
+		panic("phase 2 is not initialized, please run " + stepInitPhase2)
+	}
+	var p phase2
+	readCeremonyFile(phase2FileName(zkKeyName, n-1), &p)
+	return p, n - 1
+}
+
+// verifyPhase1Transcript checks every phase 1 contribution and returns the last one.
+func verifyPhase1Transcript(zkKeyName string) mpcsetup.Phase1 {
+	n := countContributions(zkKeyName, phase1FileName)
+	if n < 2 {
+		panic("phase 1 of " + zkKeyName + " has no contribution")
+	}
+	contributions := make([]*mpcsetup.Phase1, n)
+	for i := 0; i < n; i++ {
+		contributions[i] = &mpcsetup.Phase1{}
+		readCeremonyFile(phase1FileName(zkKeyName, i), contributions[i])
+	}
+	// the initial state must not hide any secret, its proofs of knowledge are
+	// random and never checked, only its parameters and its hash matter
+	initial := mpcsetup.InitPhase1(phase1Power(loadR1CS(zkKeyName)))
+	initial.PublicKeys = contributions[0].PublicKeys
+	initial.Hash = contributions[0].Hash
+	if !isSameAsFile(phase1FileName(zkKeyName, 0), &initial) {
+		panic(phase1FileName(zkKeyName, 0) + " is not the initial phase 1 state")
+	}
+	err := mpcsetup.VerifyPhase1(contributions[0], contributions[1], contributions[2:]...)
+	if err != nil {
+		panic("phase 1 of " + zkKeyName + " verification failed: " + err.Error())
+	}
+	fmt.Println("phase 1 of", zkKeyName, "verify passed with", n-1, "contributions, last hash is", fmt.Sprintf("%x", contributions[n-1].Hash))
+	return *contributions[n-1]
+}
+
+// preparePhase2 derives the initial phase 2 state from the r1cs and the last
+// phase 1 contribution, it is deterministic so that anyone can recompute it.
+func preparePhase2(zkKeyName string) (phase2, phase2Evaluations) {
+	r1cs := loadR1CS(zkKeyName)
+	phase1, _ := loadLastPhase1(zkKeyName)
+	return initPhase2(r1cs, &phase1)
+}
+
+// verifyPhase2Transcript checks every phase 2 contribution and returns the last
+// one together with the evaluations needed to extract the keys.
+func verifyPhase2Transcript(zkKeyName string) (phase2, phase2Evaluations) {
+	n := countContributions(zkKeyName, phase2FileName)
+	if n < 2 {
+		panic("phase 2 of " + zkKeyName + " has no contribution")
+	}
+	contributions := make([]*phase2, n)
+	for i := 0; i < n; i++ {
+		contributions[i] = &phase2{}
+		readCeremonyFile(phase2FileName(zkKeyName, i), contributions[i])
+	}
+	initial, evals := preparePhase2(zkKeyName)
+	if !isSameAsFile(phase2FileName(zkKeyName, 0), &initial) {
+		panic(phase2FileName(zkKeyName, 0) + " doesn't match the r1cs and the last phase 1 contribution")
+	}
+	err := verifyPhase2(contributions[0], contributions[1], contributions[2:]...)
+	if err != nil {
+		panic("phase 2 of " + zkKeyName + " verification failed: " + err.Error())
+	}
+	fmt.Println("phase 2 of", zkKeyName, "verify passed with", n-1, "contributions, last hash is", fmt.Sprintf("%x", contributions[n-1].Hash))
+	return *contributions[n-1], evals
+}
+
+func finalize(zkKeyName string) {
+	phase1 := verifyPhase1Transcript(zkKeyName)
+	phase2, evals := verifyPhase2Transcript(zkKeyName)
+	pk, vk := extractKeys(&phase1, &phase2, &evals, loadR1CS(zkKeyName).GetNbConstraints())
+	writeCeremonyFile(zkKeyName+".pk", &pk)
+	writeCeremonyFile(zkKeyName+".vk", &vk)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	curve "github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/rangecheck"
+)
+
+// rangeCheckedSquareCircuit has a commitment, like every tier of the batch
+// create user circuit.
+type rangeCheckedSquareCircuit struct {
+	Y circuit.Variable `gnark:",public"`
+	X circuit.Variable
+}
+
+func (c rangeCheckedSquareCircuit) Define(api circuit.API) error {
+	rangecheck.New(api).Check(c.X, 16)
+	api.AssertIsEqual(c.Y, api.Mul(c.X, c.X))
+	return nil
+}
+
+func runTestCeremony(t *testing.T) string {
+	zkKeyName := filepath.Join(t.TempDir(), "zkpor_test")
+	ccs, err := circuit.Compile(circuit.Groth16Backend, &rangeCheckedSquareCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initTranscript(zkKeyName, ccs)
+	for i := 0; i < 2; i++ {
+		phase1, n := loadLastPhase1(zkKeyName)
+		phase1.Contribute()
+		writeCeremonyFile(phase1FileName(zkKeyName, n+1), &phase1)
+	}
+	phase2, evals := preparePhase2(zkKeyName)
+	if len(evals.CKK) != 1 || len(phase2.Parameters.G2.Sigma) != 1 {
+		t.Fatalf("expected one commitment key, got %d", len(evals.CKK))
+	}
+	writeCeremonyFile(phase2FileName(zkKeyName, 0), &phase2)
+	for i := 0; i < 2; i++ {
+		phase2, n := loadLastPhase2(zkKeyName)
+		phase2.Contribute()
+		writeCeremonyFile(phase2FileName(zkKeyName, n+1), &phase2)
+	}
+	return zkKeyName
+}
+
+func TestCeremonyWithCommitment(t *testing.T) {
+	zkKeyName := runTestCeremony(t)
+	finalize(zkKeyName)
+
+	ccs := loadR1CS(zkKeyName)
+	pk := groth16.NewProvingKey(curve.ID)
+	vk := groth16.NewVerifyingKey(curve.ID)
+	readCeremonyFile(zkKeyName+".pk", pk)
+	readCeremonyFile(zkKeyName+".vk", vk)
+
+	assignment := &rangeCheckedSquareCircuit{Y: 49, X: 7}
+	w, err := frontend.NewWitness(assignment, curve.ID.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := circuit.Prove(circuit.Groth16Backend, ccs, pk, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicWitness, err := w.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = circuit.Verify(circuit.Groth16Backend, proof, vk, publicWitness); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, err := frontend.NewWitness(&rangeCheckedSquareCircuit{Y: 50}, curve.ID.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = circuit.Verify(circuit.Groth16Backend, proof, vk, wrong); err == nil {
+		t.Fatal("expected the proof to be rejected with another public input")
+	}
+}
+
+func TestVerifyPhase2RejectsBadContributions(t *testing.T) {
+	zkKeyName := runTestCeremony(t)
+	var prev, next phase2
+	readCeremonyFile(phase2FileName(zkKeyName, 1), &prev)
+	readCeremonyFile(phase2FileName(zkKeyName, 2), &next)
+	if err := verifyPhase2(&prev, &next); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commitment key is not scaled by the sigma of the contribution
+	tampered := next
+	tampered.Parameters.G1.SigmaCKK = [][]curve.G1Affine{append([]curve.G1Affine(nil), next.Parameters.G1.SigmaCKK[0]...)}
+	tampered.Parameters.G1.SigmaCKK[0][0] = prev.Parameters.G1.SigmaCKK[0][0]
+	tampered.Hash = tampered.hash()
+	if err := verifyPhase2(&prev, &tampered); err == nil {
+		t.Fatal("expected an inconsistent commitment key to be rejected")
+	}
+
+	// a contribution must not skip the sigma update
+	skipped := next
+	skipped.Parameters.G2.Sigma = append([]curve.G2Affine(nil), prev.Parameters.G2.Sigma...)
+	skipped.Parameters.G1.SigmaCKK = prev.Parameters.G1.SigmaCKK
+	skipped.Hash = skipped.hash()
+	if err := verifyPhase2(&prev, &skipped); err == nil {
+		t.Fatal("expected a contribution without sigma update to be rejected")
+	}
+
+	// σ is updated by another secret than the one of the proof of knowledge
+	var extra fr.Element
+	var extraBI big.Int
+	extra.SetRandom()
+	extra.BigInt(&extraBI)
+	forged := next
+	forged.Parameters.G2.Sigma = append([]curve.G2Affine(nil), next.Parameters.G2.Sigma...)
+	forged.Parameters.G2.Sigma[0].ScalarMultiplication(&forged.Parameters.G2.Sigma[0], &extraBI)
+	forged.Parameters.G1.SigmaCKK = [][]curve.G1Affine{append([]curve.G1Affine(nil), next.Parameters.G1.SigmaCKK[0]...)}
+	scaleG1(forged.Parameters.G1.SigmaCKK[0], &extraBI)
+	forged.Hash = forged.hash()
+	if err := verifyPhase2(&prev, &forged); err == nil || !strings.Contains(err.Error(), "σ") {
+		t.Fatalf("expected a sigma without proof of knowledge to be rejected, got %v", err)
+	}
+
+	// the proof of knowledge of another secret bound to another contribution
+	unbound := next
+	unbound.Sigma = []mpcsetup.PublicKey{newPublicKey(extra, next.Hash, dstSigma)}
+	unbound.Hash = unbound.hash()
+	if err := verifyPhase2(&prev, &unbound); err == nil || !strings.Contains(err.Error(), "σ") {
+		t.Fatalf("expected a proof of knowledge of another secret to be rejected, got %v", err)
+	}
+
+	// a contribution built on top of another contribution than the previous one
+	var first, branch phase2
+	readCeremonyFile(phase2FileName(zkKeyName, 0), &first)
+	readCeremonyFile(phase2FileName(zkKeyName, 0), &branch)
+	branch.Contribute()
+	if err := verifyPhase2(&first, &branch); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPhase2(&prev, &branch); err == nil {
+		t.Fatal("expected a contribution on top of another one to be rejected")
+	}
+
+	// a contribution can't replace the previous state
+	if err := verifyPhase2(&next, &prev); err == nil {
+		t.Fatal("expected a reordered transcript to be rejected")
+	}
+}
@@ -1,45 +1,127 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
-	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/kzg"
 
-	"github.com/consensys/gnark/backend/groth16"
 	"runtime"
 	"time"
 
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/frontend/cs/r1cs"
-	"strconv"
 )
 
+// exportSolidityVerifier writes zkKeyName.sol which verifies the proofs of the
+// zkKeyName.vk on chain.
+func exportSolidityVerifier(backend string, zkKeyName string) {
+	content, err := os.ReadFile(zkKeyName + ".vk")
+	if err != nil {
+		panic(err)
+	}
+	vk := circuit.NewVerifyingKey(backend)
+	if _, err = vk.ReadFrom(bytes.NewBuffer(content)); err != nil {
+		panic(err)
+	}
+	f, err := os.Create(zkKeyName + ".sol")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = circuit.ExportSolidity(backend, vk, f); err != nil {
+		panic(err)
+	}
+	fmt.Println("export solidity verifier to", zkKeyName+".sol")
+}
+
 func main() {
+	backendFlag := flag.String("backend", circuit.Groth16Backend, "proving backend: groth16, groth16_evm, plonk or plonk_evm")
+	srsFile := flag.String("srs", "", "canonical bn254 kzg srs file used by the plonk backend")
+	unsafeSrs := flag.Bool("unsafe_srs", false, "generate a local kzg srs for the plonk backend, only for test")
+	exportSolidity := flag.Bool("solidity", false, "export the solidity verifier contract from the vk of every tier")
+	ceremonyStep := flag.String("ceremony", "", "groth16 trusted setup ceremony step: init_phase1, contribute_phase1, verify_phase1, init_phase2, contribute_phase2, verify_phase2 or finalize")
+	incremental := flag.Bool("incremental", false, "generate the keys of the batch update user circuit used by the incremental audit, the prices and the tier ratios must not change from the previous audit")
+	circuitParams := flag.String("circuit_params", "", "circuit parameters file, the default circuit parameters are used if it is empty")
+	flag.Parse()
+	if err := utils.InitCircuitParams(*circuitParams); err != nil {
+		panic(err)
+	}
+	if *ceremonyStep != "" {
+		runCeremony(*ceremonyStep)
+		return
+	}
+	backend, err := circuit.ParseProvingBackend(*backendFlag)
+	if err != nil {
+		panic(err)
+	}
+	if *exportSolidity {
+		for k, v := range utils.BatchCreateUserOpsCountsTiers {
+			zkKeyName := circuit.ZkKeyName(backend, k, v)
+			if *incremental {
+				zkKeyName = circuit.UpdateZkKeyName(backend, k, utils.GetBatchUpdateUserOpsCounts(k))
+			}
+			if err = utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+				panic(err)
+			}
+			exportSolidityVerifier(backend, zkKeyName)
+		}
+		return
+	}
+	if circuit.IsPlonk(backend) && *srsFile == "" && !*unsafeSrs {
+		panic("plonk backend needs a kzg srs, please specify -srs")
+	}
+
 	go func() {
 		for {
 			time.Sleep(time.Second * 10)
 			runtime.GC()
 		}
 	}()
+	// the keys of all the tiers must share the same kzg srs to be aggregated
+	unsafeKzgSrs, err := circuit.NewUnsafeKzgSrs()
+	if err != nil {
+		panic(err)
+	}
 	for k, v := range utils.BatchCreateUserOpsCountsTiers {
-		circuit := circuit.NewBatchCreateUserCircuit(uint32(k), utils.AssetCounts, uint32(v))
+		var batchCircuit frontend.Circuit
+		var zkKeyName string
+		if *incremental {
+			v = utils.GetBatchUpdateUserOpsCounts(k)
+			batchCircuit = circuit.NewBatchUpdateUserCircuit(uint32(k), uint32(utils.AssetCounts), uint32(v))
+			zkKeyName = circuit.UpdateZkKeyName(backend, k, v)
+		} else {
+			batchCircuit = circuit.NewBatchCreateUserCircuit(uint32(k), uint32(utils.AssetCounts), uint32(v))
+			zkKeyName = circuit.ZkKeyName(backend, k, v)
+		}
 		startTime := time.Now()
-		oR1cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
+		ccs, err := circuit.Compile(backend, batchCircuit)
 		if err != nil {
 			panic(err)
 		}
 		endTime := time.Now()
-		fmt.Println("R1CS generation tims is ", endTime.Sub(startTime))
-		fmt.Println("batch create user constraints number is ", oR1cs.GetNbConstraints())
-		zkKeyName := "zkpor" + strconv.FormatInt(int64(k), 10) + "_" + strconv.FormatInt(int64(v), 10)
+		fmt.Println("constraint system generation time is ", endTime.Sub(startTime))
+		fmt.Println("batch user constraints number is ", ccs.GetNbConstraints())
 		pkFile, err := os.Create(zkKeyName + ".pk")
 		if err != nil {
 			panic(err)
 		}
-		pk, vk, err := groth16.Setup(oR1cs)
+		var srs, srsLagrange kzg.SRS
+		if circuit.IsPlonk(backend) {
+			if *srsFile != "" {
+				srs, srsLagrange, err = circuit.LoadKzgSrs(*srsFile, ccs)
+			} else {
+				fmt.Println("WARNING: using a locally generated kzg srs, the keys must not be used in production")
+				srs, srsLagrange, err = unsafeKzgSrs.Truncate(ccs)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		pk, vk, err := circuit.Setup(backend, ccs, srs, srsLagrange)
 		if err != nil {
 			panic(err)
 		}
@@ -56,13 +138,17 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("pk size is ", n)
+		fmt.Println("vk size is ", n)
 
-		r1csFile, _ := os.Create(zkKeyName + ".r1cs")
-		n, err = oR1cs.WriteTo(r1csFile)
+		ccsFile, _ := os.Create(zkKeyName + circuit.ConstraintSystemFileSuffix(backend))
+		n, err = ccs.WriteTo(ccsFile)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("r1cs size is ", n)
+		fmt.Println("constraint system size is ", n)
+
+		if err = utils.WriteCircuitParams(zkKeyName + utils.CircuitParamsFileSuffix); err != nil {
+			panic(err)
+		}
 	}
 }
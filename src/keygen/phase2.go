@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	curve "github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/pedersen"
+	groth16 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs "github.com/consensys/gnark/constraint/bn254"
+)
+
+// the domain separation tags of the proofs of knowledge of the phase 2
+// secrets, the tag of the secret σ of commitment j is dstSigma+j
+const (
+	dstDelta = 1
+	dstSigma = 2
+)
+
+// phase2 is the phase 2 of the groth16 mpc setup including the pedersen
+// commitment keys. The phase 2 of gnark mpcsetup only updates δ and puts all
+// the private wires under δ, so its keys can't prove a circuit which uses
+// api.Commit. Like groth16.Setup, the private wires committed by commitment j
+// are left out of the δ part, their [L(τ)]₁ are the pedersen basis of the
+// commitment and [σⱼ L(τ)]₁ prove the knowledge of the committed values, so
+// every contribution updates σⱼ of every commitment as well as δ. γ is 1 as in
+// gnark mpcsetup.
+type phase2 struct {
+	Parameters struct {
+		G1 struct {
+			Delta curve.G1Affine
+			// K are [L(τ)/δ]₁ of the private wires which are not committed
+			K []curve.G1Affine
+			// Z are [τⁱ(τⁿ - 1)/δ]₁ in bit reversed order
+			Z []curve.G1Affine
+			// SigmaCKK are [σⱼ L(τ)]₁ of the private wires committed by commitment j
+			SigmaCKK [][]curve.G1Affine
+		}
+		G2 struct {
+			Delta curve.G2Affine
+			// Sigma are [σⱼ]₂
+			Sigma []curve.G2Affine
+		}
+	}
+	// the proofs of knowledge of the secrets of the contribution, they are
+	// zero in the initial state
+	Delta mpcsetup.PublicKey
+	Sigma []mpcsetup.PublicKey
+	Hash  []byte
+}
+
+// phase2Evaluations are the parts of the keys which don't depend on the phase 2
+// secrets. G1.VKK are [L(τ)]₁ of the public wires and of the commitment wires,
+// the verifier takes the commitments as public inputs.
+type phase2Evaluations struct {
+	mpcsetup.Phase2Evaluations
+	// CKK are the pedersen basis of the commitments, [L(τ)]₁ of the committed private wires
+	CKK                          [][]curve.G1Affine
+	PublicAndCommitmentCommitted [][]int
+}
+
+// initPhase2 derives the initial phase 2 state of r1cs from the last phase 1
+// contribution, all its secrets are 1. It is deterministic, so anyone can
+// recompute it from the transcript.
+func initPhase2(r1cs *cs.R1CS, phase1 *mpcsetup.Phase1) (phase2, phase2Evaluations) {
+	// δ is 1 in the initial state of gnark mpcsetup, so its L are [L(τ)]₁ of all the private wires
+	p, e := mpcsetup.InitPhase2(r1cs, phase1)
+	l := p.Parameters.G1.L
+	nbPublic := r1cs.GetNbPublicVariables()
+	commitmentInfo := r1cs.CommitmentInfo.(constraint.Groth16Commitments)
+	commitmentWires := commitmentInfo.CommitmentIndexes()
+	privateCommitted := commitmentInfo.GetPrivateCommitted()
+
+	var evals phase2Evaluations
+	evals.Phase2Evaluations = e
+	committed := make([]bool, len(l))
+	for _, w := range commitmentWires {
+		evals.G1.VKK = append(evals.G1.VKK, l[w-nbPublic])
+		committed[w-nbPublic] = true
+	}
+	evals.CKK = make([][]curve.G1Affine, len(privateCommitted))
+	for j := range privateCommitted {
+		evals.CKK[j] = make([]curve.G1Affine, len(privateCommitted[j]))
+		for i, w := range privateCommitted[j] {
+			evals.CKK[j][i] = l[w-nbPublic]
+			committed[w-nbPublic] = true
+		}
+	}
+	evals.PublicAndCommitmentCommitted = commitmentInfo.GetPublicAndCommitmentCommitted(commitmentWires, nbPublic)
+
+	var c phase2
+	c.Parameters.G1.Delta = p.Parameters.G1.Delta
+	c.Parameters.G2.Delta = p.Parameters.G2.Delta
+	c.Parameters.G1.Z = p.Parameters.G1.Z
+	c.Parameters.G1.K = make([]curve.G1Affine, 0, len(l))
+	for i := range l {
+		if !committed[i] {
+			c.Parameters.G1.K = append(c.Parameters.G1.K, l[i])
+		}
+	}
+	_, _, _, g2 := curve.Generators()
+	c.Parameters.G1.SigmaCKK = make([][]curve.G1Affine, len(evals.CKK))
+	c.Parameters.G2.Sigma = make([]curve.G2Affine, len(evals.CKK))
+	c.Sigma = make([]mpcsetup.PublicKey, len(evals.CKK))
+	for j := range evals.CKK {
+		c.Parameters.G1.SigmaCKK[j] = append([]curve.G1Affine(nil), evals.CKK[j]...)
+		c.Parameters.G2.Sigma[j] = g2
+	}
+	c.Hash = c.hash()
+	return c, evals
+}
+
+// Contribute samples new secrets δ and σⱼ and multiplies them into c.
+func (c *phase2) Contribute() {
+	var delta, deltaInv fr.Element
+	var deltaBI, deltaInvBI big.Int
+	delta.SetRandom()
+	deltaInv.Inverse(&delta)
+	delta.BigInt(&deltaBI)
+	deltaInv.BigInt(&deltaInvBI)
+	challenge := c.Hash
+
+	c.Delta = newPublicKey(delta, challenge, dstDelta)
+	c.Parameters.G1.Delta.ScalarMultiplication(&c.Parameters.G1.Delta, &deltaBI)
+	c.Parameters.G2.Delta.ScalarMultiplication(&c.Parameters.G2.Delta, &deltaBI)
+	scaleG1(c.Parameters.G1.K, &deltaInvBI)
+	scaleG1(c.Parameters.G1.Z, &deltaInvBI)
+
+	for j := range c.Parameters.G2.Sigma {
+		var sigma fr.Element
+		var sigmaBI big.Int
+		sigma.SetRandom()
+		sigma.BigInt(&sigmaBI)
+		c.Sigma[j] = newPublicKey(sigma, challenge, byte(dstSigma+j))
+		c.Parameters.G2.Sigma[j].ScalarMultiplication(&c.Parameters.G2.Sigma[j], &sigmaBI)
+		scaleG1(c.Parameters.G1.SigmaCKK[j], &sigmaBI)
+	}
+	c.Hash = c.hash()
+}
+
+// verifyPhase2 checks every contribution is an update of the previous one by
+// secrets the contributor knows.
+func verifyPhase2(c0, c1 *phase2, c ...*phase2) error {
+	contributions := append([]*phase2{c0, c1}, c...)
+	for i := 0; i < len(contributions)-1; i++ {
+		if err := verifyPhase2Contribution(contributions[i], contributions[i+1]); err != nil {
+			return fmt.Errorf("contribution %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func verifyPhase2Contribution(current, contribution *phase2) error {
+	prev, next := &current.Parameters, &contribution.Parameters
+	if len(next.G1.K) != len(prev.G1.K) || len(next.G1.Z) != len(prev.G1.Z) ||
+		len(next.G2.Sigma) != len(prev.G2.Sigma) || len(next.G1.SigmaCKK) != len(prev.G1.SigmaCKK) ||
+		len(contribution.Sigma) != len(prev.G2.Sigma) {
+		return errors.New("the sizes of the parameters change")
+	}
+	for j := range prev.G1.SigmaCKK {
+		if len(next.G1.SigmaCKK[j]) != len(prev.G1.SigmaCKK[j]) {
+			return errors.New("the sizes of the parameters change")
+		}
+	}
+
+	// δ
+	if err := verifyUpdate(contribution.Delta, current.Hash, dstDelta, next.G2.Delta, prev.G2.Delta); err != nil {
+		return fmt.Errorf("δ: %w", err)
+	}
+	deltaR := genR(contribution.Delta.SG, contribution.Delta.SXG, current.Hash, dstDelta)
+	if !sameRatio(next.G1.Delta, prev.G1.Delta, deltaR, contribution.Delta.XR) {
+		return errors.New("couldn't verify that [δ]₁ is based on previous contribution")
+	}
+	// K and Z are divided by δ
+	if len(next.G1.K) > 0 {
+		k, prevK := merge(next.G1.K, prev.G1.K)
+		if !sameRatio(k, prevK, next.G2.Delta, prev.G2.Delta) {
+			return errors.New("couldn't verify valid updates of K using δ⁻¹")
+		}
+	}
+	z, prevZ := merge(next.G1.Z, prev.G1.Z)
+	if !sameRatio(z, prevZ, next.G2.Delta, prev.G2.Delta) {
+		return errors.New("couldn't verify valid updates of Z using δ⁻¹")
+	}
+
+	// σⱼ, SigmaCKK are multiplied by σⱼ
+	for j := range prev.G2.Sigma {
+		if err := verifyUpdate(contribution.Sigma[j], current.Hash, byte(dstSigma+j), next.G2.Sigma[j], prev.G2.Sigma[j]); err != nil {
+			return fmt.Errorf("σ of commitment %d: %w", j, err)
+		}
+		if len(prev.G1.SigmaCKK[j]) == 0 {
+			continue
+		}
+		ckk, prevCKK := merge(next.G1.SigmaCKK[j], prev.G1.SigmaCKK[j])
+		if !sameRatio(ckk, prevCKK, prev.G2.Sigma[j], next.G2.Sigma[j]) {
+			return fmt.Errorf("couldn't verify valid updates of the commitment basis %d using σ", j)
+		}
+	}
+
+	if !bytes.Equal(contribution.hash(), contribution.Hash) {
+		return errors.New("couldn't verify hash of contribution")
+	}
+	return nil
+}
+
+// verifyUpdate checks the contributor knows the secret x of pk and next = x * prev in G2.
+func verifyUpdate(pk mpcsetup.PublicKey, challenge []byte, dst byte, next, prev curve.G2Affine) error {
+	// a zero secret would wipe out the parameters
+	if pk.SG.IsInfinity() || pk.SXG.IsInfinity() || next.IsInfinity() {
+		return errors.New("the secret is zero")
+	}
+	r := genR(pk.SG, pk.SXG, challenge, dst)
+	if !sameRatio(pk.SG, pk.SXG, pk.XR, r) {
+		return errors.New("couldn't verify knowledge of the secret")
+	}
+	if !sameRatio(pk.SG, pk.SXG, next, prev) {
+		return errors.New("couldn't verify that [x]₂ is based on previous contribution")
+	}
+	return nil
+}
+
+// extractKeys returns the groth16 keys of the last phase 1 and phase 2
+// contributions, the keys have the pedersen commitment keys of evals.
+func extractKeys(phase1 *mpcsetup.Phase1, c *phase2, evals *phase2Evaluations, nbConstraints int) (groth16.ProvingKey, groth16.VerifyingKey) {
+	var p mpcsetup.Phase2
+	p.Parameters.G1.Delta = c.Parameters.G1.Delta
+	p.Parameters.G2.Delta = c.Parameters.G2.Delta
+	p.Parameters.G1.L = c.Parameters.G1.K
+	p.Parameters.G1.Z = append([]curve.G1Affine(nil), c.Parameters.G1.Z...)
+	pk, vk := mpcsetup.ExtractKeys(phase1, &p, &evals.Phase2Evaluations, nbConstraints)
+
+	_, _, _, g2 := curve.Generators()
+	pk.CommitmentKeys = make([]pedersen.ProvingKey, len(evals.CKK))
+	vk.CommitmentKeys = make([]pedersen.VerifyingKey, len(evals.CKK))
+	for j := range evals.CKK {
+		pk.CommitmentKeys[j].Basis = evals.CKK[j]
+		pk.CommitmentKeys[j].BasisExpSigma = c.Parameters.G1.SigmaCKK[j]
+		vk.CommitmentKeys[j].G = g2
+		vk.CommitmentKeys[j].GSigma.Neg(&c.Parameters.G2.Sigma[j])
+	}
+	vk.PublicAndCommitmentCommitted = evals.PublicAndCommitmentCommitted
+	return pk, vk
+}
+
+func (c *phase2) WriteTo(writer io.Writer) (int64, error) {
+	n, err := c.writeTo(writer)
+	if err != nil {
+		return n, err
+	}
+	nBytes, err := writer.Write(c.Hash)
+	return n + int64(nBytes), err
+}
+
+// writeTo writes c without its hash.
+func (c *phase2) writeTo(writer io.Writer) (int64, error) {
+	enc := curve.NewEncoder(writer)
+	toEncode := []interface{}{
+		uint64(len(c.Parameters.G2.Sigma)),
+		&c.Delta.SG,
+		&c.Delta.SXG,
+		&c.Delta.XR,
+		&c.Parameters.G1.Delta,
+		c.Parameters.G1.K,
+		c.Parameters.G1.Z,
+		&c.Parameters.G2.Delta,
+	}
+	for j := range c.Parameters.G2.Sigma {
+		toEncode = append(toEncode, &c.Sigma[j].SG, &c.Sigma[j].SXG, &c.Sigma[j].XR,
+			c.Parameters.G1.SigmaCKK[j], &c.Parameters.G2.Sigma[j])
+	}
+	for _, v := range toEncode {
+		if err := enc.Encode(v); err != nil {
+			return enc.BytesWritten(), err
+		}
+	}
+	return enc.BytesWritten(), nil
+}
+
+func (c *phase2) ReadFrom(reader io.Reader) (int64, error) {
+	dec := curve.NewDecoder(reader)
+	var nbCommitments uint64
+	toDecode := []interface{}{
+		&nbCommitments,
+		&c.Delta.SG,
+		&c.Delta.SXG,
+		&c.Delta.XR,
+		&c.Parameters.G1.Delta,
+		&c.Parameters.G1.K,
+		&c.Parameters.G1.Z,
+		&c.Parameters.G2.Delta,
+	}
+	for _, v := range toDecode {
+		if err := dec.Decode(v); err != nil {
+			return dec.BytesRead(), err
+		}
+	}
+	// the domain separation tags of the secrets are bytes
+	if nbCommitments > 255-dstSigma {
+		return dec.BytesRead(), fmt.Errorf("invalid number of commitments %d", nbCommitments)
+	}
+	c.Sigma = make([]mpcsetup.PublicKey, nbCommitments)
+	c.Parameters.G1.SigmaCKK = make([][]curve.G1Affine, nbCommitments)
+	c.Parameters.G2.Sigma = make([]curve.G2Affine, nbCommitments)
+	for j := range c.Sigma {
+		for _, v := range []interface{}{&c.Sigma[j].SG, &c.Sigma[j].SXG, &c.Sigma[j].XR,
+			&c.Parameters.G1.SigmaCKK[j], &c.Parameters.G2.Sigma[j]} {
+			if err := dec.Decode(v); err != nil {
+				return dec.BytesRead(), err
+			}
+		}
+	}
+	c.Hash = make([]byte, sha256.Size)
+	n, err := io.ReadFull(reader, c.Hash)
+	return dec.BytesRead() + int64(n), err
+}
+
+func (c *phase2) hash() []byte {
+	sha := sha256.New()
+	if _, err := c.writeTo(sha); err != nil {
+		panic(err)
+	}
+	return sha.Sum(nil)
+}
+
+// newPublicKey returns the proof of knowledge of x bound to challenge, it is
+// verified by genR and sameRatio like the public keys of gnark mpcsetup.
+func newPublicKey(x fr.Element, challenge []byte, dst byte) mpcsetup.PublicKey {
+	var pk mpcsetup.PublicKey
+	_, _, g1, _ := curve.Generators()
+	var s fr.Element
+	var sBI, xBI big.Int
+	s.SetRandom()
+	s.BigInt(&sBI)
+	x.BigInt(&xBI)
+	pk.SG.ScalarMultiplication(&g1, &sBI)
+	pk.SXG.ScalarMultiplication(&pk.SG, &xBI)
+	r := genR(pk.SG, pk.SXG, challenge, dst)
+	pk.XR.ScalarMultiplication(&r, &xBI)
+	return pk
+}
+
+// genR returns R in G2 as Hash(gˢ, gˢˣ, challenge, dst).
+func genR(sG1, sxG1 curve.G1Affine, challenge []byte, dst byte) curve.G2Affine {
+	var buf bytes.Buffer
+	buf.Write(sG1.Marshal())
+	buf.Write(sxG1.Marshal())
+	buf.Write(challenge)
+	r, err := curve.HashToG2(buf.Bytes(), []byte{dst})
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// sameRatio checks e(a₁, a₂) = e(b₁, b₂).
+func sameRatio(a1, b1 curve.G1Affine, a2, b2 curve.G2Affine) bool {
+	if !a1.IsInSubGroup() || !b1.IsInSubGroup() || !a2.IsInSubGroup() || !b2.IsInSubGroup() {
+		return false
+	}
+	var na2 curve.G2Affine
+	na2.Neg(&a2)
+	res, err := curve.PairingCheck([]curve.G1Affine{a1, b1}, []curve.G2Affine{na2, b2})
+	return err == nil && res
+}
+
+// merge returns a = ∑ rᵢAᵢ, b = ∑ rᵢBᵢ for random rᵢ.
+func merge(a, b []curve.G1Affine) (resA, resB curve.G1Affine) {
+	r := make([]fr.Element, len(a))
+	for i := range r {
+		r[i].SetRandom()
+	}
+	config := ecc.MultiExpConfig{NbTasks: runtime.NumCPU()}
+	if _, err := resA.MultiExp(a, r, config); err != nil {
+		panic(err)
+	}
+	if _, err := resB.MultiExp(b, r, config); err != nil {
+		panic(err)
+	}
+	return
+}
+
+// scaleG1 multiplies every point of a by s in place.
+func scaleG1(a []curve.G1Affine, s *big.Int) {
+	workers := runtime.NumCPU()
+	chunk := (len(a) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(a); start += chunk {
+		end := min(start+chunk, len(a))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				a[i].ScalarMultiplication(&a[i], s)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
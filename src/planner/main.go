@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/planner/planner"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+func parseInts(s string) []int {
+	res := make([]int, 0)
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			panic("invalid number list " + s + ": " + err.Error())
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+func formatTiers(plan planner.Plan) string {
+	pairs := make([]string, len(plan.Tiers))
+	for i, t := range plan.Tiers {
+		pairs[i] = fmt.Sprintf("%d:%d", t.AssetCounts, t.BatchCounts)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func printPlan(plan planner.Plan) {
+	for _, t := range plan.Tiers {
+		fmt.Printf("  tier %d: batch counts %d, users %d, proofs %d, padding users %d, padding assets %d\n",
+			t.AssetCounts, t.BatchCounts, t.Users, t.Proofs, t.PaddingUsers, t.PaddingAssets)
+	}
+	fmt.Printf("  total proofs %d, total padding assets %d, tiers %s\n", plan.Proofs, plan.PaddingAssets, formatTiers(plan))
+}
+
+func main() {
+	backendFlag := flag.String("backend", circuit.Groth16Backend, "proving backend: groth16, groth16_evm, plonk or plonk_evm")
+	budgetLog2 := flag.Int("budget", 26, "log2 of the target constraints number of one batch")
+	tiersFlag := flag.String("tiers", "", "asset counts tiers to probe, such as 50,500, the AssetCountsTiers are used if it is empty")
+	probesFlag := flag.String("probes", "1,2", "batch counts of the probe circuits of every tier")
+	userDataFile := flag.String("user_data", "", "the directory of users balance sheet files, the tiers are suggested from the histogram of users asset counts")
+	maxTiers := flag.Int("max_tiers", 2, "the max number of suggested tiers")
+	circuitParams := flag.String("circuit_params", "", "circuit parameters file, the default circuit parameters are used if it is empty")
+	flag.Parse()
+	if err := utils.InitCircuitParams(*circuitParams); err != nil {
+		panic(err)
+	}
+	backend, err := circuit.ParseProvingBackend(*backendFlag)
+	if err != nil {
+		panic(err)
+	}
+	tiers := utils.AssetCountsTiers
+	if *tiersFlag != "" {
+		tiers = parseInts(*tiersFlag)
+	}
+	sort.Ints(tiers)
+	probes := parseInts(*probesFlag)
+	budget := 1 << *budgetLog2
+
+	tierCosts := make([]planner.TierCost, 0, len(tiers))
+	for _, assetCounts := range tiers {
+		tierProbes := make([]planner.Probe, 0, len(probes))
+		for _, batchCounts := range probes {
+			p, err := planner.ProbeConstraints(backend, assetCounts, batchCounts)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("tier %d with %d users has %d constraints\n", p.AssetCounts, p.BatchCounts, p.Constraints)
+			tierProbes = append(tierProbes, p)
+		}
+		c, err := planner.FitTierCost(tierProbes)
+		if err != nil {
+			panic(err)
+		}
+		tierCosts = append(tierCosts, c)
+	}
+
+	fmt.Printf("batch counts under the budget of 2^%d constraints:\n", *budgetLog2)
+	proposal := planner.Plan{}
+	for _, c := range tierCosts {
+		batchCounts := c.BatchCounts(budget)
+		fmt.Printf("  tier %d: base %.0f, per user %.0f, batch counts %d\n", c.AssetCounts, c.Base, c.PerUser, batchCounts)
+		proposal.Tiers = append(proposal.Tiers, planner.TierPlan{AssetCounts: c.AssetCounts, BatchCounts: batchCounts})
+	}
+	fmt.Println("proposed BatchCreateUserOpsCountsTiers:", formatTiers(proposal))
+
+	if *userDataFile == "" {
+		return
+	}
+	histogram, err := planner.ReadAssetCountsHistogram(*userDataFile)
+	if err != nil {
+		panic(err)
+	}
+	model, err := planner.NewCostModel(tierCosts)
+	if err != nil {
+		panic(err)
+	}
+	current, err := planner.EvaluateTiers(histogram, tiers, model, budget)
+	if err != nil {
+		fmt.Println("the probed tiers can't be used for the users:", err.Error())
+	} else {
+		fmt.Println("the probed tiers:")
+		printPlan(current)
+	}
+	suggested, err := planner.PlanTiers(histogram, model, budget, *maxTiers)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("the suggested tiers of at most %d tiers:\n", *maxTiers)
+	printPlan(suggested)
+	fmt.Println("WARNING: the batch counts of the suggested tiers are estimated from the probed tiers, probe them again before generating keys")
+}
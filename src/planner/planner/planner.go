@@ -0,0 +1,382 @@
+package planner
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+)
+
+// Probe is the constraints number of BatchCreateUserCircuit compiled
+// for AssetCounts user assets and BatchCounts users
+type Probe struct {
+	AssetCounts int
+	BatchCounts int
+	Constraints int
+}
+
+// TierCost is the constraints cost of the batch circuit of one asset counts tier:
+// constraints = Base + PerUser * batch counts
+type TierCost struct {
+	AssetCounts int
+	Base        float64
+	PerUser     float64
+}
+
+// TierPlan is the batch counts of one tier and the users which fall into it
+type TierPlan struct {
+	AssetCounts int
+	BatchCounts int
+	Users       int
+	Proofs      int
+	// the empty accounts appended to fill up the last batch
+	PaddingUsers int
+	// the empty assets appended to users, including the assets of padding users
+	PaddingAssets int
+}
+
+type Plan struct {
+	Tiers         []TierPlan
+	Proofs        int
+	PaddingAssets int
+}
+
+func ProbeConstraints(backend string, assetCounts int, batchCounts int) (Probe, error) {
+	batchCircuit := circuit.NewBatchCreateUserCircuit(uint32(assetCounts), uint32(utils.AssetCounts), uint32(batchCounts))
+	ccs, err := circuit.Compile(backend, batchCircuit)
+	if err != nil {
+		return Probe{}, err
+	}
+	return Probe{
+		AssetCounts: assetCounts,
+		BatchCounts: batchCounts,
+		Constraints: ccs.GetNbConstraints(),
+	}, nil
+}
+
+// fitLine returns the least squares fit of y = a + b * x
+func fitLine(xs []float64, ys []float64) (a float64, b float64, err error) {
+	n := float64(len(xs))
+	var sumX, sumY, sumXX, sumXY float64
+	for i := 0; i < len(xs); i++ {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXX += xs[i] * xs[i]
+		sumXY += xs[i] * ys[i]
+	}
+	d := n*sumXX - sumX*sumX
+	if len(xs) < 2 || d == 0 {
+		return 0, 0, errors.New("at least two different x are needed to fit a line")
+	}
+	b = (n*sumXY - sumX*sumY) / d
+	a = (sumY - b*sumX) / n
+	return a, b, nil
+}
+
+// FitTierCost fits the base and per user constraints of one tier
+// from the probes of different batch counts
+func FitTierCost(probes []Probe) (TierCost, error) {
+	if len(probes) == 0 {
+		return TierCost{}, errors.New("no probes")
+	}
+	xs := make([]float64, len(probes))
+	ys := make([]float64, len(probes))
+	for i, p := range probes {
+		if p.AssetCounts != probes[0].AssetCounts {
+			return TierCost{}, fmt.Errorf("probes of different asset counts %d and %d", probes[0].AssetCounts, p.AssetCounts)
+		}
+		xs[i] = float64(p.BatchCounts)
+		ys[i] = float64(p.Constraints)
+	}
+	base, perUser, err := fitLine(xs, ys)
+	if err != nil {
+		return TierCost{}, fmt.Errorf("asset counts %d: %w", probes[0].AssetCounts, err)
+	}
+	return TierCost{
+		AssetCounts: probes[0].AssetCounts,
+		Base:        base,
+		PerUser:     perUser,
+	}, nil
+}
+
+// BatchCounts returns the max number of users whose batch constraints fit in budget
+func (c TierCost) BatchCounts(budget int) int {
+	if c.PerUser <= 0 || float64(budget) <= c.Base {
+		return 0
+	}
+	return int(math.Floor((float64(budget) - c.Base) / c.PerUser))
+}
+
+// CostModel estimates the TierCost of any asset counts by fitting the
+// base and per user constraints of the probed tiers linearly
+type CostModel struct {
+	baseA, baseB       float64
+	perUserA, perUserB float64
+}
+
+func NewCostModel(tierCosts []TierCost) (CostModel, error) {
+	xs := make([]float64, len(tierCosts))
+	bases := make([]float64, len(tierCosts))
+	perUsers := make([]float64, len(tierCosts))
+	for i, c := range tierCosts {
+		xs[i] = float64(c.AssetCounts)
+		bases[i] = c.Base
+		perUsers[i] = c.PerUser
+	}
+	var m CostModel
+	var err error
+	m.baseA, m.baseB, err = fitLine(xs, bases)
+	if err != nil {
+		return m, fmt.Errorf("the tiers cost of at least two asset counts are needed: %w", err)
+	}
+	m.perUserA, m.perUserB, _ = fitLine(xs, perUsers)
+	return m, nil
+}
+
+func (m CostModel) TierCost(assetCounts int) TierCost {
+	return TierCost{
+		AssetCounts: assetCounts,
+		Base:        m.baseA + m.baseB*float64(assetCounts),
+		PerUser:     m.perUserA + m.perUserB*float64(assetCounts),
+	}
+}
+
+// countUsers returns the number of users in histogram whose asset counts
+// are in (low, high] and the total asset counts of them
+func countUsers(histogram map[int]int, low int, high int) (users int, assets int) {
+	for k, v := range histogram {
+		if k > low && k <= high {
+			users += v
+			assets += v * k
+		}
+	}
+	return users, assets
+}
+
+// planTier puts the users which own assets in total into the tier of high
+func planTier(high int, batchCounts int, users int, assets int) TierPlan {
+	t := TierPlan{
+		AssetCounts:   high,
+		BatchCounts:   batchCounts,
+		Users:         users,
+		PaddingAssets: users*high - assets,
+	}
+	if t.Users != 0 {
+		t.Proofs = (t.Users + batchCounts - 1) / batchCounts
+		t.PaddingUsers = t.Proofs*batchCounts - t.Users
+		t.PaddingAssets += t.PaddingUsers * high
+	}
+	return t
+}
+
+func newPlan(tiers []TierPlan) Plan {
+	p := Plan{Tiers: tiers}
+	for _, t := range tiers {
+		p.Proofs += t.Proofs
+		p.PaddingAssets += t.PaddingAssets
+	}
+	return p
+}
+
+func maxAssetCounts(histogram map[int]int) int {
+	res := 0
+	for k, v := range histogram {
+		if v != 0 && k > res {
+			res = k
+		}
+	}
+	return res
+}
+
+// EvaluateTiers returns the plan of the given asset counts tiers,
+// the batch counts of every tier are the max ones under budget
+func EvaluateTiers(histogram map[int]int, tiers []int, model CostModel, budget int) (Plan, error) {
+	sortedTiers := append([]int(nil), tiers...)
+	sort.Ints(sortedTiers)
+	if len(sortedTiers) == 0 || sortedTiers[len(sortedTiers)-1] < maxAssetCounts(histogram) {
+		return Plan{}, fmt.Errorf("tiers %v can't hold the users of %d assets", tiers, maxAssetCounts(histogram))
+	}
+	res := make([]TierPlan, 0, len(sortedTiers))
+	low := -1
+	for _, high := range sortedTiers {
+		batchCounts := model.TierCost(high).BatchCounts(budget)
+		if batchCounts == 0 {
+			return Plan{}, fmt.Errorf("the batch of tier %d doesn't fit in budget %d", high, budget)
+		}
+		users, assets := countUsers(histogram, low, high)
+		res = append(res, planTier(high, batchCounts, users, assets))
+		low = high
+	}
+	return newPlan(res), nil
+}
+
+// lessPlan orders the plans by proofs number first and then padding assets
+func lessPlan(a Plan, b Plan) bool {
+	if a.Proofs != b.Proofs {
+		return a.Proofs < b.Proofs
+	}
+	return a.PaddingAssets < b.PaddingAssets
+}
+
+// PlanTiers suggests at most maxTiers asset counts tiers which minimise the
+// total proofs number and then the padding assets of the users in histogram.
+// The key of histogram is the asset counts of a user, the value is the number of such users.
+func PlanTiers(histogram map[int]int, model CostModel, budget int, maxTiers int) (Plan, error) {
+	if maxTiers <= 0 {
+		return Plan{}, errors.New("max tiers must be positive")
+	}
+	// a tier boundary is always one of the asset counts of users,
+	// increasing it to the next one only adds padding
+	candidates := make([]int, 0, len(histogram))
+	for k, v := range histogram {
+		if v != 0 {
+			candidates = append(candidates, max(k, 1))
+		}
+	}
+	sort.Ints(candidates)
+	candidates = compactInts(candidates)
+	if len(candidates) == 0 {
+		return Plan{}, errors.New("no users in histogram")
+	}
+	if candidates[len(candidates)-1] > utils.AssetCounts {
+		return Plan{}, fmt.Errorf("users own %d assets which is more than asset counts %d", candidates[len(candidates)-1], utils.AssetCounts)
+	}
+	batchCounts := make([]int, len(candidates))
+	// prefixUsers[j] and prefixAssets[j] are the users whose asset counts
+	// are not bigger than candidates[j] and the total asset counts of them
+	prefixUsers := make([]int, len(candidates))
+	prefixAssets := make([]int, len(candidates))
+	low := -1
+	for i, c := range candidates {
+		batchCounts[i] = model.TierCost(c).BatchCounts(budget)
+		prefixUsers[i], prefixAssets[i] = countUsers(histogram, low, c)
+		if i > 0 {
+			prefixUsers[i] += prefixUsers[i-1]
+			prefixAssets[i] += prefixAssets[i-1]
+		}
+		low = c
+	}
+
+	// best[t][j] is the best plan of the users whose asset counts are not
+	// bigger than candidates[j], using t+1 tiers and the last tier is candidates[j]
+	best := make([][]*Plan, maxTiers)
+	for t := 0; t < maxTiers; t++ {
+		best[t] = make([]*Plan, len(candidates))
+		for j := 0; j < len(candidates); j++ {
+			if batchCounts[j] == 0 {
+				continue
+			}
+			if t == 0 {
+				p := newPlan([]TierPlan{planTier(candidates[j], batchCounts[j], prefixUsers[j], prefixAssets[j])})
+				best[t][j] = &p
+				continue
+			}
+			for i := 0; i < j; i++ {
+				if best[t-1][i] == nil {
+					continue
+				}
+				tier := planTier(candidates[j], batchCounts[j], prefixUsers[j]-prefixUsers[i], prefixAssets[j]-prefixAssets[i])
+				tiers := append(append([]TierPlan(nil), best[t-1][i].Tiers...), tier)
+				p := newPlan(tiers)
+				if best[t][j] == nil || lessPlan(p, *best[t][j]) {
+					best[t][j] = &p
+				}
+			}
+		}
+	}
+	var res *Plan
+	for t := 0; t < maxTiers; t++ {
+		p := best[t][len(candidates)-1]
+		if p != nil && (res == nil || lessPlan(*p, *res)) {
+			res = p
+		}
+	}
+	if res == nil {
+		return Plan{}, fmt.Errorf("the batch of tier %d doesn't fit in budget %d", candidates[len(candidates)-1], budget)
+	}
+	return *res, nil
+}
+
+func compactInts(s []int) []int {
+	res := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// ReadAssetCountsHistogram counts the users of every asset counts in the user
+// files of dirname, an asset is counted if its equity or debt is not zero
+// like utils.ReadUserDataFromCsvFile. The rows with invalid data are skipped.
+func ReadAssetCountsHistogram(dirname string) (map[int]int, error) {
+	const CEX_ASSET_INFO_FILE string = "cex_assets_info.csv"
+	userFiles, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := utils.ParseAssetRegistryFromFile(filepath.Join(dirname, utils.AssetRegistryFile))
+	if err != nil {
+		return nil, err
+	}
+	cexAssetsInfo, err := utils.ParseCexAssetInfoFromFile(filepath.Join(dirname, CEX_ASSET_INFO_FILE), registry)
+	if err != nil {
+		return nil, err
+	}
+	histogram := make(map[int]int)
+	numOfAssetColumns := utils.GetNumOfAssetFields()
+	for _, userFile := range userFiles {
+		if !strings.Contains(userFile.Name(), ".csv") || userFile.Name() == CEX_ASSET_INFO_FILE || userFile.Name() == utils.AssetRegistryFile {
+			continue
+		}
+		name := filepath.Join(dirname, userFile.Name())
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		assetIndexes, err := utils.CheckUserFileHeader(name, data[0], cexAssetsInfo)
+		if err != nil {
+			return nil, err
+		}
+		invalidCounts := 0
+		for _, row := range data[1:] {
+			count := 0
+			for j, index := range assetIndexes {
+				decimals := cexAssetsInfo[index].BalanceDecimals
+				equity, err := utils.ConvertFloatStrToUint128(row[j*numOfAssetColumns+2], decimals)
+				if err != nil {
+					count = -1
+					break
+				}
+				debt, err := utils.ConvertFloatStrToUint128(row[j*numOfAssetColumns+3], decimals)
+				if err != nil {
+					count = -1
+					break
+				}
+				if !equity.IsZero() || !debt.IsZero() {
+					count += 1
+				}
+			}
+			if count < 0 {
+				invalidCounts += 1
+				continue
+			}
+			histogram[count] += 1
+		}
+		fmt.Println(name, "invalid accounts number is", invalidCounts)
+	}
+	return histogram, nil
+}
@@ -0,0 +1,94 @@
+package planner
+
+import (
+	"testing"
+)
+
+func TestFitTierCost(t *testing.T) {
+	probes := []Probe{
+		{AssetCounts: 50, BatchCounts: 1, Constraints: 6_617_300},
+		{AssetCounts: 50, BatchCounts: 2, Constraints: 6_659_600},
+		{AssetCounts: 50, BatchCounts: 4, Constraints: 6_744_200},
+	}
+	c, err := FitTierCost(probes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Base != 6_575_000 || c.PerUser != 42_300 {
+		t.Fatalf("got base %f per user %f", c.Base, c.PerUser)
+	}
+	if n := c.BatchCounts(1 << 26); n != 1431 {
+		t.Errorf("got batch counts %d, want 1431", n)
+	}
+
+	if _, err = FitTierCost(probes[:1]); err == nil {
+		t.Error("expected error for one probe, got nil")
+	}
+	probes[1].AssetCounts = 500
+	if _, err = FitTierCost(probes); err == nil {
+		t.Error("expected error for probes of different asset counts, got nil")
+	}
+}
+
+func TestPlanTiers(t *testing.T) {
+	// the batch counts of tier k is 1000 / k
+	model, err := NewCostModel([]TierCost{
+		{AssetCounts: 1, Base: 0, PerUser: 1},
+		{AssetCounts: 2, Base: 0, PerUser: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := 1000
+	histogram := map[int]int{
+		1:   9000,
+		2:   1000,
+		100: 10,
+	}
+
+	current, err := EvaluateTiers(histogram, []int{100}, model, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10010 users in batches of 10
+	if current.Proofs != 1001 {
+		t.Errorf("got %d proofs of one tier, want 1001", current.Proofs)
+	}
+
+	plan, err := PlanTiers(histogram, model, budget, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tiers) != 1 || plan.Tiers[0].AssetCounts != 100 || plan.Proofs != current.Proofs {
+		t.Errorf("got plan %+v of one tier", plan)
+	}
+
+	plan, err = PlanTiers(histogram, model, budget, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tiers 2 and 100: 10000 users in batches of 500 and 10 users in one batch
+	if len(plan.Tiers) != 2 || plan.Tiers[0].AssetCounts != 2 || plan.Tiers[1].AssetCounts != 100 || plan.Proofs != 21 {
+		t.Errorf("got plan %+v of two tiers", plan)
+	}
+
+	plan, err = PlanTiers(histogram, model, budget, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tiers 1, 2 and 100: 9 + 2 + 1 proofs
+	if len(plan.Tiers) != 3 || plan.Proofs != 12 {
+		t.Errorf("got plan %+v of three tiers", plan)
+	}
+	wantPadding := plan.Tiers[1].PaddingUsers*2 + plan.Tiers[2].PaddingUsers*100
+	if plan.PaddingAssets != wantPadding {
+		t.Errorf("got padding assets %d, want %d", plan.PaddingAssets, wantPadding)
+	}
+
+	if _, err = PlanTiers(histogram, model, 5, 2); err == nil {
+		t.Error("expected error when the biggest tier doesn't fit in budget, got nil")
+	}
+	if _, err = EvaluateTiers(histogram, []int{2}, model, budget); err == nil {
+		t.Error("expected error when the tiers can't hold all users, got nil")
+	}
+}
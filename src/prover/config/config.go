@@ -7,6 +7,13 @@ type Config struct {
 		Host     	string
 		Password  	string
 	}
+	// Backend is the proving backend of the keys in ZkKeyName: groth16 (default) or plonk
+	Backend   string
 	ZkKeyName []string
 	AssetsCountTiers []int
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+	// Incremental is true if the witnesses are generated by an incremental audit,
+	// ZkKeyName must be the keys of the update circuit generated by keygen with -incremental
+	Incremental bool
 }
@@ -23,6 +23,14 @@ func main() {
 	if len(proverConfig.AssetsCountTiers) != len(proverConfig.ZkKeyName) {
 		panic("asset tiers and asset tier names should have the same length")
 	}
+	if err = utils.InitCircuitParams(proverConfig.CircuitParams); err != nil {
+		panic(err.Error())
+	}
+	for _, zkKeyName := range proverConfig.ZkKeyName {
+		if err = utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+			panic(err.Error())
+		}
+	}
 	remotePasswdConfig := flag.String("remote_password_config", "", "fetch password from aws secretsmanager")
 	rerun := flag.Bool("rerun", false, "flag which indicates rerun proof generation")
 	flag.Parse()
@@ -34,8 +34,15 @@ type (
 		BatchCommitment         string
 		MinAccountIndex         uint32
 		MaxAccountIndex         uint32
-		AssetsCount             int
-		BatchNumber             int64 `gorm:"index:idx_number,unique"`
+		UserCount               uint32
+		// OldUserCount is the user count of the old leaves of an update batch,
+		// UserCount is the user count of its new leaves
+		OldUserCount    uint32
+		SnapshotId      uint64
+		AccountIdsCheck string
+		AssetsCount     int
+		Backend         string
+		BatchNumber     int64 `gorm:"index:idx_number,unique"`
 	}
 )
 
@@ -16,8 +16,6 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/prover/config"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
-	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/constraint/solver"
 	"github.com/consensys/gnark/frontend"
@@ -32,14 +30,17 @@ type Prover struct {
 	proofModel   ProofModel
 	redisCli     *redis.Client
 
-	VerifyingKey groth16.VerifyingKey
-	ProvingKey   groth16.ProvingKey
+	Backend      string
+	VerifyingKey circuit.VerifyingKey
+	ProvingKey   circuit.ProvingKey
 	SessionName   []string
 	AssetsCountTiers    []int
 	R1cs          constraint.ConstraintSystem
 
 	CurrentSnarkParamsInUse int
 	TaskQueueName string
+	// Incremental is true if the witnesses are batches of BatchUpdateUserCircuit
+	Incremental bool
 }
 
 func NewProver(config *config.Config) *Prover {
@@ -53,15 +54,21 @@ func NewProver(config *config.Config) *Prover {
 		Password: config.Redis.Password,
 	})
 	taskQueueName := "por_batch_task_queue_" + config.DbSuffix
+	backend, err := circuit.ParseProvingBackend(config.Backend)
+	if err != nil {
+		panic(err.Error())
+	}
 
 	prover := Prover{
 		witnessModel: witness.NewWitnessModel(db, config.DbSuffix),
 		proofModel:   NewProofModel(db, config.DbSuffix),
 		redisCli:     redisCli,
+		Backend:      backend,
 		SessionName:  config.ZkKeyName,
 		AssetsCountTiers:  config.AssetsCountTiers,
 		CurrentSnarkParamsInUse: 0,
 		TaskQueueName: taskQueueName,
+		Incremental:   config.Incremental,
 	}
 
 	// std.RegisterHints()
@@ -176,12 +183,51 @@ func (p *Prover) Run(flag bool) {
 		}
 
 		for _, batchWitness := range batchWitnesses {
-			witnessForCircuit := utils.DecodeBatchWitness(batchWitness.WitnessData)
+			var proof circuit.Proof
+			var assetsCount int
+			var batchCommitment []byte
+			var minAccountIndex, maxAccountIndex, userCount, oldUserCount uint32
+			var snapshotId uint64
+			var accountIdsCheck []byte
 			cexAssetListCommitments := make([][]byte, 2)
-			cexAssetListCommitments[0] = witnessForCircuit.BeforeCEXAssetsCommitment
-			cexAssetListCommitments[1] = witnessForCircuit.AfterCEXAssetsCommitment
-			accountTreeRoots := make([][]byte, 1)
-			accountTreeRoots[0] = witnessForCircuit.AccountTreeRoot
+			var accountTreeRoots [][]byte
+			if p.Incremental {
+				witnessForCircuit := utils.DecodeBatchUpdateWitness(batchWitness.WitnessData)
+				if witnessForCircuit == nil {
+					fmt.Println("decode batch witness failed")
+					return
+				}
+				cexAssetListCommitments[0] = witnessForCircuit.BeforeCEXAssetsCommitment
+				cexAssetListCommitments[1] = witnessForCircuit.AfterCEXAssetsCommitment
+				// the account tree roots before and after the batch
+				accountTreeRoots = [][]byte{witnessForCircuit.BeforeAccountTreeRoot, witnessForCircuit.AfterAccountTreeRoot}
+				batchCommitment = witnessForCircuit.BatchCommitment
+				userCount = witnessForCircuit.NewUserCount
+				oldUserCount = witnessForCircuit.OldUserCount
+				snapshotId = witnessForCircuit.SnapshotId
+				proof, assetsCount, err = p.GenerateAndVerifyUpdateProof(witnessForCircuit, batchWitness.Height)
+			} else {
+				witnessForCircuit := utils.DecodeBatchWitness(batchWitness.WitnessData)
+				cexAssetListCommitments[0] = witnessForCircuit.BeforeCEXAssetsCommitment
+				cexAssetListCommitments[1] = witnessForCircuit.AfterCEXAssetsCommitment
+				accountTreeRoots = make([][]byte, 1)
+				accountTreeRoots[0] = witnessForCircuit.AccountTreeRoot
+				batchCommitment = witnessForCircuit.BatchCommitment
+				minAccountIndex = witnessForCircuit.MinAccountIndex
+				maxAccountIndex = witnessForCircuit.MaxAccountIndex
+				userCount = witnessForCircuit.UserCount
+				snapshotId = witnessForCircuit.SnapshotId
+				accountIdsCheck, err = json.Marshal(witnessForCircuit.AccountIds)
+				if err != nil {
+					fmt.Println("marshal account ids check failed: ", err.Error())
+					return
+				}
+				proof, assetsCount, err = p.GenerateAndVerifyProof(witnessForCircuit, batchWitness.Height)
+			}
+			if err != nil {
+				fmt.Println("generate and verify proof error:", err.Error())
+				return
+			}
 			cexAssetListCommitmentsSerial, err := json.Marshal(cexAssetListCommitments)
 			if err != nil {
 				fmt.Println("marshal cex asset list failed: ", err.Error())
@@ -192,11 +238,6 @@ func (p *Prover) Run(flag bool) {
 				fmt.Println("marshal account tree root failed: ", err.Error())
 				return
 			}
-			proof, assetsCount, err := p.GenerateAndVerifyProof(witnessForCircuit, batchWitness.Height)
-			if err != nil {
-				fmt.Println("generate and verify proof error:", err.Error())
-				return
-			}
 			var buf bytes.Buffer
 			_, err = proof.WriteRawTo(&buf)
 			if err != nil {
@@ -229,10 +270,15 @@ func (p *Prover) Run(flag bool) {
 				BatchNumber:             batchWitness.Height,
 				CexAssetListCommitments: string(cexAssetListCommitmentsSerial),
 				AccountTreeRoots:        string(accountTreeRootsSerial),
-				BatchCommitment:         base64.StdEncoding.EncodeToString(witnessForCircuit.BatchCommitment),
-				MinAccountIndex:         witnessForCircuit.MinAccountIndex,
-				MaxAccountIndex:         witnessForCircuit.MaxAccountIndex,
+				BatchCommitment:         base64.StdEncoding.EncodeToString(batchCommitment),
+				MinAccountIndex:         minAccountIndex,
+				MaxAccountIndex:         maxAccountIndex,
+				UserCount:               userCount,
+				OldUserCount:            oldUserCount,
+				SnapshotId:              snapshotId,
+				AccountIdsCheck:         string(accountIdsCheck),
 				AssetsCount:             assetsCount,
+				Backend:                 p.Backend,
 			}
 			err = p.proofModel.CreateProof(row)
 			if err != nil {
@@ -250,30 +296,33 @@ func (p *Prover) Run(flag bool) {
 func (p *Prover) GenerateAndVerifyProof(
 	batchWitness *utils.BatchCreateUserWitness,
 	batchNumber int64,
-) (proof groth16.Proof, assetsCount int, err error) {
+) (proof circuit.Proof, assetsCount int, err error) {
 	startTime := time.Now().UnixMilli()
 	fmt.Println("begin to generate proof for batch: ", batchNumber)
 	circuitWitness, _ := circuit.SetBatchCreateUserCircuitWitness(batchWitness)
 	// Lazy load r1cs, proving key and verifying key.
 	p.LoadSnarkParamsOnce(len(circuitWitness.CreateUserOps[0].Assets))
 	verifyWitness := circuit.NewVerifyBatchCreateUserCircuit(batchWitness.BatchCommitment)
-	witness, err := frontend.NewWitness(circuitWitness, ecc.BN254.ScalarField())
+	witness, err := frontend.NewWitness(circuitWitness, utils.CurveID().ScalarField())
 	if err != nil {
 		return proof, 0, err
 	}
 
-	vWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	vWitness, err := frontend.NewWitness(verifyWitness, utils.CurveID().ScalarField(), frontend.PublicOnly())
 	if err != nil {
 		return proof, 0, err
 	}
-	proof, err = groth16.Prove(p.R1cs, p.ProvingKey, witness)
+	proof, err = circuit.Prove(p.Backend, p.R1cs, p.ProvingKey, witness)
 	if err != nil {
+		// the solver error doesn't tell which user broke the circuit, the
+		// diagnosis runs the whole batch in the test engine, so leave it to dbtool
+		fmt.Printf("prove batch %d failed, run `dbtool -diagnose_witness %d` to find the user which breaks the circuit\n", batchNumber, batchNumber)
 		return proof, 0, err
 	}
 	endTime := time.Now().UnixMilli()
 	fmt.Println("proof generation cost ", endTime-startTime, " ms")
 
-	err = groth16.Verify(proof, p.VerifyingKey, vWitness)
+	err = circuit.Verify(p.Backend, proof, p.VerifyingKey, vWitness)
 	if err != nil {
 		return proof, 0, err
 	}
@@ -282,6 +331,46 @@ func (p *Prover) GenerateAndVerifyProof(
 	return proof, len(circuitWitness.CreateUserOps[0].Assets), nil
 }
 
+// GenerateAndVerifyUpdateProof proves a batch of BatchUpdateUserCircuit, the
+// keys of ZkKeyName must be generated by keygen with -incremental.
+func (p *Prover) GenerateAndVerifyUpdateProof(
+	batchWitness *utils.BatchUpdateUserWitness,
+	batchNumber int64,
+) (proof circuit.Proof, assetsCount int, err error) {
+	startTime := time.Now().UnixMilli()
+	fmt.Println("begin to generate update proof for batch: ", batchNumber)
+	circuitWitness, err := circuit.SetBatchUpdateUserCircuitWitness(batchWitness)
+	if err != nil {
+		return proof, 0, err
+	}
+	// Lazy load r1cs, proving key and verifying key.
+	p.LoadSnarkParamsOnce(batchWitness.AssetCounts)
+	verifyWitness := circuit.NewVerifyBatchUpdateUserCircuit(batchWitness.BatchCommitment)
+	witness, err := frontend.NewWitness(circuitWitness, utils.CurveID().ScalarField())
+	if err != nil {
+		return proof, 0, err
+	}
+
+	vWitness, err := frontend.NewWitness(verifyWitness, utils.CurveID().ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return proof, 0, err
+	}
+	proof, err = circuit.Prove(p.Backend, p.R1cs, p.ProvingKey, witness)
+	if err != nil {
+		return proof, 0, err
+	}
+	endTime := time.Now().UnixMilli()
+	fmt.Println("proof generation cost ", endTime-startTime, " ms")
+
+	err = circuit.Verify(p.Backend, proof, p.VerifyingKey, vWitness)
+	if err != nil {
+		return proof, 0, err
+	}
+	endTime2 := time.Now().UnixMilli()
+	fmt.Println("proof verification cost ", endTime2-endTime, " ms")
+	return proof, batchWitness.AssetCounts, nil
+}
+
 func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 	if targerAssetsCount == p.CurrentSnarkParamsInUse {
 		return
@@ -299,7 +388,7 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 	}
 	// Load r1cs, proving key and verifying key.
 	s := time.Now()
-	fmt.Println("begin loading r1cs of ", targerAssetsCount, " assets")
+	fmt.Println("begin loading", p.Backend, "constraint system of ", targerAssetsCount, " assets")
 	loadR1csChan := make(chan bool)
 	go func() {
 		for {
@@ -314,9 +403,9 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 		}
 	}()
 
-	p.R1cs = groth16.NewCS(ecc.BN254)
+	p.R1cs = circuit.NewConstraintSystem(p.Backend)
 
-	r1csFromFile, err := os.ReadFile(p.SessionName[index] + ".r1cs")
+	r1csFromFile, err := os.ReadFile(p.SessionName[index] + circuit.ConstraintSystemFileSuffix(p.Backend))
 	if err != nil {
 		panic("r1cs file load error..." + err.Error())
 	}
@@ -339,7 +428,7 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 		panic("provingKey file load error:" + err.Error())
 	}
 	buf = bytes.NewBuffer(pkFromFile)
-	p.ProvingKey = groth16.NewProvingKey(ecc.BN254)
+	p.ProvingKey = circuit.NewProvingKey(p.Backend)
 	n, err = p.ProvingKey.UnsafeReadFrom(buf)
 	if err != nil {
 		panic("provingKey loading error:" + err.Error())
@@ -355,7 +444,7 @@ func (p *Prover) LoadSnarkParamsOnce(targerAssetsCount int) {
 		panic("verifyingKey file load error:" + err.Error())
 	}
 	buf = bytes.NewBuffer(vkFromFile)
-	p.VerifyingKey = groth16.NewVerifyingKey(ecc.BN254)
+	p.VerifyingKey = circuit.NewVerifyingKey(p.Backend)
 	n, err = p.VerifyingKey.ReadFrom(buf)
 	if err != nil {
 		panic("verifyingKey loading error:" + err.Error())
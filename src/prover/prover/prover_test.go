@@ -37,7 +37,14 @@ func TestMockProver(t *testing.T) {
 	}
 	db, err := gorm.Open(mysql.Open(dbUri), &gorm.Config{Logger: newLogger})
 	if err != nil {
-		t.Errorf("error: %s\n", err.Error())
+		t.Skipf("mysql is not available: %s", err.Error())
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Skipf("mysql is not available: %s", err.Error())
+	}
+	if err = sqlDB.Ping(); err != nil {
+		t.Skipf("mysql is not available: %s", err.Error())
 	}
 	// write test data to db
 	witnessTable := witness.NewWitnessModel(db, "test")
@@ -85,6 +92,9 @@ func TestMockProver(t *testing.T) {
 	redisCli := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 	})
+	if err = redisCli.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis is not available: %s", err.Error())
+	}
 	_, err = redisCli.Del(ctx, taskQueueName).Result()
 	if err == nil {
 		fmt.Println("delete task queue successfully")
@@ -0,0 +1,14 @@
+package config
+
+type Config struct {
+	MysqlDataSource string
+	DbSuffix        string
+	// ReservesFile is the csv file of the reserves of every cex asset
+	ReservesFile string
+	// Backend is the proving backend of the reserves keys: groth16 (default), groth16_evm or plonk
+	Backend         string
+	ReservesKeyName string
+	ReservesProof   string
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+}
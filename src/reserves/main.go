@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/reserves/config"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test/unsafekzg"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func setup(backend string, keyName string, srsFile string, unsafeSrs bool) {
+	startTime := time.Now()
+	ccs, err := circuit.Compile(backend, circuit.NewReservesComparisonCircuit(uint32(utils.AssetCounts)))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("constraint system generation time is ", time.Since(startTime))
+	fmt.Println("reserves comparison constraints number is ", ccs.GetNbConstraints())
+	var srs, srsLagrange kzg.SRS
+	if circuit.IsPlonk(backend) {
+		if srsFile != "" {
+			srs, srsLagrange, err = circuit.LoadKzgSrs(srsFile, ccs)
+		} else if unsafeSrs {
+			fmt.Println("WARNING: using a locally generated kzg srs, the keys must not be used in production")
+			srs, srsLagrange, err = unsafekzg.NewSRS(ccs)
+		} else {
+			panic("plonk backend needs a kzg srs, please specify -srs")
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	pk, vk, err := circuit.Setup(backend, ccs, srs, srsLagrange)
+	if err != nil {
+		panic(err)
+	}
+	files := map[string]io.WriterTo{
+		keyName + ".pk": pk,
+		keyName + ".vk": vk,
+		keyName + circuit.ConstraintSystemFileSuffix(backend): ccs,
+	}
+	for fileName, v := range files {
+		f, err := os.Create(fileName)
+		if err != nil {
+			panic(err)
+		}
+		n, err := v.WriteTo(f)
+		if err != nil {
+			panic(err)
+		}
+		f.Close()
+		fmt.Println(fileName, " size is ", n)
+	}
+	if err = utils.WriteCircuitParams(keyName + utils.CircuitParamsFileSuffix); err != nil {
+		panic(err)
+	}
+}
+
+// loadFinalCexAssets returns the cex assets after the last batch and the
+// blinding factor of their commitments.
+func loadFinalCexAssets(reservesConfig *config.Config) ([]utils.CexAssetInfo, []byte) {
+	db, err := gorm.Open(mysql.Open(reservesConfig.MysqlDataSource))
+	if err != nil {
+		panic(err.Error())
+	}
+	witnessModel := witness.NewWitnessModel(db, reservesConfig.DbSuffix)
+	latestWitness, err := witnessModel.GetLatestBatchWitness()
+	if err != nil {
+		panic(err.Error())
+	}
+	batchWitness := utils.DecodeBatchWitness(latestWitness.WitnessData)
+	if batchWitness == nil {
+		panic("decode invalid witness data")
+	}
+	return utils.RecoverAfterCexAssets(batchWitness), batchWitness.CexAssetsBlinding
+}
+
+// checkReserves fails fast instead of failing to solve the circuit if the
+// reserves of an asset are less than its liabilities.
+func checkReserves(cexAssets []utils.CexAssetInfo, reserves []utils.Uint128) {
+	for i := 0; i < len(cexAssets); i++ {
+		liabilities, underflow := cexAssets[i].TotalEquity.Sub(cexAssets[i].TotalDebt)
+		if !underflow && reserves[i].Cmp(liabilities) < 0 {
+			panic("the reserves of asset " + cexAssets[i].Symbol + " are less than its liabilities")
+		}
+	}
+}
+
+func prove(backend string, reservesWitness *utils.ReservesComparisonWitness, keyName string, outputFile string) {
+	ccs := circuit.NewConstraintSystem(backend)
+	pk := circuit.NewProvingKey(backend)
+	vk := circuit.NewVerifyingKey(backend)
+	for fileName, v := range map[string]io.ReaderFrom{
+		keyName + circuit.ConstraintSystemFileSuffix(backend): ccs,
+		keyName + ".pk": pk,
+		keyName + ".vk": vk,
+	} {
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = v.ReadFrom(bytes.NewBuffer(content)); err != nil {
+			panic(err)
+		}
+	}
+
+	assignment, err := circuit.SetReservesComparisonCircuitWitness(reservesWitness)
+	if err != nil {
+		panic(err)
+	}
+	fullWitness, err := frontend.NewWitness(assignment, utils.CurveID().ScalarField())
+	if err != nil {
+		panic(err)
+	}
+	publicWitness, err := fullWitness.Public()
+	if err != nil {
+		panic(err)
+	}
+	startTime := time.Now()
+	proof, err := circuit.Prove(backend, ccs, pk, fullWitness)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("reserves proof generation cost ", time.Since(startTime))
+	err = circuit.Verify(backend, proof, vk, publicWitness)
+	if err != nil {
+		panic(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err = proof.WriteRawTo(&buf); err != nil {
+		panic(err)
+	}
+	reservesProof := utils.ReservesProof{
+		Backend:                  backend,
+		Proof:                    buf.Bytes(),
+		EmptyCEXAssetsCommitment: reservesWitness.EmptyCEXAssetsCommitment,
+		FinalCEXAssetsCommitment: reservesWitness.FinalCEXAssetsCommitment,
+		Reserves:                 reservesWitness.Reserves,
+	}
+	content, err := json.MarshalIndent(reservesProof, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(outputFile, content, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Println("write reserves proof into ", outputFile)
+}
+
+func main() {
+	setupFlag := flag.Bool("setup", false, "generate the keys of the reserves comparison circuit")
+	srsFile := flag.String("srs", "", "canonical bn254 kzg srs file used by the plonk backend")
+	unsafeSrs := flag.Bool("unsafe_srs", false, "generate a local kzg srs for the plonk backend, only for test")
+	remotePasswdConfig := flag.String("remote_password_config", "", "fetch password from aws secretsmanager")
+	flag.Parse()
+
+	reservesConfig := &config.Config{}
+	content, err := os.ReadFile("config/config.json")
+	if err != nil {
+		panic(err.Error())
+	}
+	err = json.Unmarshal(content, reservesConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	if *remotePasswdConfig != "" {
+		s, err := utils.GetMysqlSource(reservesConfig.MysqlDataSource, *remotePasswdConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		reservesConfig.MysqlDataSource = s
+	}
+	if err = utils.InitCircuitParams(reservesConfig.CircuitParams); err != nil {
+		panic(err.Error())
+	}
+	backend, err := circuit.ParseProvingBackend(reservesConfig.Backend)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if *setupFlag {
+		setup(backend, reservesConfig.ReservesKeyName, *srsFile, *unsafeSrs)
+	} else {
+		if err = utils.CheckCircuitParamsOfKey(reservesConfig.ReservesKeyName); err != nil {
+			panic(err.Error())
+		}
+		cexAssets, blinding := loadFinalCexAssets(reservesConfig)
+		reserves, err := utils.ParseReservesFromFile(reservesConfig.ReservesFile, cexAssets)
+		if err != nil {
+			panic(err.Error())
+		}
+		checkReserves(cexAssets, reserves)
+		reservesWitness := utils.NewReservesComparisonWitness(cexAssets, blinding, reserves)
+		prove(backend, reservesWitness, reservesConfig.ReservesKeyName, reservesConfig.ReservesProof)
+	}
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// AccountIdsCheck proves that the account ids of all the batches are distinct.
+// Every batch carries a chunk of the sorted account ids of the whole tree,
+// the chunks are strictly increasing across the ops and the batches, and the
+// running product of (Challenge - id) / (Challenge - sorted id) over all the
+// batches is 1, so the account ids of the ops are a permutation of the sorted
+// account ids. Challenge chains the hashes of all the chunks from the account
+// tree root, so it can't be chosen after the sorted account ids.
+type AccountIdsCheck struct {
+	// SortedAccountIdsHash is the hash of the sorted account ids of the batch
+	SortedAccountIdsHash []byte
+	// the last sorted account id of the previous batches, zero for the first batch,
+	// and of the batch
+	BeforeLastAccountId []byte
+	AfterLastAccountId  []byte
+	Challenge           []byte
+	// the running product before and after the batch, it is 1 before the
+	// first batch and after the last batch
+	BeforeProduct []byte
+	AfterProduct  []byte
+}
+
+// Commitment returns the hash of c, which is part of the BatchCommitment.
+func (c *AccountIdsCheck) Commitment() []byte {
+	return HashBytes(c.SortedAccountIdsHash, c.BeforeLastAccountId, c.AfterLastAccountId,
+		c.Challenge, c.BeforeProduct, c.AfterProduct)
+}
+
+// InitialAccountIdsProduct returns the running product before the first batch.
+func InitialAccountIdsProduct() []byte {
+	return big.NewInt(1).FillBytes(make([]byte, FieldElementSize))
+}
+
+// ComputeAccountIdsChallenge returns the Challenge of the AccountIdsCheck of
+// all the batches from the SortedAccountIdsHash of the batches in order. The
+// hashes are chained one by one from the account tree root, so that the
+// aggregation proof of consecutive batches can carry the partial chain.
+func ComputeAccountIdsChallenge(accountTreeRoot []byte, sortedAccountIdsHashes [][]byte) []byte {
+	challenge := accountTreeRoot
+	for _, hash := range sortedAccountIdsHashes {
+		challenge = ChainAccountIdsHash(challenge, hash)
+	}
+	return challenge
+}
+
+// ChainAccountIdsHash appends the SortedAccountIdsHash of one batch to the chain
+// of the hashes of the previous batches.
+func ChainAccountIdsHash(chain []byte, sortedAccountIdsHash []byte) []byte {
+	return HashBytes(chain, sortedAccountIdsHash)
+}
+
+// NewAccountIdsChecks returns the AccountIdsCheck and the sorted account ids of
+// every batch, batchAccountIds are the account ids of the ops of the batches
+// in order. It returns an error if the account ids are not distinct.
+func NewAccountIdsChecks(accountTreeRoot []byte, batchAccountIds [][][]byte) ([]AccountIdsCheck, [][][]byte, error) {
+	count := 0
+	for _, ids := range batchAccountIds {
+		count += len(ids)
+	}
+	sortedIds := make([][]byte, 0, count)
+	for _, ids := range batchAccountIds {
+		for _, id := range ids {
+			if len(id) != FieldElementSize {
+				return nil, nil, fmt.Errorf("invalid account id %x, expected %d bytes", id, FieldElementSize)
+			}
+			sortedIds = append(sortedIds, id)
+		}
+	}
+	// the big endian bytes of the same size are sorted as numbers
+	sort.Slice(sortedIds, func(i, j int) bool {
+		return bytes.Compare(sortedIds[i], sortedIds[j]) < 0
+	})
+	for i := 1; i < len(sortedIds); i++ {
+		if bytes.Equal(sortedIds[i-1], sortedIds[i]) {
+			return nil, nil, fmt.Errorf("duplicate account id %x", sortedIds[i])
+		}
+	}
+
+	checks := make([]AccountIdsCheck, len(batchAccountIds))
+	sortedChunks := make([][][]byte, len(batchAccountIds))
+	hashes := make([][]byte, len(batchAccountIds))
+	offset := 0
+	for i, ids := range batchAccountIds {
+		sortedChunks[i] = sortedIds[offset : offset+len(ids)]
+		offset += len(ids)
+		hashes[i] = HashBytes(sortedChunks[i]...)
+	}
+	challenge := ComputeAccountIdsChallenge(accountTreeRoot, hashes)
+
+	modulus := FieldModulus()
+	gamma := new(big.Int).SetBytes(challenge)
+	product := big.NewInt(1)
+	lastId := make([]byte, FieldElementSize)
+	for i, ids := range batchAccountIds {
+		checks[i] = AccountIdsCheck{
+			SortedAccountIdsHash: hashes[i],
+			BeforeLastAccountId:  lastId,
+			Challenge:            challenge,
+			BeforeProduct:        product.FillBytes(make([]byte, FieldElementSize)),
+		}
+		numerator, denominator := big.NewInt(1), big.NewInt(1)
+		for j := range ids {
+			numerator.Mul(numerator, subFromChallenge(gamma, ids[j], modulus)).Mod(numerator, modulus)
+			denominator.Mul(denominator, subFromChallenge(gamma, sortedChunks[i][j], modulus)).Mod(denominator, modulus)
+		}
+		if denominator.ModInverse(denominator, modulus) == nil {
+			return nil, nil, fmt.Errorf("the challenge of the account ids is one of the account ids")
+		}
+		product.Mul(product, numerator).Mod(product, modulus)
+		product.Mul(product, denominator).Mod(product, modulus)
+		if len(ids) > 0 {
+			lastId = sortedChunks[i][len(ids)-1]
+		}
+		checks[i].AfterLastAccountId = lastId
+		checks[i].AfterProduct = product.FillBytes(make([]byte, FieldElementSize))
+	}
+	return checks, sortedChunks, nil
+}
+
+func subFromChallenge(challenge *big.Int, id []byte, modulus *big.Int) *big.Int {
+	v := new(big.Int).Sub(challenge, new(big.Int).SetBytes(id))
+	return v.Mod(v, modulus)
+}
+
+// CheckAccountIdsChain checks the AccountIdsCheck of all the batches in order
+// are chained from the initial state to the final state, then the account ids
+// of the batches are distinct if the batch proofs are valid.
+func CheckAccountIdsChain(accountTreeRoot []byte, checks []AccountIdsCheck) error {
+	if len(checks) == 0 {
+		return fmt.Errorf("no account ids checks")
+	}
+	hashes := make([][]byte, len(checks))
+	for i := range checks {
+		hashes[i] = checks[i].SortedAccountIdsHash
+	}
+	challenge := ComputeAccountIdsChallenge(accountTreeRoot, hashes)
+	zero := make([]byte, FieldElementSize)
+	for i := range checks {
+		if !bytes.Equal(checks[i].Challenge, challenge) {
+			return fmt.Errorf("the account ids challenge of batch %d doesn't match", i)
+		}
+		if i == 0 {
+			if !bytes.Equal(checks[i].BeforeLastAccountId, zero) || !bytes.Equal(checks[i].BeforeProduct, InitialAccountIdsProduct()) {
+				return fmt.Errorf("the account ids check of batch 0 doesn't start from the initial state")
+			}
+			continue
+		}
+		if !bytes.Equal(checks[i].BeforeLastAccountId, checks[i-1].AfterLastAccountId) ||
+			!bytes.Equal(checks[i].BeforeProduct, checks[i-1].AfterProduct) {
+			return fmt.Errorf("the account ids check of batch %d doesn't match the previous batch", i)
+		}
+	}
+	if !bytes.Equal(checks[len(checks)-1].AfterProduct, InitialAccountIdsProduct()) {
+		return fmt.Errorf("the account ids of the batches are not a permutation of the sorted account ids")
+	}
+	return nil
+}
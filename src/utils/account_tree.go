@@ -1,10 +1,17 @@
 package utils
 
 import (
-	"hash"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils/merkletree"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 )
 
 var (
@@ -12,18 +19,102 @@ var (
 )
 
 func NewAccountTree(capacity int) (*merkletree.FixedDepthMerkleTree, error) {
-	return merkletree.NewFixedDepthMerkleTree(
+	return NewAccountTreeWithStorage(capacity, merkletree.MemoryStorage{})
+}
+
+// NewAccountTreeWithStorage returns the account tree whose nodes are kept in
+// storage, such as merkletree.FileStorage for more accounts than fit in memory.
+func NewAccountTreeWithStorage(capacity int, storage merkletree.Storage) (*merkletree.FixedDepthMerkleTree, error) {
+	if uint64(capacity) > uint64(1)<<uint(AccountTreeDepth) {
+		storage.Close()
+		return nil, fmt.Errorf("the accounts number %d exceeds the capacity of account tree depth %d", capacity, AccountTreeDepth)
+	}
+	return merkletree.NewFixedDepthMerkleTreeWithStorage(
 		AccountTreeDepth,
 		NilAccountHash,
-		func() hash.Hash {
-			return poseidon.NewPoseidon()
-		},
+		NewHasher,
 		capacity,
-	), nil
+		storage,
+	)
 }
 
 func VerifyMerkleProof(root []byte, accountIndex uint32, proof [][]byte, node []byte) bool {
-	return merkletree.VerifyProof(root, accountIndex, proof, node, AccountTreeDepth, func() hash.Hash {
-		return poseidon.NewPoseidon()
-	})
+	return merkletree.VerifyProof(root, accountIndex, proof, node, AccountTreeDepth, NewHasher)
+}
+
+// VerifyCompactMerkleProof verifies the compact merkle proof of the account,
+// which is encoded by merkletree.CompactProof.Bytes.
+func VerifyCompactMerkleProof(root []byte, accountIndex uint32, proof []byte, node []byte) bool {
+	compactProof, err := merkletree.ParseCompactProof(proof, AccountTreeDepth, len(NilAccountHash))
+	if err != nil {
+		return false
+	}
+	nilHashes := merkletree.NilHashes(AccountTreeDepth, NilAccountHash, NewHasher)
+	return merkletree.VerifyCompactProof(root, accountIndex, compactProof, node, nilHashes, NewHasher)
+}
+
+// VerifyAccountRangeMultiProof verifies the multiproof of the accounts from
+// minAccountIndex to maxAccountIndex, such as the accounts of a batch, which
+// is encoded by merkletree.MultiProof.Bytes. leaves are the account leaf
+// hashes in index order.
+func VerifyAccountRangeMultiProof(root []byte, minAccountIndex, maxAccountIndex uint32, proof []byte, leaves [][]byte) bool {
+	multiProof, err := merkletree.ParseMultiProof(proof, AccountTreeDepth, len(NilAccountHash), len(leaves))
+	if err != nil || minAccountIndex > maxAccountIndex ||
+		uint64(len(multiProof.Keys)) != uint64(maxAccountIndex-minAccountIndex)+1 ||
+		multiProof.Keys[0] != minAccountIndex {
+		return false
+	}
+	nilHashes := merkletree.NilHashes(AccountTreeDepth, NilAccountHash, NewHasher)
+	return merkletree.VerifyMultiProof(root, multiProof, leaves, nilHashes, NewHasher)
+}
+
+// AccountTreeFingerprint returns the fingerprint of the input data of the
+// account tree: the circuit parameters, the collateral categories and the csv
+// files of the user data directories. The snapshot of the account tree is
+// reused only if the fingerprint matches.
+func AccountTreeFingerprint(userDataDirs ...string) ([]byte, error) {
+	h := sha256.New()
+	params, err := json.Marshal(CurrentCircuitParams())
+	if err != nil {
+		return nil, err
+	}
+	h.Write(params)
+	h.Write([]byte(strings.Join(CollateralCategories, ",")))
+	for _, dirname := range userDataDirs {
+		files, err := os.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(files))
+		for _, file := range files {
+			if strings.Contains(file.Name(), ".csv") {
+				names = append(names, file.Name())
+			}
+		}
+		sort.Strings(names)
+		count := make([]byte, 8)
+		binary.BigEndian.PutUint64(count, uint64(len(names)))
+		h.Write(count)
+		for _, name := range names {
+			f, err := os.Open(filepath.Join(dirname, name))
+			if err != nil {
+				return nil, err
+			}
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			size := make([]byte, 8)
+			binary.BigEndian.PutUint64(size, uint64(info.Size()))
+			h.Write([]byte(name))
+			h.Write(size)
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h.Sum(nil), nil
 }
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// AggregatedRange is the state before and after the consecutive batches proven
+// by one aggregation proof, its Commitment is the only public input of the proof.
+// The account ids checks of the batches are chained as CheckAccountIdsChain,
+// and BeforeAccountIdsHash and AfterAccountIdsHash are the chain of
+// ComputeAccountIdsChallenge before and after the batches.
+type AggregatedRange struct {
+	AccountTreeRoot           []byte
+	SnapshotId                uint64
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+	MinAccountIndex           uint32
+	MaxAccountIndex           uint32
+	UserCount                 uint64
+	AccountIdsChallenge       []byte
+	BeforeLastAccountId       []byte
+	AfterLastAccountId        []byte
+	BeforeAccountIdsProduct   []byte
+	AfterAccountIdsProduct    []byte
+	BeforeAccountIdsHash      []byte
+	AfterAccountIdsHash       []byte
+}
+
+// Commitment returns the hash of r, which is the public input of its aggregation proof.
+func (r *AggregatedRange) Commitment() []byte {
+	return HashBytes(r.AccountTreeRoot, uint64ToBytes(r.SnapshotId), r.BeforeCEXAssetsCommitment, r.AfterCEXAssetsCommitment,
+		uint32ToBytes(r.MinAccountIndex), uint32ToBytes(r.MaxAccountIndex), uint64ToBytes(r.UserCount), r.AccountIdsChallenge,
+		r.BeforeLastAccountId, r.AfterLastAccountId, r.BeforeAccountIdsProduct, r.AfterAccountIdsProduct,
+		r.BeforeAccountIdsHash, r.AfterAccountIdsHash)
+}
+
+// ChainAggregatedRanges checks the ranges are consecutive and returns the range
+// covering all of them, as the aggregation circuits do.
+func ChainAggregatedRanges(ranges []AggregatedRange) (AggregatedRange, error) {
+	if len(ranges) == 0 {
+		return AggregatedRange{}, fmt.Errorf("no aggregated ranges")
+	}
+	r := ranges[0]
+	for i := 1; i < len(ranges); i++ {
+		next := &ranges[i]
+		if !bytes.Equal(next.AccountTreeRoot, r.AccountTreeRoot) || next.SnapshotId != r.SnapshotId ||
+			!bytes.Equal(next.AccountIdsChallenge, r.AccountIdsChallenge) {
+			return AggregatedRange{}, fmt.Errorf("range %d doesn't belong to the same audit as range 0", i)
+		}
+		if !bytes.Equal(next.BeforeCEXAssetsCommitment, r.AfterCEXAssetsCommitment) {
+			return AggregatedRange{}, fmt.Errorf("the cex assets commitment of range %d doesn't match the previous range", i)
+		}
+		if uint64(next.MinAccountIndex) != uint64(r.MaxAccountIndex)+1 {
+			return AggregatedRange{}, fmt.Errorf("the account indexes of range %d are not contiguous with the previous range", i)
+		}
+		if !bytes.Equal(next.BeforeLastAccountId, r.AfterLastAccountId) ||
+			!bytes.Equal(next.BeforeAccountIdsProduct, r.AfterAccountIdsProduct) ||
+			!bytes.Equal(next.BeforeAccountIdsHash, r.AfterAccountIdsHash) {
+			return AggregatedRange{}, fmt.Errorf("the account ids check of range %d doesn't match the previous range", i)
+		}
+		r.AfterCEXAssetsCommitment = next.AfterCEXAssetsCommitment
+		r.MaxAccountIndex = next.MaxAccountIndex
+		r.UserCount += next.UserCount
+		r.AfterLastAccountId = next.AfterLastAccountId
+		r.AfterAccountIdsProduct = next.AfterAccountIdsProduct
+		r.AfterAccountIdsHash = next.AfterAccountIdsHash
+	}
+	return r, nil
+}
+
+// Range returns the range of all the batches of an audit proven by p. The
+// account ids of the batches start from the initial state, the running product
+// ends at 1 and the chain of the hashes of the sorted account ids ends at the
+// challenge, so the account ids of all the batches are distinct.
+func (p *AggregatedProof) Range() (AggregatedRange, error) {
+	if p.AccountCount == 0 || p.AccountCount > 1<<32 {
+		return AggregatedRange{}, fmt.Errorf("invalid account count %d", p.AccountCount)
+	}
+	return AggregatedRange{
+		AccountTreeRoot:           p.AccountTreeRoot,
+		SnapshotId:                p.SnapshotId,
+		BeforeCEXAssetsCommitment: p.EmptyCEXAssetsCommitment,
+		AfterCEXAssetsCommitment:  p.FinalCEXAssetsCommitment,
+		MinAccountIndex:           0,
+		MaxAccountIndex:           uint32(p.AccountCount - 1),
+		UserCount:                 p.UserCount,
+		AccountIdsChallenge:       p.AccountIdsChallenge,
+		BeforeLastAccountId:       make([]byte, FieldElementSize),
+		AfterLastAccountId:        p.LastAccountId,
+		BeforeAccountIdsProduct:   InitialAccountIdsProduct(),
+		AfterAccountIdsProduct:    InitialAccountIdsProduct(),
+		BeforeAccountIdsHash:      p.AccountTreeRoot,
+		AfterAccountIdsHash:       p.AccountIdsChallenge,
+	}, nil
+}
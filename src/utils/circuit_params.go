@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// CircuitParamsVersion is the version of the circuit parameters file
+// supported by current code, it must be increased when the fields change
+// in a way the files of the previous version can't be read with the same meaning
+const CircuitParamsVersion = 1
+
+// CircuitParamsFileSuffix is appended to the zk key name to get the circuit
+// parameters file which keygen writes beside the keys
+const CircuitParamsFileSuffix = ".params.json"
+
+// CircuitParams is the circuit parameters shared by keygen, witness, prover and verifier,
+// the proofs and the keys generated by different CircuitParams are not compatible
+type CircuitParams struct {
+	Version          int
+	AccountTreeDepth int
+	AssetCounts      int
+	TierCount        int
+	// BlindCexAssetsCommitment is optional, the cex assets commitment is not
+	// blinded if it is missing
+	BlindCexAssetsCommitment bool `json:",omitempty"`
+	// HashSuite is optional, poseidon is used if it is missing
+	HashSuite string `json:",omitempty"`
+	// Curve is optional, bn254 is used if it is missing
+	Curve string `json:",omitempty"`
+}
+
+// CurrentCircuitParams returns the circuit parameters in use
+func CurrentCircuitParams() CircuitParams {
+	return CircuitParams{
+		Version:          CircuitParamsVersion,
+		AccountTreeDepth: AccountTreeDepth,
+		AssetCounts:      AssetCounts,
+		TierCount:        TierCount,
+
+		BlindCexAssetsCommitment: BlindCexAssetsCommitment,
+		HashSuite:                HashSuite,
+		Curve:                    Curve,
+	}
+}
+
+func (p CircuitParams) Validate() error {
+	if p.Version != CircuitParamsVersion {
+		return fmt.Errorf("unsupported circuit params version %d, expected %d", p.Version, CircuitParamsVersion)
+	}
+	// the account index is uint32
+	if p.AccountTreeDepth <= 0 || p.AccountTreeDepth > 32 {
+		return fmt.Errorf("account tree depth %d out of range [1, 32]", p.AccountTreeDepth)
+	}
+	// the asset index is uint16
+	if p.AssetCounts <= 0 || p.AssetCounts > 65536 {
+		return fmt.Errorf("asset counts %d out of range [1, 65536]", p.AssetCounts)
+	}
+	curve, err := ParseCurve(p.Curve)
+	if err != nil {
+		return err
+	}
+	hashSuite, err := ParseHashSuite(p.HashSuite)
+	if err != nil {
+		return err
+	}
+	// the poseidon of gnark in use is of bn254 only
+	if curve != BN254Curve && hashSuite == PoseidonHashSuite {
+		return fmt.Errorf("hash suite %s is not supported on curve %s, use %s", hashSuite, curve, MiMCHashSuite)
+	}
+	// the circuit sums the products of the balances and the prices of a user
+	// without reducing them, they must not wrap around the field
+	if fieldBits := curveID(curve).ScalarField().BitLen(); UserValueBits(p.AssetCounts) >= fieldBits {
+		return fmt.Errorf("the user values of %d assets take %d bits, the field of curve %s has %d bits",
+			p.AssetCounts, UserValueBits(p.AssetCounts), curve, fieldBits)
+	}
+	// the tier ratios stored in one circuit Variable depend on the field size
+	perElement := packingWidth(curve, TierRatioBits)
+	if p.TierCount <= 0 || p.TierCount%perElement != 0 {
+		return fmt.Errorf("tier count %d must be a positive multiple of %d", p.TierCount, perElement)
+	}
+	for _, v := range AssetCountsTiers {
+		if v > p.AssetCounts {
+			return fmt.Errorf("asset counts tier %d is bigger than asset counts %d", v, p.AssetCounts)
+		}
+	}
+	return nil
+}
+
+// LoadCircuitParams reads and validates the circuit parameters file
+func LoadCircuitParams(path string) (CircuitParams, error) {
+	var p CircuitParams
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err = json.Unmarshal(content, &p); err != nil {
+		return p, fmt.Errorf("failed to parse circuit params file %s: %w", path, err)
+	}
+	if err = p.Validate(); err != nil {
+		return p, fmt.Errorf("invalid circuit params file %s: %w", path, err)
+	}
+	// the files written before HashSuite and Curve were introduced use poseidon on bn254
+	p.HashSuite, _ = ParseHashSuite(p.HashSuite)
+	p.Curve, _ = ParseCurve(p.Curve)
+	return p, nil
+}
+
+// SetCircuitParams replaces the circuit parameters in use, it must be called
+// before any account, witness or circuit is constructed
+func SetCircuitParams(p CircuitParams) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	AccountTreeDepth = p.AccountTreeDepth
+	AssetCounts = p.AssetCounts
+	TierCount = p.TierCount
+	BlindCexAssetsCommitment = p.BlindCexAssetsCommitment
+	HashSuite, _ = ParseHashSuite(p.HashSuite)
+	Curve, _ = ParseCurve(p.Curve)
+	NilAccountHash = computeNilAccountHash()
+	return nil
+}
+
+// InitCircuitParams loads the circuit parameters file and makes it in use,
+// the default circuit parameters are kept if path is empty
+func InitCircuitParams(path string) error {
+	if path == "" {
+		return nil
+	}
+	p, err := LoadCircuitParams(path)
+	if err != nil {
+		return err
+	}
+	if err = SetCircuitParams(p); err != nil {
+		return err
+	}
+	fmt.Printf("circuit params %s loaded: %+v\n", path, p)
+	return nil
+}
+
+// WriteCircuitParams writes the circuit parameters in use to path
+func WriteCircuitParams(path string) error {
+	content, err := json.MarshalIndent(CurrentCircuitParams(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// CheckCircuitParamsOfKey checks the circuit parameters written by keygen
+// beside the zkKeyName keys match the circuit parameters in use.
+// The keys generated before the circuit parameters file was introduced
+// have no such file, they are accepted with a warning.
+func CheckCircuitParamsOfKey(zkKeyName string) error {
+	path := zkKeyName + CircuitParamsFileSuffix
+	p, err := LoadCircuitParams(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("WARNING: %s not found, can't check the circuit params of %s\n", path, zkKeyName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p != CurrentCircuitParams() {
+		return fmt.Errorf("circuit params of %s %+v don't match circuit params in use %+v", zkKeyName, p, CurrentCircuitParams())
+	}
+	return nil
+}
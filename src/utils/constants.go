@@ -8,96 +8,49 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	"gorm.io/hints"
 )
 
 const (
 	// BatchCreateUserOpsCounts = 864
-	AccountTreeDepth         = 28
-	AssetCounts              = 500
-	// TierCount: must be even number, the cex assets commitment will depend on the TierCount/2 parts
-	TierCount				 = 12
 	R1csBatchSize            = 1000000
+	// ValueDecimals is the decimals of the USD values of the assets. The value
+	// is the balance multiplied by the price, so the BalanceDecimals and the
+	// PriceDecimals of every asset sum to ValueDecimals
+	ValueDecimals = 24
+	// MaxPriceDecimals is the most decimals of the prices in the asset registry,
+	// the prices are 64-bit integers
+	MaxPriceDecimals = 16
+	// AssetRegistryFile is the asset registry file of the user data directory
+	AssetRegistryFile = "asset_registry.csv"
+)
+
+// the circuit parameters, they are the defaults of CircuitParams and
+// can be replaced by a circuit parameters file, see LoadCircuitParams
+var (
+	AccountTreeDepth = 28
+	AssetCounts      = 500
+	// TierCount: must be even number, the cex assets commitment will depend on the TierCount/2 parts
+	TierCount = 12
+	// BlindCexAssetsCommitment appends a blinding factor to the cex assets commitment,
+	// so the totals of the cex assets can't be brute-forced from the commitment
+	BlindCexAssetsCommitment = false
+	// HashSuite is the hash of the account tree, the commitments and the circuit
+	HashSuite = PoseidonHashSuite
+	// Curve is the curve of the proofs, the packing widths of the commitments
+	// are derived from the size of its scalar field
+	Curve = BN254Curve
 )
 
 var (
 	ZeroBigInt                    = new(big.Int).SetInt64(0)
 	OneBigInt                     = new(big.Int).SetInt64(1)
 	PercentageMultiplier          = new(big.Int).SetUint64(100)
-	MaxTierBoundaryValue, _       = new(big.Int).SetString("332306998946228968225951765070086144", 10) // (pow(2,118))
+	MaxTierBoundaryValue, _       = new(big.Int).SetString("332306998946228968225951765070086144", 10) // (pow(2,118)), about 3.3e11 USD
 	Uint64MaxValueBigInt, _       = new(big.Int).SetString("18446744073709551616", 10)
 	Uint64MaxValueBigIntSquare, _ = new(big.Int).SetString("340282366920938463463374607431768211456", 10)
-	Uint8MaxValueBigInt, _        = new(big.Int).SetString("256", 10)
-	Uint16MaxValueBigInt, _       = new(big.Int).SetString("65536", 10)
-	Uint126MaxValueBigInt, _      = new(big.Int).SetString("85070591730234615865843651857942052864", 10)
-	Uint134MaxValueBigInt, _      = new(big.Int).SetString("21778071482940061661655974875633165533184", 10)
-	Uint64MaxValueFr              = new(fr.Element).SetBigInt(Uint64MaxValueBigInt)
-	Uint64MaxValueFrSquare        = new(fr.Element).SetBigInt(Uint64MaxValueBigIntSquare)
-	Uint8MaxValueFr               = new(fr.Element).SetBigInt(Uint8MaxValueBigInt)
-	Uint16MaxValueFr 			  = new(fr.Element).SetBigInt(Uint16MaxValueBigInt)
-	Uint126MaxValueFr             = new(fr.Element).SetBigInt(Uint126MaxValueBigInt)
-	Uint134MaxValueFr             = new(fr.Element).SetBigInt(Uint134MaxValueBigInt)
-	MaxTierBoundaryValueFr		  = new(fr.Element).SetBigInt(MaxTierBoundaryValue)
-	PercentageMultiplierFr     	  = new(fr.Element).SetBigInt(PercentageMultiplier)
 
-	AssetTypeForTwoDigits         = map[string]bool{
-		"BTTC":  true,
-		"bttc":  true,
-		"SHIB":  true,
-		"shib":  true,
-		"LUNC":  true,
-		"lunc":  true,
-		"XEC":   true,
-		"xec":   true,
-		"WIN":   true,
-		"win":   true,
-		"BIDR":  true,
-		"bidr":  true,
-		"SPELL": true,
-		"spell": true,
-		"HOT":   true,
-		"hot":   true,
-		"DOGE":  true,
-		"doge":  true,
-        "PEPE":  true,
-		"pepe":  true,
-		"FLOKI": true,
-		"floki": true,
-		"IDRT":  true,
-		"idrt":  true,
-		"DOGS":  true,
-		"dogs":  true,
-		"BONK":  true,
-		"bonk":  true,
-		"1000SATS": true,
-		"1000sats": true,
-        "NEIRO": true,
-		"neiro": true,
-		"1000PEPPER" : true,
-		"1000pepper" : true,
-		"NOT": true,
-		"not": true,
-		"NFT": true,
-		"nft": true,
-		"BOME": true,
-		"bome": true,
-		"1MBABYDOGE": true,
-		"1mbabydoge": true,
-		"HMSTR": true,
-		"hmstr": true,
-		"WLFI": true,
-		"wlfi": true,
-		"PUMP": true,
-		"pump": true,
-		"MONKY": true,
-		"monky": true,
-		"1000CHEEMS": true,
-		"1000cheems": true,
-		"IDR": true,
-		"idr": true,
-	}
+
 	// the key is the number of assets user own
 	// the value is the number of batch create user ops
 	BatchCreateUserOpsCountsTiers = map[int]int {
@@ -106,25 +59,24 @@ var (
 	}
 	AssetCountsTiers = make([]int, 0)
 
-	// one Fr element is 252 bits, it contains 16 16-bit elements at most
-	PowersOfSixteenBits           [15]fr.Element
+	// the collateral categories of user assets, every asset has one collateral
+	// and one tiers ratio per category. The order of the categories is the order
+	// of the collateral columns in user files and the tiers ratio columns in
+	// cex_assets_info.csv, it is also part of the commitments and the circuit, so
+	// all the services and the zk keys must use the same categories.
+	// It can be overridden by ZKPOR_COLLATERAL_CATEGORIES, e.g. "loan,margin,portfolio_margin,earn"
+	CollateralCategories = []string{"loan", "margin", "portfolio_margin"}
+
 	MaxExecutionTimeHint         = hints.New("MAX_EXECUTION_TIME(10000)")
 )
 
 func init() {
-	initValue := new(big.Int).SetUint64(1)
-	for i := 0; i < 15; i++ {
-		PowersOfSixteenBits[i].SetBigInt(initValue)
-		initValue.Mul(initValue, big.NewInt(65536))
-	}
 	for k := range BatchCreateUserOpsCountsTiers {
 		AssetCountsTiers = append(AssetCountsTiers, k)
 	}
 	sort.Ints(AssetCountsTiers)
 
-	zero := &fr.Element{0, 0, 0, 0}
-	tempHash := poseidon.Poseidon(zero, zero, zero, zero, zero).Bytes()
-	NilAccountHash = tempHash[:]
+	NilAccountHash = computeNilAccountHash()
 	// fmt.Printf("NilAccountHash: %x\n", NilAccountHash)
 
 	if testTiers := strings.TrimSpace(os.Getenv("ZKPOR_TEST_TIERS")); testTiers != "" {
@@ -140,6 +92,15 @@ func init() {
 		sort.Ints(AssetCountsTiers)
 		fmt.Printf("ZKPOR_TEST_TIERS override active: %v\n", BatchCreateUserOpsCountsTiers)
 	}
+
+	if categories := strings.TrimSpace(os.Getenv("ZKPOR_COLLATERAL_CATEGORIES")); categories != "" {
+		parsed, err := parseCollateralCategories(categories)
+		if err != nil {
+			panic("failed to parse ZKPOR_COLLATERAL_CATEGORIES: " + err.Error())
+		}
+		CollateralCategories = parsed
+		fmt.Printf("ZKPOR_COLLATERAL_CATEGORIES override active: %v\n", CollateralCategories)
+	}
 }
 
 // parseTiers parses a tier string like "500:4,50:20" into a map[int]int.
@@ -162,3 +123,21 @@ func parseTiers(s string) (map[int]int, error) {
 	}
 	return result, nil
 }
+
+// parseCollateralCategories parses a category string like "loan,margin" into a list of unique names.
+func parseCollateralCategories(s string) ([]string, error) {
+	result := make([]string, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty collateral category in %q", s)
+		}
+		for _, v := range result {
+			if v == name {
+				return nil, fmt.Errorf("duplicated collateral category: %q", name)
+			}
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
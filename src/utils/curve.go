@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"math/bits"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// the curves of the proofs, the scalar field of the curve is the field of the
+// account tree, the commitments and the circuit
+const (
+	BN254Curve    = "bn254"
+	BLS12381Curve = "bls12-381"
+	// FieldElementSize is the size of the big endian bytes of a field element of both curves
+	FieldElementSize = 32
+)
+
+// the bit size of the values packed into one field element
+const (
+	AssetIndexBits = 16
+	// the ratio is 8 bits and the boundary value is 118 bits
+	TierRatioBits = 126
+	// the balances are Uint128 and the prices are uint64
+	BalanceBits = 128
+	PriceBits   = 64
+)
+
+// ParseCurve returns the curve of name, bn254 is used if name is empty.
+func ParseCurve(name string) (string, error) {
+	switch name {
+	case "", BN254Curve:
+		return BN254Curve, nil
+	case BLS12381Curve:
+		return BLS12381Curve, nil
+	default:
+		return "", fmt.Errorf("unknown curve %q, expected %s or %s", name, BN254Curve, BLS12381Curve)
+	}
+}
+
+// CurveID returns the gnark curve id of Curve.
+func CurveID() ecc.ID {
+	return curveID(Curve)
+}
+
+func curveID(curve string) ecc.ID {
+	if curve == BLS12381Curve {
+		return ecc.BLS12_381
+	}
+	return ecc.BN254
+}
+
+// FieldModulus returns the modulus of the scalar field of Curve.
+func FieldModulus() *big.Int {
+	return CurveID().ScalarField()
+}
+
+// PackingWidth returns how many values of bits bits are packed into one field
+// element of Curve without overflowing the field.
+func PackingWidth(bits int) int {
+	return packingWidth(Curve, bits)
+}
+
+func packingWidth(curve string, bits int) int {
+	return (curveID(curve).ScalarField().BitLen() - 1) / bits
+}
+
+// UserValueBits returns the bit size of the total values of one user of
+// assetCounts assets, the sum of assetCounts products of a balance and a price.
+// The values never wrap around the field if it is less than the field size.
+func UserValueBits(assetCounts int) int {
+	return BalanceBits + PriceBits + bits.Len(uint(assetCounts))
+}
+
+// TierRatiosPerElement returns how many tier ratios are packed into one field element.
+func TierRatiosPerElement() int {
+	return PackingWidth(TierRatioBits)
+}
+
+// ReduceToFieldElement returns the big endian bytes of b modulo the scalar field of Curve.
+func ReduceToFieldElement(b []byte) []byte {
+	v := new(big.Int).SetBytes(b)
+	v.Mod(v, FieldModulus())
+	return v.FillBytes(make([]byte, FieldElementSize))
+}
+
+// RandomFieldElement returns the big endian bytes of a random element of the scalar field of Curve.
+func RandomFieldElement() ([]byte, error) {
+	v, err := rand.Int(rand.Reader, FieldModulus())
+	if err != nil {
+		return nil, err
+	}
+	return v.FillBytes(make([]byte, FieldElementSize)), nil
+}
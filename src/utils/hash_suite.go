@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+
+	mimc_bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+)
+
+// the hash suites of the account tree, the commitments and the circuit
+const (
+	PoseidonHashSuite = "poseidon"
+	MiMCHashSuite     = "mimc"
+)
+
+// ParseHashSuite returns the hash suite of name, poseidon is used if name is empty.
+func ParseHashSuite(name string) (string, error) {
+	switch name {
+	case "", PoseidonHashSuite:
+		return PoseidonHashSuite, nil
+	case MiMCHashSuite:
+		return MiMCHashSuite, nil
+	default:
+		return "", fmt.Errorf("unknown hash suite %q, expected %s or %s", name, PoseidonHashSuite, MiMCHashSuite)
+	}
+}
+
+// NewHasher returns the hasher of HashSuite on Curve. Every Write of the hasher is one
+// field element in big endian, and Sum hashes the elements written since the
+// last Sum, which is the same as the hash of the circuit.
+func NewHasher() hash.Hash {
+	switch HashSuite {
+	case MiMCHashSuite:
+		if Curve == BLS12381Curve {
+			return &mimcHasher{h: mimc_bls12381.NewMiMC()}
+		}
+		return &mimcHasher{h: mimc.NewMiMC()}
+	default:
+		return poseidon.NewPoseidon()
+	}
+}
+
+// HashBytes returns the hash of HashSuite of the field elements of inputs.
+func HashBytes(inputs ...[]byte) []byte {
+	if HashSuite == PoseidonHashSuite {
+		return poseidon.PoseidonBytes(inputs...)
+	}
+	hasher := NewHasher()
+	for _, input := range inputs {
+		if _, err := hasher.Write(input); err != nil {
+			panic(err.Error())
+		}
+	}
+	return hasher.Sum(nil)
+}
+
+// mimcHasher writes one field element for every Write as the poseidon hasher
+// does, the mimc hasher of gnark-crypto splits the data into 32 bytes blocks.
+type mimcHasher struct {
+	h hash.Hash
+}
+
+func (d *mimcHasher) Write(p []byte) (int, error) {
+	num := new(big.Int).SetBytes(p)
+	if num.Cmp(FieldModulus()) >= 0 {
+		return 0, errors.New("not support bytes bigger than modulus")
+	}
+	if _, err := d.h.Write(num.FillBytes(make([]byte, FieldElementSize))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *mimcHasher) Sum(b []byte) []byte {
+	// the mimc hasher keeps its state after Sum
+	b = d.h.Sum(b)
+	d.h.Reset()
+	return b
+}
+
+func (d *mimcHasher) Reset() {
+	d.h.Reset()
+}
+
+func (d *mimcHasher) Size() int {
+	return d.h.Size()
+}
+
+func (d *mimcHasher) BlockSize() int {
+	return d.h.BlockSize()
+}
+
+// computeNilAccountHash returns the leaf of the accounts which don't exist,
+// it is the hash of the account id, the totals and the assets commitment which are all zero.
+func computeNilAccountHash() []byte {
+	zero := []byte{}
+	return HashBytes(zero, zero, zero, zero, zero)
+}
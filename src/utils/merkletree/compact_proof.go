@@ -0,0 +1,101 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/bits"
+)
+
+// CompactProof is a Merkle proof without the siblings that are the hash of an
+// empty subtree. Most of the upper siblings of a tree far from full are empty
+// subtrees, so the compact proof is a fraction of the full proof.
+type CompactProof struct {
+	// NilSiblings has bit i set if the sibling at level i is nilHashes[i].
+	NilSiblings uint32
+	// Siblings are the other siblings from the leaf level up.
+	Siblings [][]byte
+}
+
+// CompressProof returns the compact proof of the full proof, nilHashes are the
+// hashes of the empty subtrees of the tree, see NilHashes.
+func CompressProof(proof [][]byte, nilHashes [][]byte) *CompactProof {
+	compact := &CompactProof{}
+	for level, sibling := range proof {
+		if bytes.Equal(sibling, nilHashes[level]) {
+			compact.NilSiblings |= 1 << uint(level)
+		} else {
+			compact.Siblings = append(compact.Siblings, sibling)
+		}
+	}
+	return compact
+}
+
+// Expand returns the full proof of depth len(nilHashes)-1.
+func (p *CompactProof) Expand(nilHashes [][]byte) ([][]byte, error) {
+	depth := len(nilHashes) - 1
+	if depth > 32 || uint64(p.NilSiblings)>>uint(depth) != 0 ||
+		bits.OnesCount32(p.NilSiblings)+len(p.Siblings) != depth {
+		return nil, errors.New("the compact proof doesn't match the tree depth")
+	}
+	proof := make([][]byte, depth)
+	next := 0
+	for level := range proof {
+		if p.NilSiblings&(1<<uint(level)) != 0 {
+			proof[level] = nilHashes[level]
+		} else {
+			proof[level] = p.Siblings[next]
+			next++
+		}
+	}
+	return proof, nil
+}
+
+// Bytes encodes the proof as the big endian NilSiblings bitmap followed by the
+// siblings.
+func (p *CompactProof) Bytes() []byte {
+	res := make([]byte, 4, 4+len(p.Siblings)*32)
+	binary.BigEndian.PutUint32(res, p.NilSiblings)
+	for _, sibling := range p.Siblings {
+		res = append(res, sibling...)
+	}
+	return res
+}
+
+// ParseCompactProof decodes the compact proof encoded by Bytes of a tree of
+// depth whose hashes have hashSize bytes.
+func ParseCompactProof(data []byte, depth int, hashSize int) (*CompactProof, error) {
+	if len(data) < 4 || depth <= 0 || depth > 32 || hashSize <= 0 {
+		return nil, errors.New("invalid compact proof")
+	}
+	p := &CompactProof{NilSiblings: binary.BigEndian.Uint32(data)}
+	if uint64(p.NilSiblings)>>uint(depth) != 0 ||
+		len(data)-4 != (depth-bits.OnesCount32(p.NilSiblings))*hashSize {
+		return nil, errors.New("invalid compact proof")
+	}
+	for offset := 4; offset < len(data); offset += hashSize {
+		p.Siblings = append(p.Siblings, data[offset:offset+hashSize:offset+hashSize])
+	}
+	return p, nil
+}
+
+// GetCompactProof returns the compact Merkle proof for the given key.
+func (t *FixedDepthMerkleTree) GetCompactProof(key uint32) (*CompactProof, error) {
+	proof, err := t.GetProof(key)
+	if err != nil {
+		return nil, err
+	}
+	return CompressProof(proof, t.nilHashes), nil
+}
+
+// VerifyCompactProof verifies a compact Merkle proof for the given key and
+// leaf, nilHashes are the hashes of the empty subtrees of the tree.
+func VerifyCompactProof(root []byte, key uint32, proof *CompactProof, leaf []byte, nilHashes [][]byte,
+	hasherFunc func() hash.Hash) bool {
+	fullProof, err := proof.Expand(nilHashes)
+	if err != nil {
+		return false
+	}
+	return VerifyProof(root, key, fullProof, leaf, len(nilHashes)-1, hasherFunc)
+}
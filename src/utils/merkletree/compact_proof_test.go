@@ -0,0 +1,80 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompactProof(t *testing.T) {
+	capacity := 3000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 2500; k += 3 {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+	nilHashes := NilHashes(28, nilAccountHash(), newHasherFunc())
+	for _, k := range []uint32{0, 1, 3, 2499, 2500, 2999} {
+		proof, err := tree.GetProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, err := tree.GetCompactProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the tree has 2^12 leaves at most, so the upper siblings are empty subtrees
+		if len(compact.Siblings) > 12 {
+			t.Fatalf("key %d: the compact proof has %d siblings", k, len(compact.Siblings))
+		}
+		encoded := compact.Bytes()
+		if len(encoded) != 4+len(compact.Siblings)*32 {
+			t.Fatalf("key %d: the encoded compact proof has %d bytes", k, len(encoded))
+		}
+		decoded, err := ParseCompactProof(encoded, 28, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expanded, err := decoded.Expand(nilHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for level := range proof {
+			if !bytes.Equal(expanded[level], proof[level]) {
+				t.Fatalf("key %d: the expanded sibling at level %d differs", k, level)
+			}
+		}
+		if !VerifyCompactProof(tree.Root(), k, decoded, tree.Get(k), nilHashes, newHasherFunc()) {
+			t.Fatalf("compact proof verification failed for key %d", k)
+		}
+		if _, ok := values[k]; ok && VerifyCompactProof(tree.Root(), k^1, decoded, tree.Get(k), nilHashes, newHasherFunc()) {
+			t.Fatalf("compact proof of key %d verified for key %d", k, k^1)
+		}
+	}
+}
+
+func TestParseCompactProofInvalid(t *testing.T) {
+	tree := buildTestTree(100, map[uint32][]byte{5: makeLeafValue(5), 70: makeLeafValue(70)})
+	compact, err := tree.GetCompactProof(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := compact.Bytes()
+	cases := map[string][]byte{
+		"short":           encoded[:3],
+		"missing sibling": encoded[:len(encoded)-32],
+		"extra bytes":     append(append([]byte{}, encoded...), 0),
+		"bits above depth": append([]byte{0x10 | encoded[0], encoded[1], encoded[2], encoded[3]},
+			encoded[4:]...),
+	}
+	for name, data := range cases {
+		if _, err := ParseCompactProof(data, 28, 32); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	nilHashes := NilHashes(28, nilAccountHash(), newHasherFunc())
+	compact.Siblings = compact.Siblings[1:]
+	if VerifyCompactProof(tree.Root(), 5, compact, tree.Get(5), nilHashes, newHasherFunc()) {
+		t.Fatal("the compact proof missing a sibling is verified")
+	}
+}
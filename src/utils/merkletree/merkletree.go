@@ -6,24 +6,34 @@ import (
 	"hash"
 	"math/bits"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
 
-// FixedDepthMerkleTree is an in-memory fixed-depth Merkle tree optimized for
-// batch insertion followed by batch reads. The depth is fixed at construction
-// time to match circuit constraints for proof verification.
+// FixedDepthMerkleTree is a fixed-depth Merkle tree optimized for batch
+// insertion followed by batch reads. The depth is fixed at construction time to
+// match circuit constraints for proof verification. The leaves and the
+// internal nodes are kept in memory or, with NewFixedDepthMerkleTreeWithStorage,
+// in the buffers of a Storage such as memory-mapped files; the dirty bitsets
+// always stay in memory, about capacity/4 bytes.
 //
 // Usage pattern (two-phase):
 //  1. Set leaves concurrently (Set only stores leaf values, no hashing)
 //  2. Call Build() to compute all internal nodes bottom-up in parallel
-//  3. Call GetProof/Root to read proofs (concurrent reads, no locks)
+//  3. Call GetProof/Root to read proofs (concurrent reads)
+//
+// A built tree can then be changed with Update, which recomputes only the
+// root paths of the changed leaves. Reads can run concurrently with Update,
+// GetProofWithRoot returns a proof and the root it belongs to.
 //
 // Constraints:
 //   - depth must be <= 32 (enforced by constructor).
 //   - Multiple Set→Build cycles are correct but NOT incremental: leavesDirty bits
 //     are never cleared, so each Build() recomputes all dirty nodes from scratch.
+//     Use Update to change a few leaves of a built tree instead.
 //   - GetProof/Root only reflect Sets that were followed by a Build() call.
+//   - Set and Build must not run concurrently with reads or Update.
 type FixedDepthMerkleTree struct {
 	depth      int
 	hashSize   int
@@ -49,6 +59,17 @@ type FixedDepthMerkleTree struct {
 
 	// root is set after Build().
 	root []byte
+
+	// mu guards the nodes and the root written by Build and by the commit of
+	// Update against the reads. updateMu serializes the Update calls.
+	mu       sync.RWMutex
+	updateMu sync.Mutex
+
+	// storage allocates the leaves and the level buffers. mapped is the
+	// memory-mapped snapshot file the buffers point into if the tree is opened
+	// by OpenSnapshot.
+	storage Storage
+	mapped  []byte
 }
 
 // --- Bitset utilities ---
@@ -135,6 +156,19 @@ func compressBits(w uint64) uint32 {
 // NewFixedDepthMerkleTree creates a new in-memory fixed-depth Merkle tree.
 // capacity: the number of leaf slots to pre-allocate (keys must be in [0, capacity)).
 func NewFixedDepthMerkleTree(depth int, nilLeafHash []byte, hasherFunc func() hash.Hash, capacity int) *FixedDepthMerkleTree {
+	t, err := NewFixedDepthMerkleTreeWithStorage(depth, nilLeafHash, hasherFunc, capacity, MemoryStorage{})
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
+// NewFixedDepthMerkleTreeWithStorage creates a fixed-depth Merkle tree whose
+// leaves and internal levels are allocated by storage, such as FileStorage to
+// keep them on disk. The tree computes the same root and proofs whatever the
+// storage is. Close releases the storage.
+func NewFixedDepthMerkleTreeWithStorage(depth int, nilLeafHash []byte, hasherFunc func() hash.Hash, capacity int,
+	storage Storage) (*FixedDepthMerkleTree, error) {
 	if depth > 32 {
 		panic("depth too large")
 	}
@@ -150,27 +184,46 @@ func NewFixedDepthMerkleTree(depth int, nilLeafHash []byte, hasherFunc func() ha
 		hashSize:    hashSize,
 		capacity:    capacity,
 		hasherFunc:  hasherFunc,
-		leaves:      make([]byte, capacity*hashSize),
 		leavesDirty: make([]uint64, bitsetLen(capacity)),
 		levels:      make([][]byte, depth+1), // levels[0] unused; levels[1..depth] for internal nodes
 		levelDirty:  make([][]uint64, depth+1),
+		storage:     storage,
 	}
 
-	// Precompute nilHashes for each level.
-	t.nilHashes = make([][]byte, depth+1)
-	t.nilHashes[0] = make([]byte, hashSize)
-	copy(t.nilHashes[0], nilLeafHash)
+	// Allocate the leaves and the level buffers, level l covers every position
+	// of the keys in [0, capacity) rounded up to whole bitset words.
+	var err error
+	if t.leaves, err = storage.Buffer(0, capacity*hashSize); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	words := len(t.leavesDirty)
+	for level := 1; level <= depth; level++ {
+		words = bitsetLen(words * 32)
+		if t.levels[level], err = storage.Buffer(level, words*64*hashSize); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
 
+	t.nilHashes = NilHashes(depth, nilLeafHash, hasherFunc)
+	t.root = copyBytes(t.nilHashes[depth])
+	return t, nil
+}
+
+// NilHashes returns the hashes of the empty subtrees of a tree of depth,
+// nilHashes[level] is the hash of the empty subtree at that level.
+func NilHashes(depth int, nilLeafHash []byte, hasherFunc func() hash.Hash) [][]byte {
+	nilHashes := make([][]byte, depth+1)
+	nilHashes[0] = copyBytes(nilLeafHash)
 	h := hasherFunc()
 	for i := 1; i <= depth; i++ {
 		h.Reset()
-		h.Write(t.nilHashes[i-1])
-		h.Write(t.nilHashes[i-1])
-		t.nilHashes[i] = h.Sum(nil)
+		h.Write(nilHashes[i-1])
+		h.Write(nilHashes[i-1])
+		nilHashes[i] = h.Sum(nil)
 	}
-
-	t.root = copyBytes(t.nilHashes[depth])
-	return t
+	return nilHashes
 }
 
 // Set stores a leaf value at the given key. This only writes the leaf;
@@ -190,6 +243,8 @@ func (t *FixedDepthMerkleTree) Set(key uint32, value []byte) error {
 // Must be called after all Set operations are complete.
 // After Build, GetProof and Root return correct values.
 func (t *FixedDepthMerkleTree) Build() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	hashSize := t.hashSize
 
 	// Build initial dirty bitset for level 1 from leavesDirty.
@@ -206,9 +261,8 @@ func (t *FixedDepthMerkleTree) Build() {
 			break
 		}
 
-		// Allocate level buffer and assign dirtyBits as this level's dirty bitset.
-		bufSize := len(dirtyBits) * 64 // max positions covered
-		t.levels[level] = make([]byte, bufSize*hashSize)
+		// Assign dirtyBits as this level's dirty bitset, the level buffer is
+		// allocated by the constructor and covers len(dirtyBits)*64 positions.
 		t.levelDirty[level] = dirtyBits
 
 		// Process dirty positions in parallel.
@@ -278,13 +332,150 @@ func (t *FixedDepthMerkleTree) Build() {
 	}
 }
 
+// stagedLevel holds the new nodes of one level computed by Update.
+// positions is sorted, nodes[i] is the new node at positions[i], and the
+// children of positions[i] start at childStart[i] of the level below.
+type stagedLevel struct {
+	positions  []uint32
+	nodes      [][]byte
+	childStart []int
+}
+
+// minUpdatesPerWorker is the least nodes hashed by one goroutine of Update,
+// so the few nodes near the root are hashed without spawning goroutines.
+const minUpdatesPerWorker = 256
+
+// Update sets the leaves of keys to values and recomputes only their root
+// paths, level by level in parallel. It must be called on a built tree, the
+// leaves Set after the last Build() are not included. The new nodes are
+// computed while the reads see the tree before the update, then they are
+// written and the root is replaced at once. If a key appears several times,
+// its last value is set.
+func (t *FixedDepthMerkleTree) Update(keys []uint32, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("%d keys but %d values", len(keys), len(values))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for i, key := range keys {
+		if int(key) >= t.capacity {
+			return fmt.Errorf("key %d out of range for capacity %d", key, t.capacity)
+		}
+		if len(values[i]) != t.hashSize {
+			return fmt.Errorf("value of key %d has %d bytes, expected %d", key, len(values[i]), t.hashSize)
+		}
+	}
+	t.updateMu.Lock()
+	defer t.updateMu.Unlock()
+
+	// Sort the keys, the last value of a duplicated key wins.
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+	leaves := stagedLevel{}
+	for i, idx := range order {
+		if i+1 < len(order) && keys[order[i+1]] == keys[idx] {
+			continue
+		}
+		leaves.positions = append(leaves.positions, keys[idx])
+		leaves.nodes = append(leaves.nodes, copyBytes(values[idx]))
+	}
+
+	// Compute the new nodes bottom-up. The other children are read from the
+	// tree, which only changes in the commit below.
+	staged := make([]stagedLevel, t.depth+1)
+	staged[0] = leaves
+	for level := 1; level <= t.depth; level++ {
+		children := &staged[level-1]
+		cur := stagedLevel{}
+		for i, pos := range children.positions {
+			if i == 0 || pos>>1 != children.positions[i-1]>>1 {
+				cur.positions = append(cur.positions, pos>>1)
+				cur.childStart = append(cur.childStart, i)
+			}
+		}
+		cur.nodes = make([][]byte, len(cur.positions))
+		t.hashStagedLevel(level, &cur, children)
+		staged[level] = cur
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, key := range staged[0].positions {
+		offset := int(key) * t.hashSize
+		copy(t.leaves[offset:offset+t.hashSize], staged[0].nodes[i])
+		bitSetTrue(t.leavesDirty, key)
+	}
+	words := len(t.leavesDirty)
+	for level := 1; level <= t.depth; level++ {
+		words = bitsetLen(words * 32)
+		if t.levelDirty[level] == nil {
+			t.levelDirty[level] = make([]uint64, words)
+		}
+		for i, pos := range staged[level].positions {
+			offset := int(pos) * t.hashSize
+			copy(t.levels[level][offset:offset+t.hashSize], staged[level].nodes[i])
+			bitSetTrue(t.levelDirty[level], pos)
+		}
+	}
+	t.root = staged[t.depth].nodes[0]
+	return nil
+}
+
+// hashStagedLevel computes the nodes of cur at level from the new nodes of
+// children and the current nodes of the tree.
+func (t *FixedDepthMerkleTree) hashStagedLevel(level int, cur *stagedLevel, children *stagedLevel) {
+	workers := runtime.NumCPU()
+	if n := (len(cur.positions) + minUpdatesPerWorker - 1) / minUpdatesPerWorker; n < workers {
+		workers = n
+	}
+	perWorker := (len(cur.positions) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(cur.positions); start += perWorker {
+		end := start + perWorker
+		if end > len(cur.positions) {
+			end = len(cur.positions)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			h := t.hasherFunc()
+			for i := start; i < end; i++ {
+				pos := cur.positions[i]
+				left := t.getNodeAt(level-1, pos<<1)
+				right := t.getNodeAt(level-1, (pos<<1)|1)
+				for c := cur.childStart[i]; c < len(children.positions) && children.positions[c]>>1 == pos; c++ {
+					if children.positions[c]&1 == 0 {
+						left = children.nodes[c]
+					} else {
+						right = children.nodes[c]
+					}
+				}
+				h.Reset()
+				h.Write(left)
+				h.Write(right)
+				cur.nodes[i] = h.Sum(nil)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
+
 // Root returns the current root hash.
 func (t *FixedDepthMerkleTree) Root() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.root
 }
 
 // Get returns the leaf value at the given key. Returns nilHashes[0] if not set.
 func (t *FixedDepthMerkleTree) Get(key uint32) []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	if int(key) >= t.capacity || !bitGet(t.leavesDirty, key) {
 		return copyBytes(t.nilHashes[0])
 	}
@@ -295,16 +486,26 @@ func (t *FixedDepthMerkleTree) Get(key uint32) []byte {
 // GetProof returns the Merkle proof (sibling hashes) for the given key.
 // Must be called after Build().
 func (t *FixedDepthMerkleTree) GetProof(key uint32) ([][]byte, error) {
+	proof, _, err := t.GetProofWithRoot(key)
+	return proof, err
+}
+
+// GetProofWithRoot returns the Merkle proof for the given key and the root it
+// verifies against. An Update running concurrently is either entirely included
+// or not included at all.
+func (t *FixedDepthMerkleTree) GetProofWithRoot(key uint32) ([][]byte, []byte, error) {
 	if uint64(key) >= (uint64(1) << uint(t.depth)) {
-		return nil, fmt.Errorf("key %d out of range for tree depth %d", key, t.depth)
+		return nil, nil, fmt.Errorf("key %d out of range for tree depth %d", key, t.depth)
 	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	proof := make([][]byte, t.depth)
 	pos := key
 	for level := 0; level < t.depth; level++ {
 		proof[level] = copyBytes(t.getNodeAt(level, pos^1))
 		pos >>= 1
 	}
-	return proof, nil
+	return proof, t.root, nil
 }
 
 // getNodeAt returns the hash at (level, position).
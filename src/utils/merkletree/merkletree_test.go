@@ -274,6 +274,167 @@ func TestCapacityAtMax(t *testing.T) {
 	}
 }
 
+// buildTestTree returns a built tree of capacity with the leaves of values.
+func buildTestTree(capacity int, values map[uint32][]byte) *FixedDepthMerkleTree {
+	tree := newTestTree(capacity)
+	for k, v := range values {
+		tree.Set(k, v)
+	}
+	tree.Build()
+	return tree
+}
+
+func TestUpdate(t *testing.T) {
+	capacity := 5000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 3000; k++ {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+
+	// change existing leaves, add new leaves after the built ones and
+	// update a key twice, the last value wins
+	keys := []uint32{0, 1, 77, 1024, 2999, 3000, 4999, 77}
+	updateValues := make([][]byte, len(keys))
+	for i, k := range keys {
+		updateValues[i] = makeLeafValue(uint64(k) + 10000 + uint64(i))
+		values[k] = updateValues[i]
+	}
+	if err := tree.Update(keys, updateValues); err != nil {
+		t.Fatal(err)
+	}
+	expected := buildTestTree(capacity, values)
+	if !bytes.Equal(tree.Root(), expected.Root()) {
+		t.Fatalf("got root %x after the update, want %x", tree.Root(), expected.Root())
+	}
+	for _, k := range []uint32{0, 77, 78, 2999, 3000, 4000, 4999} {
+		proof, err := tree.GetProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedProof, _ := expected.GetProof(k)
+		for i := range proof {
+			if !bytes.Equal(proof[i], expectedProof[i]) {
+				t.Fatalf("the proof of key %d differs at level %d", k, i)
+			}
+		}
+		if !bytes.Equal(tree.Get(k), expected.Get(k)) {
+			t.Fatalf("the leaf of key %d differs", k)
+		}
+	}
+
+	// Build after Update recomputes the same tree
+	tree.Build()
+	if !bytes.Equal(tree.Root(), expected.Root()) {
+		t.Fatal("the root changes after Build")
+	}
+}
+
+func TestUpdateEmptyTree(t *testing.T) {
+	tree := newTestTree(100)
+	if err := tree.Update([]uint32{3, 99}, [][]byte{makeLeafValue(3), makeLeafValue(99)}); err != nil {
+		t.Fatal(err)
+	}
+	expected := buildTestTree(100, map[uint32][]byte{3: makeLeafValue(3), 99: makeLeafValue(99)})
+	if !bytes.Equal(tree.Root(), expected.Root()) {
+		t.Fatal("the root of the updated empty tree differs")
+	}
+}
+
+func TestUpdateInvalid(t *testing.T) {
+	tree := newTestTree(100)
+	if err := tree.Update([]uint32{100}, [][]byte{makeLeafValue(0)}); err == nil {
+		t.Fatal("expected error for the key out of range")
+	}
+	if err := tree.Update([]uint32{1}, [][]byte{make([]byte, 31)}); err == nil {
+		t.Fatal("expected error for the short value")
+	}
+	if err := tree.Update([]uint32{1, 2}, [][]byte{makeLeafValue(0)}); err == nil {
+		t.Fatal("expected error for the missing value")
+	}
+	if !bytes.Equal(tree.Root(), tree.nilHashes[28]) {
+		t.Fatal("the invalid updates should not change the tree")
+	}
+}
+
+func TestGetProofWithRootDuringUpdate(t *testing.T) {
+	capacity := 2000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < uint32(capacity); k++ {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+
+	// the updates set the leaf of key 0 to one of the values of rounds, a
+	// proof of key 0 must verify one of them against the root it comes with
+	rounds := 20
+	roundValues := make([][]byte, rounds+1)
+	roundValues[0] = values[0]
+	for r := 1; r <= rounds; r++ {
+		roundValues[r] = makeLeafValue(uint64(100000 + r))
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				proof, root, err := tree.GetProofWithRoot(0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				verified := false
+				for _, v := range roundValues {
+					if VerifyProof(root, 0, proof, v, 28, newHasherFunc()) {
+						verified = true
+						break
+					}
+				}
+				if !verified {
+					t.Error("the proof doesn't verify against its root")
+					return
+				}
+			}
+		}()
+	}
+	for r := 1; r <= rounds; r++ {
+		keys := []uint32{0, uint32(r), uint32(capacity - r)}
+		updateValues := [][]byte{roundValues[r], makeLeafValue(uint64(r)), makeLeafValue(uint64(r))}
+		if err := tree.Update(keys, updateValues); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	leavesCount := 1 << 20
+	tree := newTestTree(leavesCount)
+	for j := 0; j < leavesCount; j++ {
+		tree.Set(uint32(j), makeLeafValue(uint64(j)))
+	}
+	tree.Build()
+	keys := make([]uint32, 4096)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = uint32(i * (leavesCount / len(keys)))
+		values[i] = makeLeafValue(uint64(i) + 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Update(keys, values)
+	}
+}
+
 func BenchmarkSet(b *testing.B) {
 	tree := newTestTree(b.N + 1)
 	val := makeLeafValue(0)
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package merkletree
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// mmapFile reads the file into memory on the platforms without mmap.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
+
+func mmapSharedFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("the file storage needs mmap")
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package merkletree
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file privately, the writes to the mapping are copy on
+// write and never reach the file.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// mmapSharedFile maps the file shared, the writes to the mapping are written
+// back to the file.
+func mmapSharedFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
@@ -0,0 +1,275 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/bits"
+	"sort"
+)
+
+// MultiProof proves a set of leaves against the root at once. The internal
+// nodes computed from the proven leaves are shared by their paths, so only the
+// siblings outside the paths are included, and like CompactProof the siblings
+// which are the hash of an empty subtree are omitted.
+//
+// The siblings are ordered from the leaf level up and by position within a
+// level. At each level the positions of the paths are walked in order, a
+// position whose sibling is also on a path takes it from there, otherwise it
+// takes the next sibling of the proof.
+type MultiProof struct {
+	// Keys are the proven keys in increasing order.
+	Keys []uint32
+	// NilSiblings has bit i set, least significant bit first, if the i-th
+	// sibling of the proof is the hash of an empty subtree.
+	NilSiblings []byte
+	// Siblings are the other siblings in order.
+	Siblings [][]byte
+}
+
+// GetRangeMultiProof returns the multiproof of the keys in [lo, hi] and the
+// root it verifies against.
+func (t *FixedDepthMerkleTree) GetRangeMultiProof(lo, hi uint32) (*MultiProof, []byte, error) {
+	if lo > hi {
+		return nil, nil, fmt.Errorf("invalid key range [%d, %d]", lo, hi)
+	}
+	keys := make([]uint32, 0, int(hi-lo)+1)
+	for k := uint64(lo); k <= uint64(hi); k++ {
+		keys = append(keys, uint32(k))
+	}
+	return t.GetMultiProof(keys)
+}
+
+// GetMultiProof returns the multiproof of the keys and the root it verifies
+// against, the keys are sorted and the duplicated keys are proven once. An
+// Update running concurrently is either entirely included or not included at
+// all.
+func (t *FixedDepthMerkleTree) GetMultiProof(keys []uint32) (*MultiProof, []byte, error) {
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys to prove")
+	}
+	positions := make([]uint32, len(keys))
+	copy(positions, keys)
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	positions = dedupSorted(positions)
+	if uint64(positions[len(positions)-1]) >= (uint64(1) << uint(t.depth)) {
+		return nil, nil, fmt.Errorf("key %d out of range for tree depth %d", positions[len(positions)-1], t.depth)
+	}
+	proof := &MultiProof{Keys: append([]uint32(nil), positions...)}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	count := 0
+	for level := 0; level < t.depth; level++ {
+		parents := positions[:0]
+		for i := 0; i < len(positions); i++ {
+			pos := positions[i]
+			if pos&1 == 0 && i+1 < len(positions) && positions[i+1] == pos+1 {
+				i++
+			} else {
+				sibling := t.getNodeAt(level, pos^1)
+				if count%8 == 0 {
+					proof.NilSiblings = append(proof.NilSiblings, 0)
+				}
+				if bytes.Equal(sibling, t.nilHashes[level]) {
+					proof.NilSiblings[count/8] |= 1 << uint(count%8)
+				} else {
+					proof.Siblings = append(proof.Siblings, copyBytes(sibling))
+				}
+				count++
+			}
+			parents = append(parents, pos>>1)
+		}
+		positions = parents
+	}
+	return proof, copyBytes(t.root), nil
+}
+
+// dedupSorted removes the duplicated values of the sorted values in place.
+func dedupSorted(values []uint32) []uint32 {
+	res := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// multiProofSiblingCount returns the number of siblings of the multiproof of
+// the sorted distinct keys in a tree of depth.
+func multiProofSiblingCount(keys []uint32, depth int) int {
+	positions := append([]uint32(nil), keys...)
+	count := 0
+	for level := 0; level < depth; level++ {
+		parents := positions[:0]
+		for i := 0; i < len(positions); i++ {
+			pos := positions[i]
+			if pos&1 == 0 && i+1 < len(positions) && positions[i+1] == pos+1 {
+				i++
+			} else {
+				count++
+			}
+			parents = append(parents, pos>>1)
+		}
+		positions = parents
+	}
+	return count
+}
+
+// checkMultiProofKeys checks the keys are increasing and in the range of depth.
+func checkMultiProofKeys(keys []uint32, depth int) error {
+	if len(keys) == 0 {
+		return errors.New("the multiproof has no keys")
+	}
+	for i, k := range keys {
+		if i > 0 && k <= keys[i-1] {
+			return errors.New("the keys of the multiproof are not increasing")
+		}
+	}
+	if uint64(keys[len(keys)-1]) >= (uint64(1) << uint(depth)) {
+		return fmt.Errorf("key %d out of range for tree depth %d", keys[len(keys)-1], depth)
+	}
+	return nil
+}
+
+// VerifyMultiProof verifies the multiproof of the leaves, leaves[i] is the
+// leaf of proof.Keys[i]. nilHashes are the hashes of the empty subtrees of the
+// tree, see NilHashes.
+func VerifyMultiProof(root []byte, proof *MultiProof, leaves [][]byte, nilHashes [][]byte,
+	hasherFunc func() hash.Hash) bool {
+	depth := len(nilHashes) - 1
+	if depth <= 0 || depth > 32 || checkMultiProofKeys(proof.Keys, depth) != nil || len(leaves) != len(proof.Keys) {
+		return false
+	}
+	positions := append([]uint32(nil), proof.Keys...)
+	nodes := make([][]byte, len(leaves))
+	copy(nodes, leaves)
+	h := hasherFunc()
+	count, next := 0, 0
+	for level := 0; level < depth; level++ {
+		parents := positions[:0]
+		parentNodes := nodes[:0]
+		for i := 0; i < len(positions); i++ {
+			pos := positions[i]
+			var left, right []byte
+			if pos&1 == 0 && i+1 < len(positions) && positions[i+1] == pos+1 {
+				left, right = nodes[i], nodes[i+1]
+				i++
+			} else {
+				var sibling []byte
+				if count/8 >= len(proof.NilSiblings) {
+					return false
+				}
+				if proof.NilSiblings[count/8]&(1<<uint(count%8)) != 0 {
+					sibling = nilHashes[level]
+				} else {
+					if next >= len(proof.Siblings) {
+						return false
+					}
+					sibling = proof.Siblings[next]
+					next++
+				}
+				count++
+				if pos&1 == 0 {
+					left, right = nodes[i], sibling
+				} else {
+					left, right = sibling, nodes[i]
+				}
+			}
+			h.Reset()
+			h.Write(left)
+			h.Write(right)
+			parents = append(parents, pos>>1)
+			parentNodes = append(parentNodes, h.Sum(nil))
+		}
+		positions, nodes = parents, parentNodes
+	}
+	return next == len(proof.Siblings) && len(proof.NilSiblings) == (count+7)/8 && bytes.Equal(nodes[0], root)
+}
+
+// Bytes encodes the proof as the big endian count of the runs of consecutive
+// keys, the big endian first key and length of every run, the NilSiblings
+// bitmap and the siblings. A key range is a single run.
+func (p *MultiProof) Bytes() []byte {
+	var runs []uint32
+	for i, k := range p.Keys {
+		if i > 0 && k == p.Keys[i-1]+1 {
+			runs[len(runs)-1]++
+		} else {
+			runs = append(runs, k, 1)
+		}
+	}
+	res := binary.BigEndian.AppendUint32(nil, uint32(len(runs)/2))
+	for _, v := range runs {
+		res = binary.BigEndian.AppendUint32(res, v)
+	}
+	res = append(res, p.NilSiblings...)
+	for _, sibling := range p.Siblings {
+		res = append(res, sibling...)
+	}
+	return res
+}
+
+// ParseMultiProof decodes the multiproof encoded by Bytes of a tree of depth
+// whose hashes have hashSize bytes. The runs of keys are expanded only up to
+// maxKeys keys, the number of leaves the caller verifies, so a small payload
+// can't claim a huge key range.
+func ParseMultiProof(data []byte, depth int, hashSize int, maxKeys int) (*MultiProof, error) {
+	errInvalid := errors.New("invalid multiproof")
+	if len(data) < 4 || depth <= 0 || depth > 32 || hashSize <= 0 || maxKeys <= 0 {
+		return nil, errInvalid
+	}
+	runCount := uint64(binary.BigEndian.Uint32(data))
+	if uint64(len(data)-4) < runCount*8 {
+		return nil, errInvalid
+	}
+	maxTotal := uint64(1) << uint(depth)
+	if uint64(maxKeys) < maxTotal {
+		maxTotal = uint64(maxKeys)
+	}
+	p := &MultiProof{}
+	offset := 4
+	total := uint64(0)
+	for i := uint64(0); i < runCount; i++ {
+		start := uint64(binary.BigEndian.Uint32(data[offset:]))
+		length := uint64(binary.BigEndian.Uint32(data[offset+4:]))
+		offset += 8
+		// the runs are maximal as written by Bytes, so the encoding is unique
+		if length == 0 || start+length > uint64(1)<<uint(depth) ||
+			len(p.Keys) > 0 && start <= uint64(p.Keys[len(p.Keys)-1])+1 {
+			return nil, errInvalid
+		}
+		if total += length; total > maxTotal {
+			return nil, fmt.Errorf("the multiproof has more than %d keys", maxTotal)
+		}
+		for k := start; k < start+length; k++ {
+			p.Keys = append(p.Keys, uint32(k))
+		}
+	}
+	if err := checkMultiProofKeys(p.Keys, depth); err != nil {
+		return nil, err
+	}
+
+	count := multiProofSiblingCount(p.Keys, depth)
+	bitmapLen := (count + 7) / 8
+	if len(data)-offset < bitmapLen {
+		return nil, errInvalid
+	}
+	p.NilSiblings = data[offset : offset+bitmapLen : offset+bitmapLen]
+	offset += bitmapLen
+	nilCount := 0
+	for _, b := range p.NilSiblings {
+		nilCount += bits.OnesCount8(b)
+	}
+	if count%8 != 0 && p.NilSiblings[bitmapLen-1]>>uint(count%8) != 0 ||
+		len(data)-offset != (count-nilCount)*hashSize {
+		return nil, errInvalid
+	}
+	for ; offset < len(data); offset += hashSize {
+		p.Siblings = append(p.Siblings, data[offset:offset+hashSize:offset+hashSize])
+	}
+	return p, nil
+}
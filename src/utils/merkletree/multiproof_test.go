@@ -0,0 +1,141 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMultiProof(t *testing.T) {
+	capacity := 3000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 2500; k += 3 {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+	nilHashes := NilHashes(28, nilAccountHash(), newHasherFunc())
+
+	cases := map[string][]uint32{
+		"single key":        {7},
+		"key set":           {2999, 5, 1024, 6, 5, 2047, 2048},
+		"batch range":       nil,
+		"whole tree prefix": nil,
+	}
+	for k := uint32(1000); k <= 1127; k++ {
+		cases["batch range"] = append(cases["batch range"], k)
+	}
+	for k := uint32(0); k < 4096; k++ {
+		cases["whole tree prefix"] = append(cases["whole tree prefix"], k)
+	}
+	for name, keys := range cases {
+		proof, root, err := tree.GetMultiProof(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ParseMultiProof(proof.Bytes(), 28, 32, len(proof.Keys))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		leaves := make([][]byte, len(decoded.Keys))
+		for i, k := range decoded.Keys {
+			leaves[i] = tree.Get(k)
+		}
+		if !VerifyMultiProof(root, decoded, leaves, nilHashes, newHasherFunc()) {
+			t.Fatalf("%s: multiproof verification failed", name)
+		}
+
+		// a changed leaf doesn't verify
+		leaves[len(leaves)-1] = makeLeafValue(100000)
+		if VerifyMultiProof(root, decoded, leaves, nilHashes, newHasherFunc()) {
+			t.Fatalf("%s: multiproof of a changed leaf is verified", name)
+		}
+	}
+}
+
+func TestRangeMultiProofSize(t *testing.T) {
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 2000; k++ {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(2000, values)
+	proof, root, err := tree.GetRangeMultiProof(1024, 1279)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the range is an aligned subtree of 256 leaves, so only its path to the
+	// root needs siblings
+	if len(proof.Siblings) > 28-8 {
+		t.Fatalf("the range multiproof has %d siblings", len(proof.Siblings))
+	}
+	leaves := make([][]byte, 256)
+	for i := range leaves {
+		leaves[i] = tree.Get(uint32(1024 + i))
+	}
+	nilHashes := NilHashes(28, nilAccountHash(), newHasherFunc())
+	if !VerifyMultiProof(root, proof, leaves, nilHashes, newHasherFunc()) {
+		t.Fatal("range multiproof verification failed")
+	}
+
+	if _, _, err = tree.GetRangeMultiProof(10, 9); err == nil {
+		t.Fatal("expected the error of the invalid range")
+	}
+	if _, _, err = tree.GetMultiProof([]uint32{1 << 28}); err == nil {
+		t.Fatal("expected the error of the key out of range")
+	}
+}
+
+func TestParseMultiProofInvalid(t *testing.T) {
+	tree := buildTestTree(100, map[uint32][]byte{4: makeLeafValue(4), 5: makeLeafValue(5), 70: makeLeafValue(70)})
+	proof, _, err := tree.GetMultiProof([]uint32{5, 6, 70})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := proof.Bytes()
+	cases := map[string][]byte{
+		"short":           encoded[:3],
+		"no runs":         {0, 0, 0, 0},
+		"missing sibling": encoded[:len(encoded)-32],
+		"extra bytes":     append(append([]byte{}, encoded...), 0),
+	}
+	for name, data := range cases {
+		if _, err := ParseMultiProof(data, 28, 32, 3); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := ParseMultiProof(encoded, 28, 32, 2); err == nil {
+		t.Error("expected the error of more keys than the leaves")
+	}
+
+	// a run of 2^28 keys in 12 bytes is rejected before the keys are expanded
+	hugeRun := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0x10, 0, 0, 0}
+	if _, err := ParseMultiProof(hugeRun, 28, 32, 1024); err == nil {
+		t.Error("expected the error of the huge key run")
+	}
+	if _, err := ParseMultiProof(hugeRun, 27, 32, 1<<30); err == nil {
+		t.Error("expected the error of the key run beyond the tree")
+	}
+}
+
+func FuzzParseMultiProof(f *testing.F) {
+	tree := buildTestTree(100, map[uint32][]byte{4: makeLeafValue(4), 5: makeLeafValue(5), 70: makeLeafValue(70)})
+	for _, keys := range [][]uint32{{5}, {5, 6, 70}, {0, 1, 2, 3, 4, 5, 6, 7}} {
+		proof, _, err := tree.GetMultiProof(keys)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(proof.Bytes(), uint16(len(keys)))
+	}
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0x10, 0, 0, 0}, uint16(1024))
+	f.Add([]byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}, uint16(2))
+	f.Fuzz(func(t *testing.T, data []byte, maxKeys uint16) {
+		proof, err := ParseMultiProof(data, 28, 32, int(maxKeys))
+		if err != nil {
+			return
+		}
+		if len(proof.Keys) > int(maxKeys) {
+			t.Fatalf("parsed %d keys, more than %d", len(proof.Keys), maxKeys)
+		}
+		if !bytes.Equal(proof.Bytes(), data) {
+			t.Fatal("the parsed multiproof doesn't encode to the same bytes")
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// Snapshot file layout, all integers are little endian and every section
+// starts at a multiple of 8 bytes so the bitsets can be mapped in place:
+//
+//	magic [8]byte, version uint32, depth uint32, hashSize uint32,
+//	fingerprint length uint32, capacity uint64
+//	fingerprint, nilLeafHash, nilHashes[depth], root
+//	leaves [capacity*hashSize], leavesDirty [bitsetLen(capacity)]uint64
+//	for level 1..depth: words uint64, levelDirty [words]uint64, levels [words*64*hashSize]
+//	checksum: sha256 of all the bytes above
+const (
+	snapshotMagic   = "ZKPORMT\x00"
+	snapshotVersion = 1
+	snapshotHeader  = 32
+)
+
+var (
+	errSnapshotFormat = errors.New("invalid account tree snapshot")
+	// the bitsets are mapped in place, so they must be little endian in memory
+	errBigEndianHost = errors.New("the account tree snapshot needs a little endian host")
+)
+
+// pad8 returns n rounded up to a multiple of 8.
+func pad8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// WriteSnapshot writes the built tree and the fingerprint of its input data to
+// the snapshot file name, see OpenSnapshot. The file is written to a temporary
+// file first and renamed, so a crash never leaves a partial snapshot.
+func (t *FixedDepthMerkleTree) WriteSnapshot(name string, fingerprint []byte) error {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		return errBigEndianHost
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tmpName := name + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer f.Close()
+
+	checksum := sha256.New()
+	w := bufio.NewWriterSize(io.MultiWriter(f, checksum), 1<<22)
+	header := make([]byte, snapshotHeader)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[8:], snapshotVersion)
+	binary.LittleEndian.PutUint32(header[12:], uint32(t.depth))
+	binary.LittleEndian.PutUint32(header[16:], uint32(t.hashSize))
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(fingerprint)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(t.capacity))
+	sections := [][]byte{header, fingerprint, t.nilHashes[0], t.nilHashes[t.depth], t.root, t.leaves, uint64sToBytes(t.leavesDirty)}
+	for level := 1; level <= t.depth; level++ {
+		words := make([]byte, 8)
+		binary.LittleEndian.PutUint64(words, uint64(len(t.levelDirty[level])))
+		// the level buffer is allocated before the level is built, so the
+		// levels without dirty bitset are written empty
+		nodes := t.levels[level][:len(t.levelDirty[level])*64*t.hashSize]
+		sections = append(sections, words, uint64sToBytes(t.levelDirty[level]), nodes)
+	}
+	var zeros [8]byte
+	for _, section := range sections {
+		if _, err = w.Write(section); err != nil {
+			return err
+		}
+		if _, err = w.Write(zeros[:pad8(len(section))-len(section)]); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if _, err = f.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
+
+// OpenSnapshot reopens the tree of the snapshot file name written by
+// WriteSnapshot and returns it with the fingerprint of its input data. The
+// file is memory-mapped privately: the leaves, the levels and the dirty bitsets
+// are read in place, and the updates of the tree are never written back to the
+// file. hasherFunc must be the hash function the tree was built with. The tree
+// must be closed by Close.
+func OpenSnapshot(name string, hasherFunc func() hash.Hash) (*FixedDepthMerkleTree, []byte, error) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		return nil, nil, errBigEndianHost
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() < snapshotHeader+sha256.Size {
+		return nil, nil, errSnapshotFormat
+	}
+	data, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	t, fingerprint, err := parseSnapshot(data, hasherFunc)
+	if err != nil {
+		munmapFile(data)
+		return nil, nil, err
+	}
+	t.mapped = data
+	return t, fingerprint, nil
+}
+
+func parseSnapshot(data []byte, hasherFunc func() hash.Hash) (*FixedDepthMerkleTree, []byte, error) {
+	body := data[:len(data)-sha256.Size]
+	checksum := sha256.Sum256(body)
+	if !bytes.Equal(checksum[:], data[len(body):]) {
+		return nil, nil, errors.New("the checksum of the account tree snapshot doesn't match")
+	}
+	if string(body[:8]) != snapshotMagic || binary.LittleEndian.Uint32(body[8:]) != snapshotVersion {
+		return nil, nil, errSnapshotFormat
+	}
+	depth := int(binary.LittleEndian.Uint32(body[12:]))
+	hashSize := int(binary.LittleEndian.Uint32(body[16:]))
+	fingerprintLen := int(binary.LittleEndian.Uint32(body[20:]))
+	capacity := binary.LittleEndian.Uint64(body[24:])
+	if depth <= 0 || depth > 32 || hashSize == 0 || capacity > uint64(1)<<uint(depth) {
+		return nil, nil, errSnapshotFormat
+	}
+
+	offset := snapshotHeader
+	next := func(n int) ([]byte, error) {
+		if n < 0 || offset+n > len(body) {
+			return nil, errSnapshotFormat
+		}
+		section := body[offset : offset+n : offset+n]
+		offset += pad8(n)
+		return section, nil
+	}
+	nextUint64s := func(words int) ([]uint64, error) {
+		section, err := next(words * 8)
+		if err != nil || words == 0 {
+			return nil, err
+		}
+		return unsafe.Slice((*uint64)(unsafe.Pointer(&section[0])), words), nil
+	}
+
+	fingerprint, err := next(fingerprintLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	nilLeafHash, err := next(hashSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nilRoot, err := next(hashSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := next(hashSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := NewFixedDepthMerkleTree(depth, nilLeafHash, hasherFunc, 0)
+	if !bytes.Equal(t.nilHashes[depth], nilRoot) {
+		return nil, nil, errors.New("the account tree snapshot is built with another hash function")
+	}
+	t.capacity = int(capacity)
+	t.root = copyBytes(root)
+	if t.leaves, err = next(t.capacity * hashSize); err != nil {
+		return nil, nil, err
+	}
+	if t.leavesDirty, err = nextUint64s(bitsetLen(t.capacity)); err != nil {
+		return nil, nil, err
+	}
+	maxWords := len(t.leavesDirty)
+	for level := 1; level <= depth; level++ {
+		maxWords = bitsetLen(maxWords * 32)
+		wordsSection, err := next(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		words := binary.LittleEndian.Uint64(wordsSection)
+		if words != 0 && words != uint64(maxWords) {
+			return nil, nil, errSnapshotFormat
+		}
+		if t.levelDirty[level], err = nextUint64s(int(words)); err != nil {
+			return nil, nil, err
+		}
+		if words == 0 {
+			// the level isn't built, allocate its buffer so Build and Update
+			// of the reopened tree can write it
+			t.levels[level] = make([]byte, maxWords*64*hashSize)
+		} else if t.levels[level], err = next(int(words) * 64 * hashSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	if offset != len(body) {
+		return nil, nil, errSnapshotFormat
+	}
+	return t, copyBytes(fingerprint), nil
+}
+
+// Close releases the memory-mapped snapshot of a tree opened by OpenSnapshot
+// and the storage of the tree, the tree can't be used afterwards.
+func (t *FixedDepthMerkleTree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	if t.mapped != nil {
+		err = munmapFile(t.mapped)
+		t.mapped = nil
+	}
+	if storageErr := t.storage.Close(); err == nil {
+		err = storageErr
+	}
+	t.leaves, t.leavesDirty = nil, nil
+	t.levels = make([][]byte, t.depth+1)
+	t.levelDirty = make([][]uint64, t.depth+1)
+	return err
+}
+
+// uint64sToBytes returns the bytes of the words in place.
+func uint64sToBytes(words []uint64) []byte {
+	if len(words) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(words)*8)
+}
+
+// Capacity returns the number of leaf slots of the tree.
+func (t *FixedDepthMerkleTree) Capacity() int {
+	return t.capacity
+}
@@ -0,0 +1,156 @@
+package merkletree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	capacity := 3000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 2500; k += 3 {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+	name := filepath.Join(t.TempDir(), "tree.snapshot")
+	fingerprint := []byte("input data")
+	if err := tree.WriteSnapshot(name, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, gotFingerprint, err := OpenSnapshot(name, newHasherFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if !bytes.Equal(gotFingerprint, fingerprint) {
+		t.Fatalf("got fingerprint %q, want %q", gotFingerprint, fingerprint)
+	}
+	if reopened.Capacity() != capacity || !bytes.Equal(reopened.Root(), tree.Root()) {
+		t.Fatal("the reopened tree differs")
+	}
+	for _, k := range []uint32{0, 1, 3, 2499, 2500, 2999} {
+		proof, err := reopened.GetProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyProof(reopened.Root(), k, proof, tree.Get(k), 28, newHasherFunc()) {
+			t.Fatalf("proof verification failed for key %d", k)
+		}
+	}
+
+	// the reopened tree can be updated, the snapshot file doesn't change
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []uint32{1, 2999}
+	updateValues := [][]byte{makeLeafValue(10001), makeLeafValue(10002)}
+	if err = reopened.Update(keys, updateValues); err != nil {
+		t.Fatal(err)
+	}
+	if err = tree.Update(keys, updateValues); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Root(), tree.Root()) {
+		t.Fatal("the updated reopened tree differs")
+	}
+	after, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, after) {
+		t.Fatal("the update of the reopened tree changes the snapshot file")
+	}
+}
+
+func TestSnapshotEmptyTree(t *testing.T) {
+	tree := newTestTree(100)
+	name := filepath.Join(t.TempDir(), "tree.snapshot")
+	if err := tree.WriteSnapshot(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _, err := OpenSnapshot(name, newHasherFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if !bytes.Equal(reopened.Root(), tree.Root()) {
+		t.Fatal("the reopened empty tree differs")
+	}
+	if err = reopened.Update([]uint32{7}, [][]byte{makeLeafValue(7)}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Root(), buildTestTree(100, map[uint32][]byte{7: makeLeafValue(7)}).Root()) {
+		t.Fatal("the update of the reopened empty tree differs")
+	}
+}
+
+func TestSnapshotSetAndBuild(t *testing.T) {
+	for name, values := range map[string]map[uint32][]byte{
+		"empty tree": nil,
+		"built tree": {3: makeLeafValue(3), 64: makeLeafValue(64), 99: makeLeafValue(99)},
+	} {
+		tree := buildTestTree(100, values)
+		snapshot := filepath.Join(t.TempDir(), "tree.snapshot")
+		if err := tree.WriteSnapshot(snapshot, nil); err != nil {
+			t.Fatal(err)
+		}
+		reopened, _, err := OpenSnapshot(snapshot, newHasherFunc())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened.Set(7, makeLeafValue(7))
+		reopened.Set(80, makeLeafValue(80))
+		reopened.Build()
+
+		expected := map[uint32][]byte{7: makeLeafValue(7), 80: makeLeafValue(80)}
+		for k, v := range values {
+			expected[k] = v
+		}
+		if !bytes.Equal(reopened.Root(), buildTestTree(100, expected).Root()) {
+			t.Fatalf("%s: the rebuilt reopened tree differs", name)
+		}
+		for _, k := range []uint32{3, 7, 80, 99} {
+			proof, err := reopened.GetProof(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(reopened.Root(), k, proof, reopened.Get(k), 28, newHasherFunc()) {
+				t.Fatalf("%s: proof verification failed for key %d", name, k)
+			}
+		}
+		reopened.Close()
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	tree := buildTestTree(100, map[uint32][]byte{5: makeLeafValue(5)})
+	name := filepath.Join(t.TempDir(), "tree.snapshot")
+	if err := tree.WriteSnapshot(name, []byte("fingerprint")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, content...)
+	corrupted[len(corrupted)/2] ^= 1
+	if err = os.WriteFile(name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = OpenSnapshot(name, newHasherFunc()); err == nil {
+		t.Fatal("expected error for the corrupted snapshot")
+	}
+	if err = os.WriteFile(name, content[:len(content)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = OpenSnapshot(name, newHasherFunc()); err == nil {
+		t.Fatal("expected error for the truncated snapshot")
+	}
+	if _, _, err = OpenSnapshot(filepath.Join(t.TempDir(), "missing"), newHasherFunc()); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error for the missing snapshot, got %v", err)
+	}
+}
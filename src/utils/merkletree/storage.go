@@ -0,0 +1,99 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage allocates the buffers of the leaves and the internal levels of a
+// FixedDepthMerkleTree, the tree reads and writes the buffers in place. The
+// dirty bitsets, 1 bit per node, are always kept in memory.
+type Storage interface {
+	// Buffer returns a zeroed buffer of size bytes for level, level 0 is the
+	// leaves. Every level is allocated once.
+	Buffer(level int, size int) ([]byte, error)
+	// Close releases all the buffers, they can't be used afterwards.
+	Close() error
+}
+
+// MemoryStorage allocates the buffers in memory, it is the storage of
+// NewFixedDepthMerkleTree.
+type MemoryStorage struct{}
+
+func (MemoryStorage) Buffer(level int, size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func (MemoryStorage) Close() error {
+	return nil
+}
+
+// FileStorage keeps every buffer in a memory-mapped file of a directory. The
+// operating system writes the pages of the tree back to the files and evicts
+// them under memory pressure, so a tree larger than RAM can be built and
+// queried. The files are scratch space, they are removed by Close, see
+// WriteSnapshot to persist a built tree.
+type FileStorage struct {
+	dir     string
+	mu      sync.Mutex
+	buffers map[int][]byte
+}
+
+// NewFileStorage returns the storage of the tree buffers in the files of dir,
+// dir is created if it doesn't exist.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, buffers: make(map[int][]byte)}, nil
+}
+
+func (s *FileStorage) levelFile(level int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("level%02d.bin", level))
+}
+
+func (s *FileStorage) Buffer(level int, size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buffers[level]; ok {
+		return nil, fmt.Errorf("the buffer of level %d is already allocated", level)
+	}
+	if size == 0 {
+		s.buffers[level] = nil
+		return []byte{}, nil
+	}
+	// the truncated file reads as zeros and takes no disk space until written
+	f, err := os.OpenFile(s.levelFile(level), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = f.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	data, err := mmapSharedFile(f, size)
+	if err != nil {
+		return nil, err
+	}
+	s.buffers[level] = data
+	return data, nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for level, data := range s.buffers {
+		if data != nil {
+			errs = append(errs, munmapFile(data))
+		}
+		if err := os.Remove(s.levelFile(level)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		delete(s.buffers, level)
+	}
+	return errors.Join(errs...)
+}
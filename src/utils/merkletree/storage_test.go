@@ -0,0 +1,83 @@
+package merkletree
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorage(t *testing.T) {
+	capacity := 3000
+	values := make(map[uint32][]byte)
+	for k := uint32(0); k < 2500; k += 3 {
+		values[k] = makeLeafValue(uint64(k))
+	}
+	tree := buildTestTree(capacity, values)
+
+	dir := filepath.Join(t.TempDir(), "account_tree")
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTree, err := NewFixedDepthMerkleTreeWithStorage(28, nilAccountHash(), newHasherFunc(), capacity, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		fileTree.Set(k, v)
+	}
+	fileTree.Build()
+	if !bytes.Equal(fileTree.Root(), tree.Root()) {
+		t.Fatal("the tree of the file storage differs")
+	}
+	for _, k := range []uint32{0, 1, 3, 2499, 2500, 2999} {
+		proof, err := fileTree.GetProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyProof(fileTree.Root(), k, proof, tree.Get(k), 28, newHasherFunc()) {
+			t.Fatalf("proof verification failed for key %d", k)
+		}
+	}
+
+	keys := []uint32{1, 2999}
+	updateValues := [][]byte{makeLeafValue(10001), makeLeafValue(10002)}
+	if err = fileTree.Update(keys, updateValues); err != nil {
+		t.Fatal(err)
+	}
+	if err = tree.Update(keys, updateValues); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileTree.Root(), tree.Root()) {
+		t.Fatal("the updated tree of the file storage differs")
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("the file storage has no files")
+	}
+	if err = fileTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = os.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Fatalf("the files of the closed storage are not removed: %v %v", files, err)
+	}
+}
+
+func TestFileStorageBufferTwice(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err = storage.Buffer(1, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Buffer(1, 4096); err == nil {
+		t.Fatal("expected the error of the allocated buffer")
+	}
+}
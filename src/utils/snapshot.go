@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotSequenceLimit bounds the sequence number of the audits on one date,
+// the snapshot id is date*snapshotSequenceLimit + sequence
+const snapshotSequenceLimit = 10000
+
+// ParseSnapshotId parses the snapshot id of an audit, which is the date of the
+// user data snapshot and the sequence number of the audit on that date, such as
+// "20240131-1". The snapshot id is bound into the batch commitments, so the
+// proofs of one audit can't be replayed into another one.
+func ParseSnapshotId(s string) (uint64, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid snapshot id %q, expected <yyyymmdd>-<sequence>", s)
+	}
+	date, err := time.Parse("20060102", parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid date of snapshot id %q: %w", s, err)
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || sequence >= snapshotSequenceLimit {
+		return 0, fmt.Errorf("invalid sequence of snapshot id %q, expected [0, %d)", s, snapshotSequenceLimit)
+	}
+	day := uint64(date.Year()*10000 + int(date.Month())*100 + date.Day())
+	return day*snapshotSequenceLimit + sequence, nil
+}
+
+// FormatSnapshotId returns the string form of the snapshot id parsed by ParseSnapshotId.
+func FormatSnapshotId(id uint64) string {
+	return fmt.Sprintf("%08d-%d", id/snapshotSequenceLimit, id%snapshotSequenceLimit)
+}
@@ -9,26 +9,36 @@ type TierRatio struct {
 }
 
 type CexAssetInfo struct {
-	TotalEquity               uint64
-	TotalDebt                 uint64
-	BasePrice                 uint64
-	Symbol                    string
-	Index                     uint32
-	LoanCollateral            uint64
-	MarginCollateral          uint64
-	PortfolioMarginCollateral uint64
-	LoanRatios                [TierCount]TierRatio
-	MarginRatios              [TierCount]TierRatio
-	PortfolioMarginRatios     [TierCount]TierRatio
+	TotalEquity Uint128
+	TotalDebt   Uint128
+	BasePrice   uint64
+	Symbol      string
+	Index       uint32
+	// the balances of the asset have BalanceDecimals decimals and the price has
+	// PriceDecimals decimals, they sum to ValueDecimals
+	BalanceDecimals uint8
+	PriceDecimals   uint8
+	// the total collateral and the tiers ratio of each CollateralCategories
+	Collaterals      []Uint128
+	CollateralRatios [][]TierRatio
+}
+
+// AssetRegistryEntry is a row of the asset registry file, the registry is
+// published with the audit so the balances and the prices can be converted
+// back to the amounts
+type AssetRegistryEntry struct {
+	Symbol          string
+	Index           uint32
+	BalanceDecimals uint8
+	PriceDecimals   uint8
 }
 
 type AccountAsset struct {
-	Index           uint16
-	Equity          uint64
-	Debt            uint64
-	Loan            uint64
-	Margin          uint64
-	PortfolioMargin uint64
+	Index  uint16
+	Equity Uint128
+	Debt   Uint128
+	// the collateral of each CollateralCategories
+	Collaterals []Uint128
 }
 
 type AccountInfo struct {
@@ -44,7 +54,7 @@ type CreateUserOperation struct {
 	Assets       []AccountAsset
 	AccountIndex uint32
 	AccountIdHash []byte
-	AccountProof  [AccountTreeDepth][]byte
+	AccountProof  [][]byte
 }
 
 type BatchCreateUserWitness struct {
@@ -54,7 +64,92 @@ type BatchCreateUserWitness struct {
 	AfterCEXAssetsCommitment  []byte
 	MinAccountIndex           uint32
 	MaxAccountIndex           uint32
+	// UserCount is the number of the ops which are not padding accounts
+	UserCount uint32
+	// SnapshotId is the audit of the batch, see ParseSnapshotId
+	SnapshotId uint64
+	// AccountIds proves the account ids are distinct with SortedAccountIds,
+	// the chunk of the sorted account ids of the tree for the batch
+	AccountIds       AccountIdsCheck
+	SortedAccountIds [][]byte
+	// CexAssetsBlinding is the blinding factor of the cex assets commitments,
+	// it is nil if BlindCexAssetsCommitment is not set
+	CexAssetsBlinding []byte
 
 	BeforeCexAssets []CexAssetInfo
 	CreateUserOps   []CreateUserOperation
 }
+
+// UpdateUserOperation replaces the leaf of one account of the previous account
+// tree by its new assets, the account id of the leaf doesn't change.
+// The assets are sorted by index and only contain the assets the user owns.
+type UpdateUserOperation struct {
+	OldAssets     []AccountAsset
+	NewAssets     []AccountAsset
+	AccountIndex  uint32
+	AccountIdHash []byte
+	// the proof of the account against the root before this op
+	AccountProof [][]byte
+}
+
+type BatchUpdateUserWitness struct {
+	BatchCommitment           []byte
+	BeforeAccountTreeRoot     []byte
+	AfterAccountTreeRoot      []byte
+	BeforeCEXAssetsCommitment []byte
+	AfterCEXAssetsCommitment  []byte
+	// the assets count of the users in the batch, it is one of AssetCountsTiers
+	AssetCounts       int
+	CexAssetsBlinding []byte
+
+	BeforeCexAssets []CexAssetInfo
+	UpdateUserOps   []UpdateUserOperation
+	// SnapshotId is the audit of the batch, see ParseSnapshotId
+	SnapshotId uint64
+	// OldUserCount and NewUserCount are the number of the ops whose old and
+	// new leaves are not padding accounts, see CountUpdatedUsers
+	OldUserCount uint32
+	NewUserCount uint32
+}
+
+type AggregatedProof struct {
+	Backend string
+	// Level is the level of the aggregation circuit which generated Proof,
+	// 0 for the circuit which aggregates the batch proofs
+	Level                    int
+	Proof                    []byte
+	AccountTreeRoot          []byte
+	EmptyCEXAssetsCommitment []byte
+	FinalCEXAssetsCommitment []byte
+	AccountCount             uint64
+	// UserCount is the number of the accounts which are not padding accounts
+	UserCount  uint64
+	SnapshotId uint64
+	// the Challenge and the AfterLastAccountId of the AccountIdsCheck of the last batch
+	AccountIdsChallenge []byte
+	LastAccountId       []byte
+}
+
+// ReservesComparisonWitness opens the final cex assets commitment of the batch
+// proofs and compares the totals of every cex asset with its reserves.
+type ReservesComparisonWitness struct {
+	Commitment                []byte
+	EmptyCEXAssetsCommitment  []byte
+	FinalCEXAssetsCommitment  []byte
+	PublicCEXAssetsCommitment []byte
+	ReservesCommitment        []byte
+	CexAssetsBlinding         []byte
+
+	CexAssets []CexAssetInfo
+	Reserves  []Uint128
+}
+
+// ReservesProof is the proof of ReservesComparisonCircuit, the verifier recomputes
+// its public commitment from the published cex assets prices and Reserves.
+type ReservesProof struct {
+	Backend                  string
+	Proof                    []byte
+	EmptyCEXAssetsCommitment []byte
+	FinalCEXAssetsCommitment []byte
+	Reserves                 []Uint128
+}
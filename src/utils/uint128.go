@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// Uint128 is an unsigned 128-bit integer. The balances of the user assets,
+// the totals of the cex assets and the reserves are Uint128, so the balances
+// of the assets with many decimals don't overflow.
+type Uint128 struct {
+	Hi uint64
+	Lo uint64
+}
+
+func NewUint128(v uint64) Uint128 {
+	return Uint128{Lo: v}
+}
+
+// Uint128FromBig returns v as Uint128, it fails if v is negative or doesn't
+// fit in 128 bits.
+func Uint128FromBig(v *big.Int) (Uint128, error) {
+	if v.Sign() < 0 {
+		return Uint128{}, errors.New("negative uint128")
+	}
+	if v.BitLen() > BalanceBits {
+		return Uint128{}, errors.New("overflow uint128")
+	}
+	lo := new(big.Int).And(v, maxUint64BigInt)
+	hi := new(big.Int).Rsh(v, 64)
+	return Uint128{Hi: hi.Uint64(), Lo: lo.Uint64()}, nil
+}
+
+var maxUint64BigInt = new(big.Int).SetUint64(^uint64(0))
+
+func (u Uint128) Big() *big.Int {
+	res := new(big.Int).SetUint64(u.Hi)
+	res.Lsh(res, 64)
+	return res.Or(res, new(big.Int).SetUint64(u.Lo))
+}
+
+func (u Uint128) IsZero() bool {
+	return u.Hi == 0 && u.Lo == 0
+}
+
+// Cmp returns -1, 0 or +1 if u is less than, equal to or greater than v.
+func (u Uint128) Cmp(v Uint128) int {
+	switch {
+	case u.Hi < v.Hi || u.Hi == v.Hi && u.Lo < v.Lo:
+		return -1
+	case u == v:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// Add returns u + v and whether it overflows.
+func (u Uint128) Add(v Uint128) (Uint128, bool) {
+	lo, carry := bits.Add64(u.Lo, v.Lo, 0)
+	hi, carry := bits.Add64(u.Hi, v.Hi, carry)
+	return Uint128{Hi: hi, Lo: lo}, carry != 0
+}
+
+// Sub returns u - v and whether it underflows.
+func (u Uint128) Sub(v Uint128) (Uint128, bool) {
+	lo, borrow := bits.Sub64(u.Lo, v.Lo, 0)
+	hi, borrow := bits.Sub64(u.Hi, v.Hi, borrow)
+	return Uint128{Hi: hi, Lo: lo}, borrow != 0
+}
+
+func (u Uint128) String() string {
+	return u.Big().String()
+}
+
+// MarshalJSON encodes u as a JSON number like the big.Int values of the
+// configs, so the configs of the balances less than 2^64 don't change.
+func (u Uint128) MarshalJSON() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+func (u *Uint128) UnmarshalJSON(data []byte) error {
+	v := new(big.Int)
+	if err := v.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	res, err := Uint128FromBig(v)
+	if err != nil {
+		return err
+	}
+	*u = res
+	return nil
+}
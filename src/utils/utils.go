@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/gob"
 	"encoding/hex"
@@ -13,39 +14,31 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	"github.com/shopspring/decimal"
 	"github.com/klauspost/compress/s2"
 	"github.com/go-sql-driver/mysql"
 )
 
+// ConvertTierRatiosToBytes packs TierRatiosPerElement tier ratios into one
+// field element, the j-th tier ratio of the element takes the bits from
+// j*TierRatioBits: the ratio takes 8 bits and the boundary value takes the rest.
 func ConvertTierRatiosToBytes(tiersRatio []TierRatio) [][]byte {
-	res := make([][]byte, 0, len(tiersRatio)/2)
-	resBigInt := new(big.Int).SetUint64(0)
-	aBigInt := new(big.Int).SetUint64(0)
-	bBigInt := new(big.Int).SetUint64(0)
-	cBigInt := new(big.Int).SetUint64(0)
-	dBigInt := new(big.Int).SetUint64(0)
-	for i := 0; i < len(tiersRatio); i += 2 {
-		resBigInt.SetUint64(0)
-		aBigInt.SetUint64(uint64(tiersRatio[i].Ratio))
-		bBigInt.Set(tiersRatio[i].BoundaryValue)
-		bBigInt.Mul(bBigInt, Uint8MaxValueBigInt)
-		aBigInt.Add(aBigInt, bBigInt)
-
-		cBigInt.SetUint64(uint64(tiersRatio[i+1].Ratio))
-		cBigInt.Mul(cBigInt, Uint126MaxValueBigInt)
-		dBigInt.Set(tiersRatio[i+1].BoundaryValue)
-		dBigInt.Mul(dBigInt, Uint134MaxValueBigInt)
-		cBigInt.Add(cBigInt, dBigInt)
-
-		resBigInt.Add(aBigInt, cBigInt)
+	perElement := TierRatiosPerElement()
+	res := make([][]byte, 0, (len(tiersRatio)+perElement-1)/perElement)
+	tierBigInt := new(big.Int)
+	for i := 0; i < len(tiersRatio); i += perElement {
+		resBigInt := new(big.Int)
+		for j := min(i+perElement, len(tiersRatio)) - 1; j >= i; j-- {
+			resBigInt.Lsh(resBigInt, TierRatioBits)
+			tierBigInt.Lsh(tiersRatio[j].BoundaryValue, 8)
+			tierBigInt.Add(tierBigInt, new(big.Int).SetUint64(uint64(tiersRatio[j].Ratio)))
+			resBigInt.Add(resBigInt, tierBigInt)
+		}
 		res = append(res, resBigInt.Bytes())
-
 	}
 	return res
 }
@@ -53,34 +46,29 @@ func ConvertTierRatiosToBytes(tiersRatio []TierRatio) [][]byte {
 func ConvertAssetInfoToBytes(value any) [][]byte {
 	switch t := value.(type) {
 	case CexAssetInfo:
-		res := make([][]byte, 0, 10)
-		aBigInt := new(big.Int).SetUint64(t.TotalEquity)
-		bBigInt := new(big.Int).SetUint64(t.TotalDebt)
-		cBigInt := new(big.Int).SetUint64(t.BasePrice)
-		aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
-		bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
-		aBigInt.Add(aBigInt, bBigInt)
-		resBigInt := new(big.Int).Add(aBigInt, cBigInt)
-		res = append(res, resBigInt.Bytes())
-
-		resBigInt.SetUint64(0)
-		aBigInt.SetUint64(t.LoanCollateral)
-		bBigInt.SetUint64(t.MarginCollateral)
-		cBigInt.SetUint64(t.PortfolioMarginCollateral)
-		aBigInt.Mul(aBigInt, Uint64MaxValueBigIntSquare)
-		bBigInt.Mul(bBigInt, Uint64MaxValueBigInt)
-		aBigInt.Add(aBigInt, bBigInt)
-		resBigInt.Add(cBigInt, aBigInt)
-		res = append(res, resBigInt.Bytes())
+		if len(t.Collaterals) != len(CollateralCategories) || len(t.CollateralRatios) != len(CollateralCategories) {
+			panic("the collaterals of cex asset " + t.Symbol + " don't match the collateral categories")
+		}
+		res := make([][]byte, 0, 2+len(t.Collaterals)+len(t.CollateralRatios)*TierCount/TierRatiosPerElement())
+		// TotalEquity*2^64 + BasePrice takes 192 bits, TotalDebt and
+		// every collateral take one circuit Variable
+		equityAndPrice := t.TotalEquity.Big()
+		equityAndPrice.Lsh(equityAndPrice, PriceBits).Add(equityAndPrice, new(big.Int).SetUint64(t.BasePrice))
+		res = append(res, equityAndPrice.Bytes(), t.TotalDebt.Big().Bytes())
+		for i := 0; i < len(t.Collaterals); i++ {
+			res = append(res, t.Collaterals[i].Big().Bytes())
+		}
 
 		// one tier ratio: boundaryValue take 118 bits, ratio take 8 bits = 126 bits
 		// so two tier ratio take 252 bits, can be stored in one circuit Variable
-		tempRes := ConvertTierRatiosToBytes(t.LoanRatios[:])
-		res = append(res, tempRes...)
-		tempRes = ConvertTierRatiosToBytes(t.MarginRatios[:])
-		res = append(res, tempRes...)
-		tempRes = ConvertTierRatiosToBytes(t.PortfolioMarginRatios[:])
-		res = append(res, tempRes...)
+		// of bn254 or bls12-381
+		for i := 0; i < len(t.CollateralRatios); i++ {
+			if len(t.CollateralRatios[i]) != TierCount {
+				panic("the tiers ratio count of cex asset " + t.Symbol + " doesn't match the TierCount")
+			}
+			tempRes := ConvertTierRatiosToBytes(t.CollateralRatios[i])
+			res = append(res, tempRes...)
+		}
 		return res
 	default:
 		panic("not supported type")
@@ -95,24 +83,65 @@ func SelectAssetValue(expectAssetIndex int, flag int, currentAssetPosition int,
 		return ZeroBigInt, false
 	} else {
 		if flag == 0 {
-			return new(big.Int).SetUint64(assets[currentAssetPosition].Equity), false
+			return assets[currentAssetPosition].Equity.Big(), false
 		} else if flag == 1 {
-			return new(big.Int).SetUint64(assets[currentAssetPosition].Debt), false
-		} else if flag == 2 {
-			return new(big.Int).SetUint64(assets[currentAssetPosition].Loan), false
-		} else if flag == 3 {
-			return new(big.Int).SetUint64(assets[currentAssetPosition].Margin), false
+			return assets[currentAssetPosition].Debt.Big(), false
 		} else {
-			return new(big.Int).SetUint64(assets[currentAssetPosition].PortfolioMargin), true
+			// the flag of the collaterals starts from 2
+			collaterals := assets[currentAssetPosition].Collaterals
+			return collaterals[flag-2].Big(), flag-2 == len(collaterals)-1
 		}
 	}
 }
 
 func IsAssetEmpty(ua *AccountAsset) bool {
-	if ua.Debt == 0 && ua.Equity == 0 && ua.Margin == 0 && ua.PortfolioMargin == 0 && ua.Loan == 0 {
-		return true
+	if !ua.Debt.IsZero() || !ua.Equity.IsZero() {
+		return false
 	}
-	return false
+	for _, c := range ua.Collaterals {
+		if !c.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+func NewEmptyAccountAsset(index uint16) AccountAsset {
+	return AccountAsset{
+		Index:       index,
+		Collaterals: make([]Uint128, len(CollateralCategories)),
+	}
+}
+
+func NewEmptyCexAssetInfo(index uint32) CexAssetInfo {
+	res := CexAssetInfo{
+		Symbol:           "reserved",
+		BasePrice:        0,
+		Index:            index,
+		Collaterals:      make([]Uint128, len(CollateralCategories)),
+		CollateralRatios: make([][]TierRatio, len(CollateralCategories)),
+	}
+	for i := 0; i < len(res.CollateralRatios); i++ {
+		res.CollateralRatios[i] = PaddingTierRatios([]TierRatio{})
+	}
+	return res
+}
+
+// CloneCexAssetsInfo copies the cex assets info, so that updating the
+// collaterals of one doesn't change the other.
+func CloneCexAssetsInfo(cexAssetsInfo []CexAssetInfo) []CexAssetInfo {
+	res := make([]CexAssetInfo, len(cexAssetsInfo))
+	copy(res, cexAssetsInfo)
+	for i := 0; i < len(res); i++ {
+		res[i].Collaterals = append([]Uint128(nil), cexAssetsInfo[i].Collaterals...)
+	}
+	return res
+}
+
+// GetNumOfAssetFields returns the number of fields of one user asset in the
+// user assets commitment: index, equity, debt and the collaterals.
+func GetNumOfAssetFields() int {
+	return 3 + len(CollateralCategories)
 }
 
 func GetNonEmptyAssetsCountOfUser(assets []AccountAsset) int {
@@ -144,14 +173,21 @@ func GetAssetsCountOfUser(assets []AccountAsset) int {
 	return targetCounts
 }
 
-func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []uint64) {
+// GetBatchUpdateUserOpsCounts returns the number of ops of one batch of
+// BatchUpdateUserCircuit. An update op checks both the old and the new assets
+// of a user, so it costs about twice as much as a create op.
+func GetBatchUpdateUserOpsCounts(assetCounts int) int {
+	return max(BatchCreateUserOpsCountsTiers[assetCounts]/2, 1)
+}
+
+func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []Uint128) {
 	targetCounts := GetAssetsCountOfUser(assets)
 	if targetCounts < len(assets) {
 		fmt.Println("the target counts is ", targetCounts, " the length of assets is ", len(assets))
 		panic("the target counts is less than the length of assets")
 	}
-	numOfAssetsFields := 6
-	paddingFlattenAssets = make([]uint64, targetCounts*numOfAssetsFields)
+	numOfAssetsFields := GetNumOfAssetFields()
+	paddingFlattenAssets = make([]Uint128, targetCounts*numOfAssetsFields)
 	paddingCounts := targetCounts - len(assets)
 	currentPaddingCounts := 0
 	currentAssetIndex := 0
@@ -161,60 +197,44 @@ func PaddingAccountAssets(assets []AccountAsset) (paddingFlattenAssets []uint64)
 			for j := currentAssetIndex; j < int(assets[i].Index); j++ {
 				currentPaddingCounts += 1
 
-				paddingFlattenAssets[index*numOfAssetsFields] = uint64(j)
+				paddingFlattenAssets[index*numOfAssetsFields] = NewUint128(uint64(j))
 				index += 1
 				if currentPaddingCounts >= paddingCounts {
 					break
 				}
 			}
 		}
-		paddingFlattenAssets[index*numOfAssetsFields] = uint64(assets[i].Index)
+		if len(assets[i].Collaterals) != len(CollateralCategories) {
+			panic("the collaterals count of asset doesn't match the collateral categories")
+		}
+		paddingFlattenAssets[index*numOfAssetsFields] = NewUint128(uint64(assets[i].Index))
 		paddingFlattenAssets[index*numOfAssetsFields+1] = assets[i].Equity
 		paddingFlattenAssets[index*numOfAssetsFields+2] = assets[i].Debt
-		paddingFlattenAssets[index*numOfAssetsFields+3] = assets[i].Loan
-		paddingFlattenAssets[index*numOfAssetsFields+4] = assets[i].Margin
-		paddingFlattenAssets[index*numOfAssetsFields+5] = assets[i].PortfolioMargin
+		copy(paddingFlattenAssets[index*numOfAssetsFields+3:(index+1)*numOfAssetsFields], assets[i].Collaterals)
 		index += 1
 		currentAssetIndex = int(assets[i].Index) + 1
 	}
 	for i := index; i < targetCounts; i++ {
-		paddingFlattenAssets[i*numOfAssetsFields] = uint64(currentAssetIndex)
+		paddingFlattenAssets[i*numOfAssetsFields] = NewUint128(uint64(currentAssetIndex))
 		currentAssetIndex += 1
 	}
 
 	return paddingFlattenAssets
 }
 
+// ComputeUserAssetsCommitment packs the fields of every asset into the circuit
+// Variables: index*2^128 + equity, debt and every collateral.
 func ComputeUserAssetsCommitment(hasher *hash.Hash, assets []AccountAsset) []byte {
 	(*hasher).Reset()
 	paddingFlattenAssets := PaddingAccountAssets(assets)
-	targetCounts := GetAssetsCountOfUser(assets)
-	numOfAssetsFields := 6
-	numOfOneField := 3
-	nEles := (targetCounts*numOfAssetsFields + 2) / numOfOneField
-
-	aBigInt := new(big.Int).SetUint64(0)
-	bBigInt := new(big.Int).SetUint64(0)
-	cBigInt := new(big.Int).SetUint64(0)
-	for i := 0; i < nEles; i++ {
-		aBigInt.SetUint64(0)
-		if i*numOfOneField < len(paddingFlattenAssets) {
-			aBigInt.SetUint64(paddingFlattenAssets[i*numOfOneField])
-		}
-		bBigInt.SetUint64(0)
-		if i*numOfOneField+1 < len(paddingFlattenAssets) {
-			bBigInt.SetUint64(paddingFlattenAssets[i*numOfOneField+1])
+	numOfAssetsFields := GetNumOfAssetFields()
+	for i := 0; i < len(paddingFlattenAssets); i += numOfAssetsFields {
+		indexAndEquity := paddingFlattenAssets[i].Big()
+		indexAndEquity.Lsh(indexAndEquity, BalanceBits).Add(indexAndEquity, paddingFlattenAssets[i+1].Big())
+		(*hasher).Write(indexAndEquity.Bytes())
+		for j := i + 2; j < i+numOfAssetsFields; j++ {
+			(*hasher).Write(paddingFlattenAssets[j].Big().Bytes())
 		}
-		cBigInt.SetUint64(0)
-		if i*numOfOneField+2 < len(paddingFlattenAssets) {
-			cBigInt.SetUint64(paddingFlattenAssets[i*numOfOneField+2])
-		}
-
-		sumBigIntBytes := new(big.Int).Add(new(big.Int).Add(
-			new(big.Int).Mul(aBigInt, Uint64MaxValueBigIntSquare),
-			new(big.Int).Mul(bBigInt, Uint64MaxValueBigInt)),
-			cBigInt).Bytes()
-		(*hasher).Write(sumBigIntBytes)
 	}
 
 	return (*hasher).Sum(nil)
@@ -245,18 +265,17 @@ func ParseUserDataSet(dirname string) (map[int][]AccountInfo, []CexAssetInfo, er
 		if !strings.Contains(userFile.Name(), ".csv") {
 			continue
 		}
-		if userFile.Name() == CEX_ASSET_INFO_FILE {
+		if userFile.Name() == CEX_ASSET_INFO_FILE || userFile.Name() == AssetRegistryFile {
 			continue
 		}
 
 		userFileNames = append(userFileNames, filepath.Join(dirname, userFile.Name()))
 	}
-	assetIndexes, err := ParseAssetIndexFromUserFile(userFileNames[0])
+	registry, err := ParseAssetRegistryFromFile(filepath.Join(dirname, AssetRegistryFile))
 	if err != nil {
 		return nil, nil, err
 	}
-
-	cexAssetInfo, err = ParseCexAssetInfoFromFile(filepath.Join(dirname, CEX_ASSET_INFO_FILE), assetIndexes)
+	cexAssetInfo, err = ParseCexAssetInfoFromFile(filepath.Join(dirname, CEX_ASSET_INFO_FILE), registry)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -315,40 +334,61 @@ func ParseUserDataSet(dirname string) (map[int][]AccountInfo, []CexAssetInfo, er
 	return accountInfo, cexAssetInfo, nil
 }
 
-func SafeAdd(a uint64, b uint64) (c uint64) {
-	c = a + b
-	if c < a {
+func SafeAdd(a Uint128, b Uint128) Uint128 {
+	c, overflow := a.Add(b)
+	if overflow {
 		panic("overflow for balance")
 	}
 	return c
 }
 
-func ParseAssetIndexFromUserFile(userFilename string) ([]string, error) {
-	f, err := os.Open(userFilename)
-	if err != nil {
-		return nil, err
+func SafeSub(a Uint128, b Uint128) Uint128 {
+	c, underflow := a.Sub(b)
+	if underflow {
+		panic("underflow for balance")
 	}
-	defer f.Close()
-	csvReader := csv.NewReader(f)
-	data, err := csvReader.Read()
-	if err != nil {
-		return nil, err
+	return c
+}
+
+// CheckUserFileHeader checks the header of the user file name lists the
+// columns of the listed cex assets in the order of their indexes, and returns
+// the indexes of the assets of the columns.
+func CheckUserFileHeader(name string, header []string, cexAssetsInfo []CexAssetInfo) ([]int, error) {
+	assetIndexes := make([]int, 0, len(cexAssetsInfo))
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		if cexAssetsInfo[i].Symbol != "reserved" {
+			assetIndexes = append(assetIndexes, i)
+		}
 	}
 	// 3: rn, id, total_net_balance
-	// 6: equity_assetA, debt_assetA, assetA, assetA_loan, assetA_margin, assetA_portfolio_margin
-	assetCounts := (len(data) - 3) / 6
-	cexAssetsList := make([]string, assetCounts)
-
-	for i := 0; i < assetCounts; i++ {
-		cexAssetsList[i] = strings.ToLower(data[i*6+4])
+	// GetNumOfAssetFields(): equity_assetA, debt_assetA, assetA, and the collateral of each category,
+	// e.g. vl_assetA, m_assetA, pm_assetA
+	numOfAssetColumns := GetNumOfAssetFields()
+	if len(header) != 3+len(assetIndexes)*numOfAssetColumns {
+		return nil, fmt.Errorf("%s has %d columns, expected %d columns of %d assets and %d collateral categories",
+			name, len(header), 3+len(assetIndexes)*numOfAssetColumns, len(assetIndexes), len(CollateralCategories))
 	}
-	return cexAssetsList, nil
+	for j, index := range assetIndexes {
+		symbol := cexAssetsInfo[index].Symbol
+		base := 2 + j*numOfAssetColumns
+		expected := []string{"e_" + symbol, "d_" + symbol, symbol}
+		for c := 0; c < numOfAssetColumns; c++ {
+			column := strings.ToLower(header[base+c])
+			if c < len(expected) && column != expected[c] ||
+				c >= len(expected) && !strings.HasSuffix(column, "_"+symbol) {
+				return nil, fmt.Errorf("%s column %d is %q, expected the column of asset %s which has index %d in the asset registry",
+					name, base+c+1, header[base+c], symbol, index)
+			}
+		}
+	}
+	return assetIndexes, nil
 }
 
-func PaddingTierRatios(tiersRatio []TierRatio) (res [TierCount]TierRatio) {
+func PaddingTierRatios(tiersRatio []TierRatio) (res []TierRatio) {
 	if len(tiersRatio) > TierCount {
 		panic("the length of tiers ratio is bigger than TierCount")
 	}
+	res = make([]TierRatio, TierCount)
 	for i := 0; i < TierCount; i++ {
 		if i < len(tiersRatio) {
 			res[i] = tiersRatio[i]
@@ -368,14 +408,14 @@ func PaddingTierRatios(tiersRatio []TierRatio) (res [TierCount]TierRatio) {
 	return res
 }
 
-func ParseTiersRatioFromStr(tiersRatioEnc string) ([TierCount]TierRatio, error) {
+func ParseTiersRatioFromStr(tiersRatioEnc string) ([]TierRatio, error) {
 	tiersRatioEnc = strings.Trim(tiersRatioEnc, "[]")
 	if len(tiersRatioEnc) == 0 {
 		return PaddingTierRatios([]TierRatio{}), nil
 	}
 	tiersRatioStrs := strings.Split(tiersRatioEnc, ",")
 	tiersRatio := make([]TierRatio, 0, 10)
-	valueMultiplier := new(big.Int).SetUint64(10000000000000000)
+	valueMultiplier := new(big.Int).Exp(big.NewInt(10), big.NewInt(ValueDecimals), nil)
 	for i := 0; i < len(tiersRatioStrs); i += 1 {
 		tmpTierRatio := strings.Split(strings.Trim(tiersRatioStrs[i], " "), ":")
 		rangeValues := strings.Split(tmpTierRatio[0], "-")
@@ -404,8 +444,14 @@ func ParseTiersRatioFromStr(tiersRatioEnc string) ([TierCount]TierRatio, error)
 		if boundaryValueBigInt.Cmp(lowBoundaryValueBigInt) < 0 {
 			return PaddingTierRatios([]TierRatio{}), errors.New("tiers boundry value data wrong")
 		}
+		// the collateral values are never larger than MaxTierBoundaryValue, so the
+		// larger boundary values are capped and the tiers above it are dropped,
+		// such as the boundary value 18446744073709551615 of the last tier
+		if lowBoundaryValueBigInt.Cmp(MaxTierBoundaryValue) >= 0 {
+			break
+		}
 		if boundaryValueBigInt.Cmp(MaxTierBoundaryValue) > 0 {
-			return PaddingTierRatios([]TierRatio{}), errors.New("tiers boundry value data wrong")
+			boundaryValueBigInt.Set(MaxTierBoundaryValue)
 		}
 		tiersRatio = append(tiersRatio, TierRatio{
 			BoundaryValue: boundaryValueBigInt,
@@ -433,7 +479,10 @@ func CalculatePrecomputedValue(tiersRatio []TierRatio) {
 	}
 }
 
-func ParseCexAssetInfoFromFile(name string, assetIndexes []string) ([]CexAssetInfo, error) {
+// ParseCexAssetInfoFromFile parses the cex assets info file, the assets are
+// placed at their indexes in the asset registry. The assets of the registry
+// which are not in the file are delisted, their indexes stay reserved.
+func ParseCexAssetInfoFromFile(name string, registry []AssetRegistryEntry) ([]CexAssetInfo, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -444,66 +493,208 @@ func ParseCexAssetInfoFromFile(name string, assetIndexes []string) ([]CexAssetIn
 	if err != nil {
 		return nil, err
 	}
+	symbols := make(map[string]AssetRegistryEntry, len(registry))
+	for _, entry := range registry {
+		symbols[entry.Symbol] = entry
+	}
 	cexAssets2Info := make(map[string]CexAssetInfo)
 	data = data[1:]
 	for i := 0; i < len(data); i++ {
-		if len(data[i]) != 5 {
+		// symbol, price, and the tiers ratio of each collateral category
+		if len(data[i]) != 2+len(CollateralCategories) {
 			fmt.Println("cex asset data wrong:", data[i])
 			return nil, errors.New("cex asset data wrong")
 		}
 		tmpCexAssetInfo := CexAssetInfo{
-			Symbol: strings.ToLower(data[i][0]),
+			Symbol:           strings.ToLower(data[i][0]),
+			Collaterals:      make([]Uint128, len(CollateralCategories)),
+			CollateralRatios: make([][]TierRatio, len(CollateralCategories)),
 		}
-		multiplier := int64(100000000)
-		if AssetTypeForTwoDigits[tmpCexAssetInfo.Symbol] {
-			multiplier = 100000000000000
+		entry, ok := symbols[tmpCexAssetInfo.Symbol]
+		if !ok {
+			fmt.Println("the asset", tmpCexAssetInfo.Symbol, "is not in the asset registry")
+			return nil, errors.New("cex asset data wrong")
 		}
-		tmpCexAssetInfo.BasePrice, err = ConvertFloatStrToUint64(data[i][1], multiplier)
+		tmpCexAssetInfo.BalanceDecimals = entry.BalanceDecimals
+		tmpCexAssetInfo.PriceDecimals = entry.PriceDecimals
+		tmpCexAssetInfo.BasePrice, err = ConvertPriceStrToUint64(data[i][1], entry.PriceDecimals)
 		if err != nil {
 			fmt.Println("asset data wrong:", data[i][0], err.Error())
 			return nil, err
 		}
-		tmpCexAssetInfo.LoanRatios, err = ParseTiersRatioFromStr(data[i][2])
-		if err != nil {
-			fmt.Println("parse loan tiers ratio failed:", data[i][2], err.Error())
-			return nil, err
-		}
-		tmpCexAssetInfo.MarginRatios, err = ParseTiersRatioFromStr(data[i][3])
-		if err != nil {
-			fmt.Println("parse margin tiers ratio failed:", data[i][3], err.Error())
-			return nil, err
-		}
-		tmpCexAssetInfo.PortfolioMarginRatios, err = ParseTiersRatioFromStr(data[i][4])
-		if err != nil {
-			fmt.Println("parse portfolio margin tiers ratio failed:", data[i][4], err.Error())
-			return nil, err
+		for c, category := range CollateralCategories {
+			tmpCexAssetInfo.CollateralRatios[c], err = ParseTiersRatioFromStr(data[i][2+c])
+			if err != nil {
+				fmt.Println("parse", category, "tiers ratio failed:", data[i][2+c], err.Error())
+				return nil, err
+			}
 		}
 
+		if _, ok = cexAssets2Info[tmpCexAssetInfo.Symbol]; ok {
+			fmt.Println("the asset", tmpCexAssetInfo.Symbol, "is duplicated in cex assets info")
+			return nil, errors.New("cex asset data wrong")
+		}
+		tmpCexAssetInfo.Index = entry.Index
 		cexAssets2Info[tmpCexAssetInfo.Symbol] = tmpCexAssetInfo
 	}
 
 	cexAssetsInfo := make([]CexAssetInfo, AssetCounts)
+	for i := 0; i < AssetCounts; i++ {
+		cexAssetsInfo[i] = NewEmptyCexAssetInfo(uint32(i))
+	}
+	for _, info := range cexAssets2Info {
+		cexAssetsInfo[info.Index] = info
+	}
+	return cexAssetsInfo, nil
+
+}
 
-	if len(assetIndexes) != len(cexAssets2Info) {
-		fmt.Println("the length of asset indexes is not equal to the length of cex assets info")
-		return nil, errors.New("cex asset data wrong")
+// ParseAssetRegistryFromFile parses the asset registry file of symbol, index,
+// balance_decimals and price_decimals columns, it returns the entries ordered
+// by index. The registry is append only: the index of every asset is its row,
+// the new assets are appended and the delisted assets keep their rows, so the
+// index of an asset never changes between audits. The balance decimals and the
+// price decimals of every asset must sum to ValueDecimals.
+func ParseAssetRegistryFromFile(name string) ([]AssetRegistryEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	csvReader := csv.NewReader(f)
+	data, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; i < len(assetIndexes); i++ {
-		cexAssetsInfo[i] = cexAssets2Info[assetIndexes[i]]
-		cexAssetsInfo[i].Index = uint32(i)
+	if len(data) == 0 {
+		return nil, errors.New("asset registry file is empty")
+	}
+	data = data[1:]
+	if len(data) > AssetCounts {
+		return nil, fmt.Errorf("the asset registry has %d assets, more than %d", len(data), AssetCounts)
 	}
-	for i := len(assetIndexes); i < AssetCounts; i++ {
-		cexAssetsInfo[i] = CexAssetInfo{
-			Symbol:                "reserved",
-			BasePrice:             0,
-			LoanRatios:            PaddingTierRatios([]TierRatio{}),
-			MarginRatios:          PaddingTierRatios([]TierRatio{}),
-			PortfolioMarginRatios: PaddingTierRatios([]TierRatio{}),
-			Index:                 uint32(i),
+	registry := make([]AssetRegistryEntry, len(data))
+	symbols := make(map[string]bool, len(data))
+	for i := 0; i < len(data); i++ {
+		if len(data[i]) != 4 {
+			fmt.Println("asset registry data wrong:", data[i])
+			return nil, errors.New("asset registry data wrong")
+		}
+		index, err := strconv.ParseUint(data[i][1], 10, 32)
+		if err != nil || index != uint64(i) {
+			fmt.Println("the index of asset", data[i][0], "is", data[i][1], "but it is the row", i, "of the asset registry, the new assets must be appended")
+			return nil, errors.New("asset registry data wrong")
+		}
+		balanceDecimals, err := strconv.ParseUint(data[i][2], 10, 8)
+		if err != nil {
+			fmt.Println("the balance decimals of asset", data[i][0], "is wrong:", data[i][2])
+			return nil, errors.New("asset registry data wrong")
 		}
+		priceDecimals, err := strconv.ParseUint(data[i][3], 10, 8)
+		if err != nil || priceDecimals > MaxPriceDecimals || balanceDecimals+priceDecimals != ValueDecimals {
+			fmt.Println("the price decimals of asset", data[i][0], "is wrong:", data[i][3])
+			return nil, errors.New("asset registry data wrong")
+		}
+		registry[i] = AssetRegistryEntry{
+			Symbol:          strings.ToLower(data[i][0]),
+			Index:           uint32(index),
+			BalanceDecimals: uint8(balanceDecimals),
+			PriceDecimals:   uint8(priceDecimals),
+		}
+		if registry[i].Symbol == "" || registry[i].Symbol == "reserved" || symbols[registry[i].Symbol] {
+			fmt.Println("the asset", registry[i].Symbol, "is invalid or duplicated")
+			return nil, errors.New("asset registry data wrong")
+		}
+		symbols[registry[i].Symbol] = true
 	}
-	return cexAssetsInfo, nil
+	return registry, nil
+}
 
+// CheckAssetRegistryAppended checks registry only appends assets to the
+// registry of the previous audit, so the assets keep their indexes and decimals.
+func CheckAssetRegistryAppended(prevRegistry, registry []AssetRegistryEntry) error {
+	if len(registry) < len(prevRegistry) {
+		return fmt.Errorf("the asset registry has %d assets, less than %d of the previous audit", len(registry), len(prevRegistry))
+	}
+	for i := 0; i < len(prevRegistry); i++ {
+		if registry[i] != prevRegistry[i] {
+			return fmt.Errorf("the asset %d changes from %+v to %+v", i, prevRegistry[i], registry[i])
+		}
+	}
+	return nil
+}
+
+// CheckCexAssetsWithRegistry checks the symbol and the decimals of every cex
+// asset are the ones of its index in the asset registry, the reserved assets
+// are skipped.
+func CheckCexAssetsWithRegistry(cexAssetsInfo []CexAssetInfo, registry []AssetRegistryEntry) error {
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		if cexAssetsInfo[i].Symbol == "reserved" {
+			continue
+		}
+		if int(cexAssetsInfo[i].Index) >= len(registry) {
+			return fmt.Errorf("the asset %s is not in the asset registry", cexAssetsInfo[i].Symbol)
+		}
+		entry := registry[cexAssetsInfo[i].Index]
+		if entry.Symbol != cexAssetsInfo[i].Symbol || entry.BalanceDecimals != cexAssetsInfo[i].BalanceDecimals ||
+			entry.PriceDecimals != cexAssetsInfo[i].PriceDecimals {
+			return fmt.Errorf("the asset %s doesn't match the asset registry", cexAssetsInfo[i].Symbol)
+		}
+	}
+	return nil
+}
+
+// FormatBalance converts the balance integer of the decimals back to the amount.
+func FormatBalance(v Uint128, decimals uint8) string {
+	return decimal.NewFromBigInt(v.Big(), -int32(decimals)).String()
+}
+
+// ParseReservesFromFile parses the reserves file of symbol and reserves columns,
+// the reserves use the same decimals as the user balances. It returns the reserves
+// ordered by the index of cexAssetsInfo, the assets not in the file have no reserves.
+func ParseReservesFromFile(name string, cexAssetsInfo []CexAssetInfo) ([]Uint128, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	csvReader := csv.NewReader(f)
+	data, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("reserves file is empty")
+	}
+	assetIndexes := make(map[string]int, len(cexAssetsInfo))
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		if cexAssetsInfo[i].Symbol != "" {
+			assetIndexes[cexAssetsInfo[i].Symbol] = i
+		}
+	}
+	reserves := make([]Uint128, len(cexAssetsInfo))
+	found := make(map[string]bool)
+	data = data[1:]
+	for i := 0; i < len(data); i++ {
+		// symbol, reserves
+		if len(data[i]) != 2 {
+			fmt.Println("reserves data wrong:", data[i])
+			return nil, errors.New("reserves data wrong")
+		}
+		symbol := strings.ToLower(data[i][0])
+		index, ok := assetIndexes[symbol]
+		if !ok || found[symbol] {
+			fmt.Println("the asset", symbol, "is not a cex asset or duplicated")
+			return nil, errors.New("reserves data wrong")
+		}
+		found[symbol] = true
+		reserves[index], err = ConvertFloatStrToUint128(data[i][1], cexAssetsInfo[index].BalanceDecimals)
+		if err != nil {
+			fmt.Println("asset reserves wrong:", data[i][0], err.Error())
+			return nil, err
+		}
+	}
+	return reserves, nil
 }
 
 func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int][]AccountInfo, int, error) {
@@ -519,10 +710,14 @@ func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int
 	}
 	accounts := make(map[int][]AccountInfo)
 	// rn, id,
-	// equity_assetA, debt_assetA, assetA, assetA_loan, assetA_margin, assetA_portfolio_margin,
-	// equity_assetB, debt_assetB, assetB, assetB_loan, assetB_margin, assetA_portfolio_margin,
+	// equity_assetA, debt_assetA, assetA, and the collateral of each category, e.g. vl_assetA, m_assetA, pm_assetA,
+	// equity_assetB, debt_assetB, assetB, and the collateral of each category, e.g. vl_assetB, m_assetB, pm_assetB,
 	// ......
-	assetCounts := (len(data[0]) - 3) / 6
+	numOfAssetColumns := GetNumOfAssetFields()
+	assetIndexes, err := CheckUserFileHeader(name, data[0], cexAssetsInfo)
+	if err != nil {
+		return nil, 0, err
+	}
 	data = data[1:]
 	invalidCounts := 0
 	for i := 0; i < len(data); i++ {
@@ -536,69 +731,68 @@ func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int
 		if err != nil || len(accountId) != 32 {
 			panic("accountId is invalid: " + data[i][1])
 		}
-		account.AccountId = new(fr.Element).SetBytes(accountId).Marshal()
-		var tmpAsset AccountAsset
-		for j := 0; j < assetCounts; j++ {
-			multiplier := int64(100000000)
-			if AssetTypeForTwoDigits[cexAssetsInfo[j].Symbol] {
-				multiplier = 100
-			}
-			equity, err := ConvertFloatStrToUint64(data[i][j*6+2], multiplier)
+		account.AccountId = ReduceToFieldElement(accountId)
+		for j, index := range assetIndexes {
+			decimals := cexAssetsInfo[index].BalanceDecimals
+			equity, err := ConvertFloatStrToUint128(data[i][j*numOfAssetColumns+2], decimals)
 			if err != nil {
-				fmt.Println("the symbol is ", cexAssetsInfo[j].Symbol)
+				fmt.Println("the symbol is ", cexAssetsInfo[index].Symbol)
 				fmt.Println("account", data[i][1], "equity data wrong:", err.Error())
 				invalidCounts += 1
 				invalidAccountFlag = true
 				break
 			}
 
-			debt, err := ConvertFloatStrToUint64(data[i][j*6+3], multiplier)
+			debt, err := ConvertFloatStrToUint128(data[i][j*numOfAssetColumns+3], decimals)
 			if err != nil {
-				fmt.Println("the debt symbol is ", cexAssetsInfo[j].Symbol)
+				fmt.Println("the debt symbol is ", cexAssetsInfo[index].Symbol)
 				fmt.Println("account", data[i][1], "debt data wrong:", err.Error())
 				invalidCounts += 1
 				invalidAccountFlag = true
 				break
 			}
 
-			loan, err := ConvertFloatStrToUint64(data[i][j*6+5], multiplier)
-			if err != nil {
-				fmt.Println("the loan symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "loan data wrong:", err.Error())
-				invalidCounts += 1
-				invalidAccountFlag = true
-				break
+			collaterals := make([]Uint128, len(CollateralCategories))
+			for c, category := range CollateralCategories {
+				collaterals[c], err = ConvertFloatStrToUint128(data[i][j*numOfAssetColumns+5+c], decimals)
+				if err != nil {
+					fmt.Println("the", category, "symbol is ", cexAssetsInfo[index].Symbol)
+					fmt.Println("account", data[i][1], category, "data wrong:", err.Error())
+					invalidAccountFlag = true
+					break
+				}
 			}
-
-			margin, err := ConvertFloatStrToUint64(data[i][j*6+6], multiplier)
-			if err != nil {
-				fmt.Println("the margin symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "margin data wrong:", err.Error())
+			if invalidAccountFlag {
 				invalidCounts += 1
-				invalidAccountFlag = true
 				break
 			}
 
-			portfolioMargin, err := ConvertFloatStrToUint64(data[i][j*6+7], multiplier)
-			if err != nil {
-				fmt.Println("the portfolio margin symbol is ", cexAssetsInfo[j].Symbol)
-				fmt.Println("account", data[i][1], "portfolio margin data wrong:", err.Error())
+			for c := range collaterals {
+				if err = CheckCollateralValue(collaterals[c], cexAssetsInfo[index].BasePrice); err != nil {
+					fmt.Println("the", CollateralCategories[c], "symbol is ", cexAssetsInfo[index].Symbol)
+					fmt.Println("account", data[i][1], CollateralCategories[c], "data wrong:", err.Error())
+					invalidAccountFlag = true
+					break
+				}
+			}
+			if invalidAccountFlag {
 				invalidCounts += 1
-				invalidAccountFlag = true
 				break
 			}
 
-			if equity != 0 || debt != 0 {
-				tmpAsset.Index = uint16(j)
-				tmpAsset.Equity = equity
-				tmpAsset.Debt = debt
-				tmpAsset.Loan = loan
-				tmpAsset.Margin = margin
-				tmpAsset.PortfolioMargin = portfolioMargin
+			if !equity.IsZero() || !debt.IsZero() {
+				tmpAsset := AccountAsset{
+					Index:       uint16(index),
+					Equity:      equity,
+					Debt:        debt,
+					Collaterals: collaterals,
+				}
 				assets = append(assets, tmpAsset)
-				assetTotalCollateral := SafeAdd(tmpAsset.Loan, tmpAsset.Margin)
-				assetTotalCollateral = SafeAdd(assetTotalCollateral, tmpAsset.PortfolioMargin)
-				if assetTotalCollateral > tmpAsset.Equity {
+				var assetTotalCollateral Uint128
+				for _, c := range tmpAsset.Collaterals {
+					assetTotalCollateral = SafeAdd(assetTotalCollateral, c)
+				}
+				if assetTotalCollateral.Cmp(tmpAsset.Equity) > 0 {
 					fmt.Println("account", data[i][1], "data wrong: total collateral is bigger than equity", assetTotalCollateral, tmpAsset.Equity)
 					invalidCounts += 1
 					invalidAccountFlag = true
@@ -606,12 +800,12 @@ func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int
 				}
 
 				account.TotalEquity = account.TotalEquity.Add(account.TotalEquity,
-					new(big.Int).Mul(new(big.Int).SetUint64(tmpAsset.Equity), new(big.Int).SetUint64(cexAssetsInfo[j].BasePrice)))
+					new(big.Int).Mul(tmpAsset.Equity.Big(), new(big.Int).SetUint64(cexAssetsInfo[index].BasePrice)))
 				account.TotalDebt = account.TotalDebt.Add(account.TotalDebt,
-					new(big.Int).Mul(new(big.Int).SetUint64(tmpAsset.Debt), new(big.Int).SetUint64(cexAssetsInfo[j].BasePrice)))
+					new(big.Int).Mul(tmpAsset.Debt.Big(), new(big.Int).SetUint64(cexAssetsInfo[index].BasePrice)))
 
 				account.TotalCollateral = account.TotalCollateral.Add(account.TotalCollateral,
-					CalculateAssetValueForCollateral(loan, margin, portfolioMargin, &cexAssetsInfo[j]))
+					CalculateAssetValueForCollateral(collaterals, &cexAssetsInfo[index]))
 			}
 		}
 
@@ -645,20 +839,29 @@ func ReadUserDataFromCsvFile(name string, cexAssetsInfo []CexAssetInfo) (map[int
 	return accounts, invalidCounts, nil
 }
 
-func CalculateAssetValueForCollateral(loan uint64, margin uint64, portfolioMargin uint64, cexAssetInfo *CexAssetInfo) *big.Int {
-	assetPrice := new(big.Int).SetUint64(cexAssetInfo.BasePrice)
-	loanValue := new(big.Int).SetUint64(loan)
-	loanValue.Mul(loanValue, assetPrice)
-	loanValue = CalculateAssetValueViaTiersRatio(loanValue, cexAssetInfo.LoanRatios[:])
-
-	marginValue := new(big.Int).SetUint64(margin)
-	marginValue.Mul(marginValue, assetPrice)
-	marginValue = CalculateAssetValueViaTiersRatio(marginValue, cexAssetInfo.MarginRatios[:])
+// CheckCollateralValue checks the value of the collateral, the balance
+// multiplied by the price, is at most MaxTierBoundaryValue like the circuit
+// does, it is about 3.3e11 USD of ValueDecimals. The balance and the price fit
+// in BalanceBits and PriceBits, so the value is less than 2^192 whatever the
+// decimals of the asset are.
+func CheckCollateralValue(collateral Uint128, price uint64) error {
+	value := collateral.Big()
+	value.Mul(value, new(big.Int).SetUint64(price))
+	if value.Cmp(MaxTierBoundaryValue) > 0 {
+		return fmt.Errorf("the collateral value %s is bigger than the max tier boundary value %s", value, MaxTierBoundaryValue)
+	}
+	return nil
+}
 
-	portfolioMarginValue := new(big.Int).SetUint64(portfolioMargin)
-	portfolioMarginValue.Mul(portfolioMarginValue, assetPrice)
-	portfolioMarginValue = CalculateAssetValueViaTiersRatio(portfolioMarginValue, cexAssetInfo.PortfolioMarginRatios[:])
-	return loanValue.Add(loanValue, marginValue).Add(loanValue, portfolioMarginValue)
+func CalculateAssetValueForCollateral(collaterals []Uint128, cexAssetInfo *CexAssetInfo) *big.Int {
+	assetPrice := new(big.Int).SetUint64(cexAssetInfo.BasePrice)
+	res := new(big.Int).SetUint64(0)
+	for i := 0; i < len(collaterals); i++ {
+		collateralValue := collaterals[i].Big()
+		collateralValue.Mul(collateralValue, assetPrice)
+		res.Add(res, CalculateAssetValueViaTiersRatio(collateralValue, cexAssetInfo.CollateralRatios[i]))
+	}
+	return res
 }
 
 func CalculateAssetValueViaTiersRatio(collateralValue *big.Int, tiersRatio []TierRatio) *big.Int {
@@ -701,36 +904,71 @@ func ConvertFloatStrToUint64(f string, multiplier int64) (uint64, error) {
 	return num, nil
 }
 
-func DecodeBatchWitness(data string) *BatchCreateUserWitness {
-	var witnessForCircuit BatchCreateUserWitness
+// ConvertFloatStrToUint128 converts the balance f to the integer of its
+// decimals, it fails rather than rounding if f has more decimals.
+func ConvertFloatStrToUint128(f string, decimals uint8) (Uint128, error) {
+	if f == "0.0" {
+		return Uint128{}, nil
+	}
+	numFloat, err := decimal.NewFromString(f)
+	if err != nil {
+		return Uint128{}, err
+	}
+	numFloat = numFloat.Shift(int32(decimals))
+	if !numFloat.IsInteger() {
+		return Uint128{}, fmt.Errorf("%s has more than %d decimals", f, decimals)
+	}
+	return Uint128FromBig(numFloat.BigInt())
+}
+
+// ConvertPriceStrToUint64 converts the price to the integer of the price
+// decimals of its asset, the digits beyond the decimals are truncated.
+func ConvertPriceStrToUint64(price string, decimals uint8) (uint64, error) {
+	numFloat, err := decimal.NewFromString(price)
+	if err != nil {
+		return 0, err
+	}
+	if numFloat.IsNegative() {
+		return 0, errors.New("negative price")
+	}
+	numBigInt := numFloat.Shift(int32(decimals)).BigInt()
+	if !numBigInt.IsUint64() {
+		return 0, errors.New("overflow uint64")
+	}
+	return numBigInt.Uint64(), nil
+}
+
+// decodeWitnessData decodes the base64 encoded, s2 compressed gob of a batch witness.
+func decodeWitnessData(data string, witness any) bool {
 	b, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		fmt.Println("deserialize batch witness failed: ", err.Error())
-		return nil
+		return false
 	}
 	uncompressedData, err := s2.Decode(nil, b)
 	if err != nil {
 		fmt.Println("uncompress batch witness failed: ", err.Error())
-		return nil
+		return false
 	}
 	unserializeBuf := bytes.NewBuffer(uncompressedData)
 	dec := gob.NewDecoder(unserializeBuf)
-	err = dec.Decode(&witnessForCircuit)
+	err = dec.Decode(witness)
 	if err != nil {
 		fmt.Println("unmarshal batch witness failed: ", err.Error())
+		return false
+	}
+	return true
+}
+
+func DecodeBatchWitness(data string) *BatchCreateUserWitness {
+	var witnessForCircuit BatchCreateUserWitness
+	if !decodeWitnessData(data, &witnessForCircuit) {
 		return nil
 	}
 	for i := 0; i < len(witnessForCircuit.CreateUserOps); i++ {
 		userAssets := make([]AccountAsset, AssetCounts)
 		for p := 0; p < AssetCounts; p++ {
-			userAssets[p] = AccountAsset{
-				Index:           uint16(p),
-				Equity:          0,
-				Debt:            0,
-				Loan:            0,
-				Margin:          0,
-				PortfolioMargin: 0,
-			}
+			userAssets[p] = NewEmptyAccountAsset(uint16(p))
 		}
 		storeUserAssets := witnessForCircuit.CreateUserOps[i].Assets
 		for p := 0; p < len(storeUserAssets); p++ {
@@ -741,11 +979,89 @@ func DecodeBatchWitness(data string) *BatchCreateUserWitness {
 	return &witnessForCircuit
 }
 
+func DecodeBatchUpdateWitness(data string) *BatchUpdateUserWitness {
+	var witnessForCircuit BatchUpdateUserWitness
+	if !decodeWitnessData(data, &witnessForCircuit) {
+		return nil
+	}
+	return &witnessForCircuit
+}
+
+// ComputeBatchCommitment returns the BatchCommitment of a batch of
+// BatchCreateUserCircuit, userCount is the number of the users in the batch
+// which are not padding accounts, snapshotId is the audit of the batch and
+// accountIdsCommitment is the Commitment of the AccountIdsCheck of the batch.
+func ComputeBatchCommitment(accountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment []byte,
+	minAccountIndex, maxAccountIndex, userCount uint32, snapshotId uint64, accountIdsCommitment []byte) []byte {
+	return HashBytes(accountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment,
+		uint32ToBytes(minAccountIndex), uint32ToBytes(maxAccountIndex), uint32ToBytes(userCount), uint64ToBytes(snapshotId),
+		accountIdsCommitment)
+}
+
+func uint32ToBytes(v uint32) []byte {
+	res := make([]byte, 4)
+	binary.BigEndian.PutUint32(res, v)
+	return res
+}
+
+func uint64ToBytes(v uint64) []byte {
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, v)
+	return res
+}
+
+// isRealUser returns true if the assets have at least one asset which isn't
+// empty, the assets of a padding account are all empty.
+func isRealUser(assets []AccountAsset) bool {
+	for j := 0; j < len(assets); j++ {
+		if !IsAssetEmpty(&assets[j]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountRealUsers returns the number of the ops which are not padding accounts,
+// the op of a real user has at least one asset which isn't empty.
+func CountRealUsers(ops []CreateUserOperation) uint32 {
+	count := uint32(0)
+	for i := 0; i < len(ops); i++ {
+		if isRealUser(ops[i].Assets) {
+			count++
+		}
+	}
+	return count
+}
+
+// CountUpdatedUsers returns the number of the ops whose old leaves are real
+// users and the number of the ops whose new leaves are real users, so the
+// user count after the batch is the user count before it plus newCount minus
+// oldCount.
+func CountUpdatedUsers(ops []UpdateUserOperation) (oldCount uint32, newCount uint32) {
+	for i := 0; i < len(ops); i++ {
+		if isRealUser(ops[i].OldAssets) {
+			oldCount++
+		}
+		if isRealUser(ops[i].NewAssets) {
+			newCount++
+		}
+	}
+	return oldCount, newCount
+}
+
+// ComputeBatchUpdateCommitment returns the BatchCommitment of a batch of
+// BatchUpdateUserCircuit, snapshotId is the audit of the batch.
+func ComputeBatchUpdateCommitment(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment []byte,
+	snapshotId uint64, oldUserCount uint32, newUserCount uint32) []byte {
+	return HashBytes(beforeAccountTreeRoot, afterAccountTreeRoot, beforeCexAssetsCommitment, afterCexAssetsCommitment,
+		uint64ToBytes(snapshotId), uint32ToBytes(oldUserCount), uint32ToBytes(newUserCount))
+}
+
 func AccountInfoToHash(account *AccountInfo, hasher *hash.Hash) []byte {
 	assetCommitment := ComputeUserAssetsCommitment(hasher, account.Assets)
 	(*hasher).Reset()
 	// compute new account leaf node hash
-	accountHash := poseidon.PoseidonBytes(account.AccountId, account.TotalEquity.Bytes(), account.TotalDebt.Bytes(), account.TotalCollateral.Bytes(), assetCommitment)
+	accountHash := HashBytes(account.AccountId, account.TotalEquity.Bytes(), account.TotalDebt.Bytes(), account.TotalCollateral.Bytes(), assetCommitment)
 	return accountHash
 }
 
@@ -756,20 +1072,13 @@ func RecoverAfterCexAssets(witness *BatchCreateUserWitness) []CexAssetInfo {
 			asset := &witness.CreateUserOps[i].Assets[j]
 			cexAssets[asset.Index].TotalEquity = SafeAdd(cexAssets[asset.Index].TotalEquity, asset.Equity)
 			cexAssets[asset.Index].TotalDebt = SafeAdd(cexAssets[asset.Index].TotalDebt, asset.Debt)
-			cexAssets[asset.Index].LoanCollateral = SafeAdd(cexAssets[asset.Index].LoanCollateral, asset.Loan)
-			cexAssets[asset.Index].MarginCollateral = SafeAdd(cexAssets[asset.Index].MarginCollateral, asset.Margin)
-			cexAssets[asset.Index].PortfolioMarginCollateral = SafeAdd(cexAssets[asset.Index].PortfolioMarginCollateral, asset.PortfolioMargin)
+			for c := 0; c < len(asset.Collaterals); c++ {
+				cexAssets[asset.Index].Collaterals[c] = SafeAdd(cexAssets[asset.Index].Collaterals[c], asset.Collaterals[c])
+			}
 		}
 	}
 	// sanity check
-	hasher := poseidon.NewPoseidon()
-	for i := 0; i < len(cexAssets); i++ {
-		commitments := ConvertAssetInfoToBytes(cexAssets[i])
-		for j := 0; j < len(commitments); j++ {
-			hasher.Write(commitments[j])
-		}
-	}
-	cexCommitment := hasher.Sum(nil)
+	cexCommitment := ComputeBlindedCexAssetsCommitment(cexAssets, witness.CexAssetsBlinding)
 	if string(cexCommitment) != string(witness.AfterCEXAssetsCommitment) {
 		panic("after cex commitment verify failed")
 	}
@@ -777,17 +1086,18 @@ func RecoverAfterCexAssets(witness *BatchCreateUserWitness) []CexAssetInfo {
 }
 
 func ComputeCexAssetsCommitment(cexAssetsInfo []CexAssetInfo) []byte {
-	hasher := poseidon.NewPoseidon()
+	return ComputeBlindedCexAssetsCommitment(cexAssetsInfo, nil)
+}
+
+// ComputeBlindedCexAssetsCommitment returns the cex assets commitment with the
+// blinding factor appended if BlindCexAssetsCommitment is set. A nil blinding
+// factor returns the commitment without blinding, such as the commitment of the
+// cex assets prices which are public.
+func ComputeBlindedCexAssetsCommitment(cexAssetsInfo []CexAssetInfo, blinding []byte) []byte {
+	hasher := NewHasher()
 	emptyCexAssets := make([]CexAssetInfo, AssetCounts-len(cexAssetsInfo))
 	for i := len(cexAssetsInfo); i < AssetCounts; i++ {
-		emptyCexAssets[i-len(cexAssetsInfo)] = CexAssetInfo{
-			Symbol:                "reserved",
-			BasePrice:             0,
-			LoanRatios:            PaddingTierRatios([]TierRatio{}),
-			MarginRatios:          PaddingTierRatios([]TierRatio{}),
-			PortfolioMarginRatios: PaddingTierRatios([]TierRatio{}),
-			Index:                 uint32(i),
-		}
+		emptyCexAssets[i-len(cexAssetsInfo)] = NewEmptyCexAssetInfo(uint32(i))
 	}
 	cexAssetsInfo = append(cexAssetsInfo, emptyCexAssets...)
 	for i := 0; i < len(cexAssetsInfo); i++ {
@@ -796,35 +1106,112 @@ func ComputeCexAssetsCommitment(cexAssetsInfo []CexAssetInfo) []byte {
 			hasher.Write(commitments[j])
 		}
 	}
+	if BlindCexAssetsCommitment && blinding != nil {
+		hasher.Write(blinding)
+	}
+	return hasher.Sum(nil)
+}
+
+// ComputeReservesCommitment returns the commitment of the reserves of every
+// cex asset, the reserves are padded to AssetCounts.
+func ComputeReservesCommitment(reserves []Uint128) []byte {
+	hasher := NewHasher()
+	for i := 0; i < AssetCounts; i++ {
+		reserve := new(big.Int)
+		if i < len(reserves) {
+			reserve = reserves[i].Big()
+		}
+		hasher.Write(reserve.FillBytes(make([]byte, FieldElementSize)))
+	}
 	return hasher.Sum(nil)
 }
 
+// ComputeReservesComparisonCommitment returns the public Commitment of
+// ReservesComparisonCircuit.
+func ComputeReservesComparisonCommitment(emptyCexAssetsCommitment, finalCexAssetsCommitment, publicCexAssetsCommitment, reservesCommitment []byte) []byte {
+	return HashBytes(emptyCexAssetsCommitment, finalCexAssetsCommitment, publicCexAssetsCommitment, reservesCommitment)
+}
+
+// NewReservesComparisonWitness returns the witness comparing the final cex assets
+// of the batch proofs with reserves, blinding is the blinding factor of the
+// cex assets commitments.
+func NewReservesComparisonWitness(cexAssetsInfo []CexAssetInfo, blinding []byte, reserves []Uint128) *ReservesComparisonWitness {
+	emptyCexAssetsInfo := EmptyCexAssetsInfo(cexAssetsInfo)
+	witness := &ReservesComparisonWitness{
+		EmptyCEXAssetsCommitment:  ComputeBlindedCexAssetsCommitment(emptyCexAssetsInfo, blinding),
+		FinalCEXAssetsCommitment:  ComputeBlindedCexAssetsCommitment(cexAssetsInfo, blinding),
+		PublicCEXAssetsCommitment: ComputeCexAssetsCommitment(emptyCexAssetsInfo),
+		ReservesCommitment:        ComputeReservesCommitment(reserves),
+		CexAssetsBlinding:         blinding,
+		CexAssets:                 cexAssetsInfo,
+		Reserves:                  reserves,
+	}
+	witness.Commitment = ComputeReservesComparisonCommitment(witness.EmptyCEXAssetsCommitment,
+		witness.FinalCEXAssetsCommitment, witness.PublicCEXAssetsCommitment, witness.ReservesCommitment)
+	return witness
+}
+
+// NewCexAssetsBlinding returns a random blinding factor of the cex assets
+// commitment, or nil if BlindCexAssetsCommitment is not set.
+func NewCexAssetsBlinding() ([]byte, error) {
+	if !BlindCexAssetsCommitment {
+		return nil, nil
+	}
+	return RandomFieldElement()
+}
+
+// EmptyCexAssetsInfo returns the cex assets without any user assets,
+// it is the cex assets before the first batch.
+func EmptyCexAssetsInfo(cexAssetsInfo []CexAssetInfo) []CexAssetInfo {
+	emptyCexAssetsInfo := make([]CexAssetInfo, len(cexAssetsInfo))
+	copy(emptyCexAssetsInfo, cexAssetsInfo)
+	for i := 0; i < len(emptyCexAssetsInfo); i++ {
+		emptyCexAssetsInfo[i].TotalDebt = Uint128{}
+		emptyCexAssetsInfo[i].TotalEquity = Uint128{}
+		emptyCexAssetsInfo[i].Collaterals = make([]Uint128, len(CollateralCategories))
+	}
+	return emptyCexAssetsInfo
+}
+
 func PaddingAccounts(accounts []AccountInfo, assetKey int) []AccountInfo {
 	opsPerBatch := BatchCreateUserOpsCountsTiers[assetKey]
 	batchCounts := (len(accounts) + opsPerBatch - 1) / opsPerBatch
 	paddingAccountCounts := batchCounts*opsPerBatch - len(accounts)
 	for i := 0; i < paddingAccountCounts; i++ {
-		assets := make([]AccountAsset, assetKey)
-		for j := 0; j < assetKey; j++ {
-			assets[j] = AccountAsset{
-				Index:           uint16(j),
-				Equity:          0,
-				Debt:            0,
-				Loan:            0,
-				Margin:          0,
-				PortfolioMargin: 0,
-			}
-		}
-		accounts = append(accounts, AccountInfo{
-			TotalEquity:     new(big.Int).SetInt64(0),
-			TotalDebt:       new(big.Int).SetInt64(0),
-			TotalCollateral: new(big.Int).SetInt64(0),
-			Assets:          assets,
-		})
+		accounts = append(accounts, NewPaddingAccount(assetKey))
 	}
 	return accounts
 }
 
+// NewPaddingAccount returns an account without assets whose leaf has the
+// assets commitment of assetKey empty assets.
+func NewPaddingAccount(assetKey int) AccountInfo {
+	assets := make([]AccountAsset, assetKey)
+	for j := 0; j < assetKey; j++ {
+		assets[j] = NewEmptyAccountAsset(uint16(j))
+	}
+	return AccountInfo{
+		TotalEquity:     new(big.Int).SetInt64(0),
+		TotalDebt:       new(big.Int).SetInt64(0),
+		TotalCollateral: new(big.Int).SetInt64(0),
+		Assets:          assets,
+	}
+}
+
+// IsPaddingAccount returns true if the account is created by PaddingAccounts.
+// The assets of real users only contain the assets they own, so they are never empty.
+func IsPaddingAccount(account *AccountInfo) bool {
+	if len(account.Assets) == 0 {
+		return false
+	}
+	for i := 0; i < len(account.Assets); i++ {
+		if !IsAssetEmpty(&account.Assets[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func ConvertMysqlErrToDbErr(err error) error {
 	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
 		if mysqlErr.Number == 1317 {
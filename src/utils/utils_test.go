@@ -2,39 +2,35 @@ package utils
 
 import (
 	// "encoding/hex"
+	"bytes"
 	"fmt"
 	"os"
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	// "github.com/stretchr/testify/assert"
 	"encoding/csv"
+	"math"
 	"math/big"
+	"strings"
 	"testing"
 )
 
 func ComputeAssetsCommitmentForTest(userAssets []AccountAsset) []byte {
 	target := GetAssetsCountOfUser(userAssets)
-	nEles := (target*6 + 2) / 3
-	flattenUserAssets := make([]uint64, 3*nEles)
-	for i := 0; i < target; i++ {
-		flattenUserAssets[6*i] = uint64(userAssets[i].Index)
-		flattenUserAssets[6*i+1] = userAssets[i].Equity
-		flattenUserAssets[6*i+2] = userAssets[i].Debt
-		flattenUserAssets[6*i+3] = userAssets[i].Loan
-		flattenUserAssets[6*i+4] = userAssets[i].Margin
-		flattenUserAssets[6*i+5] = userAssets[i].PortfolioMargin
-	}
-
 	hasher := poseidon.NewPoseidon()
-	for i := 0; i < nEles; i++ {
-		aBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i])
-		bBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i+1])
-		cBigInt := new(big.Int).SetUint64(flattenUserAssets[3*i+2])
-		sumBigIntBytes := new(big.Int).Add(new(big.Int).Add(
-			new(big.Int).Mul(aBigInt, Uint64MaxValueBigIntSquare),
-			new(big.Int).Mul(bBigInt, Uint64MaxValueBigInt)),
-			cBigInt).Bytes()
-		hasher.Write(sumBigIntBytes)
+	for i := 0; i < target; i++ {
+		indexAndEquity := new(big.Int).Mul(big.NewInt(int64(userAssets[i].Index)), Uint64MaxValueBigIntSquare)
+		indexAndEquity.Add(indexAndEquity, userAssets[i].Equity.Big())
+		hasher.Write(indexAndEquity.Bytes())
+		hasher.Write(userAssets[i].Debt.Big().Bytes())
+		// loan, margin and portfolio margin of the default collateral categories
+		for c := 0; c < 3; c++ {
+			collateral := new(big.Int)
+			if c < len(userAssets[i].Collaterals) {
+				collateral = userAssets[i].Collaterals[c].Big()
+			}
+			hasher.Write(collateral.Bytes())
+		}
 	}
 	expectHash := hasher.Sum(nil)
 	return expectHash
@@ -44,11 +40,10 @@ func TestComputeUserAssetsCommitment(t *testing.T) {
 	testUserAssets1 := make([]AccountAsset, 10)
 	for i := 0; i < 10; i++ {
 		testUserAssets1[i].Index = uint16(3*i + 30)
-		testUserAssets1[i].Equity = uint64(i*10 + 1000)
-		testUserAssets1[i].Debt = uint64(i*10 + 500)
-		testUserAssets1[i].Loan = uint64(i*10 + 100)
-		testUserAssets1[i].Margin = uint64(i*10 + 100)
-		testUserAssets1[i].PortfolioMargin = uint64(i*10 + 100)
+		// the balances take more than 64 bits
+		testUserAssets1[i].Equity = Uint128{Hi: uint64(i + 3), Lo: uint64(i*10 + 1000)}
+		testUserAssets1[i].Debt = Uint128{Hi: uint64(i), Lo: uint64(i*10 + 500)}
+		testUserAssets1[i].Collaterals = []Uint128{NewUint128(uint64(i*10 + 100)), {Hi: 1}, NewUint128(uint64(i*10 + 100))}
 	}
 	target := GetAssetsCountOfUser(testUserAssets1)
 	paddingCounts := target - len(testUserAssets1)
@@ -70,9 +65,7 @@ func TestComputeUserAssetsCommitment(t *testing.T) {
 		userAssets[index].Index = testUserAssets1[i].Index
 		userAssets[index].Equity = testUserAssets1[i].Equity
 		userAssets[index].Debt = testUserAssets1[i].Debt
-		userAssets[index].Loan = testUserAssets1[i].Loan
-		userAssets[index].Margin = testUserAssets1[i].Margin
-		userAssets[index].PortfolioMargin = testUserAssets1[i].PortfolioMargin
+		userAssets[index].Collaterals = testUserAssets1[i].Collaterals
 		index++
 		currentAssetIndex = int(testUserAssets1[i].Index) + 1
 	}
@@ -98,17 +91,13 @@ func TestComputeUserAssetsCommitment(t *testing.T) {
 	}
 	for i := 0; i < 100; i++ {
 		testUserAssets2[i].Index = uint16(3*i) + 2
-		testUserAssets2[i].Equity = uint64(i*10 + 1000)
-		testUserAssets2[i].Debt = uint64(i*10 + 500)
-		testUserAssets2[i].Loan = uint64(i*10 + 100)
-		testUserAssets2[i].Margin = uint64(i*10 + 100)
-		testUserAssets2[i].PortfolioMargin = uint64(i*10 + 100)
+		testUserAssets2[i].Equity = NewUint128(uint64(i*10 + 1000))
+		testUserAssets2[i].Debt = NewUint128(uint64(i*10 + 500))
+		testUserAssets2[i].Collaterals = []Uint128{NewUint128(uint64(i*10 + 100)), NewUint128(uint64(i*10 + 100)), NewUint128(uint64(i*10 + 100))}
 
 		userAssets[testUserAssets2[i].Index].Equity = testUserAssets2[i].Equity
 		userAssets[testUserAssets2[i].Index].Debt = testUserAssets2[i].Debt
-		userAssets[testUserAssets2[i].Index].Loan = testUserAssets2[i].Loan
-		userAssets[testUserAssets2[i].Index].Margin = testUserAssets2[i].Margin
-		userAssets[testUserAssets2[i].Index].PortfolioMargin = testUserAssets2[i].PortfolioMargin
+		userAssets[testUserAssets2[i].Index].Collaterals = testUserAssets2[i].Collaterals
 	}
 
 	expectHash = ComputeAssetsCommitmentForTest(userAssets)
@@ -123,8 +112,9 @@ func TestComputeUserAssetsCommitment(t *testing.T) {
 	userAssets = make([]AccountAsset, AssetCounts)
 	for i := 0; i < AssetCounts; i++ {
 		userAssets[i].Index = uint16(i)
-		userAssets[i].Equity = uint64(i*10 + 1000)
-		userAssets[i].Debt = uint64(i*10 + 500)
+		userAssets[i].Equity = NewUint128(uint64(i*10 + 1000))
+		userAssets[i].Debt = NewUint128(uint64(i*10 + 500))
+		userAssets[i].Collaterals = make([]Uint128, len(CollateralCategories))
 	}
 	expectHash = ComputeAssetsCommitmentForTest(userAssets)
 	hasher.Reset()
@@ -188,12 +178,11 @@ func TestParseCexAssetInfoFromFile(t *testing.T) {
 		t.Error(err.Error())
 	}
 	data = data[1:]
-	assetIndexes := make([]string, len(data))
-	for i, d := range data {
-		assetIndexes[i] = d[0]
+	registry, err := ParseAssetRegistryFromFile("./asset_registry.csv")
+	if err != nil {
+		t.Fatal(err)
 	}
-	fmt.Println("assetIndexes: ", len(assetIndexes))
-	cexAssetsInfo, err := ParseCexAssetInfoFromFile("./cex_assets_info.csv", assetIndexes)
+	cexAssetsInfo, err := ParseCexAssetInfoFromFile("./cex_assets_info.csv", registry)
 	if err != nil {
 		t.Errorf("error: %s\n", err.Error())
 	}
@@ -206,7 +195,72 @@ func TestParseCexAssetInfoFromFile(t *testing.T) {
 	if actualAssetsCount != 483 {
 		t.Errorf("error: %d\n", actualAssetsCount)
 	}
-	fmt.Println("cexAssetsInfo: ", cexAssetsInfo[0].PortfolioMarginRatios)
+	// the assets are at their indexes in the asset registry
+	for i, d := range data {
+		if cexAssetsInfo[registry[i].Index].Symbol != d[0] {
+			t.Errorf("the asset %d is %s, want %s", i, cexAssetsInfo[registry[i].Index].Symbol, d[0])
+		}
+	}
+	fmt.Println("cexAssetsInfo: ", cexAssetsInfo[0].CollateralRatios[2])
+	if err = CheckCexAssetsWithRegistry(cexAssetsInfo, registry); err != nil {
+		t.Error(err.Error())
+	}
+	cexAssetsInfo[0].BalanceDecimals += 1
+	if err = CheckCexAssetsWithRegistry(cexAssetsInfo, registry); err == nil {
+		t.Error("expected error for the wrong balance decimals, got nil")
+	}
+
+	// a delisted asset keeps its index reserved
+	delisted := append([]AssetRegistryEntry{}, registry...)
+	delisted = append(delisted, AssetRegistryEntry{Symbol: "delisted", Index: uint32(len(registry)), BalanceDecimals: 8, PriceDecimals: 16})
+	cexAssetsInfo, err = ParseCexAssetInfoFromFile("./cex_assets_info.csv", delisted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cexAssetsInfo[len(registry)].Symbol != "reserved" {
+		t.Errorf("the delisted asset is %s, want reserved", cexAssetsInfo[len(registry)].Symbol)
+	}
+	// every cex asset must be in the asset registry
+	if _, err = ParseCexAssetInfoFromFile("./cex_assets_info.csv", registry[1:]); err == nil {
+		t.Error("expected error for the asset not in the asset registry, got nil")
+	}
+}
+
+func TestCheckUserFileHeader(t *testing.T) {
+	cexAssetsInfo := []CexAssetInfo{{Symbol: "btc"}, NewEmptyCexAssetInfo(1), {Symbol: "eth", Index: 2}, NewEmptyCexAssetInfo(3)}
+	header := []string{"rn", "id"}
+	for _, symbol := range []string{"btc", "eth"} {
+		header = append(header, "e_"+symbol, "d_"+symbol, symbol)
+		for _, category := range CollateralCategories {
+			header = append(header, category+"_"+symbol)
+		}
+	}
+	header = append(header, "total_net_balance_usdt")
+	assetIndexes, err := CheckUserFileHeader("users.csv", header, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assetIndexes) != 2 || assetIndexes[0] != 0 || assetIndexes[1] != 2 {
+		t.Errorf("got asset indexes %v, want [0 2]", assetIndexes)
+	}
+
+	// the assets must be in the order of the asset registry
+	swapped := append([]string{}, header...)
+	swapped[2], swapped[2+GetNumOfAssetFields()] = swapped[2+GetNumOfAssetFields()], swapped[2]
+	_, err = CheckUserFileHeader("users.csv", swapped, cexAssetsInfo)
+	if err == nil || !strings.Contains(err.Error(), "users.csv column 3") {
+		t.Errorf("expected error for column 3 of users.csv, got %v", err)
+	}
+	// the collateral column of another asset
+	wrongCollateral := append([]string{}, header...)
+	wrongCollateral[5] = "vl_eth"
+	if _, err = CheckUserFileHeader("users.csv", wrongCollateral, cexAssetsInfo); err == nil {
+		t.Error("expected error for the collateral column of another asset, got nil")
+	}
+	// the columns of a delisted asset
+	if _, err = CheckUserFileHeader("users.csv", header[:len(header)-1-GetNumOfAssetFields()], cexAssetsInfo); err == nil {
+		t.Error("expected error for the missing asset columns, got nil")
+	}
 }
 
 func TestParseTiers(t *testing.T) {
@@ -265,3 +319,520 @@ func TestParseTiers(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCollateralCategories(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "default categories",
+			input: "loan,margin,portfolio_margin",
+			want:  []string{"loan", "margin", "portfolio_margin"},
+		},
+		{
+			name:  "with spaces",
+			input: " loan , vip_loan ",
+			want:  []string{"loan", "vip_loan"},
+		},
+		{
+			name:    "empty category",
+			input:   "loan,,margin",
+			wantErr: true,
+		},
+		{
+			name:    "duplicated category",
+			input:   "loan,margin,loan",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCollateralCategories(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("index %d: got %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitParams(t *testing.T) {
+	defaultParams := CurrentCircuitParams()
+	if err := defaultParams.Validate(); err != nil {
+		t.Fatalf("default circuit params are invalid: %v", err)
+	}
+	invalidParams := []CircuitParams{
+		{Version: CircuitParamsVersion + 1, AccountTreeDepth: 28, AssetCounts: 500, TierCount: 12},
+		{Version: CircuitParamsVersion, AccountTreeDepth: 33, AssetCounts: 500, TierCount: 12},
+		{Version: CircuitParamsVersion, AccountTreeDepth: 28, AssetCounts: 65537, TierCount: 12},
+		{Version: CircuitParamsVersion, AccountTreeDepth: 28, AssetCounts: 500, TierCount: 11},
+		{Version: CircuitParamsVersion, AccountTreeDepth: 28, AssetCounts: AssetCountsTiers[len(AssetCountsTiers)-1] - 1, TierCount: 12},
+	}
+	for _, p := range invalidParams {
+		if err := p.Validate(); err == nil {
+			t.Errorf("expected error for %+v, got nil", p)
+		}
+	}
+
+	zkKeyName := t.TempDir() + "/zkpor"
+	if err := CheckCircuitParamsOfKey(zkKeyName); err != nil {
+		t.Fatalf("keys without circuit params file should be accepted: %v", err)
+	}
+	if err := WriteCircuitParams(zkKeyName + CircuitParamsFileSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCircuitParamsOfKey(zkKeyName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defer SetCircuitParams(defaultParams)
+	newParams := defaultParams
+	newParams.AccountTreeDepth = 30
+	newParams.AssetCounts = 1000
+	if err := SetCircuitParams(newParams); err != nil {
+		t.Fatal(err)
+	}
+	if AccountTreeDepth != 30 || AssetCounts != 1000 || TierCount != defaultParams.TierCount {
+		t.Fatalf("circuit params not applied: %+v", CurrentCircuitParams())
+	}
+	if err := CheckCircuitParamsOfKey(zkKeyName); err == nil {
+		t.Fatal("expected circuit params mismatch error, got nil")
+	}
+	loaded, err := LoadCircuitParams(zkKeyName + CircuitParamsFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != defaultParams {
+		t.Errorf("got %+v, want %+v", loaded, defaultParams)
+	}
+}
+
+func TestParseReservesFromFile(t *testing.T) {
+	cexAssetsInfo := []CexAssetInfo{{Symbol: "btc", BalanceDecimals: 10}, {Symbol: "shib", Index: 1, BalanceDecimals: 8},
+		{Symbol: "eth", Index: 2, BalanceDecimals: 10}, {Index: 3}}
+	name := t.TempDir() + "/reserves.csv"
+	if err := os.WriteFile(name, []byte("symbol,reserves\nETH,1.5\nshib,2.25\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reserves, err := ParseReservesFromFile(name, cexAssetsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Uint128{{}, NewUint128(225000000), NewUint128(15000000000), {}}
+	for i := range expected {
+		if reserves[i] != expected[i] {
+			t.Errorf("got reserves %v, want %v", reserves, expected)
+			break
+		}
+	}
+
+	for _, data := range []string{"symbol,reserves\nbnb,1\n", "symbol,reserves\neth,1\neth,2\n", "symbol,reserves\neth,-1\n",
+		"symbol,reserves\neth,0.00000000001\n"} {
+		if err = os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseReservesFromFile(name, cexAssetsInfo); err == nil {
+			t.Errorf("expected error for %q, got nil", data)
+		}
+	}
+}
+
+func TestConvertFloatStrToUint128(t *testing.T) {
+	for _, tc := range []struct {
+		f        string
+		decimals uint8
+		expected Uint128
+	}{
+		{"0.0", 8, Uint128{}},
+		{"1.5", 8, NewUint128(150000000)},
+		{"0.00000001", 8, NewUint128(1)},
+		// 10^30 * 10^8 takes more than 64 bits
+		{"1000000000000000000000000000000", 8, Uint128{Hi: 0x4b3b4ca85a86c47a, Lo: 0x098a224000000000}},
+		{"340282366920938463463374607431768211455", 0, Uint128{Hi: math.MaxUint64, Lo: math.MaxUint64}},
+	} {
+		v, err := ConvertFloatStrToUint128(tc.f, tc.decimals)
+		if err != nil || v != tc.expected {
+			t.Errorf("got %s, %v for %s, want %s", v, err, tc.f, tc.expected)
+		}
+	}
+	// the balances are never rounded
+	for _, f := range []string{"0.000000001", "-1", "340282366920938463463374607431768211456", "1e"} {
+		if v, err := ConvertFloatStrToUint128(f, 8); err == nil {
+			t.Errorf("expected error for %s, got %s", f, v)
+		}
+	}
+}
+
+func TestConvertPriceStrToUint64(t *testing.T) {
+	for _, tc := range []struct {
+		price    string
+		decimals uint8
+		expected uint64
+	}{
+		{"0.0000390500000000", 16, 390500000000},
+		{"65100.22000000", 14, 6510022000000000000},
+		// the digits beyond the decimals are truncated
+		{"0.123456789", 8, 12345678},
+		{"0", 16, 0},
+	} {
+		price, err := ConvertPriceStrToUint64(tc.price, tc.decimals)
+		if err != nil || price != tc.expected {
+			t.Errorf("got %d, %v for %s, want %d", price, err, tc.price, tc.expected)
+		}
+	}
+	for _, price := range []string{"-1", "65100.22"} {
+		if _, err := ConvertPriceStrToUint64(price, 16); err == nil {
+			t.Errorf("expected error for %s, got nil", price)
+		}
+	}
+}
+
+func TestCheckCollateralValue(t *testing.T) {
+	// the worst case of 24 value decimals and 16 price decimals
+	price, err := ConvertPriceStrToUint64("1844.6744073709551615", MaxPriceDecimals)
+	if err != nil || price != math.MaxUint64 {
+		t.Fatalf("got %d, %v, want the max price", price, err)
+	}
+	if _, err := ConvertPriceStrToUint64("1844.6744073709551616", MaxPriceDecimals); err == nil {
+		t.Fatal("expected error for the price overflowing uint64, got nil")
+	}
+	balance, err := ConvertFloatStrToUint128("3402823669209384634633746074317.68211455", ValueDecimals-MaxPriceDecimals)
+	if err != nil || balance != (Uint128{Hi: math.MaxUint64, Lo: math.MaxUint64}) {
+		t.Fatalf("got %s, %v, want the max balance", balance, err)
+	}
+
+	capCollateral, err := Uint128FromBig(new(big.Int).Quo(MaxTierBoundaryValue, new(big.Int).SetUint64(price)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCollateralValue(capCollateral, price); err != nil {
+		t.Errorf("unexpected error for the collateral at the cap: %v", err)
+	}
+	if err := CheckCollateralValue(balance, 1); err == nil {
+		t.Error("expected error for the max balance, got nil")
+	}
+	for _, collateral := range []Uint128{SafeAdd(capCollateral, NewUint128(1)), balance} {
+		if err := CheckCollateralValue(collateral, price); err == nil {
+			t.Errorf("expected error for the collateral %s, got nil", collateral)
+		}
+	}
+
+	// the user values of the most assets never wrap around the field of both curves
+	for _, curve := range []string{BN254Curve, BLS12381Curve} {
+		if bits := UserValueBits(65536); bits >= curveID(curve).ScalarField().BitLen() {
+			t.Errorf("the user values take %d bits on curve %s", bits, curve)
+		}
+	}
+}
+
+func TestFormatBalance(t *testing.T) {
+	for _, tc := range []struct {
+		v        Uint128
+		decimals uint8
+		expected string
+	}{
+		{NewUint128(150000000), 8, "1.5"},
+		{NewUint128(1), 10, "0.0000000001"},
+		{Uint128{}, 8, "0"},
+		{Uint128{Hi: 0x4b3b4ca85a86c47a, Lo: 0x098a224000000000}, 8, "1000000000000000000000000000000"},
+	} {
+		if res := FormatBalance(tc.v, tc.decimals); res != tc.expected {
+			t.Errorf("got %s for %s, want %s", res, tc.v, tc.expected)
+		}
+	}
+}
+
+func TestParseAssetRegistryFromFile(t *testing.T) {
+	name := t.TempDir() + "/asset_registry.csv"
+	if err := os.WriteFile(name, []byte("symbol,index,balance_decimals,price_decimals\nBTC,0,10,14\nshib,1,8,16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := ParseAssetRegistryFromFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AssetRegistryEntry{
+		{Symbol: "btc", Index: 0, BalanceDecimals: 10, PriceDecimals: 14},
+		{Symbol: "shib", Index: 1, BalanceDecimals: 8, PriceDecimals: 16},
+	}
+	if len(registry) != len(expected) || registry[0] != expected[0] || registry[1] != expected[1] {
+		t.Errorf("got registry %v, want %v", registry, expected)
+	}
+
+	for _, data := range []string{
+		// the decimals don't sum to ValueDecimals
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,8,14\n",
+		// too many price decimals
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,4,20\n",
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,10,14\nbtc,1,10,14\n",
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,10,14\neth,0,10,14\n",
+		// the index isn't the row of the asset
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,10,14\neth,2,10,14\n",
+		"symbol,index,balance_decimals,price_decimals\nbtc,-1,10,14\n",
+		"symbol,index,balance_decimals,price_decimals\nreserved,0,10,14\n",
+		"symbol,index,balance_decimals,price_decimals\nbtc,0,10\n",
+	} {
+		if err = os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseAssetRegistryFromFile(name); err == nil {
+			t.Errorf("expected error for %q, got nil", data)
+		}
+	}
+}
+
+func TestCheckAssetRegistryAppended(t *testing.T) {
+	prevRegistry := []AssetRegistryEntry{{Symbol: "btc", Index: 0, BalanceDecimals: 10, PriceDecimals: 14}}
+	registry := append([]AssetRegistryEntry{}, prevRegistry...)
+	registry = append(registry, AssetRegistryEntry{Symbol: "eth", Index: 1, BalanceDecimals: 9, PriceDecimals: 15})
+	if err := CheckAssetRegistryAppended(prevRegistry, registry); err != nil {
+		t.Error(err.Error())
+	}
+	if err := CheckAssetRegistryAppended(registry, prevRegistry); err == nil {
+		t.Error("expected error for the removed asset, got nil")
+	}
+	registry[0].BalanceDecimals, registry[0].PriceDecimals = 8, 16
+	if err := CheckAssetRegistryAppended(prevRegistry, registry); err == nil {
+		t.Error("expected error for the changed decimals, got nil")
+	}
+}
+
+func TestHashSuite(t *testing.T) {
+	for name, expected := range map[string]string{"": PoseidonHashSuite, "poseidon": PoseidonHashSuite, "mimc": MiMCHashSuite} {
+		if hashSuite, err := ParseHashSuite(name); err != nil || hashSuite != expected {
+			t.Errorf("got hash suite %q, %v for %q, want %q", hashSuite, err, name, expected)
+		}
+	}
+	for _, name := range []string{"poseidon2", "sha256"} {
+		if _, err := ParseHashSuite(name); err == nil {
+			t.Errorf("expected error for hash suite %q, got nil", name)
+		}
+	}
+
+	defaultParams := CurrentCircuitParams()
+	defer SetCircuitParams(defaultParams)
+	poseidonNilAccountHash := NilAccountHash
+	params := defaultParams
+	params.HashSuite = MiMCHashSuite
+	if err := SetCircuitParams(params); err != nil {
+		t.Fatal(err)
+	}
+	if string(NilAccountHash) == string(poseidonNilAccountHash) {
+		t.Fatal("NilAccountHash should follow the hash suite")
+	}
+	// every Write is one element and Sum starts a new hash as the poseidon hasher
+	hasher := NewHasher()
+	for i := 0; i < 2; i++ {
+		hasher.Write([]byte{})
+		hasher.Write([]byte{1, 2, 3})
+		if res := hasher.Sum(nil); string(res) != string(HashBytes([]byte{0}, []byte{1, 2, 3})) {
+			t.Fatalf("got hash %x after %d Sum", res, i)
+		}
+	}
+	if string(HashBytes([]byte{1}, []byte{2})) == string(HashBytes([]byte{1, 2})) {
+		t.Fatal("the inputs should not be concatenated")
+	}
+
+	// the circuit params files without HashSuite use poseidon
+	path := t.TempDir() + "/params.json"
+	if err := os.WriteFile(path, []byte(`{"Version":1,"AccountTreeDepth":28,"AssetCounts":500,"TierCount":12}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCircuitParams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.HashSuite != PoseidonHashSuite {
+		t.Errorf("got hash suite %q, want %q", loaded.HashSuite, PoseidonHashSuite)
+	}
+}
+
+func TestCurve(t *testing.T) {
+	for name, expected := range map[string]string{"": BN254Curve, "bn254": BN254Curve, "bls12-381": BLS12381Curve} {
+		if curve, err := ParseCurve(name); err != nil || curve != expected {
+			t.Errorf("got curve %q, %v for %q, want %q", curve, err, name, expected)
+		}
+	}
+	if _, err := ParseCurve("bls12-377"); err == nil {
+		t.Error("expected error for curve bls12-377, got nil")
+	}
+
+	defaultParams := CurrentCircuitParams()
+	defer SetCircuitParams(defaultParams)
+	params := defaultParams
+	params.Curve = BLS12381Curve
+	if err := params.Validate(); err == nil {
+		t.Fatal("expected error for poseidon on bls12-381, got nil")
+	}
+
+	// the packing widths of bn254 and bls12-381 are the same, so are the packed bytes
+	tierRatios := []TierRatio{
+		{Ratio: 100, BoundaryValue: big.NewInt(1000)},
+		{Ratio: 50, BoundaryValue: new(big.Int).Sub(MaxTierBoundaryValue, OneBigInt)},
+	}
+	expected := new(big.Int).Lsh(big.NewInt(50), 126)
+	expected.Add(expected, new(big.Int).Lsh(tierRatios[1].BoundaryValue, 134))
+	expected.Add(expected, big.NewInt(100+1000*256))
+	nilAccountHashes := make(map[string]bool)
+	for _, curve := range []string{BN254Curve, BLS12381Curve} {
+		params.Curve = curve
+		params.HashSuite = MiMCHashSuite
+		if err := SetCircuitParams(params); err != nil {
+			t.Fatal(err)
+		}
+		if PackingWidth(AssetIndexBits) != 15 || TierRatiosPerElement() != 2 {
+			t.Errorf("got packing widths %d, %d on %s", PackingWidth(AssetIndexBits), TierRatiosPerElement(), curve)
+		}
+		res := ConvertTierRatiosToBytes(tierRatios)
+		if len(res) != 1 || new(big.Int).SetBytes(res[0]).Cmp(expected) != 0 {
+			t.Errorf("got tier ratios %x on %s, want %x", res, curve, expected.Bytes())
+		}
+		maxBytes := bytes.Repeat([]byte{0xff}, 32)
+		if new(big.Int).SetBytes(ReduceToFieldElement(maxBytes)).Cmp(FieldModulus()) >= 0 {
+			t.Errorf("account id is not reduced on %s", curve)
+		}
+		if _, err := NewHasher().Write(FieldModulus().Bytes()); err == nil {
+			t.Errorf("expected error for the modulus of %s, got nil", curve)
+		}
+		nilAccountHashes[string(NilAccountHash)] = true
+	}
+	if len(nilAccountHashes) != 2 {
+		t.Fatal("NilAccountHash should follow the curve")
+	}
+}
+
+func TestParseSnapshotId(t *testing.T) {
+	id, err := ParseSnapshotId("20240131-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 202401310001 || FormatSnapshotId(id) != "20240131-1" {
+		t.Errorf("got snapshot id %d, %s", id, FormatSnapshotId(id))
+	}
+	for _, s := range []string{"", "20240131", "20240230-1", "20240131-x", "20240131-10000"} {
+		if _, err = ParseSnapshotId(s); err == nil {
+			t.Errorf("expected error for %q, got nil", s)
+		}
+	}
+
+	// the batch commitment is bound to the snapshot id
+	root, before, after := []byte{1}, []byte{2}, []byte{3}
+	if bytes.Equal(ComputeBatchCommitment(root, before, after, 0, 9, 10, id, root), ComputeBatchCommitment(root, before, after, 0, 9, 10, id+1, root)) {
+		t.Error("the batch commitment doesn't depend on the snapshot id")
+	}
+	if bytes.Equal(ComputeBatchUpdateCommitment(root, root, before, after, id, 1, 2), ComputeBatchUpdateCommitment(root, root, before, after, id+1, 1, 2)) {
+		t.Error("the batch update commitment doesn't depend on the snapshot id")
+	}
+	if bytes.Equal(ComputeBatchUpdateCommitment(root, root, before, after, id, 1, 2), ComputeBatchUpdateCommitment(root, root, before, after, id, 2, 1)) {
+		t.Error("the batch update commitment doesn't depend on the user counts")
+	}
+}
+
+func TestAccountIdsChecks(t *testing.T) {
+	id := func(v int64) []byte {
+		return big.NewInt(v).FillBytes(make([]byte, FieldElementSize))
+	}
+	root := []byte{1}
+	checks, sortedIds, err := NewAccountIdsChecks(root, [][][]byte{{id(7), id(1), id(4)}, {id(3), id(8), id(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{id(1), id(2), id(3), id(4), id(7), id(8)}
+	for i := range expected {
+		if !bytes.Equal(sortedIds[i/3][i%3], expected[i]) {
+			t.Fatalf("got sorted account ids %x", sortedIds)
+		}
+	}
+	if err = CheckAccountIdsChain(root, checks); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(checks[0].AfterProduct, InitialAccountIdsProduct()) {
+		t.Error("the running product of the first batch shouldn't be 1")
+	}
+	if err = CheckAccountIdsChain([]byte{2}, checks); err == nil {
+		t.Error("expected error for the challenge of another account tree root")
+	}
+	if err = CheckAccountIdsChain(root, checks[:1]); err == nil {
+		t.Error("expected error for the missing batch")
+	}
+
+	if _, _, err = NewAccountIdsChecks(root, [][][]byte{{id(7), id(1)}, {id(7), id(2)}}); err == nil {
+		t.Error("expected error for the duplicate account ids")
+	}
+}
+
+func TestAccountTreeFingerprint(t *testing.T) {
+	fingerprint, err := AccountTreeFingerprint("../sampledata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files, err := os.ReadDir("../sampledata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := os.ReadFile("../sampledata/" + file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(dir+"/"+file.Name(), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the copy of the user data has the same fingerprint
+	copied, err := AccountTreeFingerprint(dir)
+	if err != nil || !bytes.Equal(copied, fingerprint) {
+		t.Fatalf("got fingerprint %x, %v, want %x", copied, err, fingerprint)
+	}
+	if both, _ := AccountTreeFingerprint("../sampledata", dir); bytes.Equal(both, fingerprint) {
+		t.Fatal("the fingerprint of two user data directories should differ")
+	}
+	if err = os.WriteFile(dir+"/sample_users0.csv", []byte("rn,id\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := AccountTreeFingerprint(dir); bytes.Equal(changed, fingerprint) {
+		t.Fatal("the fingerprint should change with the user data")
+	}
+}
+
+func TestVerifyAccountRangeMultiProof(t *testing.T) {
+	tree, err := NewAccountTree(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 64; i++ {
+		tree.Set(i, HashBytes([]byte{byte(i + 1)}))
+	}
+	tree.Build()
+	proof, root, err := tree.GetRangeMultiProof(16, 31)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := make([][]byte, 16)
+	for i := range leaves {
+		leaves[i] = tree.Get(uint32(16 + i))
+	}
+	if !VerifyAccountRangeMultiProof(root, 16, 31, proof.Bytes(), leaves) {
+		t.Fatal("the multiproof of the account range is not verified")
+	}
+	if VerifyAccountRangeMultiProof(root, 16, 32, proof.Bytes(), leaves) {
+		t.Fatal("the multiproof is verified for another account range")
+	}
+}
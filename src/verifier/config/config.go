@@ -10,6 +10,31 @@ type Config struct {
 	ZkKeyName     []string
 	AssetsCountTiers []int
 	CexAssetsInfo []utils.CexAssetInfo
+	// only used to verify the aggregated proof generated by aggregator
+	AggregationKeyName string
+	AggregatedProof    string
+	// AggregationArity is the arity of the aggregation tree used by aggregator,
+	// the level of the aggregated proof must be the one of the batches of ProofTable
+	AggregationArity int
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+	// only used to verify the proofs of an incremental audit, ZkKeyName must be
+	// the keys of the update circuit and CexAssetsInfo the assets after the update.
+	// They are the account tree root, the cex assets info and the proven user
+	// count of the previous audit
+	PreviousAccountTreeRoot string
+	PreviousCexAssetsInfo   []utils.CexAssetInfo
+	PreviousUserCount       uint64
+	// the reserves proof generated by reserves service, it is required if the cex
+	// assets commitment is blinded and the totals of CexAssetsInfo are not published
+	ReservesKeyName string
+	ReservesProof   string
+	// AssetRegistry is the asset registry file published with the audit, if it
+	// is set the indexes and the decimals of CexAssetsInfo are checked against it
+	AssetRegistry string
+	// SnapshotId is the expected audit of the proofs, such as "20240131-1",
+	// it isn't checked if it is empty
+	SnapshotId string
 }
 
 type UserConfig struct {
@@ -20,5 +45,12 @@ type UserConfig struct {
 	TotalCollateral big.Int
 	Root          string
 	Assets        []utils.AccountAsset
-	Proof         []string
+	// Proof is the base64 encoding of the compact merkle proof, the bitmap of
+	// the siblings which are empty subtrees followed by the other siblings
+	Proof string
+	// AssetRegistry is the asset registry file published with the audit, if it
+	// is set the amounts of the assets are printed
+	AssetRegistry string
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
+	"github.com/consensys/gnark/frontend"
+)
+
+func sortCexAssetsInfo(cexAssetsInfo []utils.CexAssetInfo) []utils.CexAssetInfo {
+	res := make([]utils.CexAssetInfo, len(cexAssetsInfo))
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		res[cexAssetsInfo[i].Index] = cexAssetsInfo[i]
+	}
+	return res
+}
+
+// verifyIncrementalProofs verifies the proofs of an incremental audit. The
+// batches must update the account tree root, the cex assets and the user count
+// of the previous audit to the cex assets of CexAssetsInfo one after another.
+// Every batch keeps the account ids of the leaves it updates, so the account
+// ids stay distinct as the previous audit proved them. The cex assets
+// commitments contain the prices and the tier ratios, so the chain also checks
+// CexAssetsInfo has the prices and the tier ratios of the previous audit.
+func verifyIncrementalProofs(verifierConfig *config.Config, proofs []Proof, snapshotId uint64) {
+	if utils.BlindCexAssetsCommitment {
+		panic("the incremental audit doesn't support the blinded cex assets commitment")
+	}
+	prevAccountTreeRoot, err := hex.DecodeString(verifierConfig.PreviousAccountTreeRoot)
+	if err != nil || len(prevAccountTreeRoot) != 32 {
+		panic("invalid previous account tree root")
+	}
+	prevCexAssetListCommitment := utils.ComputeCexAssetsCommitment(sortCexAssetsInfo(verifierConfig.PreviousCexAssetsInfo))
+	cexAssetsInfo := sortCexAssetsInfo(verifierConfig.CexAssetsInfo)
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		if cexAssetsInfo[i].TotalEquity.Cmp(cexAssetsInfo[i].TotalDebt) < 0 {
+			fmt.Printf("%s asset equity %s less then debt %s\n", cexAssetsInfo[i].Symbol, cexAssetsInfo[i].TotalEquity, cexAssetsInfo[i].TotalDebt)
+			panic("invalid cex asset info")
+		}
+	}
+	expectFinalCexAssetsInfoComm := utils.ComputeCexAssetsCommitment(cexAssetsInfo)
+	userCount := verifierConfig.PreviousUserCount
+
+	var vk circuit.VerifyingKey
+	currentAssetCountsTier := 0
+	currentBackend := ""
+	for batchNumber := 0; batchNumber < len(proofs); batchNumber++ {
+		backend, err := circuit.ParseProvingBackend(proofs[batchNumber].Backend)
+		if err != nil {
+			panic("verify proof " + strconv.Itoa(batchNumber) + " failed: " + err.Error())
+		}
+		proofRaw, err := base64.StdEncoding.DecodeString(proofs[batchNumber].ZkProof)
+		if err != nil {
+			panic("decode proof " + strconv.Itoa(batchNumber) + " failed: " + err.Error())
+		}
+		proof := circuit.NewProof(backend)
+		if _, err = proof.ReadFrom(bytes.NewBuffer(proofRaw)); err != nil {
+			panic("deserialize proof " + strconv.Itoa(batchNumber) + " failed: " + err.Error())
+		}
+		if len(proofs[batchNumber].AccountTreeRoots) != 2 || len(proofs[batchNumber].CexAssetCommitment) != 2 {
+			panic("expected the account tree roots and cex asset commitments before and after batch " + strconv.Itoa(batchNumber))
+		}
+		accountTreeRoots := make([][]byte, 2)
+		cexAssetListCommitments := make([][]byte, 2)
+		for p := 0; p < 2; p++ {
+			accountTreeRoots[p], err = base64.StdEncoding.DecodeString(proofs[batchNumber].AccountTreeRoots[p])
+			if err != nil {
+				fmt.Println("decode account tree root failed")
+				panic(err.Error())
+			}
+			cexAssetListCommitments[p], err = base64.StdEncoding.DecodeString(proofs[batchNumber].CexAssetCommitment[p])
+			if err != nil {
+				fmt.Println("decode cex asset commitment failed")
+				panic(err.Error())
+			}
+		}
+		if string(accountTreeRoots[0]) != string(prevAccountTreeRoot) {
+			panic("account tree root not match: " + strconv.Itoa(batchNumber))
+		}
+		if string(cexAssetListCommitments[0]) != string(prevCexAssetListCommitment) {
+			panic("cex asset list commitment not match: " + strconv.Itoa(batchNumber))
+		}
+
+		// verify the public input: BatchCommitment == Hash(BeforeAccountTreeRoot, AfterAccountTreeRoot, BeforeCEXAssets, AfterCEXAssets,
+		// SnapshotId, OldUserCount, NewUserCount)
+		expectHash := utils.ComputeBatchUpdateCommitment(accountTreeRoots[0], accountTreeRoots[1],
+			cexAssetListCommitments[0], cexAssetListCommitments[1], snapshotId,
+			proofs[batchNumber].OldUserCount, proofs[batchNumber].UserCount)
+		actualHash, err := base64.StdEncoding.DecodeString(proofs[batchNumber].BatchCommitment)
+		if err != nil {
+			panic("decode batch commitment " + strconv.Itoa(batchNumber) + " failed: " + err.Error())
+		}
+		if string(expectHash) != string(actualHash) {
+			fmt.Println("public input verify failed ", batchNumber)
+			fmt.Printf("%x:%x\n", expectHash, actualHash)
+			panic("verify proof " + strconv.Itoa(batchNumber) + " failed")
+		}
+		vWitness, err := frontend.NewWitness(circuit.NewVerifyBatchUpdateUserCircuit(actualHash), utils.CurveID().ScalarField(), frontend.PublicOnly())
+		if err != nil {
+			panic(err.Error())
+		}
+		if proofs[batchNumber].AssetsCount != currentAssetCountsTier || backend != currentBackend {
+			index := -1
+			for p := 0; p < len(verifierConfig.AssetsCountTiers); p++ {
+				if verifierConfig.AssetsCountTiers[p] == proofs[batchNumber].AssetsCount {
+					index = p
+					break
+				}
+			}
+			if index == -1 {
+				panic("invalid asset counts tier")
+			}
+			vk, err = LoadVerifyingKey(backend, verifierConfig.ZkKeyName[index]+".vk")
+			if err != nil {
+				panic(err.Error())
+			}
+			currentAssetCountsTier = proofs[batchNumber].AssetsCount
+			currentBackend = backend
+		}
+		if err = circuit.Verify(backend, proof, vk, vWitness); err != nil {
+			panic(backend + " verification failed for batch " + strconv.Itoa(batchNumber) + ": " + err.Error())
+		}
+		fmt.Println("proof verify success", batchNumber)
+		prevAccountTreeRoot = accountTreeRoots[1]
+		prevCexAssetListCommitment = cexAssetListCommitments[1]
+		// the old leaves of the batch are leaves of the account tree before it,
+		// so their users are counted in userCount
+		if userCount < uint64(proofs[batchNumber].OldUserCount) {
+			panic("user count of batch " + strconv.Itoa(batchNumber) + " is more than the user count before it")
+		}
+		userCount = userCount - uint64(proofs[batchNumber].OldUserCount) + uint64(proofs[batchNumber].UserCount)
+	}
+
+	if string(prevCexAssetListCommitment) != string(expectFinalCexAssetsInfoComm) {
+		panic("Final Cex Assets Info Not Match")
+	}
+	fmt.Printf("account merkle tree root is %x\n", prevAccountTreeRoot)
+	fmt.Println("proven user count is ", userCount)
+	fmt.Println("snapshot id is ", utils.FormatSnapshotId(snapshotId))
+	fmt.Println("All proofs verify passed!!!")
+}
@@ -8,7 +8,6 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/big"
 	"os"
 	"runtime"
 	"strconv"
@@ -17,20 +16,43 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
-	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/frontend"
 	"github.com/gocarina/gocsv"
 )
 
-func LoadVerifyingKey(vkFileName string) (groth16.VerifyingKey, error) {
+// index 4: proof_info, index 5: cex_asset_list_commitments
+// index 6: account_tree_roots, index 7: batch_commitment
+// index 8: batch_number
+type Proof struct {
+	BatchNumber        int64    `csv:"batch_number"`
+	ZkProof            string   `csv:"proof_info"`
+	CexAssetCommitment []string `csv:"cex_asset_list_commitments"`
+	AccountTreeRoots   []string `csv:"account_tree_roots"`
+	BatchCommitment    string   `csv:"batch_commitment"`
+	MinAccountIndex    uint32   `csv:"min_account_index"`
+	MaxAccountIndex    uint32   `csv:"max_account_index"`
+	UserCount          uint32   `csv:"user_count"`
+	OldUserCount       uint32   `csv:"old_user_count"`
+	SnapshotId         uint64   `csv:"snapshot_id"`
+	AccountIdsCheck    string   `csv:"account_ids_check"`
+	AssetsCount        int      `csv:"assets_count"`
+	Backend            string   `csv:"backend"`
+}
+
+// ProofCalldata is the call of the solidity verifier for one batch proof.
+type ProofCalldata struct {
+	BatchNumber int64  `csv:"batch_number"`
+	Backend     string `csv:"backend"`
+	Calldata    string `csv:"calldata"`
+}
+
+func LoadVerifyingKey(backend string, vkFileName string) (circuit.VerifyingKey, error) {
 	vkFile, err := os.ReadFile(vkFileName)
 	if err != nil {
 		return nil, err
 	}
 	buf := bytes.NewBuffer(vkFile)
-	vk := groth16.NewVerifyingKey(ecc.BN254)
+	vk := circuit.NewVerifyingKey(backend)
 	_, err = vk.ReadFrom(buf)
 	if err != nil {
 		return nil, err
@@ -38,10 +60,106 @@ func LoadVerifyingKey(vkFileName string) (groth16.VerifyingKey, error) {
 	return vk, nil
 }
 
+// checkSnapshotId returns the snapshot id of proofs, the proofs must belong to
+// the same audit and match the SnapshotId of verifierConfig if it is set.
+func checkSnapshotId(verifierConfig *config.Config, proofs []Proof) uint64 {
+	if len(proofs) == 0 {
+		panic("no proofs to verify")
+	}
+	snapshotId := proofs[0].SnapshotId
+	for i := 1; i < len(proofs); i++ {
+		if proofs[i].SnapshotId != snapshotId {
+			panic("proofs of different snapshots: " + utils.FormatSnapshotId(snapshotId) + " and " +
+				utils.FormatSnapshotId(proofs[i].SnapshotId) + " of batch " + strconv.Itoa(i))
+		}
+	}
+	checkExpectedSnapshotId(verifierConfig, snapshotId)
+	return snapshotId
+}
+
+// countBatches returns the number of the batch proofs of the proof table.
+func countBatches(fileName string) int {
+	f, err := os.Open(fileName)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer f.Close()
+	proofs := []*Proof{}
+	if err = gocsv.UnmarshalFile(f, &proofs); err != nil {
+		panic(err.Error())
+	}
+	if len(proofs) == 0 {
+		panic("no batch proofs in " + fileName)
+	}
+	return len(proofs)
+}
+
+// loadAccountIdsChecks returns the AccountIdsCheck of the proofs.
+func loadAccountIdsChecks(proofs []Proof) []utils.AccountIdsCheck {
+	checks := make([]utils.AccountIdsCheck, len(proofs))
+	for i := 0; i < len(proofs); i++ {
+		if err := json.Unmarshal([]byte(proofs[i].AccountIdsCheck), &checks[i]); err != nil {
+			panic("decode account ids check " + strconv.Itoa(i) + " failed: " + err.Error())
+		}
+	}
+	return checks
+}
+
+func checkExpectedSnapshotId(verifierConfig *config.Config, snapshotId uint64) {
+	if verifierConfig.SnapshotId == "" {
+		return
+	}
+	expectSnapshotId, err := utils.ParseSnapshotId(verifierConfig.SnapshotId)
+	if err != nil {
+		panic(err.Error())
+	}
+	if snapshotId != expectSnapshotId {
+		panic("snapshot id not match: expected " + verifierConfig.SnapshotId + ", got " + utils.FormatSnapshotId(snapshotId))
+	}
+}
+
+// checkAssetRegistry checks CexAssetsInfo and PreviousCexAssetsInfo against
+// the asset registry if it is set.
+func checkAssetRegistry(verifierConfig *config.Config) {
+	if verifierConfig.AssetRegistry == "" {
+		return
+	}
+	registry, err := utils.ParseAssetRegistryFromFile(verifierConfig.AssetRegistry)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = utils.CheckCexAssetsWithRegistry(verifierConfig.CexAssetsInfo, registry); err != nil {
+		panic(err.Error())
+	}
+	if err = utils.CheckCexAssetsWithRegistry(verifierConfig.PreviousCexAssetsInfo, registry); err != nil {
+		panic(err.Error())
+	}
+}
+
+// printUserAssets prints the amounts of the user assets, the decimals of the
+// assets are from the asset registry.
+func printUserAssets(userConfig *config.UserConfig) {
+	registry, err := utils.ParseAssetRegistryFromFile(userConfig.AssetRegistry)
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, asset := range userConfig.Assets {
+		if int(asset.Index) >= len(registry) {
+			panic(fmt.Sprintf("the asset %d is not in the asset registry", asset.Index))
+		}
+		entry := registry[asset.Index]
+		fmt.Printf("%s equity %s debt %s\n", entry.Symbol, utils.FormatBalance(asset.Equity, entry.BalanceDecimals),
+			utils.FormatBalance(asset.Debt, entry.BalanceDecimals))
+	}
+}
 
 func main() {
 	userFlag := flag.Bool("user", false, "flag which indicates user proof verification")
 	hashFlag := flag.Bool("hash", false, "flag which indicates hash command")
+	aggregatedFlag := flag.Bool("aggregated", false, "flag which indicates aggregated proof verification")
+	incrementalFlag := flag.Bool("incremental", false, "flag which indicates the proofs are generated by an incremental audit")
+	calldataFile := flag.String("calldata", "", "convert the batch proofs to solidity verifier calldata csv file")
+	circuitParams := flag.String("circuit_params", "", "circuit parameters file used by the hash command")
 	flag.Parse()
 	if *userFlag {
 		userConfig := &config.UserConfig{}
@@ -53,22 +171,21 @@ func main() {
 		if err != nil {
 			panic(err.Error())
 		}
+		if err = utils.InitCircuitParams(userConfig.CircuitParams); err != nil {
+			panic(err.Error())
+		}
 		root, err := hex.DecodeString(userConfig.Root)
 		if err != nil || len(root) != 32 {
 			panic("invalid account tree root")
 		}
 
-		var proof [][]byte
-		for i := 0; i < len(userConfig.Proof); i++ {
-			p, err := base64.StdEncoding.DecodeString(userConfig.Proof[i])
-			if err != nil || len(p) != 32 {
-				panic("invalid proof")
-			}
-			proof = append(proof, p)
+		proof, err := base64.StdEncoding.DecodeString(userConfig.Proof)
+		if err != nil {
+			panic("invalid proof")
 		}
 
 		// padding user assets
-		hasher := poseidon.NewPoseidon()
+		hasher := utils.NewHasher()
 		assetCommitment := utils.ComputeUserAssetsCommitment(&hasher, userConfig.Assets)
 		hasher.Reset()
 		// compute new account leaf node hash
@@ -76,10 +193,13 @@ func main() {
 		if err != nil || len(accountIdHash) != 32 {
 			panic("the AccountIdHash is invalid")
 		}
-		accountHash := poseidon.PoseidonBytes(accountIdHash, userConfig.TotalEquity.Bytes(), userConfig.TotalDebt.Bytes(), userConfig.TotalCollateral.Bytes(), assetCommitment)
+		accountHash := utils.HashBytes(accountIdHash, userConfig.TotalEquity.Bytes(), userConfig.TotalDebt.Bytes(), userConfig.TotalCollateral.Bytes(), assetCommitment)
 		fmt.Println("user merkle leave hash base64 encode: ", base64.StdEncoding.EncodeToString(accountHash))
 		fmt.Printf("user merkle leave hash hex encode: %x\n", accountHash)
-		verifyFlag := utils.VerifyMerkleProof(root, userConfig.AccountIndex, proof, accountHash)
+		verifyFlag := utils.VerifyCompactMerkleProof(root, userConfig.AccountIndex, proof, accountHash)
+		if userConfig.AssetRegistry != "" {
+			printUserAssets(userConfig)
+		}
 		if verifyFlag {
 			fmt.Println("verify pass!!!")
 		} else {
@@ -90,7 +210,10 @@ func main() {
 		if len(args) != 2 {
 			panic("invalid hash command, it needs two arguments")
 		}
-		hasher := poseidon.NewPoseidon()
+		if err := utils.InitCircuitParams(*circuitParams); err != nil {
+			panic(err.Error())
+		}
+		hasher := utils.NewHasher()
 		p0, err := base64.StdEncoding.DecodeString(args[0])
 		if err != nil {
 			panic("invalid hash command, the first argument is not base64 encoded")
@@ -105,7 +228,7 @@ func main() {
 		resBase64 := base64.StdEncoding.EncodeToString(res)
 		fmt.Printf("hash result base64 encode: %s\n", resBase64)
 		fmt.Printf("hash result hex encode: %x\n", res)
-	} else {
+	} else if *aggregatedFlag {
 		verifierConfig := &config.Config{}
 		content, err := ioutil.ReadFile("config/config.json")
 		if err != nil {
@@ -115,25 +238,181 @@ func main() {
 		if err != nil {
 			panic(err.Error())
 		}
+		if err = utils.InitCircuitParams(verifierConfig.CircuitParams); err != nil {
+			panic(err.Error())
+		}
+		checkAssetRegistry(verifierConfig)
+		content, err = ioutil.ReadFile(verifierConfig.AggregatedProof)
+		if err != nil {
+			panic(err.Error())
+		}
+		aggregatedProof := &utils.AggregatedProof{}
+		err = json.Unmarshal(content, aggregatedProof)
+		if err != nil {
+			panic(err.Error())
+		}
+		backend, err := circuit.ParseProvingBackend(aggregatedProof.Backend)
+		if err != nil {
+			panic(err.Error())
+		}
+		// the aggregation circuits verify the plonk batch proofs by a plonk recursion tree
+		if backend != circuit.PlonkBackend {
+			panic("the aggregated proof should be a plonk proof, got " + backend)
+		}
+		if verifierConfig.AggregationArity < 1 {
+			panic("the aggregation arity should be positive")
+		}
+		// the level of the proof file isn't trusted, it selects the verifying key
+		// of the aggregation circuit, so it must be the level of all the batches
+		batchCount := countBatches(verifierConfig.ProofTable)
+		if expected := circuit.AggregationLevel(batchCount, verifierConfig.AggregationArity); aggregatedProof.Level != expected {
+			panic(fmt.Sprintf("aggregation level %d doesn't match the level %d of %d batches", aggregatedProof.Level, expected, batchCount))
+		}
+
+		// the cex assets commitments are not trusted, recompute them from the published cex assets info
+		cexAssetsInfo := make([]utils.CexAssetInfo, len(verifierConfig.CexAssetsInfo))
+		for i := 0; i < len(verifierConfig.CexAssetsInfo); i++ {
+			cexAssetsInfo[verifierConfig.CexAssetsInfo[i].Index] = verifierConfig.CexAssetsInfo[i]
+		}
+		emptyCexAssetsInfo := utils.EmptyCexAssetsInfo(cexAssetsInfo)
+		emptyCexAssetListCommitment := utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo)
+		expectFinalCexAssetsInfoComm := utils.ComputeCexAssetsCommitment(cexAssetsInfo)
+		if utils.BlindCexAssetsCommitment || verifierConfig.ReservesProof != "" {
+			emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm = verifyReservesProof(verifierConfig, cexAssetsInfo)
+		}
+		if string(aggregatedProof.EmptyCEXAssetsCommitment) != string(emptyCexAssetListCommitment) {
+			panic("Empty Cex Assets Info Not Match")
+		}
+		if string(aggregatedProof.FinalCEXAssetsCommitment) != string(expectFinalCexAssetsInfoComm) {
+			panic("Final Cex Assets Info Not Match")
+		}
+		checkExpectedSnapshotId(verifierConfig, aggregatedProof.SnapshotId)
 
+		proof := circuit.NewProof(backend)
+		_, err = proof.ReadFrom(bytes.NewBuffer(aggregatedProof.Proof))
+		if err != nil {
+			panic(err.Error())
+		}
+		// the proof of every level has the commitment of its aggregated range as
+		// the only public input, the level selects the verifying key
+		vk, err := LoadVerifyingKey(backend, circuit.AggregationKeyName(verifierConfig.AggregationKeyName, aggregatedProof.Level)+".vk")
+		if err != nil {
+			panic(err.Error())
+		}
+		aggregatedRange, err := aggregatedProof.Range()
+		if err != nil {
+			panic(err.Error())
+		}
+		vWitness, err := circuit.NewAggregationPublicWitness(&aggregatedRange)
+		if err != nil {
+			panic(err.Error())
+		}
+		err = circuit.Verify(backend, proof, vk, vWitness)
+		if err != nil {
+			panic(backend + " verification failed for aggregated proof: " + err.Error())
+		}
+		fmt.Printf("account merkle tree root is %x\n", aggregatedProof.AccountTreeRoot)
+		fmt.Println("account count is ", aggregatedProof.AccountCount)
+		fmt.Println("proven user count is ", aggregatedProof.UserCount)
+		fmt.Println("snapshot id is ", utils.FormatSnapshotId(aggregatedProof.SnapshotId))
+		fmt.Println("Aggregated proof verify passed!!!")
+	} else if *calldataFile != "" {
+		verifierConfig := &config.Config{}
+		content, err := ioutil.ReadFile("config/config.json")
+		if err != nil {
+			panic(err.Error())
+		}
+		err = json.Unmarshal(content, verifierConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		if err = utils.InitCircuitParams(verifierConfig.CircuitParams); err != nil {
+			panic(err.Error())
+		}
+		for _, zkKeyName := range verifierConfig.ZkKeyName {
+			if err = utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+				panic(err.Error())
+			}
+		}
 		f, err := os.Open(verifierConfig.ProofTable)
 		if err != nil {
 			panic(err.Error())
 		}
 		defer f.Close()
-		// index 4: proof_info, index 5: cex_asset_list_commitments
-		// index 6: account_tree_roots, index 7: batch_commitment
-		// index 8: batch_number
-		type Proof struct {
-			BatchNumber        int64    `csv:"batch_number"`
-			ZkProof            string   `csv:"proof_info"`
-			CexAssetCommitment []string `csv:"cex_asset_list_commitments"`
-			AccountTreeRoots   []string `csv:"account_tree_roots"`
-			BatchCommitment    string   `csv:"batch_commitment"`
-			MinAccountIndex    uint32   `csv:"min_account_index"`
-			MaxAccountIndex    uint32   `csv:"max_account_index"`
-			AssetsCount        int      `csv:"assets_count"`
+		proofs := []*Proof{}
+		err = gocsv.UnmarshalFile(f, &proofs)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		calldatas := make([]*ProofCalldata, len(proofs))
+		for i := 0; i < len(proofs); i++ {
+			batchNumber := strconv.FormatInt(proofs[i].BatchNumber, 10)
+			backend, err := circuit.ParseProvingBackend(proofs[i].Backend)
+			if err != nil {
+				panic("convert proof " + batchNumber + " failed: " + err.Error())
+			}
+			proofRaw, err := base64.StdEncoding.DecodeString(proofs[i].ZkProof)
+			if err != nil {
+				panic("decode proof " + batchNumber + " failed: " + err.Error())
+			}
+			proof := circuit.NewProof(backend)
+			if _, err = proof.ReadFrom(bytes.NewBuffer(proofRaw)); err != nil {
+				panic("deserialize proof " + batchNumber + " failed: " + err.Error())
+			}
+			batchCommitment, err := base64.StdEncoding.DecodeString(proofs[i].BatchCommitment)
+			if err != nil {
+				panic("decode batch commitment " + batchNumber + " failed: " + err.Error())
+			}
+			vWitness, err := frontend.NewWitness(circuit.NewVerifyBatchCreateUserCircuit(batchCommitment), utils.CurveID().ScalarField(), frontend.PublicOnly())
+			if err != nil {
+				panic(err.Error())
+			}
+			calldata, err := circuit.SolidityCalldata(backend, proof, vWitness)
+			if err != nil {
+				panic("convert proof " + batchNumber + " failed: " + err.Error())
+			}
+			calldatas[i] = &ProofCalldata{
+				BatchNumber: proofs[i].BatchNumber,
+				Backend:     backend,
+				Calldata:    "0x" + hex.EncodeToString(calldata),
+			}
 		}
+		out, err := os.Create(*calldataFile)
+		if err != nil {
+			panic(err.Error())
+		}
+		defer out.Close()
+		err = gocsv.MarshalFile(&calldatas, out)
+		if err != nil {
+			panic(err.Error())
+		}
+		fmt.Println("convert", len(calldatas), "proofs to calldata in", *calldataFile)
+	} else {
+		verifierConfig := &config.Config{}
+		content, err := ioutil.ReadFile("config/config.json")
+		if err != nil {
+			panic(err.Error())
+		}
+		err = json.Unmarshal(content, verifierConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		if err = utils.InitCircuitParams(verifierConfig.CircuitParams); err != nil {
+			panic(err.Error())
+		}
+		checkAssetRegistry(verifierConfig)
+		for _, zkKeyName := range verifierConfig.ZkKeyName {
+			if err = utils.CheckCircuitParamsOfKey(zkKeyName); err != nil {
+				panic(err.Error())
+			}
+		}
+
+		f, err := os.Open(verifierConfig.ProofTable)
+		if err != nil {
+			panic(err.Error())
+		}
+		defer f.Close()
 		tmpProofs := []*Proof{}
 
 		err = gocsv.UnmarshalFile(f, &tmpProofs)
@@ -145,6 +424,12 @@ func main() {
 		for i := 0; i < len(tmpProofs); i++ {
 			proofs[tmpProofs[i].BatchNumber] = *tmpProofs[i]
 		}
+		snapshotId := checkSnapshotId(verifierConfig, proofs)
+		if *incrementalFlag {
+			verifyIncrementalProofs(verifierConfig, proofs, snapshotId)
+			return
+		}
+		accountIdsChecks := loadAccountIdsChecks(proofs)
 
 		prevCexAssetListCommitments := make([][]byte, 2)
 		var prevAccountTreeRoot []byte
@@ -153,25 +438,21 @@ func main() {
 		cexAssetsInfo := make([]utils.CexAssetInfo, len(verifierConfig.CexAssetsInfo))
 		for i := 0; i < len(verifierConfig.CexAssetsInfo); i++ {
 			cexAssetsInfo[verifierConfig.CexAssetsInfo[i].Index] = verifierConfig.CexAssetsInfo[i]
-			if verifierConfig.CexAssetsInfo[i].TotalEquity < verifierConfig.CexAssetsInfo[i].TotalDebt {
-				fmt.Printf("%s asset equity %d less then debt %d\n", verifierConfig.CexAssetsInfo[i].Symbol, verifierConfig.CexAssetsInfo[i].TotalEquity, verifierConfig.CexAssetsInfo[i].TotalDebt)
+			if verifierConfig.CexAssetsInfo[i].TotalEquity.Cmp(verifierConfig.CexAssetsInfo[i].TotalDebt) < 0 {
+				fmt.Printf("%s asset equity %s less then debt %s\n", verifierConfig.CexAssetsInfo[i].Symbol, verifierConfig.CexAssetsInfo[i].TotalEquity, verifierConfig.CexAssetsInfo[i].TotalDebt)
 				panic("invalid cex asset info")
 			}
 		}
-		emptyCexAssetsInfo := make([]utils.CexAssetInfo, len(cexAssetsInfo))
-		copy(emptyCexAssetsInfo, cexAssetsInfo)
-		for i := 0; i < len(emptyCexAssetsInfo); i++ {
-			emptyCexAssetsInfo[i].TotalDebt = 0
-			emptyCexAssetsInfo[i].TotalEquity = 0
-			emptyCexAssetsInfo[i].LoanCollateral = 0
-			emptyCexAssetsInfo[i].MarginCollateral = 0
-			emptyCexAssetsInfo[i].PortfolioMarginCollateral = 0
-		}
+		emptyCexAssetsInfo := utils.EmptyCexAssetsInfo(cexAssetsInfo)
 		emptyCexAssetListCommitment := utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo)
 		expectFinalCexAssetsInfoComm := utils.ComputeCexAssetsCommitment(cexAssetsInfo)
+		if utils.BlindCexAssetsCommitment || verifierConfig.ReservesProof != "" {
+			emptyCexAssetListCommitment, expectFinalCexAssetsInfoComm = verifyReservesProof(verifierConfig, cexAssetsInfo)
+		}
 		prevCexAssetListCommitments[1] = emptyCexAssetListCommitment
 		var finalCexAssetsInfoComm []byte
 		var accountTreeRoot []byte
+		totalUserCount := uint64(0)
 
 		workersNum := 16
 		if runtime.NumCPU() > workersNum {
@@ -184,6 +465,7 @@ func main() {
 			cexAssetListCommitments [][]byte
 			minAccountIndex         uint32
 			maxAccountIndex         uint32
+			userCount               uint32
 		}
 		type SafeProofMap struct {
 			sync.Mutex
@@ -195,8 +477,9 @@ func main() {
 			wg.Add(1)
 			go func(index int) {
 				defer wg.Done()
-				var vk groth16.VerifyingKey
+				var vk circuit.VerifyingKey
 				currentAssetCountsTier := 0
+				currentBackend := ""
 				startIndex := index * averageProofCount
 				endIndex := (index + 1) * averageProofCount
 				if endIndex > len(proofs) {
@@ -204,8 +487,13 @@ func main() {
 				}
 				for j := startIndex; j < endIndex; j++ {
 					batchNumber := int(proofs[j].BatchNumber)
+					// proofs exported before the backend column existed are groth16 proofs
+					backend, err := circuit.ParseProvingBackend(proofs[j].Backend)
+					if err != nil {
+						panic("verify proof " + strconv.Itoa(batchNumber) + " failed: " + err.Error())
+					}
 					// first deserialize proof
-					proof := groth16.NewProof(ecc.BN254)
+					proof := circuit.NewProof(backend)
 					var bufRaw bytes.Buffer
 					proofRaw, err := base64.StdEncoding.DecodeString(proofs[j].ZkProof)
 					if err != nil {
@@ -233,22 +521,10 @@ func main() {
 						fmt.Println("decode account tree root failed")
 						panic(err.Error())
 					}
-					// verify the public input: BatchCommitment == Poseidon(AccountTreeRoot, BeforeCEXAssets, AfterCEXAssets, MinAccountIndex, MaxAccountIndex)
-					minBytes := new(big.Int).SetUint64(uint64(proofs[j].MinAccountIndex)).Bytes()
-					if len(minBytes) == 0 {
-						minBytes = []byte{0}
-					}
-					maxBytes := new(big.Int).SetUint64(uint64(proofs[j].MaxAccountIndex)).Bytes()
-					if len(maxBytes) == 0 {
-						maxBytes = []byte{0}
-					}
-					poseidonHasher := poseidon.NewPoseidon()
-					poseidonHasher.Write(accountTreeRoot)
-					poseidonHasher.Write(cexAssetListCommitments[0])
-					poseidonHasher.Write(cexAssetListCommitments[1])
-					poseidonHasher.Write(minBytes)
-					poseidonHasher.Write(maxBytes)
-					expectHash := poseidonHasher.Sum(nil)
+					// verify the public input: BatchCommitment == Hash(AccountTreeRoot, BeforeCEXAssets, AfterCEXAssets, MinAccountIndex, MaxAccountIndex, UserCount, SnapshotId, AccountIdsCheck)
+					expectHash := utils.ComputeBatchCommitment(accountTreeRoot, cexAssetListCommitments[0], cexAssetListCommitments[1],
+						proofs[j].MinAccountIndex, proofs[j].MaxAccountIndex, proofs[j].UserCount, snapshotId,
+						accountIdsChecks[j].Commitment())
 					actualHash, err := base64.StdEncoding.DecodeString(proofs[j].BatchCommitment)
 					if err != nil {
 						fmt.Println("decode batch commitment failed", batchNumber)
@@ -260,11 +536,11 @@ func main() {
 						panic("verify proof " + strconv.Itoa(batchNumber) + " failed")
 					}
 					verifyWitness := circuit.NewVerifyBatchCreateUserCircuit(actualHash)
-					vWitness, err := frontend.NewWitness(verifyWitness, ecc.BN254.ScalarField(), frontend.PublicOnly())
+					vWitness, err := frontend.NewWitness(verifyWitness, utils.CurveID().ScalarField(), frontend.PublicOnly())
 					if err != nil {
 						panic(err.Error())
 					}
-					if proofs[j].AssetsCount != currentAssetCountsTier {
+					if proofs[j].AssetsCount != currentAssetCountsTier || backend != currentBackend {
 						index := -1
 						for p := 0; p < len(verifierConfig.AssetsCountTiers); p++ {
 							if verifierConfig.AssetsCountTiers[p] == proofs[j].AssetsCount {
@@ -275,16 +551,17 @@ func main() {
 						if index == -1 {
 							panic("invalid asset counts tier")
 						}
-						vk, err = LoadVerifyingKey(verifierConfig.ZkKeyName[index] + ".vk")
+						vk, err = LoadVerifyingKey(backend, verifierConfig.ZkKeyName[index]+".vk")
 						if err != nil {
 							panic(err.Error())
 						}
 						currentAssetCountsTier = proofs[j].AssetsCount
+						currentBackend = backend
 					}
-					err = groth16.Verify(proof, vk, vWitness)
+					err = circuit.Verify(backend, proof, vk, vWitness)
 					if err != nil {
 						fmt.Println("proof verify failed:", batchNumber, err.Error())
-						panic("groth16 verification failed for batch " + strconv.Itoa(batchNumber) + ": " + err.Error())
+						panic(backend + " verification failed for batch " + strconv.Itoa(batchNumber) + ": " + err.Error())
 					}
 					fmt.Println("proof verify success", batchNumber)
 					// Only write to map after successful verification
@@ -294,6 +571,7 @@ func main() {
 						cexAssetListCommitments: cexAssetListCommitments,
 						minAccountIndex:         proofs[j].MinAccountIndex,
 						maxAccountIndex:         proofs[j].MaxAccountIndex,
+						userCount:               proofs[j].UserCount,
 					}
 					safeProofMap.Unlock()
 				}
@@ -324,6 +602,7 @@ func main() {
 					", got " + strconv.FormatUint(uint64(proofData.minAccountIndex), 10))
 			}
 			prevMaxAccountIndex = int64(proofData.maxAccountIndex)
+			totalUserCount += uint64(proofData.userCount)
 			prevAccountTreeRoot = proofData.accountTreeRoot
 			prevCexAssetListCommitments = proofData.cexAssetListCommitments
 			accountTreeRoot = proofData.accountTreeRoot
@@ -333,7 +612,13 @@ func main() {
 		if string(finalCexAssetsInfoComm) != string(expectFinalCexAssetsInfoComm) {
 			panic("Final Cex Assets Info Not Match")
 		}
+		// the sorted account ids are chained across the batches, so the account ids are distinct
+		if err = utils.CheckAccountIdsChain(accountTreeRoot, accountIdsChecks); err != nil {
+			panic(err.Error())
+		}
 		fmt.Printf("account merkle tree root is %x\n", accountTreeRoot)
+		fmt.Println("proven user count is ", totalUserCount)
+		fmt.Println("snapshot id is ", utils.FormatSnapshotId(snapshotId))
 		fmt.Println("All proofs verify passed!!!")
 	}
 }
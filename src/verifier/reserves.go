@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
+	"github.com/consensys/gnark/frontend"
+)
+
+// verifyReservesProof verifies the reserves proof against the published prices
+// of cexAssetsInfo. It returns the empty and the final cex assets commitments
+// proved by the reserves proof, which are recomputed from cexAssetsInfo if the
+// commitment is not blinded.
+func verifyReservesProof(verifierConfig *config.Config, cexAssetsInfo []utils.CexAssetInfo) ([]byte, []byte) {
+	if err := utils.CheckCircuitParamsOfKey(verifierConfig.ReservesKeyName); err != nil {
+		panic(err.Error())
+	}
+	content, err := os.ReadFile(verifierConfig.ReservesProof)
+	if err != nil {
+		panic(err.Error())
+	}
+	reservesProof := &utils.ReservesProof{}
+	if err = json.Unmarshal(content, reservesProof); err != nil {
+		panic(err.Error())
+	}
+	if len(reservesProof.Reserves) != utils.AssetCounts {
+		panic("the reserves count doesn't match the asset counts")
+	}
+	backend, err := circuit.ParseProvingBackend(reservesProof.Backend)
+	if err != nil {
+		panic(err.Error())
+	}
+	proof := circuit.NewProof(backend)
+	if _, err = proof.ReadFrom(bytes.NewBuffer(reservesProof.Proof)); err != nil {
+		panic(err.Error())
+	}
+	vk, err := LoadVerifyingKey(backend, verifierConfig.ReservesKeyName+".vk")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	emptyCexAssetsInfo := utils.EmptyCexAssetsInfo(cexAssetsInfo)
+	if !utils.BlindCexAssetsCommitment {
+		if string(reservesProof.EmptyCEXAssetsCommitment) != string(utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo)) ||
+			string(reservesProof.FinalCEXAssetsCommitment) != string(utils.ComputeCexAssetsCommitment(cexAssetsInfo)) {
+			panic("the reserves proof doesn't match the cex assets info")
+		}
+	}
+	// the published prices and reserves are bound by the public commitment
+	commitment := utils.ComputeReservesComparisonCommitment(reservesProof.EmptyCEXAssetsCommitment,
+		reservesProof.FinalCEXAssetsCommitment, utils.ComputeCexAssetsCommitment(emptyCexAssetsInfo),
+		utils.ComputeReservesCommitment(reservesProof.Reserves))
+	vWitness, err := frontend.NewWitness(circuit.NewVerifyReservesComparisonCircuit(commitment), utils.CurveID().ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = circuit.Verify(backend, proof, vk, vWitness); err != nil {
+		panic(backend + " verification failed for reserves proof: " + err.Error())
+	}
+	printReserveRatios(cexAssetsInfo, reservesProof.Reserves)
+	fmt.Println("Reserves proof verify passed!!!")
+	return reservesProof.EmptyCEXAssetsCommitment, reservesProof.FinalCEXAssetsCommitment
+}
+
+// printReserveRatios prints the reserves of every asset divided by its liabilities
+// TotalEquity - TotalDebt. The totals are not published if the commitment is
+// blinded, so only the reserves are printed and the proof guarantees the ratio
+// is at least 100%.
+func printReserveRatios(cexAssetsInfo []utils.CexAssetInfo, reserves []utils.Uint128) {
+	for i := 0; i < len(cexAssetsInfo); i++ {
+		if cexAssetsInfo[i].Symbol == "" {
+			continue
+		}
+		if utils.BlindCexAssetsCommitment {
+			fmt.Printf("%s reserves %s, reserve ratio >= 100%%\n", cexAssetsInfo[i].Symbol, reserves[i])
+			continue
+		}
+		if cexAssetsInfo[i].TotalEquity.Cmp(cexAssetsInfo[i].TotalDebt) <= 0 {
+			fmt.Printf("%s reserves %s, no liabilities\n", cexAssetsInfo[i].Symbol, reserves[i])
+			continue
+		}
+		liabilities := utils.SafeSub(cexAssetsInfo[i].TotalEquity, cexAssetsInfo[i].TotalDebt)
+		ratio := new(big.Rat).SetFrac(reserves[i].Big(), liabilities.Big())
+		ratio.Mul(ratio, big.NewRat(100, 1))
+		fmt.Printf("%s reserves %s, liabilities %s, reserve ratio %s%%\n", cexAssetsInfo[i].Symbol, reserves[i], liabilities, ratio.FloatString(2))
+	}
+}
@@ -4,4 +4,23 @@ type Config struct {
 	MysqlDataSource string
 	UserDataFile    string
 	DbSuffix        string
+	// CircuitParams is the circuit parameters file, the default circuit parameters are used if it is empty
+	CircuitParams string
+	// PreviousUserDataFile is the user data of the previous audit, if it is set
+	// only the changes from the previous audit are proved
+	PreviousUserDataFile string
+	// PreviousAssetRegistry is the asset registry of the previous audit, if it
+	// is set the asset registry of the user data must only append assets to it
+	PreviousAssetRegistry string
+	// AccountTreeSnapshot is the snapshot file of the built account tree, if it
+	// is set the witness reopens the account tree from it when the user data
+	// doesn't change, such as after a crash, instead of rebuilding the tree
+	AccountTreeSnapshot string
+	// AccountTreeStorageDir is the directory of the memory-mapped files of the
+	// account tree nodes, if it is set the account tree isn't limited by the
+	// memory, otherwise it is kept in memory
+	AccountTreeStorageDir string
+	// SnapshotId identifies the audit, it is the date of the user data snapshot
+	// and the sequence number of the audit on that date, such as "20240131-1"
+	SnapshotId string
 }
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,8 +17,6 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils/merkletree"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/config"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/witness"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 )
 
 func main() {
@@ -42,7 +39,13 @@ func main() {
 		}
 		witnessConfig.MysqlDataSource = s
 	}
+	if err = utils.InitCircuitParams(witnessConfig.CircuitParams); err != nil {
+		panic(err.Error())
+	}
 
+	if witnessConfig.PreviousAssetRegistry != "" {
+		checkAssetRegistryAppended(witnessConfig)
+	}
 	accounts, cexAssetsInfo, err := utils.ParseUserDataSet(witnessConfig.UserDataFile)
 	if err != nil {
 		panic(err.Error())
@@ -55,32 +58,13 @@ func main() {
 	}
 	fmt.Println("total account num before padding:", totalAccountNum)
 
-	// Padding accounts to align with batch sizes.
-	keys := make([]int, 0, len(accounts))
-	for k := range accounts {
-		keys = append(keys, k)
-	}
-	sort.Ints(keys)
-	for _, k := range keys {
-		accounts[k] = utils.PaddingAccounts(accounts[k], k)
+	if witnessConfig.PreviousUserDataFile != "" {
+		runIncremental(witnessConfig, accounts, cexAssetsInfo, *witnessDoneMarker)
+		return
 	}
 
-	// Assign AccountIndex sequentially (0, 1, 2, ...) in batch order
-	// so that within each batch AccountIndex increments by 1,
-	// and between consecutive batches the indices are contiguous.
-	globalIndex := uint32(0)
-	for _, k := range keys {
-		for i := range accounts[k] {
-			accounts[k][i].AccountIndex = globalIndex
-			if len(accounts[k][i].AccountId) == 0 {
-				var buf [4]byte
-				binary.BigEndian.PutUint32(buf[:], globalIndex)
-				h := sha256.Sum256(buf[:])
-				accounts[k][i].AccountId = new(fr.Element).SetBytes(h[:]).Marshal()
-			}
-			globalIndex++
-		}
-	}
+	// Padding accounts to align with batch sizes and assign AccountIndex sequentially.
+	keys := witness.PadAndIndexAccounts(accounts)
 
 	// Compute total capacity (sum of all padded accounts).
 	capacity := 0
@@ -89,15 +73,10 @@ func main() {
 	}
 	fmt.Println("total capacity after padding:", capacity)
 
-	// Create account tree with exact capacity.
-	accountTree, err := utils.NewAccountTree(capacity)
-	if err != nil {
-		panic(err.Error())
-	}
-	fmt.Println("account tree initialized")
-
-	// Set all account leaves into the tree in parallel.
-	buildAccountTree(accountTree, accounts, keys)
+	// Create account tree with exact capacity and set all account leaves into
+	// the tree in parallel, or reopen it from the snapshot of the same input.
+	accountTree := loadOrBuildAccountTree(witnessConfig, capacity, accounts, keys, witnessConfig.UserDataFile)
+	defer accountTree.Close()
 	fmt.Printf("account tree root is %x\n", accountTree.Root())
 
 	witnessService := witness.NewWitness(accountTree, accounts, cexAssetsInfo, witnessConfig)
@@ -109,14 +88,7 @@ func main() {
 		defer wg.Done()
 		witnessService.Run()
 		fmt.Println("witness service run finished...")
-		if *witnessDoneMarker != "" {
-			f, err := os.Create(*witnessDoneMarker)
-			if err != nil {
-				fmt.Printf("failed to create witness done marker: %v\n", err)
-			} else {
-				f.Close()
-			}
-		}
+		createWitnessDoneMarker(*witnessDoneMarker)
 	}()
 	go func() {
 		defer wg.Done()
@@ -125,6 +97,131 @@ func main() {
 	wg.Wait()
 }
 
+// checkAssetRegistryAppended checks the asset registry of the user data only
+// appends assets to the asset registry of the previous audit.
+func checkAssetRegistryAppended(witnessConfig *config.Config) {
+	prevRegistry, err := utils.ParseAssetRegistryFromFile(witnessConfig.PreviousAssetRegistry)
+	if err != nil {
+		panic(err.Error())
+	}
+	registry, err := utils.ParseAssetRegistryFromFile(filepath.Join(witnessConfig.UserDataFile, utils.AssetRegistryFile))
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = utils.CheckAssetRegistryAppended(prevRegistry, registry); err != nil {
+		panic(err.Error())
+	}
+}
+
+// runIncremental proves the changes from the previous snapshot to the current
+// one. The account tree of the previous snapshot is rebuilt first, then the
+// user proofs are generated from the updated account tree.
+func runIncremental(witnessConfig *config.Config, accounts map[int][]utils.AccountInfo,
+	cexAssetsInfo []utils.CexAssetInfo, witnessDoneMarker string) {
+	if utils.BlindCexAssetsCommitment {
+		panic("the incremental audit doesn't support the blinded cex assets commitment")
+	}
+	prevAccounts, prevCexAssetsInfo, err := utils.ParseUserDataSet(witnessConfig.PreviousUserDataFile)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = witness.CheckSameCexAssetsPrices(prevCexAssetsInfo, cexAssetsInfo); err != nil {
+		panic("the incremental audit needs the prices and the tier ratios of the previous audit, run a full audit instead: " + err.Error())
+	}
+	prevKeys := witness.PadAndIndexAccounts(prevAccounts)
+	prevAccountList := make([]utils.AccountInfo, 0)
+	for _, k := range prevKeys {
+		prevAccountList = append(prevAccountList, prevAccounts[k]...)
+	}
+	finalAccounts, updates, err := witness.DiffSnapshots(prevAccountList, accounts)
+	if err != nil {
+		panic("run a full audit instead: " + err.Error())
+	}
+	updateNum := 0
+	for k, v := range updates {
+		updateNum += len(v)
+		fmt.Println("the asset counts of user is ", k, "total update ops number is ", len(v))
+	}
+	fmt.Println("total accounts num of previous snapshot:", len(prevAccountList), "after update:", len(finalAccounts), "updates:", updateNum)
+
+	accountTree := loadOrBuildAccountTree(witnessConfig, len(finalAccounts), prevAccounts, prevKeys,
+		witnessConfig.PreviousUserDataFile, witnessConfig.UserDataFile)
+	defer accountTree.Close()
+	fmt.Printf("previous account tree root is %x\n", accountTree.Root())
+
+	witnessService := witness.NewIncrementalWitness(accountTree, updates,
+		witness.SumCexAssets(prevCexAssetsInfo, prevAccountList), witnessConfig)
+	witnessService.RunIncremental()
+	fmt.Println("witness service run finished...")
+	createWitnessDoneMarker(witnessDoneMarker)
+
+	// the user proofs depend on the final account tree, so they are generated after the witness
+	userProofService := witness.NewUserProofService(accountTree,
+		map[int][]utils.AccountInfo{0: finalAccounts}, witnessService.GetDB(), witnessConfig.DbSuffix)
+	userProofService.Run()
+}
+
+func createWitnessDoneMarker(witnessDoneMarker string) {
+	if witnessDoneMarker == "" {
+		return
+	}
+	f, err := os.Create(witnessDoneMarker)
+	if err != nil {
+		fmt.Printf("failed to create witness done marker: %v\n", err)
+	} else {
+		f.Close()
+	}
+}
+
+// loadOrBuildAccountTree reopens the account tree from AccountTreeSnapshot if
+// the snapshot is built from the same user data, otherwise it builds the tree
+// of accounts and writes the snapshot. The fingerprint of the input data is
+// computed from userDataDirs.
+func loadOrBuildAccountTree(witnessConfig *config.Config, capacity int, accounts map[int][]utils.AccountInfo,
+	keys []int, userDataDirs ...string) *merkletree.FixedDepthMerkleTree {
+	var fingerprint []byte
+	if witnessConfig.AccountTreeSnapshot != "" {
+		var err error
+		fingerprint, err = utils.AccountTreeFingerprint(userDataDirs...)
+		if err != nil {
+			panic(err.Error())
+		}
+		accountTree, snapshotFingerprint, err := merkletree.OpenSnapshot(witnessConfig.AccountTreeSnapshot, utils.NewHasher)
+		if err == nil {
+			if bytes.Equal(snapshotFingerprint, fingerprint) && accountTree.Capacity() == capacity {
+				fmt.Println("account tree is reopened from snapshot", witnessConfig.AccountTreeSnapshot)
+				return accountTree
+			}
+			accountTree.Close()
+			fmt.Println("account tree snapshot is built from other user data, rebuild the account tree")
+		} else if !os.IsNotExist(err) {
+			fmt.Println("open account tree snapshot failed, rebuild the account tree:", err.Error())
+		}
+	}
+
+	var storage merkletree.Storage = merkletree.MemoryStorage{}
+	if witnessConfig.AccountTreeStorageDir != "" {
+		fileStorage, err := merkletree.NewFileStorage(witnessConfig.AccountTreeStorageDir)
+		if err != nil {
+			panic(err.Error())
+		}
+		storage = fileStorage
+	}
+	accountTree, err := utils.NewAccountTreeWithStorage(capacity, storage)
+	if err != nil {
+		panic(err.Error())
+	}
+	fmt.Println("account tree initialized")
+	buildAccountTree(accountTree, accounts, keys)
+	if witnessConfig.AccountTreeSnapshot != "" {
+		if err = accountTree.WriteSnapshot(witnessConfig.AccountTreeSnapshot, fingerprint); err != nil {
+			panic(err.Error())
+		}
+		fmt.Println("account tree snapshot is written to", witnessConfig.AccountTreeSnapshot)
+	}
+	return accountTree
+}
+
 // buildAccountTree computes hashes for all accounts and sets them into the tree,
 // then calls Build to compute internal nodes.
 func buildAccountTree(tree *merkletree.FixedDepthMerkleTree, accounts map[int][]utils.AccountInfo, keys []int) {
@@ -178,9 +275,9 @@ func buildAccountTree(tree *merkletree.FixedDepthMerkleTree, accounts map[int][]
 			wg.Add(1)
 			go func(accs []utils.AccountInfo, start, end int) {
 				defer wg.Done()
-				poseidonHasher := poseidon.NewPoseidon()
+				hasher := utils.NewHasher()
 				for i := start; i < end; i++ {
-					accountHash := utils.AccountInfoToHash(&accs[i], &poseidonHasher)
+					accountHash := utils.AccountInfoToHash(&accs[i], &hasher)
 					if err := tree.Set(accs[i].AccountIndex, accountHash); err != nil {
 						panic(fmt.Sprintf("failed to set account %d: %v", accs[i].AccountIndex, err))
 					}
@@ -0,0 +1,343 @@
+package witness
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+	"time"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils/merkletree"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/config"
+)
+
+// AccountUpdate is the change of one account between two snapshots.
+type AccountUpdate struct {
+	Old *utils.AccountInfo
+	New *utils.AccountInfo
+}
+
+// PadAndIndexAccounts pads the accounts of every tier to align with batch sizes,
+// then assigns AccountIndex sequentially (0, 1, 2, ...) in batch order so that
+// within each batch AccountIndex increments by 1, and between consecutive
+// batches the indices are contiguous. It returns the sorted tiers.
+func PadAndIndexAccounts(accounts map[int][]utils.AccountInfo) []int {
+	keys := make([]int, 0, len(accounts))
+	for k := range accounts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		accounts[k] = utils.PaddingAccounts(accounts[k], k)
+	}
+
+	globalIndex := uint32(0)
+	for _, k := range keys {
+		for i := range accounts[k] {
+			accounts[k][i].AccountIndex = globalIndex
+			if len(accounts[k][i].AccountId) == 0 {
+				var buf [4]byte
+				binary.BigEndian.PutUint32(buf[:], globalIndex)
+				h := sha256.Sum256(buf[:])
+				accounts[k][i].AccountId = utils.ReduceToFieldElement(h[:])
+			}
+			globalIndex++
+		}
+	}
+	return keys
+}
+
+// CheckSameCexAssetsPrices returns an error if the prices or the tier ratios of
+// two snapshots differ. They are part of every account leaf, so an incremental
+// audit can't change them.
+func CheckSameCexAssetsPrices(prevCexAssets, cexAssets []utils.CexAssetInfo) error {
+	if len(prevCexAssets) != len(cexAssets) {
+		return fmt.Errorf("the previous snapshot has %d assets, the current snapshot has %d assets", len(prevCexAssets), len(cexAssets))
+	}
+	for i := 0; i < len(cexAssets); i++ {
+		prev, cur := &prevCexAssets[i], &cexAssets[i]
+		if prev.Symbol != cur.Symbol || prev.BasePrice != cur.BasePrice || prev.PriceDecimals != cur.PriceDecimals {
+			return fmt.Errorf("asset %d changes from %s at price %d of %d decimals to %s at price %d of %d decimals",
+				i, prev.Symbol, prev.BasePrice, prev.PriceDecimals, cur.Symbol, cur.BasePrice, cur.PriceDecimals)
+		}
+		for c := 0; c < len(cur.CollateralRatios); c++ {
+			prevRatios := utils.ConvertTierRatiosToBytes(prev.CollateralRatios[c])
+			ratios := utils.ConvertTierRatiosToBytes(cur.CollateralRatios[c])
+			for j := 0; j < len(ratios); j++ {
+				if !bytes.Equal(prevRatios[j], ratios[j]) {
+					return fmt.Errorf("the %s tiers ratio of asset %s changes", utils.CollateralCategories[c], cur.Symbol)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SumCexAssets returns the cex assets whose totals are the sum of the accounts.
+func SumCexAssets(cexAssets []utils.CexAssetInfo, accounts []utils.AccountInfo) []utils.CexAssetInfo {
+	res := utils.CloneCexAssetsInfo(cexAssets)
+	for i := 0; i < len(res); i++ {
+		res[i].TotalEquity = utils.Uint128{}
+		res[i].TotalDebt = utils.Uint128{}
+		for c := 0; c < len(res[i].Collaterals); c++ {
+			res[i].Collaterals[c] = utils.Uint128{}
+		}
+	}
+	for i := 0; i < len(accounts); i++ {
+		addAccountAssets(res, &accounts[i], false)
+	}
+	return res
+}
+
+func addAccountAssets(cexAssets []utils.CexAssetInfo, account *utils.AccountInfo, subtract bool) {
+	update := utils.SafeAdd
+	if subtract {
+		update = utils.SafeSub
+	}
+	for _, asset := range account.Assets {
+		cexAssets[asset.Index].TotalEquity = update(cexAssets[asset.Index].TotalEquity, asset.Equity)
+		cexAssets[asset.Index].TotalDebt = update(cexAssets[asset.Index].TotalDebt, asset.Debt)
+		for c := 0; c < len(asset.Collaterals); c++ {
+			cexAssets[asset.Index].Collaterals[c] = update(cexAssets[asset.Index].Collaterals[c], asset.Collaterals[c])
+		}
+	}
+}
+
+func isSameAssets(a, b []utils.AccountAsset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i].Index != b[i].Index || a[i].Equity != b[i].Equity || a[i].Debt != b[i].Debt {
+			return false
+		}
+		for c := 0; c < len(a[i].Collaterals); c++ {
+			if a[i].Collaterals[c] != b[i].Collaterals[c] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DiffSnapshots compares the previous snapshot, indexed by AccountIndex, with
+// the accounts of the current snapshot, which are neither padded nor indexed.
+//   - an account of both snapshots keeps its index, it is updated if its assets change;
+//   - an account which is only in the previous snapshot is updated to an account without assets.
+//
+// The update circuit keeps the account id of every leaf, so the account ids
+// stay distinct without proving them again. An account which is only in the
+// current snapshot or whose asset counts tier changes would need a new leaf,
+// DiffSnapshots returns an error for them and a full audit is needed.
+// It returns the accounts of the new account tree indexed by AccountIndex and
+// the updates grouped by asset counts tier and sorted by AccountIndex.
+func DiffSnapshots(prevAccounts []utils.AccountInfo, accounts map[int][]utils.AccountInfo) ([]utils.AccountInfo, map[int][]AccountUpdate, error) {
+	prevIndexes := make(map[string]uint32, len(prevAccounts))
+	for i := 0; i < len(prevAccounts); i++ {
+		if !utils.IsPaddingAccount(&prevAccounts[i]) {
+			prevIndexes[string(prevAccounts[i].AccountId)] = prevAccounts[i].AccountIndex
+		}
+	}
+	finalAccounts := make([]utils.AccountInfo, len(prevAccounts))
+	copy(finalAccounts, prevAccounts)
+	updates := make(map[int][]AccountUpdate)
+
+	newAccounts, tierChanges := 0, 0
+	for k := range accounts {
+		for i := range accounts[k] {
+			account := accounts[k][i]
+			index, ok := prevIndexes[string(account.AccountId)]
+			if !ok {
+				newAccounts++
+				continue
+			}
+			delete(prevIndexes, string(account.AccountId))
+			old := &prevAccounts[index]
+			if isSameAssets(old.Assets, account.Assets) {
+				continue
+			}
+			if utils.GetAssetsCountOfUser(old.Assets) != k {
+				tierChanges++
+				continue
+			}
+			account.AccountIndex = index
+			finalAccounts[index] = account
+			updates[k] = append(updates[k], AccountUpdate{Old: old, New: &finalAccounts[index]})
+		}
+	}
+	if newAccounts > 0 || tierChanges > 0 {
+		return nil, nil, fmt.Errorf("%d accounts are not in the previous snapshot and %d accounts change their asset counts tier, "+
+			"the incremental audit can't prove their account ids are distinct from the other accounts", newAccounts, tierChanges)
+	}
+	// the accounts which leave the exchange keep their account ids without assets
+	for _, index := range prevIndexes {
+		old := &prevAccounts[index]
+		tier := utils.GetAssetsCountOfUser(old.Assets)
+		finalAccounts[index] = utils.NewPaddingAccount(tier)
+		finalAccounts[index].AccountIndex = index
+		finalAccounts[index].AccountId = old.AccountId
+		updates[tier] = append(updates[tier], AccountUpdate{Old: old, New: &finalAccounts[index]})
+	}
+	for k := range updates {
+		sort.Slice(updates[k], func(i, j int) bool {
+			return updates[k][i].New.AccountIndex < updates[k][j].New.AccountIndex
+		})
+	}
+	return finalAccounts, updates, nil
+}
+
+// accountTreeUpdater applies the updates of an incremental audit on top of the
+// account tree of the previous snapshot one after another, so the proof of
+// every update is against the root right before it.
+type accountTreeUpdater struct {
+	accountTree *merkletree.FixedDepthMerkleTree
+	root        []byte
+}
+
+func newAccountTreeUpdater(accountTree *merkletree.FixedDepthMerkleTree) *accountTreeUpdater {
+	return &accountTreeUpdater{
+		accountTree: accountTree,
+		root:        accountTree.Root(),
+	}
+}
+
+// update replaces the leaf at index and returns the proof against the root
+// before the update. The old leaf is checked against the proof.
+func (u *accountTreeUpdater) update(index uint32, oldLeaf []byte, newLeaf []byte) [][]byte {
+	proof, root, err := u.accountTree.GetProofWithRoot(index)
+	if err != nil {
+		panic(err.Error())
+	}
+	if !utils.VerifyMerkleProof(root, index, proof, oldLeaf) {
+		panic(fmt.Sprintf("the leaf of account %d doesn't match the account tree", index))
+	}
+	if err = u.accountTree.Update([]uint32{index}, [][]byte{newLeaf}); err != nil {
+		panic(err.Error())
+	}
+	u.root = u.accountTree.Root()
+	return proof
+}
+
+// NewIncrementalWitness returns the witness service of an incremental audit,
+// accountTree is the account tree of the previous snapshot and cexAssets are
+// the cex assets of the previous snapshot.
+func NewIncrementalWitness(accountTree *merkletree.FixedDepthMerkleTree,
+	updates map[int][]AccountUpdate, cexAssets []utils.CexAssetInfo,
+	config *config.Config) *Witness {
+	w := NewWitness(accountTree, nil, cexAssets, config)
+	w.updates = updates
+	return w
+}
+
+// RunIncremental generates the witness of BatchUpdateUserCircuit for all the
+// updates, then applies them to the account tree. The witness is regenerated
+// from the previous snapshot on restart, only the missing batches are written.
+func (w *Witness) RunIncremental() {
+	w.witnessModel.CreateBatchWitnessTable()
+	var height int64
+	var err error
+	for {
+		height, err = w.witnessModel.GetLatestBatchWitnessHeight()
+		if err == utils.DbErrQueryInterrupted || err == utils.DbErrQueryTimeout {
+			fmt.Println("get latest witness height timeout, retry...:", err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		break
+	}
+	if err == utils.DbErrNotFound {
+		height = -1
+	} else if err != nil {
+		panic(err.Error())
+	}
+	w.currentBatchNumber = height
+	fmt.Println("latest height is ", height)
+	fmt.Printf("previous account tree root is %x\n", w.accountTree.Root())
+	fmt.Println("starting incremental witness generation...")
+
+	go w.WriteBatchWitnessToDB()
+	jobCh := make(chan serializeJob, 1)
+	go serializeWorker(jobCh)
+	orderCh := make(chan chan BatchWitness, 1)
+	go func() {
+		for done := range orderCh {
+			w.ch <- <-done
+		}
+		close(w.ch)
+	}()
+
+	keys := make([]int, 0, len(w.updates))
+	for k := range w.updates {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	updater := newAccountTreeUpdater(w.accountTree)
+	hasher := utils.NewHasher()
+	batchNumber := int64(0)
+	for _, k := range keys {
+		updates := w.updates[k]
+		opsPerBatch := utils.GetBatchUpdateUserOpsCounts(k)
+		for start := 0; start < len(updates); start += opsPerBatch {
+			batchUpdateUserWit := &utils.BatchUpdateUserWitness{
+				BeforeAccountTreeRoot:     updater.root,
+				BeforeCEXAssetsCommitment: utils.ComputeCexAssetsCommitment(w.cexAssets),
+				AssetCounts:               k,
+				BeforeCexAssets:           utils.CloneCexAssetsInfo(w.cexAssets),
+				UpdateUserOps:             make([]utils.UpdateUserOperation, opsPerBatch),
+				SnapshotId:                w.snapshotId,
+			}
+			for j := 0; j < opsPerBatch; j++ {
+				var update AccountUpdate
+				if start+j < len(updates) {
+					update = updates[start+j]
+				} else {
+					// pad the batch by updating the last account to itself
+					last := updates[len(updates)-1].New
+					update = AccountUpdate{Old: last, New: last}
+				}
+				batchUpdateUserWit.UpdateUserOps[j] = w.fillUpdateUserOp(updater, &hasher, update)
+			}
+			batchUpdateUserWit.AfterAccountTreeRoot = updater.root
+			batchUpdateUserWit.AfterCEXAssetsCommitment = utils.ComputeCexAssetsCommitment(w.cexAssets)
+			batchUpdateUserWit.OldUserCount, batchUpdateUserWit.NewUserCount = utils.CountUpdatedUsers(batchUpdateUserWit.UpdateUserOps)
+			batchUpdateUserWit.BatchCommitment = utils.ComputeBatchUpdateCommitment(
+				batchUpdateUserWit.BeforeAccountTreeRoot,
+				batchUpdateUserWit.AfterAccountTreeRoot,
+				batchUpdateUserWit.BeforeCEXAssetsCommitment,
+				batchUpdateUserWit.AfterCEXAssetsCommitment,
+				batchUpdateUserWit.SnapshotId,
+				batchUpdateUserWit.OldUserCount,
+				batchUpdateUserWit.NewUserCount)
+
+			if batchNumber > height {
+				done := make(chan BatchWitness, 1)
+				orderCh <- done
+				jobCh <- serializeJob{height: batchNumber, wit: batchUpdateUserWit, done: done}
+			}
+			batchNumber++
+		}
+	}
+	close(jobCh)
+	close(orderCh)
+	<-w.quit
+
+	fmt.Printf("incremental witness run finished, %d batches, the account tree root is %x\n", batchNumber, w.accountTree.Root())
+}
+
+// fillUpdateUserOp applies one update to the account tree and the cex assets.
+func (w *Witness) fillUpdateUserOp(updater *accountTreeUpdater, hasher *hash.Hash, update AccountUpdate) utils.UpdateUserOperation {
+	op := utils.UpdateUserOperation{
+		OldAssets:     update.Old.Assets,
+		NewAssets:     update.New.Assets,
+		AccountIndex:  update.New.AccountIndex,
+		AccountIdHash: update.New.AccountId,
+	}
+	oldLeaf := utils.AccountInfoToHash(update.Old, hasher)
+	addAccountAssets(w.cexAssets, update.Old, true)
+	addAccountAssets(w.cexAssets, update.New, false)
+	op.AccountProof = updater.update(op.AccountIndex, oldLeaf, utils.AccountInfoToHash(update.New, hasher))
+	return op
+}
@@ -0,0 +1,121 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
+)
+
+func newTestAccount(id byte, equities ...uint64) utils.AccountInfo {
+	account := utils.AccountInfo{
+		AccountId:       []byte{id},
+		TotalEquity:     new(big.Int).SetInt64(0),
+		TotalDebt:       new(big.Int).SetInt64(0),
+		TotalCollateral: new(big.Int).SetInt64(0),
+	}
+	for i, equity := range equities {
+		asset := utils.NewEmptyAccountAsset(uint16(i))
+		asset.Equity = utils.NewUint128(equity)
+		account.Assets = append(account.Assets, asset)
+		account.TotalEquity.Add(account.TotalEquity, new(big.Int).SetUint64(equity))
+	}
+	return account
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	defaultAssetCountsTiers := utils.AssetCountsTiers
+	defer func() {
+		utils.AssetCountsTiers = defaultAssetCountsTiers
+	}()
+	utils.AssetCountsTiers = []int{1, 2}
+
+	prevAccounts := []utils.AccountInfo{
+		newTestAccount(1, 10),
+		newTestAccount(2, 20),
+		newTestAccount(3, 30),
+		utils.NewPaddingAccount(1),
+	}
+	for i := range prevAccounts {
+		prevAccounts[i].AccountIndex = uint32(i)
+	}
+	accounts := map[int][]utils.AccountInfo{
+		// account 1 is unchanged, account 2 changes and account 3 leaves
+		1: {newTestAccount(1, 10), newTestAccount(2, 25)},
+	}
+
+	finalAccounts, updates, err := DiffSnapshots(prevAccounts, accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finalAccounts) != len(prevAccounts) {
+		t.Fatalf("got %d final accounts, want %d", len(finalAccounts), len(prevAccounts))
+	}
+	for i := range finalAccounts {
+		if finalAccounts[i].AccountIndex != uint32(i) {
+			t.Fatalf("got account index %d at %d", finalAccounts[i].AccountIndex, i)
+		}
+	}
+	if !utils.IsPaddingAccount(&finalAccounts[2]) || !bytes.Equal(finalAccounts[2].AccountId, []byte{3}) {
+		t.Error("account 3 should be emptied at its previous index")
+	}
+	wantIndexes := []uint32{1, 2}
+	if len(updates) != 1 || len(updates[1]) != len(wantIndexes) {
+		t.Fatalf("got %d updates of tier 1, want %d", len(updates[1]), len(wantIndexes))
+	}
+	for i, index := range wantIndexes {
+		if updates[1][i].New != &finalAccounts[index] || updates[1][i].Old != &prevAccounts[index] {
+			t.Errorf("update %d should be account %d", i, index)
+		}
+		if !bytes.Equal(updates[1][i].Old.AccountId, updates[1][i].New.AccountId) {
+			t.Errorf("update %d changes the account id", i)
+		}
+	}
+
+	// a new account or a tier change would add an account id to the account tree
+	for _, accounts := range []map[int][]utils.AccountInfo{
+		{1: {newTestAccount(1, 10), newTestAccount(2, 20), newTestAccount(3, 30), newTestAccount(4, 40)}},
+		{1: {newTestAccount(1, 10), newTestAccount(2, 20)}, 2: {newTestAccount(3, 30, 31)}},
+	} {
+		if _, _, err = DiffSnapshots(prevAccounts, accounts); err == nil {
+			t.Error("expected the accounts which need a new leaf to be rejected")
+		}
+	}
+
+	// applying the updates on the previous tree results in the tree of the final accounts
+	poseidonHasher := poseidon.NewPoseidon()
+	accountTree, err := utils.NewAccountTree(len(finalAccounts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range prevAccounts {
+		accountTree.Set(uint32(i), utils.AccountInfoToHash(&prevAccounts[i], &poseidonHasher))
+	}
+	accountTree.Build()
+	updater := newAccountTreeUpdater(accountTree)
+	for _, update := range updates[1] {
+		oldLeaf := utils.AccountInfoToHash(update.Old, &poseidonHasher)
+		newLeaf := utils.AccountInfoToHash(update.New, &poseidonHasher)
+		beforeRoot := updater.root
+		proof := updater.update(update.New.AccountIndex, oldLeaf, newLeaf)
+		if !utils.VerifyMerkleProof(beforeRoot, update.New.AccountIndex, proof, oldLeaf) {
+			t.Fatal("the proof should verify the old leaf against the root before the update")
+		}
+		if !utils.VerifyMerkleProof(updater.root, update.New.AccountIndex, proof, newLeaf) {
+			t.Fatal("the proof should verify the new leaf against the root after the update")
+		}
+	}
+	expectedTree, err := utils.NewAccountTree(len(finalAccounts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range finalAccounts {
+		expectedTree.Set(uint32(i), utils.AccountInfoToHash(&finalAccounts[i], &poseidonHasher))
+	}
+	expectedTree.Build()
+	if !bytes.Equal(updater.root, expectedTree.Root()) {
+		t.Fatalf("got root %x after the updates, want %x", updater.root, expectedTree.Root())
+	}
+}
@@ -135,11 +135,11 @@ func (s *UserProofService) Run() {
 					for i := lo; i < hi; i++ {
 						acc := &accs[baseIdx+i]
 						leaf := s.accountTree.Get(acc.AccountIndex)
-						proof, err := s.accountTree.GetProof(acc.AccountIndex)
+						proof, err := s.accountTree.GetCompactProof(acc.AccountIndex)
 						if err != nil {
 							panic(err.Error())
 						}
-						proofs[i] = *convertAccount(acc, leaf, proof, accountTreeRoot)
+						proofs[i] = *convertAccount(acc, leaf, proof.Bytes(), accountTreeRoot)
 					}
 				}(accounts, startIdx+segStart, lo, hi)
 			}
@@ -175,7 +175,8 @@ func (s *UserProofService) Run() {
 }
 
 // convertAccount builds a UserProof (including UserConfig JSON) from an account.
-func convertAccount(account *utils.AccountInfo, leafHash []byte, proof [][]byte, root string) *UserProof {
+// proof is the compact merkle proof encoded by merkletree.CompactProof.Bytes.
+func convertAccount(account *utils.AccountInfo, leafHash []byte, proof []byte, root string) *UserProof {
 	var userProof UserProof
 	var userConfig UserConfig
 
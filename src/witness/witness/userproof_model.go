@@ -58,7 +58,9 @@ type (
 		TotalCollateral *big.Int
 		Assets          []utils.AccountAsset
 		Root            string
-		Proof           [][]byte
+		// Proof is the compact merkle proof which omits the siblings of the
+		// empty subtrees, see merkletree.CompactProof
+		Proof []byte
 	}
 )
 
@@ -6,7 +6,6 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
-	"math/big"
 	"os"
 	"runtime"
 	"sort"
@@ -16,7 +15,6 @@ import (
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/utils/merkletree"
 	"github.com/binance/zkmerkle-proof-of-solvency/src/witness/config"
-	"github.com/consensys/gnark-crypto/ecc/bn254/fr/poseidon"
 	"github.com/klauspost/compress/s2"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -34,6 +32,12 @@ type Witness struct {
 	currentBatchNumber       int64
 	batchNumberMappingKeys   []int
 	batchNumberMappingValues []int
+	// the updates of an incremental audit
+	updates map[int][]AccountUpdate
+	// the blinding factor of the cex assets commitments
+	cexAssetsBlinding []byte
+	// the audit of the witness, it is bound into every batch commitment
+	snapshotId uint64
 }
 
 func NewWitness(accountTree *merkletree.FixedDepthMerkleTree,
@@ -54,6 +58,10 @@ func NewWitness(accountTree *merkletree.FixedDepthMerkleTree,
 	if err != nil {
 		panic(err.Error())
 	}
+	snapshotId, err := utils.ParseSnapshotId(config.SnapshotId)
+	if err != nil {
+		panic(err.Error())
+	}
 
 	return &Witness{
 		accountTree:        accountTree,
@@ -64,6 +72,7 @@ func NewWitness(accountTree *merkletree.FixedDepthMerkleTree,
 		ch:                 make(chan BatchWitness, 100),
 		quit:               make(chan int, 1),
 		currentBatchNumber: 0,
+		snapshotId:         snapshotId,
 	}
 }
 
@@ -76,7 +85,7 @@ func (w *Witness) GetDB() *gorm.DB {
 // serializeJob holds the data needed to serialize and compress a batch witness.
 type serializeJob struct {
 	height int64
-	wit    *utils.BatchCreateUserWitness
+	wit    any               // *utils.BatchCreateUserWitness or *utils.BatchUpdateUserWitness
 	done   chan BatchWitness // single-element channel to deliver the result
 }
 
@@ -102,7 +111,12 @@ func (w *Witness) Run() {
 	}
 	if err == nil {
 		height = latestWitness.Height
-		w.cexAssets = w.GetCexAssets(latestWitness)
+		w.cexAssets, w.cexAssetsBlinding = w.GetCexAssets(latestWitness)
+	} else {
+		w.cexAssetsBlinding, err = utils.NewCexAssetsBlinding()
+		if err != nil {
+			panic(err.Error())
+		}
 	}
 	batchNumber := w.GetBatchNumber()
 	if height == int64(batchNumber)-1 {
@@ -136,7 +150,7 @@ func (w *Witness) Run() {
 
 	// Main loop: generate witness data (serial), dispatch serialization (parallel).
 	accountTreeRoot := w.accountTree.Root()
-	poseidonHasher := poseidon.NewPoseidon()
+	accountIdsChecks, sortedAccountIds := w.GetAccountIdsChecks(accountTreeRoot)
 
 	userOpsPerBatch := 0
 	startBatchNum := 0
@@ -149,21 +163,14 @@ func (w *Witness) Run() {
 			if i <= recoveredBatchNum {
 				continue
 			}
+			// the collaterals of w.cexAssets are updated by fillCreateUserOp
 			batchCreateUserWit := &utils.BatchCreateUserWitness{
-				AccountTreeRoot: accountTreeRoot,
-				BeforeCexAssets: make([]utils.CexAssetInfo, utils.AssetCounts),
-				CreateUserOps:   make([]utils.CreateUserOperation, userOpsPerBatch),
+				AccountTreeRoot:   accountTreeRoot,
+				CexAssetsBlinding: w.cexAssetsBlinding,
+				BeforeCexAssets:   utils.CloneCexAssetsInfo(w.cexAssets),
+				CreateUserOps:     make([]utils.CreateUserOperation, userOpsPerBatch),
 			}
-
-			copy(batchCreateUserWit.BeforeCexAssets[:], w.cexAssets[:])
-			for j := 0; j < len(w.cexAssets); j++ {
-				commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
-				for c := 0; c < len(commitments); c++ {
-					poseidonHasher.Write(commitments[c])
-				}
-			}
-			batchCreateUserWit.BeforeCEXAssetsCommitment = poseidonHasher.Sum(nil)
-			poseidonHasher.Reset()
+			batchCreateUserWit.BeforeCEXAssetsCommitment = utils.ComputeBlindedCexAssetsCommitment(w.cexAssets, w.cexAssetsBlinding)
 
 			relativeBatchNum := i - startBatchNum
 			for j := relativeBatchNum * userOpsPerBatch; j < (relativeBatchNum+1)*userOpsPerBatch; j++ {
@@ -173,29 +180,21 @@ func (w *Witness) Run() {
 			batchCreateUserWit.MinAccountIndex = batchCreateUserWit.CreateUserOps[0].AccountIndex
 			batchCreateUserWit.MaxAccountIndex = batchCreateUserWit.CreateUserOps[userOpsPerBatch-1].AccountIndex
 
-			for j := 0; j < len(w.cexAssets); j++ {
-				commitments := utils.ConvertAssetInfoToBytes(w.cexAssets[j])
-				for c := 0; c < len(commitments); c++ {
-					poseidonHasher.Write(commitments[c])
-				}
-			}
-			batchCreateUserWit.AfterCEXAssetsCommitment = poseidonHasher.Sum(nil)
-			poseidonHasher.Reset()
+			batchCreateUserWit.AfterCEXAssetsCommitment = utils.ComputeBlindedCexAssetsCommitment(w.cexAssets, w.cexAssetsBlinding)
 
-			minBytes := new(big.Int).SetUint64(uint64(batchCreateUserWit.MinAccountIndex)).Bytes()
-			if len(minBytes) == 0 {
-				minBytes = []byte{0}
-			}
-			maxBytes := new(big.Int).SetUint64(uint64(batchCreateUserWit.MaxAccountIndex)).Bytes()
-			if len(maxBytes) == 0 {
-				maxBytes = []byte{0}
-			}
-			batchCreateUserWit.BatchCommitment = poseidon.PoseidonBytes(
+			batchCreateUserWit.UserCount = utils.CountRealUsers(batchCreateUserWit.CreateUserOps)
+			batchCreateUserWit.SnapshotId = w.snapshotId
+			batchCreateUserWit.AccountIds = accountIdsChecks[i]
+			batchCreateUserWit.SortedAccountIds = sortedAccountIds[i]
+			batchCreateUserWit.BatchCommitment = utils.ComputeBatchCommitment(
 				batchCreateUserWit.AccountTreeRoot,
 				batchCreateUserWit.BeforeCEXAssetsCommitment,
 				batchCreateUserWit.AfterCEXAssetsCommitment,
-				minBytes,
-				maxBytes)
+				batchCreateUserWit.MinAccountIndex,
+				batchCreateUserWit.MaxAccountIndex,
+				batchCreateUserWit.UserCount,
+				batchCreateUserWit.SnapshotId,
+				batchCreateUserWit.AccountIds.Commitment())
 
 			// Dispatch to serialize worker pool.
 			done := make(chan BatchWitness, 1)
@@ -231,14 +230,15 @@ func serializeWorker(jobs <-chan serializeJob) {
 	}
 }
 
-func (w *Witness) GetCexAssets(wit *BatchWitness) []utils.CexAssetInfo {
+// GetCexAssets returns the cex assets after the batch and the blinding factor of their commitment.
+func (w *Witness) GetCexAssets(wit *BatchWitness) ([]utils.CexAssetInfo, []byte) {
 	witness := utils.DecodeBatchWitness(wit.WitnessData)
 	if witness == nil {
 		panic("decode invalid witness data")
 	}
 	cexAssetsInfo := utils.RecoverAfterCexAssets(witness)
 	fmt.Println("recover cex assets successfully")
-	return cexAssetsInfo
+	return cexAssetsInfo, witness.CexAssetsBlinding
 }
 
 func (w *Witness) WriteBatchWitnessToDB() {
@@ -324,14 +324,14 @@ func (w *Witness) fillCreateUserOp(assetKey int, accountIndex uint32, currentAcc
 	if err != nil {
 		panic(err.Error())
 	}
-	copy(batchCreateUserWit.CreateUserOps[index].AccountProof[:], accountProof[:])
+	batchCreateUserWit.CreateUserOps[index].AccountProof = accountProof
 
 	for p := 0; p < len(account.Assets); p++ {
 		w.cexAssets[account.Assets[p].Index].TotalEquity = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].TotalEquity, account.Assets[p].Equity)
 		w.cexAssets[account.Assets[p].Index].TotalDebt = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].TotalDebt, account.Assets[p].Debt)
-		w.cexAssets[account.Assets[p].Index].LoanCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].LoanCollateral, account.Assets[p].Loan)
-		w.cexAssets[account.Assets[p].Index].MarginCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].MarginCollateral, account.Assets[p].Margin)
-		w.cexAssets[account.Assets[p].Index].PortfolioMarginCollateral = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].PortfolioMarginCollateral, account.Assets[p].PortfolioMargin)
+		for c := 0; c < len(account.Assets[p].Collaterals); c++ {
+			w.cexAssets[account.Assets[p].Index].Collaterals[c] = utils.SafeAdd(w.cexAssets[account.Assets[p].Index].Collaterals[c], account.Assets[p].Collaterals[c])
+		}
 	}
 
 	batchCreateUserWit.CreateUserOps[index].AccountIndex = account.AccountIndex
@@ -355,3 +355,24 @@ func (w *Witness) GetBatchNumber() int {
 	}
 	return b
 }
+
+// GetAccountIdsChecks returns the AccountIdsCheck and the sorted account ids
+// of every batch, it must be called after GetBatchNumber.
+func (w *Witness) GetAccountIdsChecks(accountTreeRoot []byte) ([]utils.AccountIdsCheck, [][][]byte) {
+	batchAccountIds := make([][][]byte, 0)
+	for _, k := range w.batchNumberMappingKeys {
+		opsPerBatch := utils.BatchCreateUserOpsCountsTiers[k]
+		for start := 0; start < len(w.ops[k]); start += opsPerBatch {
+			ids := make([][]byte, opsPerBatch)
+			for j := 0; j < opsPerBatch; j++ {
+				ids[j] = w.ops[k][start+j].AccountId
+			}
+			batchAccountIds = append(batchAccountIds, ids)
+		}
+	}
+	checks, sortedAccountIds, err := utils.NewAccountIdsChecks(accountTreeRoot, batchAccountIds)
+	if err != nil {
+		panic(err.Error())
+	}
+	return checks, sortedAccountIds
+}
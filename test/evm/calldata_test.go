@@ -0,0 +1,127 @@
+package evm
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/rangecheck"
+	"github.com/consensys/gnark/test/unsafekzg"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+const solidityVerifierAbi = `[
+	{"type":"function","name":"verifyProof","stateMutability":"view","outputs":[],"inputs":[
+		{"name":"proof","type":"uint256[8]"},{"name":"commitments","type":"uint256[2]"},
+		{"name":"commitmentPok","type":"uint256[2]"},{"name":"input","type":"uint256[1]"}]},
+	{"type":"function","name":"Verify","stateMutability":"view","outputs":[{"name":"success","type":"bool"}],"inputs":[
+		{"name":"proof","type":"bytes"},{"name":"public_inputs","type":"uint256[]"}]}
+]`
+
+// commitmentCircuit has the BatchCommitment public input of the batch circuit
+// and uses the range checker, so that its proofs carry a commitment as well.
+type commitmentCircuit struct {
+	BatchCommitment circuit.Variable `gnark:",public"`
+	UserCount       circuit.Variable
+}
+
+func (c commitmentCircuit) Define(api circuit.API) error {
+	rangecheck.New(api).Check(c.UserCount, 32)
+	api.AssertIsEqual(c.BatchCommitment, api.Mul(c.UserCount, c.UserCount))
+	return nil
+}
+
+func setupAndProve(t *testing.T, backend string, c frontend.Circuit, fullWitness witness.Witness) (circuit.Proof, witness.Witness) {
+	ccs, err := circuit.Compile(backend, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srs, srsLagrange kzg.SRS
+	if circuit.IsPlonk(backend) {
+		srs, srsLagrange, err = unsafekzg.NewSRS(ccs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pk, vk, err := circuit.Setup(backend, ccs, srs, srsLagrange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := circuit.Prove(backend, ccs, pk, fullWitness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicWitness, err := fullWitness.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = circuit.Verify(backend, proof, vk, publicWitness); err != nil {
+		t.Fatal(err)
+	}
+	return proof, publicWitness
+}
+
+func words(b []byte) []*big.Int {
+	res := make([]*big.Int, len(b)/32)
+	for i := 0; i < len(res); i++ {
+		res[i] = new(big.Int).SetBytes(b[32*i : 32*(i+1)])
+	}
+	return res
+}
+
+// TestSolidityCalldata checks the calldata against the abi encoder of go-ethereum,
+// so it doesn't need solc.
+func TestSolidityCalldata(t *testing.T) {
+	verifierAbi, err := abi.JSON(strings.NewReader(solidityVerifierAbi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullWitness, err := frontend.NewWitness(&commitmentCircuit{BatchCommitment: 49, UserCount: 7}, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchCommitment := big.NewInt(49)
+
+	proof, publicWitness := setupAndProve(t, circuit.Groth16EvmBackend, &commitmentCircuit{}, fullWitness)
+	calldata, err := circuit.SolidityCalldata(circuit.Groth16EvmBackend, proof, publicWitness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = proof.WriteRawTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	// Ar | Bs | Krs | number of commitments | Commitments | CommitmentPok
+	p, c, pok := words(raw[:256]), words(raw[260:324]), words(raw[324:388])
+	expected, err := verifierAbi.Pack("verifyProof", [8]*big.Int(p), [2]*big.Int(c), [2]*big.Int(pok), [1]*big.Int{batchCommitment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(calldata, expected) {
+		t.Fatalf("groth16 calldata mismatch\n%x\n%x", calldata, expected)
+	}
+
+	proof, publicWitness = setupAndProve(t, circuit.PlonkEvmBackend, &commitmentCircuit{}, fullWitness)
+	calldata, err = circuit.SolidityCalldata(circuit.PlonkEvmBackend, proof, publicWitness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err = verifierAbi.Pack("Verify", proof.(interface{ MarshalSolidity() []byte }).MarshalSolidity(), []*big.Int{batchCommitment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(calldata, expected) {
+		t.Fatalf("plonk calldata mismatch\n%x\n%x", calldata, expected)
+	}
+
+	if _, err = circuit.SolidityCalldata(circuit.Groth16Backend, proof, publicWitness); err == nil {
+		t.Fatal("expected error for groth16 proofs which target the aggregation")
+	}
+}
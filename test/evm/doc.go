@@ -0,0 +1,4 @@
+// Package evm checks the Solidity verifiers exported by keygen and the
+// calldata of the batch proofs on a simulated EVM backend. It is a separate
+// module so that go-ethereum is only a dependency of the tests.
+package evm
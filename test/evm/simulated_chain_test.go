@@ -0,0 +1,221 @@
+package evm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/binance/zkmerkle-proof-of-solvency/circuit"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/utils"
+	"github.com/binance/zkmerkle-proof-of-solvency/src/verifier/config"
+	"github.com/consensys/gnark/frontend"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/gocarina/gocsv"
+)
+
+// Proof is a row of the proof table exported by dbtool -export_proof_csv.
+type Proof struct {
+	BatchNumber     int64  `csv:"batch_number"`
+	ZkProof         string `csv:"proof_info"`
+	BatchCommitment string `csv:"batch_commitment"`
+	AssetsCount     int    `csv:"assets_count"`
+	Backend         string `csv:"backend"`
+}
+
+// compileSolidity returns the deployment bytecode of the verifier contract.
+func compileSolidity(t *testing.T, solcPath string, fileName string) []byte {
+	out, err := exec.Command(solcPath, "--optimize", "--combined-json", "bin", fileName).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Contracts map[string]struct {
+			Bin string `json:"bin"`
+		} `json:"contracts"`
+	}
+	if err = json.Unmarshal(out, &res); err != nil {
+		t.Fatal(err)
+	}
+	for name, contract := range res.Contracts {
+		if strings.HasSuffix(name, ":Verifier") || strings.HasSuffix(name, ":PlonkVerifier") {
+			bin, err := hex.DecodeString(contract.Bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bin
+		}
+	}
+	t.Fatal("no verifier contract in ", fileName)
+	return nil
+}
+
+// loadVerifierConfig returns the config.json of verifier and the rows of its
+// ProofTable, the relative paths of the config are relative to the directory
+// of the verifier service, which is the parent of the config directory.
+func loadVerifierConfig(t *testing.T, fileName string) (*config.Config, []*Proof) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifierConfig := &config.Config{}
+	if err = json.Unmarshal(content, verifierConfig); err != nil {
+		t.Fatal(err)
+	}
+	serviceDir := filepath.Dir(filepath.Dir(fileName))
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(serviceDir, path)
+	}
+	verifierConfig.ProofTable = resolve(verifierConfig.ProofTable)
+	verifierConfig.CircuitParams = resolve(verifierConfig.CircuitParams)
+	for i := range verifierConfig.ZkKeyName {
+		verifierConfig.ZkKeyName[i] = resolve(verifierConfig.ZkKeyName[i])
+	}
+	if len(verifierConfig.ZkKeyName) != len(verifierConfig.AssetsCountTiers) {
+		t.Fatal("asset tiers and asset tier names should have the same length")
+	}
+
+	f, err := os.Open(verifierConfig.ProofTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	proofs := []*Proof{}
+	if err = gocsv.UnmarshalFile(f, &proofs); err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) == 0 {
+		t.Fatal("no proofs in ", verifierConfig.ProofTable)
+	}
+	return verifierConfig, proofs
+}
+
+// TestBatchProofsOnSimulatedChain deploys the Solidity verifiers exported by
+// keygen -solidity to a simulated EVM backend and verifies the groth16_evm or
+// plonk_evm proofs of the proof table generated by prover on chain.
+// ZKPOR_TEST_VERIFIER_CONFIG is the config.json of verifier which lists the
+// proof table and the keys, scripts/evm_test.sh generates them.
+func TestBatchProofsOnSimulatedChain(t *testing.T) {
+	configFile := os.Getenv("ZKPOR_TEST_VERIFIER_CONFIG")
+	if configFile == "" {
+		t.Skip("ZKPOR_TEST_VERIFIER_CONFIG not set, run scripts/evm_test.sh to prove the batches")
+	}
+	solcPath, err := exec.LookPath("solc")
+	if err != nil {
+		t.Fatal("solc not found")
+	}
+	verifierConfig, proofs := loadVerifierConfig(t, configFile)
+	if err = utils.InitCircuitParams(verifierConfig.CircuitParams); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := simulated.NewBackend(types.GenesisAlloc{auth.From: {Balance: big.NewInt(1e18)}}, simulated.WithBlockGasLimit(30_000_000))
+	defer sim.Close()
+	client := sim.Client()
+
+	// the verifier contract of every tier is deployed once
+	addresses := make(map[int]common.Address)
+	deploy := func(t *testing.T, tier int) common.Address {
+		if address, ok := addresses[tier]; ok {
+			return address
+		}
+		verifierAbi, err := abi.JSON(strings.NewReader("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := compileSolidity(t, solcPath, verifierConfig.ZkKeyName[tier]+".sol")
+		address, _, _, err := bind.DeployContract(auth, verifierAbi, bin, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sim.Commit()
+		addresses[tier] = address
+		return address
+	}
+
+	for _, p := range proofs {
+		t.Run("batch_"+strconv.FormatInt(p.BatchNumber, 10), func(t *testing.T) {
+			backend, err := circuit.ParseProvingBackend(p.Backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend != circuit.Groth16EvmBackend && backend != circuit.PlonkEvmBackend {
+				t.Fatalf("the proofs of backend %s can't be verified on chain", backend)
+			}
+			tier := -1
+			for i, v := range verifierConfig.AssetsCountTiers {
+				if v == p.AssetsCount {
+					tier = i
+				}
+			}
+			if tier == -1 {
+				t.Fatalf("invalid asset counts tier %d", p.AssetsCount)
+			}
+			address := deploy(t, tier)
+
+			// the same conversion as verifier -calldata
+			proofRaw, err := base64.StdEncoding.DecodeString(p.ZkProof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof := circuit.NewProof(backend)
+			if _, err = proof.ReadFrom(bytes.NewBuffer(proofRaw)); err != nil {
+				t.Fatal(err)
+			}
+			batchCommitment, err := base64.StdEncoding.DecodeString(p.BatchCommitment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicWitness, err := frontend.NewWitness(circuit.NewVerifyBatchCreateUserCircuit(batchCommitment), utils.CurveID().ScalarField(), frontend.PublicOnly())
+			if err != nil {
+				t.Fatal(err)
+			}
+			calldata, err := circuit.SolidityCalldata(backend, proof, publicWitness)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			verify := func(calldata []byte) bool {
+				res, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &address, Data: calldata}, nil)
+				if err != nil {
+					return false
+				}
+				// groth16 verifier reverts on failure, plonk verifier returns a bool
+				return backend != circuit.PlonkEvmBackend || (len(res) == 32 && res[31] == 1)
+			}
+			if !verify(calldata) {
+				t.Fatal("proof rejected on chain")
+			}
+			// the BatchCommitment public input is the last word of the calldata
+			calldata[len(calldata)-1] ^= 1
+			if verify(calldata) {
+				t.Fatal("proof accepted on chain with a wrong BatchCommitment")
+			}
+		})
+	}
+}